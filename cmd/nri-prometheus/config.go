@@ -14,6 +14,7 @@ import (
 
 	"github.com/newrelic/infra-integrations-sdk/v4/args"
 	"github.com/newrelic/nri-prometheus/internal/cmd/scraper"
+	"github.com/newrelic/nri-prometheus/internal/pkg/prometheus"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
@@ -80,6 +81,9 @@ func loadConfig() (*scraper.Config, error) {
 	if scraperCfg.MetricAPIURL == "" {
 		scraperCfg.MetricAPIURL = determineMetricAPIURL(string(scraperCfg.LicenseKey))
 	}
+	if scraperCfg.EventAPIURL == "" {
+		scraperCfg.EventAPIURL = determineEventAPIURL(string(scraperCfg.LicenseKey))
+	}
 	scraperCfg.HostID = c.NriHostID
 
 	return &scraperCfg, nil
@@ -95,7 +99,7 @@ func setViperDefaults(viper *viper.Viper) {
 	viper.SetDefault("scrape_timeout", 5*time.Second)
 	viper.SetDefault("scrape_duration", "30s")
 	// Note that this default is taken directly from the Prometheus server acceptHeader prior to the open-metrics support. https://github.com/prometheus/prometheus/commit/9c03e11c2cf2ad6c638567471faa5c0f6c11ba3d
-	viper.SetDefault("scrape_accept_header", "text/plain;version=0.0.4;q=1,*/*;q=0.1")
+	viper.SetDefault("scrape_accept_header", prometheus.DefaultAcceptHeader)
 	viper.SetDefault("emitter_harvest_period", fmt.Sprint(integration.BoundedHarvesterDefaultHarvestPeriod))
 	viper.SetDefault("min_emitter_harvest_period", fmt.Sprint(integration.BoundedHarvesterDefaultMinReportInterval))
 	viper.SetDefault("max_stored_metrics", fmt.Sprint(integration.BoundedHarvesterDefaultMetricsCap))
@@ -108,6 +112,7 @@ func setViperDefaults(viper *viper.Viper) {
 	viper.SetDefault("percentiles", []float64{50.0, 95.0, 99.0})
 	viper.SetDefault("worker_threads", 4)
 	viper.SetDefault("self_metrics_listening_address", ":8080")
+	viper.SetDefault("replay_speed", 1)
 }
 
 // bindViperEnv automatically binds the variables in given configuration struct to environment variables.
@@ -139,6 +144,10 @@ var (
 	metricAPIRegionURL = "https://metric-api.%s.newrelic.com/metric/v1/infra"
 	// for historical reasons the US datacenter is the default Metric API
 	defaultMetricAPIURL = "https://metric-api.newrelic.com/metric/v1/infra"
+
+	regionEventLicenseRegex = regexp.MustCompile(`^([a-z]{2,3}[0-9]{2})x{1,2}`)
+	eventAPIRegionURL       = "https://insights-collector.%s.nr-data.net/v1/accounts/events"
+	defaultEventAPIURL      = "https://insights-collector.newrelic.com/v1/accounts/events"
 )
 
 // determineMetricAPIURL determines the Metric API URL based on the license key.
@@ -151,3 +160,14 @@ func determineMetricAPIURL(license string) string {
 
 	return defaultMetricAPIURL
 }
+
+// determineEventAPIURL determines the Event API URL based on the license key,
+// whose first characters indicate the region.
+func determineEventAPIURL(license string) string {
+	m := regionEventLicenseRegex.FindStringSubmatch(license)
+	if len(m) > 1 {
+		return fmt.Sprintf(eventAPIRegionURL, m[1])
+	}
+
+	return defaultEventAPIURL
+}
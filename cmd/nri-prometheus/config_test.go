@@ -35,9 +35,28 @@ func TestDetermineMetricAPIURL(t *testing.T) {
 	}
 }
 
+func TestDetermineEventAPIURL(t *testing.T) {
+	testCases := []struct {
+		license     string
+		expectedURL string
+	}{
+		{license: "", expectedURL: defaultEventAPIURL},
+		{license: "0123456789012345678901234567890123456789", expectedURL: defaultEventAPIURL},
+		{license: "eu01xx6789012345678901234567890123456789", expectedURL: "https://insights-collector.eu01.nr-data.net/v1/accounts/events"},
+	}
+
+	for _, tt := range testCases {
+		actualURL := determineEventAPIURL(tt.license)
+		if actualURL != tt.expectedURL {
+			t.Fatalf("URL does not match expected URL, got=%s, expected=%s", actualURL, tt.expectedURL)
+		}
+	}
+}
+
 func TestLoadConfig(t *testing.T) {
 	expectedScrapper := scraper.Config{
 		MetricAPIURL:                      "https://metric-api.newrelic.com/metric/v1/infra",
+		EventAPIURL:                       "https://insights-collector.newrelic.com/v1/accounts/events",
 		Verbose:                           true,
 		Emitters:                          []string{"infra-sdk"},
 		ScrapeEnabledLabel:                "prometheus.io/scrape",
@@ -57,9 +76,20 @@ func TestLoadConfig(t *testing.T) {
 				TLSConfig:   endpoints.TLSConfig{},
 				UseBearer:   true,
 			},
+			{
+				Description: "BBB",
+				URLs:        []string{"localhost:9122"},
+				Auth: endpoints.Auth{
+					BasicAuth: endpoints.BasicAuth{Username: "user", PasswordFile: "/etc/secrets/password"},
+					// Viper lowercases the keys, which doesn't matter for headers.
+					Headers: map[string]string{"x-api-key": "key"},
+				},
+				Proxy: endpoints.Proxy{URL: "socks5://proxy:1080"},
+			},
 		},
 		InsecureSkipVerify: true,
 		WorkerThreads:      4,
+		ReplaySpeed:        1,
 		HostID:             "awesome-host",
 	}
 	t.Setenv("CONFIG_PATH", "testdata/config-with-legacy-entity-definitions.yaml")
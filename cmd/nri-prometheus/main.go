@@ -3,6 +3,11 @@
 package main
 
 import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
 	"github.com/newrelic/nri-prometheus/internal/cmd/scraper"
 	"github.com/newrelic/nri-prometheus/internal/integration"
 	"github.com/sirupsen/logrus"
@@ -17,7 +22,11 @@ func main() {
 	logrus.Infof("Starting New Relic's Prometheus OpenMetrics Integration version %s", integration.Version)
 	logrus.Debugf("Config: %#v", cfg)
 
-	err = scraper.Run(cfg)
+	// The scraper shuts down gracefully when the process is terminated.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	err = scraper.Run(ctx, cfg)
 	if err != nil {
 		logrus.WithError(err).Fatal("error occurred while running scraper")
 	}
@@ -4,17 +4,20 @@
 package scraper
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/pprof"
 	"net/url"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/newrelic/newrelic-telemetry-sdk-go/telemetry"
 	"github.com/newrelic/nri-prometheus/internal/integration"
 	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
+	"github.com/newrelic/nri-prometheus/internal/pkg/prometheus"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
@@ -23,6 +26,7 @@ import (
 // Config is the config struct for the scraper.
 type Config struct {
 	MetricAPIURL                      string                       `mapstructure:"metric_api_url"`
+	EventAPIURL                       string                       `mapstructure:"event_api_url"`
 	LicenseKey                        LicenseKey                   `mapstructure:"license_key"`
 	ClusterName                       string                       `mapstructure:"cluster_name"`
 	Debug                             bool                         `mapstructure:"debug"`
@@ -38,6 +42,7 @@ type Config struct {
 	ScrapeEndpoints                   bool                         `mapstructure:"scrape_endpoints"`
 	ScrapeDuration                    string                       `mapstructure:"scrape_duration"`
 	ScrapeAcceptHeader                string                       `mapstructure:"scrape_accept_header"`
+	ScrapeNativeHistograms            bool                         `mapstructure:"scrape_native_histograms"`
 	EmitterHarvestPeriod              string                       `mapstructure:"emitter_harvest_period"`
 	MinEmitterHarvestPeriod           string                       `mapstructure:"min_emitter_harvest_period"`
 	MaxStoredMetrics                  int                          `mapstructure:"max_stored_metrics"`
@@ -58,12 +63,110 @@ type Config struct {
 	TelemetryEmitterDeltaExpirationCheckInterval time.Duration        `mapstructure:"telemetry_emitter_delta_expiration_check_interval"`
 	WorkerThreads                                int                  `mapstructure:"worker_threads"`
 	IntegrationMetadata                          integration.Metadata `mapstructure:"integration_metadata"`
+	// Stdout configures the `stdout` emitter.
+	Stdout integration.StdoutEmitterConfig `mapstructure:"stdout"`
+	// RemoteWrite configures the `remote_write` emitter.
+	RemoteWrite integration.RemoteWriteEmitterConfig `mapstructure:"remote_write"`
+	// Federate configures the `federate` emitter.
+	Federate integration.FederateEmitterConfig `mapstructure:"federate"`
+	// File configures the `file` emitter.
+	File integration.FileEmitterConfig `mapstructure:"file"`
+	// EmitExemplars reports the exemplars of counters and histograms as PrometheusExemplar events.
+	EmitExemplars bool `mapstructure:"emit_exemplars"`
+	// IgnoreExporterTimestamps reports every sample at the time its target was scraped,
+	// even when the exporter sets a timestamp on it.
+	IgnoreExporterTimestamps bool `mapstructure:"ignore_exporter_timestamps"`
+	// EmitStalenessEvents reports the series that vanished from their target, or whose target
+	// was removed, as PrometheusStaleSeries events.
+	EmitStalenessEvents bool `mapstructure:"emit_staleness_events"`
+	// ScrapeMaxBodySize is the maximum size in bytes of the body of a scrape. Larger scrapes
+	// fail. 0 means no limit.
+	ScrapeMaxBodySize int64 `mapstructure:"scrape_max_body_size"`
+	// ScrapeMaxSamples is the maximum number of samples of a scrape. Larger scrapes fail.
+	// 0 means no limit.
+	ScrapeMaxSamples int `mapstructure:"scrape_max_samples"`
+	// ScrapeChunkSize makes the metrics of a target be processed and emitted in chunks of
+	// about this number of metrics while it is scraped. The processing rules, such as copy_attributes,
+	// only apply within every chunk. 0 processes them all at once.
+	ScrapeChunkSize int `mapstructure:"scrape_chunk_size"`
+	// ScrapeNegotiateFormats replaces the default accept header with one preferring protobuf, then
+	// OpenMetrics and then the Prometheus text format.
+	ScrapeNegotiateFormats bool `mapstructure:"scrape_negotiate_formats"`
+	// ScrapeUnitAttribute adds the unit declared by OpenMetrics and protobuf payloads to the metrics
+	// as the `unit` attribute.
+	ScrapeUnitAttribute bool `mapstructure:"scrape_unit_attribute"`
+	// ScrapeCompression is the comma separated list of encodings the scrape responses are accepted
+	// compressed with, in order of preference. Empty or "none" asks for uncompressed responses.
+	ScrapeCompression string `mapstructure:"scrape_compression"`
+	// ScrapeProxy is the URL of the HTTP CONNECT or SOCKS5 proxy the targets are scraped through.
+	// Targets can override it with their proxy_url option.
+	ScrapeProxy string `mapstructure:"scrape_proxy"`
+	// ScrapeNoProxy is the comma separated list of hosts, domain names, IP addresses and CIDR ranges
+	// of the targets scraped without the proxy.
+	ScrapeNoProxy string `mapstructure:"scrape_no_proxy"`
+	// ScrapeRetries is the number of times the scrapes failing because of connection errors or
+	// 5xx and 429 responses are retried within a cycle. 0 disables retries.
+	ScrapeRetries int `mapstructure:"scrape_retries"`
+	// ScrapeRetryMinBackoff and ScrapeRetryMaxBackoff bound the wait between retries, which is
+	// doubled on every attempt. They default to 100ms and 1s.
+	ScrapeRetryMinBackoff time.Duration `mapstructure:"scrape_retry_min_backoff"`
+	ScrapeRetryMaxBackoff time.Duration `mapstructure:"scrape_retry_max_backoff"`
+	// ScrapeCircuitBreakerFailures is the number of consecutive failed scrapes after which a
+	// target is only probed after a backoff instead of on every cycle. 0 disables it.
+	ScrapeCircuitBreakerFailures int `mapstructure:"scrape_circuit_breaker_failures"`
+	// ScrapeCircuitBreakerMinBackoff and ScrapeCircuitBreakerMaxBackoff bound the time a failing
+	// target isn't scraped for, which is doubled every time its probe fails. They default to 1m
+	// and 10m.
+	ScrapeCircuitBreakerMinBackoff time.Duration `mapstructure:"scrape_circuit_breaker_min_backoff"`
+	ScrapeCircuitBreakerMaxBackoff time.Duration `mapstructure:"scrape_circuit_breaker_max_backoff"`
+	// EmitterBufferDir is the directory where the telemetry emitter stores the payloads it fails to
+	// send, replaying them in order once the New Relic APIs are reachable again. Disabled when empty.
+	EmitterBufferDir string `mapstructure:"emitter_buffer_dir"`
+	// EmitterBufferMaxSize is the maximum size in bytes of the stored payloads. The oldest ones are
+	// dropped when it is reached. It defaults to 100MiB.
+	EmitterBufferMaxSize int64 `mapstructure:"emitter_buffer_max_size"`
+	// EmitterQueueSize is the number of scrapes, or chunks of them, queued for every emitter, which
+	// emits them in the background. It defaults to 100.
+	EmitterQueueSize int `mapstructure:"emitter_queue_size"`
+	// EmitterQueueOverflowPolicy is applied when the queue of an emitter is full: `block` waits for
+	// room in it (default), `drop_oldest` drops the oldest queued metrics and `drop_newest` the new ones.
+	EmitterQueueOverflowPolicy string `mapstructure:"emitter_queue_overflow_policy"`
+	// ScrapeCycleTimeout bounds every scrape cycle, cancelling the scrapes and emissions still in
+	// progress once it elapses. Cycles aren't bounded when it is unset.
+	ScrapeCycleTimeout time.Duration `mapstructure:"scrape_cycle_timeout"`
+	// ShutdownGracePeriod is the time given on shutdown to the current scrape cycle to finish and to
+	// the emitters to send the pending metrics. It defaults to 25s, within the default termination
+	// grace period of the Kubernetes pods.
+	ShutdownGracePeriod time.Duration `mapstructure:"shutdown_grace_period"`
+	// ShutdownFlushTimeout is the part of the shutdown grace period reserved for the emitters to send
+	// the pending metrics, which the current scrape cycle can't use. It defaults to a fifth of the
+	// grace period, and has to be shorter than it.
+	ShutdownFlushTimeout time.Duration `mapstructure:"shutdown_flush_timeout"`
+	// RecordDir is the directory where the raw scrapes are recorded. Recording is disabled when empty.
+	RecordDir string `mapstructure:"record_dir"`
+	// ReplayDir is a directory with recorded scrapes. When set, the recordings are replayed
+	// through the processing rules and emitters instead of scraping any target.
+	ReplayDir string `mapstructure:"replay_dir"`
+	// ReplaySpeed divides the time between the replayed scrapes. 1 replays them at the original
+	// pace and 0 as fast as possible.
+	ReplaySpeed float64 `mapstructure:"replay_speed"`
 	// Coming from main.ArgumentList NriHostID
 	HostID string
 }
 
 const maskedLicenseKey = "****"
 
+const defaultShutdownGracePeriod = 25 * time.Second
+
+// shutdownGracePeriod returns the configured shutdown grace period, or the
+// default one.
+func shutdownGracePeriod(cfg *Config) time.Duration {
+	if cfg.ShutdownGracePeriod == 0 {
+		return defaultShutdownGracePeriod
+	}
+	return cfg.ShutdownGracePeriod
+}
+
 // LicenseKey is a New Relic license key that will be masked when printed using standard formatters
 type LicenseKey string
 
@@ -104,6 +207,70 @@ func validateConfig(cfg *Config) error {
 		}
 	}
 
+	// The formats are negotiated unless the accept header is set.
+	if cfg.ScrapeNegotiateFormats && (cfg.ScrapeAcceptHeader == "" || cfg.ScrapeAcceptHeader == prometheus.DefaultAcceptHeader) {
+		cfg.ScrapeAcceptHeader = prometheus.NegotiatedAcceptHeader
+	}
+
+	// Native histograms are only exposed in the protobuf format, so it's preferred over the
+	// accepted ones when they are enabled.
+	if cfg.ScrapeNativeHistograms && !strings.HasPrefix(cfg.ScrapeAcceptHeader, prometheus.ProtobufAcceptHeader) {
+		accepted := []string{prometheus.ProtobufAcceptHeader}
+		if cfg.ScrapeAcceptHeader != "" {
+			accepted = append(accepted, cfg.ScrapeAcceptHeader)
+		}
+		cfg.ScrapeAcceptHeader = strings.Join(accepted, ",")
+	}
+
+	if cfg.ReplaySpeed < 0 {
+		return fmt.Errorf("replay_speed can't be negative")
+	}
+
+	if cfg.ScrapeMaxBodySize < 0 || cfg.ScrapeMaxSamples < 0 || cfg.ScrapeChunkSize < 0 {
+		return fmt.Errorf("scrape_max_body_size, scrape_max_samples and scrape_chunk_size can't be negative")
+	}
+
+	if _, err := prometheus.AcceptEncoding(cfg.ScrapeCompression); err != nil {
+		return fmt.Errorf("invalid scrape_compression: %w", err)
+	}
+	for _, tc := range cfg.TargetConfigs {
+		if _, err := prometheus.AcceptEncoding(tc.Compression); err != nil {
+			return fmt.Errorf("invalid compression of target %v: %w", tc.URLs, err)
+		}
+	}
+
+	if err := scrapeProxy(cfg).Validate(); err != nil {
+		return fmt.Errorf("invalid scrape_proxy: %w", err)
+	}
+
+	if cfg.ScrapeRetries < 0 || cfg.ScrapeRetryMinBackoff < 0 || cfg.ScrapeRetryMaxBackoff < 0 {
+		return fmt.Errorf("scrape_retries, scrape_retry_min_backoff and scrape_retry_max_backoff can't be negative")
+	}
+	if cfg.ScrapeCircuitBreakerFailures < 0 || cfg.ScrapeCircuitBreakerMinBackoff < 0 || cfg.ScrapeCircuitBreakerMaxBackoff < 0 {
+		return fmt.Errorf("scrape_circuit_breaker_failures, scrape_circuit_breaker_min_backoff and scrape_circuit_breaker_max_backoff can't be negative")
+	}
+	if cfg.EmitterBufferMaxSize < 0 {
+		return fmt.Errorf("emitter_buffer_max_size can't be negative")
+	}
+	if cfg.ScrapeCycleTimeout < 0 {
+		return fmt.Errorf("scrape_cycle_timeout can't be negative")
+	}
+	if cfg.ShutdownGracePeriod < 0 || cfg.ShutdownFlushTimeout < 0 {
+		return fmt.Errorf("shutdown_grace_period and shutdown_flush_timeout can't be negative")
+	}
+	if cfg.ShutdownFlushTimeout > 0 && cfg.ShutdownFlushTimeout >= shutdownGracePeriod(cfg) {
+		return fmt.Errorf("shutdown_flush_timeout must be shorter than shutdown_grace_period")
+	}
+	if cfg.EmitterQueueSize < 0 {
+		return fmt.Errorf("emitter_queue_size can't be negative")
+	}
+	switch cfg.EmitterQueueOverflowPolicy {
+	case "", integration.EmitterQueueBlock, integration.EmitterQueueDropOldest, integration.EmitterQueueDropNewest:
+	default:
+		return fmt.Errorf("invalid emitter_queue_overflow_policy %q, it must be %s, %s or %s", cfg.EmitterQueueOverflowPolicy,
+			integration.EmitterQueueBlock, integration.EmitterQueueDropOldest, integration.EmitterQueueDropNewest)
+	}
+
 	if cfg.WorkerThreads < 4 {
 		logrus.Infof("Minimum amount of 4 worker threads required, %d given. Setting to 4.", cfg.WorkerThreads)
 		cfg.WorkerThreads = 4
@@ -112,8 +279,11 @@ func validateConfig(cfg *Config) error {
 	return nil
 }
 
-// RunWithEmitters runs the scraper with preselected emitters.
-func RunWithEmitters(cfg *Config, emitters []integration.Emitter) error {
+// RunWithEmitters runs the scraper with preselected emitters until the
+// context is done. It then stops discovering targets, waits for the current
+// scrape cycle to finish and for the emitters to send the pending metrics,
+// and stops serving the self-metrics, all within the shutdown grace period.
+func RunWithEmitters(ctx context.Context, cfg *Config, emitters []integration.Emitter) error {
 	if len(emitters) == 0 {
 		return fmt.Errorf("you need to configure at least one valid emitter")
 	}
@@ -137,44 +307,58 @@ func RunWithEmitters(cfg *Config, emitters []integration.Emitter) error {
 			retrievers = append(retrievers, kubernetesRetriever)
 		}
 	}
-	defaultTransformations := integration.ProcessingRule{
-		Description: "Default transformation rules",
-		AddAttributes: []integration.AddAttributesRule{
-			{
-				MetricPrefix: "",
-				Attributes: map[string]interface{}{
-					"k8s.cluster.name": cfg.ClusterName,
-					"clusterName":      cfg.ClusterName,
-					// Keeping these for backward compatibility
-					"integrationVersion": integration.Version,
-					"integrationName":    integration.Name,
-					// Since the agent is not used we add the attributes manually
-					"collector.name":           integration.Name,
-					"collector.version":        integration.Version,
-					"instrumentation.name":     integration.Name,
-					"instrumentation.version":  integration.Version,
-					"instrumentation.provider": "newRelic",
-				},
-			},
-		},
-	}
-	processingRules := append(cfg.ProcessingRules, defaultTransformations)
 
 	scrapeDuration, err := time.ParseDuration(cfg.ScrapeDuration)
 	if err != nil {
 		return fmt.Errorf("parsing scrape_duration value (%v): %w", cfg.ScrapeDuration, err)
 	}
 
-	go integration.Execute(
-		scrapeDuration,
-		selfRetriever,
-		retrievers,
-		integration.NewFetcher(scrapeDuration, cfg.ScrapeTimeout, cfg.ScrapeAcceptHeader, cfg.WorkerThreads, cfg.BearerTokenFile, cfg.CaFile, cfg.InsecureSkipVerify, queueLength),
-		integration.RuleProcessor(processingRules, queueLength),
-		emitters)
+	fetcherOpts, err := fetcherOptions(cfg)
+	if err != nil {
+		return err
+	}
+
+	queued, err := queueEmitters(cfg, emitters)
+	if err != nil {
+		return err
+	}
+
+	// The emitters are given the flush timeout out of the grace period, even
+	// when the current scrape cycle doesn't finish.
+	gracePeriod := shutdownGracePeriod(cfg)
+	flushTimeout := cfg.ShutdownFlushTimeout
+	if flushTimeout == 0 {
+		flushTimeout = gracePeriod / 5
+	}
+	cycleGracePeriod := gracePeriod - flushTimeout
+
+	// The watches of the retrievers end once the context is done, while the
+	// current scrape cycle is given the rest of the grace period to finish.
+	executeCtx, stopExecute := context.WithCancel(ctx)
+	defer stopExecute()
+	executed := make(chan struct{})
+	go func() {
+		defer close(executed)
+		integration.Execute(
+			executeCtx,
+			scrapeDuration,
+			selfRetriever,
+			retrievers,
+			integration.NewFetcher(scrapeDuration, cfg.ScrapeTimeout, cfg.ScrapeAcceptHeader, cfg.WorkerThreads, cfg.BearerTokenFile, cfg.CaFile, cfg.InsecureSkipVerify, queueLength, fetcherOpts...),
+			integration.RuleProcessor(processingRules(cfg), queueLength),
+			queued,
+			integration.WithCycleTimeout(cfg.ScrapeCycleTimeout),
+			integration.WithCycleGracePeriod(cycleGracePeriod))
+	}()
 
 	r := http.NewServeMux()
 	r.Handle("/metrics", promhttp.Handler())
+	for _, e := range emitters {
+		// The federate emitter exposes the processed metrics in the same server as the self-metrics.
+		if fe, ok := e.(*integration.FederateEmitter); ok {
+			r.Handle("/federate", fe)
+		}
+	}
 	if cfg.Debug {
 		r.HandleFunc("/debug/pprof/", pprof.Index)
 		r.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
@@ -182,11 +366,41 @@ func RunWithEmitters(cfg *Config, emitters []integration.Emitter) error {
 		r.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
 		r.HandleFunc("/debug/pprof/trace", pprof.Trace)
 	}
-	err = http.ListenAndServe(cfg.SelfMetricsListeningAddress, r)
-	if err != nil {
+	server := &http.Server{Addr: cfg.SelfMetricsListeningAddress, Handler: r}
+	served := make(chan error, 1)
+	go func() {
+		served <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-served:
 		return fmt.Errorf("listening on %q for metrics: %w", cfg.SelfMetricsListeningAddress, err)
+	case <-ctx.Done():
+	}
+
+	logrus.Infof("Shutting down within %s...", gracePeriod)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), gracePeriod)
+	defer cancel()
+
+	cycleTimer := time.NewTimer(cycleGracePeriod)
+	defer cycleTimer.Stop()
+	select {
+	case <-executed:
+	case <-cycleTimer.C:
+		logrus.Warn("the current scrape cycle didn't finish within the shutdown grace period")
+	}
+	for _, e := range queued {
+		if s, ok := e.(interface{ Shutdown(context.Context) error }); ok {
+			if err := s.Shutdown(shutdownCtx); err != nil {
+				logrus.WithError(err).Warnf("shutting down the %s emitter", e.Name())
+			}
+		}
+	}
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		logrus.WithError(err).Warn("shutting down the self-metrics server")
 	}
 
+	logrus.Info("Shutdown complete")
 	return nil
 }
 
@@ -212,18 +426,173 @@ func RunOnceWithEmitters(cfg *Config, emitters []integration.Emitter) error {
 		)
 	}
 
+	fetcherOpts, err := fetcherOptions(cfg)
+	if err != nil {
+		return err
+	}
+
+	queued, err := queueEmitters(cfg, emitters)
+	if err != nil {
+		return err
+	}
+
 	// Fetch duration is hardcoded to 1 since the target is scraped only once
 	integration.ExecuteOnce(
 		retrievers,
-		integration.NewFetcher(scrapeDuration, cfg.ScrapeTimeout, cfg.ScrapeAcceptHeader, cfg.WorkerThreads, cfg.BearerTokenFile, cfg.CaFile, cfg.InsecureSkipVerify, queueLength),
+		integration.NewFetcher(scrapeDuration, cfg.ScrapeTimeout, cfg.ScrapeAcceptHeader, cfg.WorkerThreads, cfg.BearerTokenFile, cfg.CaFile, cfg.InsecureSkipVerify, queueLength, fetcherOpts...),
 		integration.RuleProcessor(cfg.ProcessingRules, queueLength),
-		emitters)
+		queued)
+
+	return nil
+}
+
+// processingRules returns the configured processing rules followed by the
+// default transformations.
+func processingRules(cfg *Config) []integration.ProcessingRule {
+	defaultTransformations := integration.ProcessingRule{
+		Description: "Default transformation rules",
+		AddAttributes: []integration.AddAttributesRule{
+			{
+				MetricPrefix: "",
+				Attributes: map[string]interface{}{
+					"k8s.cluster.name": cfg.ClusterName,
+					"clusterName":      cfg.ClusterName,
+					// Keeping these for backward compatibility
+					"integrationVersion": integration.Version,
+					"integrationName":    integration.Name,
+					// Since the agent is not used we add the attributes manually
+					"collector.name":           integration.Name,
+					"collector.version":        integration.Version,
+					"instrumentation.name":     integration.Name,
+					"instrumentation.version":  integration.Version,
+					"instrumentation.provider": "newRelic",
+				},
+			},
+		},
+	}
+	return append(cfg.ProcessingRules, defaultTransformations)
+}
 
+// scrapeProxy returns the proxy the targets are scraped through by default.
+func scrapeProxy(cfg *Config) endpoints.Proxy {
+	return endpoints.Proxy{URL: cfg.ScrapeProxy, NoProxy: cfg.ScrapeNoProxy}
+}
+
+// fetcherOptions returns the optional Fetcher configuration.
+func fetcherOptions(cfg *Config) ([]integration.FetcherOption, error) {
+	var opts []integration.FetcherOption
+	if cfg.RecordDir != "" {
+		recorder, err := integration.NewScrapeRecorder(cfg.RecordDir)
+		if err != nil {
+			return nil, fmt.Errorf("creating scrape recorder: %w", err)
+		}
+		opts = append(opts, integration.WithScrapeRecorder(recorder))
+	}
+	if cfg.IgnoreExporterTimestamps {
+		opts = append(opts, integration.WithIgnoredExporterTimestamps())
+	}
+	if cfg.ScrapeUnitAttribute {
+		opts = append(opts, integration.WithUnitAttribute())
+	}
+	if cfg.ScrapeMaxBodySize > 0 || cfg.ScrapeMaxSamples > 0 {
+		opts = append(opts, integration.WithScrapeLimits(prometheus.ScrapeLimits{
+			MaxBodySize: cfg.ScrapeMaxBodySize,
+			MaxSamples:  cfg.ScrapeMaxSamples,
+		}))
+	}
+	if cfg.ScrapeChunkSize > 0 {
+		opts = append(opts, integration.WithChunkSize(cfg.ScrapeChunkSize))
+	}
+	if cfg.ScrapeCompression != "" {
+		opts = append(opts, integration.WithCompression(cfg.ScrapeCompression))
+	}
+	if proxy := scrapeProxy(cfg); !proxy.IsZero() {
+		opts = append(opts, integration.WithProxy(proxy))
+	}
+	if cfg.ScrapeRetries > 0 {
+		opts = append(opts, integration.WithScrapeRetries(integration.ScrapeRetries{
+			Max:        cfg.ScrapeRetries,
+			MinBackoff: cfg.ScrapeRetryMinBackoff,
+			MaxBackoff: cfg.ScrapeRetryMaxBackoff,
+		}))
+	}
+	if cfg.ScrapeCircuitBreakerFailures > 0 {
+		opts = append(opts, integration.WithCircuitBreaker(integration.CircuitBreakerConfig{
+			Failures:   cfg.ScrapeCircuitBreakerFailures,
+			MinBackoff: cfg.ScrapeCircuitBreakerMinBackoff,
+			MaxBackoff: cfg.ScrapeCircuitBreakerMaxBackoff,
+		}))
+	}
+	var ignoreRules []integration.IgnoreRule
+	for _, pr := range cfg.ProcessingRules {
+		ignoreRules = append(ignoreRules, pr.IgnoreMetrics...)
+	}
+	if len(ignoreRules) > 0 {
+		opts = append(opts, integration.WithIgnoreRules(ignoreRules))
+	}
+	return opts, nil
+}
+
+// queueEmitters wraps every emitter in a queue, so they emit the metrics in
+// the background.
+func queueEmitters(cfg *Config, emitters []integration.Emitter) ([]integration.Emitter, error) {
+	queueCfg := integration.EmitterQueueConfig{
+		Size:           cfg.EmitterQueueSize,
+		OverflowPolicy: cfg.EmitterQueueOverflowPolicy,
+	}
+	queued := make([]integration.Emitter, 0, len(emitters))
+	for _, e := range emitters {
+		q, err := integration.NewEmitterQueue(e, queueCfg)
+		if err != nil {
+			return nil, fmt.Errorf("creating the queue of the %s emitter: %w", e.Name(), err)
+		}
+		queued = append(queued, q)
+	}
+	return queued, nil
+}
+
+// RunReplayWithEmitters replays the scrapes recorded in cfg.ReplayDir through
+// the processing rules and the emitters, and returns once all of them have
+// been replayed.
+func RunReplayWithEmitters(cfg *Config, emitters []integration.Emitter) error {
+	if len(emitters) == 0 {
+		return fmt.Errorf("you need to configure at least one valid emitter")
+	}
+
+	replay, err := integration.NewScrapeReplay(cfg.ReplayDir, cfg.ReplaySpeed)
+	if err != nil {
+		return fmt.Errorf("loading recorded scrapes: %w", err)
+	}
+
+	fetcherOpts, err := fetcherOptions(cfg)
+	if err != nil {
+		return err
+	}
+	queued, err := queueEmitters(cfg, emitters)
+	if err != nil {
+		return err
+	}
+
+	retrievers := []endpoints.TargetRetriever{replay.Retriever()}
+	fetcher := replay.Fetcher(fetcherOpts...)
+	processor := integration.RuleProcessor(processingRules(cfg), queueLength)
+	for !replay.Done() {
+		integration.ExecuteOnce(retrievers, fetcher, processor, queued)
+	}
+
+	// Emitters sending asynchronously need to be stopped so the last replayed metrics are sent.
+	// Their queues stop them once the queued metrics are emitted.
+	for _, e := range queued {
+		if s, ok := e.(interface{ Stop() }); ok {
+			s.Stop()
+		}
+	}
 	return nil
 }
 
-// Run runs the scraper. If Standalone=true it keeps running otherwise runs once and exits
-func Run(cfg *Config) error {
+// Run runs the scraper. If Standalone=true it keeps running until the context is done, otherwise
+// runs once and exits. When ReplayDir is set, the recorded scrapes are replayed instead.
+func Run(ctx context.Context, cfg *Config) error {
 	err := validateConfig(cfg)
 	if err != nil {
 		return fmt.Errorf("while getting configuration options: %w", err)
@@ -236,7 +605,11 @@ func Run(cfg *Config) error {
 	for _, e := range cfg.Emitters {
 		switch e {
 		case "stdout":
-			emitters = append(emitters, integration.NewStdoutEmitter())
+			emitter, err := integration.NewStdoutEmitter(cfg.Stdout)
+			if err != nil {
+				return errors.Wrap(err, "could not create new StdoutEmitter")
+			}
+			emitters = append(emitters, emitter)
 		case "telemetry":
 			harvesterOpts := []func(*telemetry.Config){
 				telemetry.ConfigAPIKey(string(cfg.LicenseKey)),
@@ -244,6 +617,10 @@ func Run(cfg *Config) error {
 				integration.TelemetryHarvesterWithMetricsURL(cfg.MetricAPIURL),
 			}
 
+			if cfg.EventAPIURL != "" {
+				harvesterOpts = append(harvesterOpts, integration.TelemetryHarvesterWithEventsURL(cfg.EventAPIURL))
+			}
+
 			if cfg.EmitterProxyURL != nil {
 				harvesterOpts = append(
 					harvesterOpts,
@@ -302,6 +679,12 @@ func Run(cfg *Config) error {
 				HarvesterOpts:                 harvesterOpts,
 				DeltaExpirationAge:            cfg.TelemetryEmitterDeltaExpirationAge,
 				DeltaExpirationCheckInternval: cfg.TelemetryEmitterDeltaExpirationCheckInterval,
+				Exemplars:                     cfg.EmitExemplars,
+				StalenessEvents:               cfg.EmitStalenessEvents,
+				DiskBuffer: integration.DiskBufferConfig{
+					Dir:     cfg.EmitterBufferDir,
+					MaxSize: cfg.EmitterBufferMaxSize,
+				},
 				BoundedHarvesterCfg: integration.BoundedHarvesterCfg{
 					HarvestPeriod:     hTime,
 					MinReportInterval: mhTime,
@@ -314,11 +697,26 @@ func Run(cfg *Config) error {
 				return errors.Wrap(err, "could not create new TelemetryEmitter")
 			}
 			emitters = append(emitters, emitter)
+		case "remote_write":
+			emitter, err := integration.NewRemoteWriteEmitter(cfg.RemoteWrite)
+			if err != nil {
+				return errors.Wrap(err, "could not create new RemoteWriteEmitter")
+			}
+			emitters = append(emitters, emitter)
+		case "file":
+			emitter, err := integration.NewFileEmitter(cfg.File)
+			if err != nil {
+				return errors.Wrap(err, "could not create new FileEmitter")
+			}
+			emitters = append(emitters, emitter)
+		case "federate":
+			emitters = append(emitters, integration.NewFederateEmitter(cfg.Federate))
 		case "infra-sdk":
 			emitter := integration.NewInfraSdkEmitter(cfg.HostID)
 			if err := emitter.SetIntegrationMetadata(cfg.IntegrationMetadata); err != nil {
 				logrus.WithError(err).Debugf("could not set emitter metadata: %v", cfg.IntegrationMetadata)
 			}
+			emitter.SetExemplars(cfg.EmitExemplars)
 			emitters = append(emitters, emitter)
 		default:
 			logrus.Debugf("unknown emitter: %s", e)
@@ -326,9 +724,12 @@ func Run(cfg *Config) error {
 		}
 	}
 
-	if cfg.Standalone {
+	if cfg.ReplayDir != "" {
+		logrus.Infof("Replaying scrapes recorded in %s...", cfg.ReplayDir)
+		err = RunReplayWithEmitters(cfg, emitters)
+	} else if cfg.Standalone {
 		logrus.Info("Running in standalone mode...")
-		err = RunWithEmitters(cfg, emitters)
+		err = RunWithEmitters(ctx, cfg, emitters)
 	} else {
 		logrus.Info("Running in run-once mode...")
 		err = RunOnceWithEmitters(cfg, emitters)
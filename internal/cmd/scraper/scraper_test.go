@@ -5,16 +5,20 @@ package scraper
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"path"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/newrelic/nri-prometheus/internal/integration"
 	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
+	"github.com/newrelic/nri-prometheus/internal/pkg/prometheus"
 	"github.com/stretchr/testify/require"
 
 	"github.com/sirupsen/logrus"
@@ -117,7 +121,7 @@ func TestRunIntegrationOnceNoTokenAttached(t *testing.T) {
 		Verbose:        true,
 		ScrapeDuration: "500ms",
 	}
-	err = Run(c)
+	err = Run(context.Background(), c)
 	require.NoError(t, err)
 	require.Equal(t, 2, counter, "the scraper should have hit the mock exactly twice")
 	require.Equal(t, "", headers.Get("Authorization"), "the scraper should not add any authorization token")
@@ -145,7 +149,7 @@ func TestScrapingAnsweringWithError(t *testing.T) {
 		Verbose:        true,
 		ScrapeDuration: "500ms",
 	}
-	err := Run(c)
+	err := Run(context.Background(), c)
 	// Currently no error is returned in case a scraper does not return any data / err status code
 	require.NoError(t, err)
 	require.Equal(t, 2, counter, "the scraper should have hit the mock exactly twice")
@@ -173,7 +177,7 @@ func TestScrapingAnsweringUnexpectedData(t *testing.T) {
 		Verbose:        true,
 		ScrapeDuration: "500ms",
 	}
-	err := Run(c)
+	err := Run(context.Background(), c)
 	// Currently no error is returned in case a scraper does not return any data / err status code
 	require.NoError(t, err)
 	require.Equal(t, 2, counter, "the scraper should have hit the mock exactly twice")
@@ -194,7 +198,7 @@ func TestScrapingNotAnswering(t *testing.T) {
 	}
 
 	// when
-	err := Run(c)
+	err := Run(context.Background(), c)
 
 	// then
 	require.NoError(t, err)
@@ -230,9 +234,166 @@ func TestScrapingWithToken(t *testing.T) {
 	}
 
 	// when
-	err = Run(c)
+	err = Run(context.Background(), c)
 	require.NoError(t, err)
 
 	// then
 	require.Equal(t, "Bearer "+fakeToken, headers.Get("Authorization"))
 }
+
+func TestRunWithEmittersShutdown(t *testing.T) {
+	scraped := make(chan struct{}, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case scraped <- struct{}{}:
+		default:
+		}
+		_, _ = w.Write([]byte("up 1\n"))
+	}))
+	defer srv.Close()
+
+	c := &Config{
+		TargetConfigs: []endpoints.TargetConfig{
+			{
+				URLs: []string{srv.URL},
+			},
+		},
+		Standalone:                  true,
+		SelfMetricsListeningAddress: "127.0.0.1:0",
+		ScrapeDuration:              "1h",
+		ScrapeTimeout:               time.Second,
+		WorkerThreads:               4,
+		ShutdownGracePeriod:         5 * time.Second,
+	}
+	emitter := &shutdownEmitter{}
+	ctx, cancel := context.WithCancel(context.Background())
+	ran := make(chan error)
+	go func() {
+		ran <- RunWithEmitters(ctx, c, []integration.Emitter{emitter})
+	}()
+
+	<-scraped
+	cancel()
+	select {
+	case err := <-ran:
+		require.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("the scraper didn't shut down")
+	}
+	emitter.lock.Lock()
+	defer emitter.lock.Unlock()
+	require.True(t, emitter.shutdown, "the emitters are shut down")
+	require.Greater(t, emitter.emitted, 0, "the metrics of the current cycle are emitted")
+}
+
+// The emitters are given the flush timeout even when the scrape cycle doesn't
+// finish within the grace period.
+func TestRunWithEmittersShutdown_FlushTimeout(t *testing.T) {
+	scraped := make(chan struct{}, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case scraped <- struct{}{}:
+		default:
+		}
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	c := &Config{
+		TargetConfigs: []endpoints.TargetConfig{
+			{
+				URLs: []string{srv.URL},
+			},
+		},
+		Standalone:                  true,
+		SelfMetricsListeningAddress: "127.0.0.1:0",
+		ScrapeDuration:              "1h",
+		ScrapeTimeout:               time.Hour,
+		WorkerThreads:               4,
+		ShutdownGracePeriod:         2 * time.Second,
+		ShutdownFlushTimeout:        time.Second,
+	}
+	emitter := &shutdownEmitter{}
+	ctx, cancel := context.WithCancel(context.Background())
+	ran := make(chan error)
+	go func() {
+		ran <- RunWithEmitters(ctx, c, []integration.Emitter{emitter})
+	}()
+
+	<-scraped
+	cancel()
+	select {
+	case err := <-ran:
+		require.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("the scraper didn't shut down")
+	}
+	emitter.lock.Lock()
+	defer emitter.lock.Unlock()
+	require.True(t, emitter.shutdown, "the emitters are shut down")
+	assert.Greater(t, emitter.flushTime, 500*time.Millisecond)
+}
+
+func TestValidateConfig_ShutdownFlushTimeout(t *testing.T) {
+	t.Parallel()
+
+	cfg := &Config{ScrapeDuration: "30s", ShutdownFlushTimeout: 30 * time.Second}
+	assert.Error(t, validateConfig(cfg), "longer than the default grace period")
+	cfg.ShutdownGracePeriod = time.Minute
+	assert.NoError(t, validateConfig(cfg))
+}
+
+func TestValidateConfig_NegotiateFormats(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name      string
+		accept    string
+		negotiate bool
+		expected  string
+	}{
+		{name: "default", accept: prometheus.DefaultAcceptHeader, expected: prometheus.DefaultAcceptHeader},
+		{name: "negotiated", accept: prometheus.DefaultAcceptHeader, negotiate: true, expected: prometheus.NegotiatedAcceptHeader},
+		{name: "set accept header", accept: "text/plain", negotiate: true, expected: "text/plain"},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			cfg := &Config{ScrapeDuration: "30s", ScrapeAcceptHeader: tc.accept, ScrapeNegotiateFormats: tc.negotiate}
+			require.NoError(t, validateConfig(cfg))
+			assert.Equal(t, tc.expected, cfg.ScrapeAcceptHeader)
+		})
+	}
+}
+
+type shutdownEmitter struct {
+	lock     sync.Mutex
+	emitted  int
+	shutdown bool
+	// flushTime is the time left to the emitter to shut down.
+	flushTime time.Duration
+}
+
+func (e *shutdownEmitter) Name() string {
+	return "shutdown"
+}
+
+func (e *shutdownEmitter) Emit(metrics []integration.Metric) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.emitted += len(metrics)
+	return nil
+}
+
+func (e *shutdownEmitter) Shutdown(ctx context.Context) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.shutdown = true
+	if deadline, ok := ctx.Deadline(); ok {
+		e.flushTime = time.Until(deadline)
+	}
+	return nil
+}
@@ -0,0 +1,334 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package integration
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// defaultRetryAfter is the time harvests are paused for when a 429 response
+// doesn't tell how long to wait.
+const defaultRetryAfter = time.Second
+
+// maxPendingHalves is the number of split payloads whose second half is kept
+// to be sent again.
+const maxPendingHalves = 100
+
+// harvestLimiter is notified of the limits of the New Relic APIs, so the
+// harvests adapt to them.
+type harvestLimiter interface {
+	// pauseUntil stops the harvests until the given time.
+	pauseUntil(t time.Time)
+	// limitMetrics lowers the number of metrics of every harvest below the
+	// number of metrics of a payload rejected for being too large.
+	limitMetrics(rejected int)
+	// growMetrics raises the number of metrics of every harvest back towards
+	// the configured one, once a payload is accepted without being split.
+	growMetrics()
+}
+
+// apiLimitsRoundTripper adapts the requests of the telemetry emitter to the
+// limits of the New Relic APIs. 429 responses pause the harvests for the time
+// set by their Retry-After header, answering the requests sent meanwhile
+// without sending them. Payloads rejected with a 413 response are split in
+// halves, which are sent again.
+type apiLimitsRoundTripper struct {
+	rt  http.RoundTripper
+	log *logrus.Entry
+	now func() time.Time
+
+	lock        sync.Mutex
+	pausedUntil time.Time
+	limiter     harvestLimiter
+	// pending are the second halves of the split payloads that failed once
+	// the first halves were accepted, by the hash of the whole payload.
+	pending map[[sha256.Size]byte][]byte
+}
+
+func newAPILimitsRoundTripper(rt http.RoundTripper) *apiLimitsRoundTripper {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	return &apiLimitsRoundTripper{
+		rt:      rt,
+		log:     logrus.WithField("component", "TelemetryEmitter"),
+		now:     time.Now,
+		pending: map[[sha256.Size]byte][]byte{},
+	}
+}
+
+// setLimiter sets the harvester notified of the limits.
+func (l *apiLimitsRoundTripper) setLimiter(limiter harvestLimiter) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.limiter = limiter
+}
+
+// RoundTrip sends the request unless the harvests are paused.
+func (l *apiLimitsRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	l.lock.Lock()
+	wait := l.pausedUntil.Sub(l.now())
+	l.lock.Unlock()
+	if wait > 0 {
+		return rateLimitedResponse(req, wait), nil
+	}
+
+	body, err := readRequestBody(req)
+	if err != nil {
+		return nil, err
+	}
+	return l.send(req, body, true)
+}
+
+// send sends a copy of the request with the given body, so the headers set by
+// the wrapped round trippers aren't kept in the halves of a split payload.
+// Payloads sent again after being partially accepted only send the half that
+// wasn't. The limiter grows the metrics per harvest when a whole payload, not
+// a half, is accepted.
+func (l *apiLimitsRoundTripper) send(req *http.Request, body []byte, whole bool) (*http.Response, error) {
+	key := sha256.Sum256(body)
+	l.lock.Lock()
+	half, ok := l.pending[key]
+	l.lock.Unlock()
+	if ok {
+		resp, err := l.send(req, half, false)
+		if !shouldBuffer(resp, err) {
+			l.lock.Lock()
+			delete(l.pending, key)
+			l.lock.Unlock()
+		}
+		return resp, err
+	}
+
+	resp, err := l.rt.RoundTrip(requestWithBody(req, body))
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests:
+		l.rateLimited(parseRetryAfter(resp.Header.Get("Retry-After"), l.now()))
+	case http.StatusRequestEntityTooLarge:
+		return l.split(req, body, resp)
+	}
+	if whole && resp.StatusCode/100 == 2 {
+		l.lock.Lock()
+		limiter := l.limiter
+		l.lock.Unlock()
+		if limiter != nil {
+			limiter.growMetrics()
+		}
+	}
+	return resp, nil
+}
+
+// rateLimited pauses the harvests for the given time.
+func (l *apiLimitsRoundTripper) rateLimited(wait time.Duration) {
+	apiRateLimitedMetric.Inc()
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	until := l.now().Add(wait)
+	if until.After(l.pausedUntil) {
+		l.pausedUntil = until
+	}
+	l.log.Warnf("New Relic API rate limit reached, pausing harvests for %s", wait)
+	if l.limiter != nil {
+		l.limiter.pauseUntil(l.pausedUntil)
+	}
+}
+
+// split sends the halves of the payload rejected by the response. The
+// response is returned when the payload can't be split, and the one of the
+// first half that failed otherwise. When only the second half fails, its
+// response is returned and the half is kept, so only it is sent when the
+// payload is sent again, and no data is sent twice.
+func (l *apiLimitsRoundTripper) split(req *http.Request, body []byte, resp *http.Response) (*http.Response, error) {
+	halves, metrics, err := splitPayload(body)
+	if err != nil || halves == nil {
+		l.log.WithError(err).Warn("dropping payload too large for the New Relic API that can't be split")
+		apiPayloadsDroppedMetric.Inc()
+		return resp, nil
+	}
+	discardResponse(resp)
+	apiPayloadsSplitMetric.Inc()
+
+	if metrics > 0 {
+		l.lock.Lock()
+		limiter := l.limiter
+		l.lock.Unlock()
+		if limiter != nil {
+			limiter.limitMetrics(metrics)
+		}
+	}
+
+	for i, half := range halves {
+		resp, err := l.send(req, half, false)
+		if err == nil && resp.StatusCode/100 == 2 {
+			if i == 0 {
+				discardResponse(resp)
+				continue
+			}
+			return resp, nil
+		}
+		if i == 0 {
+			return resp, err
+		}
+		if shouldBuffer(resp, err) {
+			l.keepPending(sha256.Sum256(body), half)
+			return resp, err
+		}
+		failure := err
+		if failure == nil {
+			failure = fmt.Errorf("endpoint returned %d", resp.StatusCode)
+		}
+		l.log.WithError(failure).Warn("dropping half of a split payload, the other half was accepted")
+		apiPayloadsDroppedMetric.Inc()
+		return resp, err
+	}
+	return acceptedResponse(req), nil
+}
+
+// keepPending keeps the second half of the split payload to be sent when the
+// payload is sent again. Other halves are forgotten when there are too many,
+// so those payloads are sent whole.
+func (l *apiLimitsRoundTripper) keepPending(key [sha256.Size]byte, half []byte) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for k := range l.pending {
+		if len(l.pending) < maxPendingHalves {
+			break
+		}
+		delete(l.pending, k)
+	}
+	l.pending[key] = half
+}
+
+// splitPayload splits the gzipped JSON payload of the Metric or Event API in
+// two. Payloads with several batches or events are split by them, and the
+// ones with a single batch by its metrics, whose number is returned. Nil is
+// returned when the payload can't be split.
+func splitPayload(body []byte) ([][]byte, int, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, 0, err
+	}
+	data, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return nil, 0, err
+	}
+	var items []json.RawMessage
+	if err := json.Unmarshal(data, &items); err != nil {
+		return nil, 0, err
+	}
+
+	var halves [2]interface{}
+	var metrics int
+	switch {
+	case len(items) > 1:
+		halves[0], halves[1] = items[:len(items)/2], items[len(items)/2:]
+	case len(items) == 1:
+		var batch map[string]json.RawMessage
+		if err := json.Unmarshal(items[0], &batch); err != nil {
+			return nil, 0, nil
+		}
+		var batchMetrics []json.RawMessage
+		if err := json.Unmarshal(batch["metrics"], &batchMetrics); err != nil || len(batchMetrics) < 2 {
+			return nil, 0, nil
+		}
+		metrics = len(batchMetrics)
+		for i, part := range [][]json.RawMessage{batchMetrics[:metrics/2], batchMetrics[metrics/2:]} {
+			half := make(map[string]interface{}, len(batch))
+			for k, v := range batch {
+				half[k] = v
+			}
+			half["metrics"] = part
+			halves[i] = []interface{}{half}
+		}
+	default:
+		return nil, 0, nil
+	}
+
+	split := make([][]byte, 0, len(halves))
+	for _, half := range halves {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if err := json.NewEncoder(zw).Encode(half); err != nil {
+			return nil, 0, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, 0, err
+		}
+		split = append(split, buf.Bytes())
+	}
+	return split, metrics, nil
+}
+
+// parseRetryAfter returns the time to wait set by a Retry-After header, in
+// seconds or as a date.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if seconds, err := strconv.Atoi(strings.TrimSpace(value)); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return defaultRetryAfter
+}
+
+func requestWithBody(req *http.Request, body []byte) *http.Request {
+	r := req.Clone(req.Context())
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+	return r
+}
+
+func discardResponse(resp *http.Response) {
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+}
+
+// rateLimitedResponse answers the requests sent while the harvests are
+// paused, telling how long to wait.
+func rateLimitedResponse(req *http.Request, wait time.Duration) *http.Response {
+	resp := syntheticResponse(req, http.StatusTooManyRequests)
+	resp.Header.Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	return resp
+}
+
+func acceptedResponse(req *http.Request) *http.Response {
+	return syntheticResponse(req, http.StatusAccepted)
+}
+
+func syntheticResponse(req *http.Request, status int) *http.Response {
+	return &http.Response{
+		Status:     http.StatusText(status),
+		StatusCode: status,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+		Body:       ioutil.NopCloser(strings.NewReader("")),
+		Request:    req,
+	}
+}
@@ -0,0 +1,385 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package integration
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/newrelic/newrelic-telemetry-sdk-go/telemetry"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeMetricAPI is a Metric API rejecting the payloads with more than
+// maxMetrics metrics, and rate limiting the first rateLimited requests.
+type fakeMetricAPI struct {
+	*httptest.Server
+	maxMetrics  int
+	rateLimited int
+
+	lock     sync.Mutex
+	requests int
+	metrics  []string
+}
+
+func newFakeMetricAPI(t *testing.T, maxMetrics, rateLimited int) *fakeMetricAPI {
+	t.Helper()
+
+	api := &fakeMetricAPI{maxMetrics: maxMetrics, rateLimited: rateLimited}
+	api.Server = httptest.NewServer(http.HandlerFunc(api.handle))
+	t.Cleanup(api.Close)
+	return api
+}
+
+func (api *fakeMetricAPI) handle(w http.ResponseWriter, r *http.Request) {
+	api.lock.Lock()
+	defer api.lock.Unlock()
+
+	api.requests++
+	if api.requests <= api.rateLimited {
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+
+	zr, err := gzip.NewReader(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var batches []struct {
+		Metrics []struct {
+			Name string `json:"name"`
+		} `json:"metrics"`
+	}
+	if err := json.NewDecoder(zr).Decode(&batches); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var names []string
+	for _, batch := range batches {
+		for _, m := range batch.Metrics {
+			names = append(names, m.Name)
+		}
+	}
+	if len(names) > api.maxMetrics {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+	api.metrics = append(api.metrics, names...)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (api *fakeMetricAPI) received() (int, []string) {
+	api.lock.Lock()
+	defer api.lock.Unlock()
+
+	metrics := append([]string(nil), api.metrics...)
+	sort.Strings(metrics)
+	return api.requests, metrics
+}
+
+func newTestAPIEmitter(t *testing.T, api *fakeMetricAPI) *TelemetryEmitter {
+	t.Helper()
+
+	emitter, err := NewTelemetryEmitter(TelemetryEmitterConfig{
+		HarvesterOpts: []TelemetryHarvesterOpt{
+			telemetry.ConfigAPIKey("license key"),
+			TelemetryHarvesterWithMetricsURL(api.URL),
+		},
+		BoundedHarvesterCfg: BoundedHarvesterCfg{
+			MetricCap:                100,
+			DisablePeriodicReporting: true,
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(boundedHarvesterOf(emitter).Stop)
+	return emitter
+}
+
+func boundedHarvesterOf(emitter *TelemetryEmitter) *boundedHarvester {
+	return emitter.harvester.(harvesterDecorator).innerHarvester.(*boundedHarvester)
+}
+
+func testGauges(n int) ([]Metric, []string) {
+	metrics := make([]Metric, 0, n)
+	names := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		name := "gauge_" + strconv.Itoa(i)
+		metrics = append(metrics, Metric{name: name, metricType: metricType_GAUGE, value: float64(i)})
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return metrics, names
+}
+
+// TestTelemetryEmitter_PayloadTooLarge isn't parallel, as it checks the
+// self-metrics.
+func TestTelemetryEmitter_PayloadTooLarge(t *testing.T) {
+	api := newFakeMetricAPI(t, 3, 0)
+	emitter := newTestAPIEmitter(t, api)
+	split := testutil.ToFloat64(apiPayloadsSplitMetric)
+
+	metrics, names := testGauges(10)
+	require.NoError(t, emitter.Emit(metrics))
+	emitter.harvester.HarvestNow(context.Background())
+
+	// The payload of 10 metrics is split in 5 and 5, and those in 2 and 3.
+	require.Eventually(t, func() bool {
+		_, received := api.received()
+		return len(received) == len(names)
+	}, 5*time.Second, 10*time.Millisecond)
+	requests, received := api.received()
+	assert.Equal(t, names, received)
+	assert.Equal(t, 7, requests)
+	assert.Equal(t, split+3, testutil.ToFloat64(apiPayloadsSplitMetric))
+
+	// The metrics per harvest are lowered to half of the smallest rejected
+	// payload.
+	bounded := boundedHarvesterOf(emitter)
+	bounded.mtx.Lock()
+	assert.Equal(t, 2, bounded.MetricCap)
+	bounded.mtx.Unlock()
+	assert.Equal(t, float64(2), testutil.ToFloat64(harvestMetricCapMetric))
+
+	// They grow back by a tenth of the configured ones as payloads are
+	// accepted whole.
+	require.NoError(t, emitter.Emit(metrics[:2]))
+	emitter.harvester.HarvestNow(context.Background())
+	require.Eventually(t, func() bool {
+		requests, _ := api.received()
+		return requests == 8
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Eventually(t, func() bool {
+		bounded.mtx.Lock()
+		defer bounded.mtx.Unlock()
+		return bounded.MetricCap == 12
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, float64(12), testutil.ToFloat64(harvestMetricCapMetric))
+}
+
+// TestTelemetryEmitter_RateLimited isn't parallel, as it checks the
+// self-metrics.
+func TestTelemetryEmitter_RateLimited(t *testing.T) {
+	api := newFakeMetricAPI(t, 100, 1)
+	emitter := newTestAPIEmitter(t, api)
+	rateLimited := testutil.ToFloat64(apiRateLimitedMetric)
+
+	metrics, names := testGauges(2)
+	require.NoError(t, emitter.Emit(metrics))
+	emitter.harvester.HarvestNow(context.Background())
+
+	bounded := boundedHarvesterOf(emitter)
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(apiRateLimitedMetric) == rateLimited+1
+	}, 5*time.Second, 10*time.Millisecond)
+	bounded.mtx.Lock()
+	assert.True(t, bounded.pausedUntil.After(time.Now()), "harvests are paused")
+	bounded.mtx.Unlock()
+
+	// Metrics recorded while paused are sent with the next harvest.
+	more, moreNames := testGauges(3)
+	require.NoError(t, emitter.Emit(more[2:]))
+	emitter.harvester.HarvestNow(context.Background())
+
+	// The rate limited payload is retried once the pause ends, and the one
+	// harvested meanwhile is answered without being sent.
+	require.Eventually(t, func() bool {
+		_, received := api.received()
+		return len(received) == len(moreNames)
+	}, 10*time.Second, 10*time.Millisecond)
+	requests, received := api.received()
+	assert.Equal(t, append(names, "gauge_2"), received)
+	assert.Equal(t, 3, requests)
+	assert.Equal(t, rateLimited+1, testutil.ToFloat64(apiRateLimitedMetric))
+}
+
+// TestAPILimits_SecondHalfFails isn't parallel, as it checks the self-metrics.
+func TestAPILimits_SecondHalfFails(t *testing.T) {
+	testCases := []struct {
+		name string
+		// status is the one of the first response to the second half.
+		status  int
+		retried bool
+	}{
+		{
+			name:    "transient failure",
+			status:  http.StatusServiceUnavailable,
+			retried: true,
+		},
+		{
+			name:   "permanent failure",
+			status: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			var received []string
+			failed := false
+			limits := newAPILimitsRoundTripper(roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				zr, err := gzip.NewReader(req.Body)
+				require.NoError(t, err)
+				var batches []struct {
+					Metrics []struct {
+						Name string `json:"name"`
+					} `json:"metrics"`
+				}
+				require.NoError(t, json.NewDecoder(zr).Decode(&batches))
+				metrics := batches[0].Metrics
+				switch {
+				case len(metrics) > 1:
+					return emptyResponse(http.StatusRequestEntityTooLarge), nil
+				case metrics[0].Name == "b" && !failed:
+					failed = true
+					return emptyResponse(tc.status), nil
+				}
+				received = append(received, metrics[0].Name)
+				return emptyResponse(http.StatusAccepted), nil
+			}))
+			dropped := testutil.ToFloat64(apiPayloadsDroppedMetric)
+
+			var payload bytes.Buffer
+			zw := gzip.NewWriter(&payload)
+			_, err := zw.Write([]byte(`[{"common":{},"metrics":[{"name":"a"},{"name":"b"}]}]`))
+			require.NoError(t, err)
+			require.NoError(t, zw.Close())
+			send := func() int {
+				req, err := http.NewRequest(http.MethodPost, "https://metric-api.newrelic.com/metric/v1", bytes.NewReader(payload.Bytes()))
+				require.NoError(t, err)
+				resp, err := limits.RoundTrip(req)
+				require.NoError(t, err)
+				return resp.StatusCode
+			}
+
+			// The failure of the second half is returned.
+			assert.Equal(t, tc.status, send())
+			assert.Equal(t, []string{"a"}, received)
+
+			// Only the second half is sent again, when the failure is
+			// transient.
+			assert.Equal(t, http.StatusAccepted, send())
+			if tc.retried {
+				assert.Equal(t, []string{"a", "b"}, received)
+				assert.Equal(t, dropped, testutil.ToFloat64(apiPayloadsDroppedMetric))
+			} else {
+				assert.Equal(t, []string{"a", "a", "b"}, received)
+				assert.Equal(t, dropped+1, testutil.ToFloat64(apiPayloadsDroppedMetric))
+			}
+			assert.Empty(t, limits.pending)
+		})
+	}
+}
+
+func TestSplitPayload(t *testing.T) {
+	t.Parallel()
+
+	gzipped := func(t *testing.T, payload string) []byte {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		_, err := zw.Write([]byte(payload))
+		require.NoError(t, err)
+		require.NoError(t, zw.Close())
+		return buf.Bytes()
+	}
+
+	testCases := []struct {
+		name    string
+		payload string
+		halves  []string
+		metrics int
+	}{
+		{
+			name:    "metrics",
+			payload: `[{"common":{"interval.ms":10},"metrics":[{"name":"a"},{"name":"b"},{"name":"c"}]}]`,
+			halves: []string{
+				`[{"common":{"interval.ms":10},"metrics":[{"name":"a"}]}]`,
+				`[{"common":{"interval.ms":10},"metrics":[{"name":"b"},{"name":"c"}]}]`,
+			},
+			metrics: 3,
+		},
+		{
+			name:    "events",
+			payload: `[{"eventType":"a"},{"eventType":"b"}]`,
+			halves:  []string{`[{"eventType":"a"}]`, `[{"eventType":"b"}]`},
+		},
+		{
+			name:    "single metric",
+			payload: `[{"common":{},"metrics":[{"name":"a"}]}]`,
+		},
+		{
+			name:    "single event",
+			payload: `[{"eventType":"a"}]`,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			halves, metrics, err := splitPayload(gzipped(t, tc.payload))
+			require.NoError(t, err)
+			assert.Equal(t, tc.metrics, metrics)
+			require.Len(t, halves, len(tc.halves))
+			for i, half := range halves {
+				zr, err := gzip.NewReader(bytes.NewReader(half))
+				require.NoError(t, err)
+				var decoded interface{}
+				require.NoError(t, json.NewDecoder(zr).Decode(&decoded))
+				var expected interface{}
+				require.NoError(t, json.Unmarshal([]byte(tc.halves[i]), &expected))
+				assert.Equal(t, expected, decoded)
+			}
+		})
+	}
+
+	_, _, err := splitPayload([]byte("not gzipped"))
+	assert.Error(t, err)
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC)
+	testCases := map[string]time.Duration{
+		"30":                            30 * time.Second,
+		"Mon, 19 Oct 2026 10:01:00 GMT": time.Minute,
+		"Mon, 19 Oct 2026 09:59:00 GMT": defaultRetryAfter,
+		"":                              defaultRetryAfter,
+		"0":                             defaultRetryAfter,
+		"soon":                          defaultRetryAfter,
+	}
+	for value, expected := range testCases {
+		assert.Equal(t, expected, parseRetryAfter(value, now), value)
+	}
+}
+
+func TestTelemetryEmitter_Shutdown(t *testing.T) {
+	t.Parallel()
+
+	api := newFakeMetricAPI(t, 100, 0)
+	emitter := newTestAPIEmitter(t, api)
+
+	metrics, names := testGauges(2)
+	require.NoError(t, emitter.Emit(metrics))
+	require.NoError(t, emitter.Shutdown(context.Background()))
+
+	// The recorded metrics are sent without waiting for a harvest.
+	requests, received := api.received()
+	assert.Equal(t, 1, requests)
+	assert.Equal(t, names, received)
+}
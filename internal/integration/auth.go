@@ -0,0 +1,93 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package integration
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
+)
+
+// newAuthRoundTripper wraps the round tripper with the ones authenticating
+// the requests as configured. The tokens of OAuth2 are got from the given
+// sources, so they are reused across scrapes.
+func newAuthRoundTripper(auth endpoints.Auth, rt http.RoundTripper, tokens *tokenSources) (http.RoundTripper, error) {
+	switch {
+	case !auth.BasicAuth.IsZero():
+		rt = newBasicAuthRoundTripper(BasicAuthConfig(auth.BasicAuth), rt)
+	case auth.BearerTokenFile != "":
+		rt = NewBearerAuthFileRoundTripper(auth.BearerTokenFile, rt)
+	case auth.BearerToken != "":
+		rt = newHeadersRoundTripper(map[string]string{"Authorization": "Bearer " + auth.BearerToken}, rt)
+	case !auth.OAuth2.IsZero():
+		source, err := tokens.get(auth.OAuth2)
+		if err != nil {
+			return nil, err
+		}
+		rt = newOAuth2RoundTripper(source, rt)
+	}
+	if len(auth.Headers) > 0 {
+		rt = newHeadersRoundTripper(auth.Headers, rt)
+	}
+	return rt, nil
+}
+
+// tokenSources keeps the sources of the OAuth2 client credentials tokens of
+// every configuration, which cache the tokens until they expire.
+type tokenSources struct {
+	// client requests the tokens.
+	client  *http.Client
+	lock    sync.Mutex
+	sources map[string]oauth2.TokenSource
+}
+
+func newTokenSources(client *http.Client) *tokenSources {
+	return &tokenSources{
+		client:  client,
+		sources: map[string]oauth2.TokenSource{},
+	}
+}
+
+// get returns the token source of the configuration. Since the client secret
+// is part of it, changing the secret file gets new tokens.
+func (ts *tokenSources) get(cfg endpoints.OAuth2) (oauth2.TokenSource, error) {
+	secret, err := cfg.ReadClientSecret()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read oauth2 client secret: %w", err)
+	}
+
+	params := url.Values{}
+	for k, v := range cfg.EndpointParams {
+		params.Set(k, v)
+	}
+	scopes := append([]string(nil), cfg.Scopes...)
+	sort.Strings(scopes)
+	key := strings.Join([]string{cfg.TokenURL, cfg.ClientID, secret, strings.Join(scopes, " "), params.Encode()}, "\x00")
+
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+
+	if source, ok := ts.sources[key]; ok {
+		return source, nil
+	}
+	cc := clientcredentials.Config{
+		ClientID:       cfg.ClientID,
+		ClientSecret:   secret,
+		TokenURL:       cfg.TokenURL,
+		Scopes:         cfg.Scopes,
+		EndpointParams: params,
+	}
+	source := cc.TokenSource(context.WithValue(context.Background(), oauth2.HTTPClient, ts.client))
+	ts.sources[key] = source
+	return source, nil
+}
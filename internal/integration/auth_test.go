@@ -0,0 +1,113 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package integration
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
+)
+
+func TestFetcher_Auth(t *testing.T) {
+	t.Parallel()
+
+	var tokenRequests int32
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&tokenRequests, 1)
+		if err := r.ParseForm(); err != nil || r.PostForm.Get("grant_type") != "client_credentials" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		id, secret, _ := r.BasicAuth()
+		if id != "id" || secret != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "oauth2-token",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+		})
+	}))
+	t.Cleanup(tokenServer.Close)
+
+	// The servers only answer the requests with the expected header.
+	newServer := func(header, expected string) *httptest.Server {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get(header) != expected {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			_, _ = io.WriteString(w, "up 1\n")
+		}))
+		t.Cleanup(ts.Close)
+		return ts
+	}
+
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	require.NoError(t, os.WriteFile(passwordFile, []byte("pass\n"), 0o600))
+
+	basic := newServer("Authorization", "Basic dXNlcjpwYXNz")
+	headers := newServer("X-Api-Key", "key")
+	bearer := newServer("Authorization", "Bearer token")
+	oauth2 := newServer("Authorization", "Bearer oauth2-token")
+	unauthenticated := newServer("Authorization", "Bearer token")
+
+	retriever, err := endpoints.FixedRetriever(
+		endpoints.TargetConfig{
+			URLs: []string{basic.URL},
+			Auth: endpoints.Auth{BasicAuth: endpoints.BasicAuth{Username: "user", PasswordFile: passwordFile}},
+		},
+		endpoints.TargetConfig{
+			URLs: []string{headers.URL},
+			Auth: endpoints.Auth{Headers: map[string]string{"X-Api-Key": "key"}},
+		},
+		endpoints.TargetConfig{
+			URLs: []string{bearer.URL},
+			Auth: endpoints.Auth{BearerToken: "token"},
+		},
+		endpoints.TargetConfig{
+			URLs: []string{oauth2.URL},
+			Auth: endpoints.Auth{OAuth2: endpoints.OAuth2{
+				ClientID:     "id",
+				ClientSecret: "secret",
+				TokenURL:     tokenServer.URL,
+			}},
+		},
+		endpoints.TargetConfig{URLs: []string{unauthenticated.URL}},
+	)
+	require.NoError(t, err)
+	targets, err := retriever.GetTargets()
+	require.NoError(t, err)
+
+	fetcher := NewFetcher(fetchDuration, fetchTimeout, "", workerThreads, "", "", true, queueLength)
+	for i := 0; i < 2; i++ {
+		pairs := collectTargetMetrics(t, fetcher.Fetch(targets))
+
+		var scraped []string
+		for _, pair := range pairs {
+			scraped = append(scraped, pair.Target.URL.Host)
+		}
+		assert.ElementsMatch(t, []string{
+			basic.Listener.Addr().String(),
+			headers.Listener.Addr().String(),
+			bearer.Listener.Addr().String(),
+			oauth2.Listener.Addr().String(),
+		}, scraped)
+	}
+
+	// The OAuth2 token is cached until it expires.
+	assert.Equal(t, int32(1), atomic.LoadInt32(&tokenRequests))
+}
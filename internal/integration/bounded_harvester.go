@@ -33,10 +33,12 @@ func bindHarvester(inner harvester, cfg BoundedHarvesterCfg) harvester {
 	if cfg.MetricCap == 0 {
 		cfg.MetricCap = BoundedHarvesterDefaultMetricsCap
 	}
+	harvestMetricCapMetric.Set(float64(cfg.MetricCap))
 
 	h := &boundedHarvester{
 		BoundedHarvesterCfg: cfg,
 		mtx:                 sync.Mutex{},
+		maxMetricCap:        cfg.MetricCap,
 		inner:               inner,
 	}
 
@@ -52,7 +54,9 @@ func bindHarvester(inner harvester, cfg BoundedHarvesterCfg) harvester {
 type BoundedHarvesterCfg struct {
 	// MetricCap is the number of metrics to store in memory before triggering a HarvestNow action regardless of
 	// HarvestPeriod. It will directly influence the amount of memory that nri-prometheus allocates.
-	// A value of 10000 is rougly equivalent to 500M in RAM in the tested scenarios
+	// A value of 10000 is rougly equivalent to 500M in RAM in the tested scenarios.
+	// It is lowered when the payloads are rejected for being too large, and grows back to the configured value
+	// as the payloads are accepted again.
 	MetricCap int
 
 	// HarvestPeriod specifies the period that will trigger a HarvestNow action for the inner harvester.
@@ -86,6 +90,7 @@ const BoundedHarvesterDefaultMinReportInterval = 200 * time.Millisecond
 // metrics is above a given threshold (BoundedHarvesterCfg.MetricCap), a harvest is triggered.
 // A harvest is also triggered in periodic time intervals (BoundedHarvesterCfg.HarvestPeriod)
 // boundedHarvester will never trigger harvests more often than specified in BoundedHarvesterCfg.MinReportInterval.
+// Harvests are paused while the New Relic APIs rate limit the requests.
 type boundedHarvester struct {
 	BoundedHarvesterCfg
 
@@ -93,6 +98,10 @@ type boundedHarvester struct {
 
 	storedMetrics int
 	lastReport    time.Time
+	pausedUntil   time.Time
+	// maxMetricCap is the configured MetricCap, which it grows back to after
+	// being lowered.
+	maxMetricCap int
 
 	stopper chan struct{}
 	stopped bool
@@ -109,6 +118,12 @@ func (h *boundedHarvester) RecordMetric(m telemetry.Metric) {
 	h.inner.RecordMetric(m)
 }
 
+// RecordEvent records the event in the underlying harvester. Events aren't
+// counted towards the MetricCap.
+func (h *boundedHarvester) RecordEvent(e telemetry.Event) error {
+	return h.inner.RecordEvent(e)
+}
+
 // HarvestNow forces a new report
 func (h *boundedHarvester) HarvestNow(ctx context.Context) {
 	h.reportIfNeeded(ctx, true)
@@ -125,16 +140,71 @@ func (h *boundedHarvester) Stop() {
 	}
 }
 
+// pauseUntil stops the harvests that aren't forced until the given time.
+func (h *boundedHarvester) pauseUntil(t time.Time) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	if t.After(h.pausedUntil) {
+		h.pausedUntil = t
+	}
+}
+
+// limitMetrics lowers the MetricCap to half of the metrics of a payload
+// rejected for being too large.
+func (h *boundedHarvester) limitMetrics(rejected int) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	metricCap := rejected / 2
+	if metricCap < 1 {
+		metricCap = 1
+	}
+	if metricCap < h.MetricCap {
+		log.Warnf("payload with %d metrics too large, lowering the metrics per harvest from %d to %d", rejected, h.MetricCap, metricCap)
+		h.MetricCap = metricCap
+		harvestMetricCapMetric.Set(float64(metricCap))
+	}
+}
+
+// growMetrics raises the MetricCap by a tenth of the configured one after a
+// payload is accepted, so a payload rejected once doesn't lower the metrics
+// per harvest for good. Payloads growing too large again are split and lower
+// it again.
+func (h *boundedHarvester) growMetrics() {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	if h.MetricCap >= h.maxMetricCap {
+		return
+	}
+	metricCap := h.MetricCap + h.maxMetricCap/10
+	if metricCap == h.MetricCap {
+		metricCap++
+	}
+	if metricCap > h.maxMetricCap {
+		metricCap = h.maxMetricCap
+	}
+	log.Debugf("payloads accepted, raising the metrics per harvest from %d to %d", h.MetricCap, metricCap)
+	h.MetricCap = metricCap
+	harvestMetricCapMetric.Set(float64(metricCap))
+}
+
 // reportIfNeeded carries the logic to report metrics.
 // A report is triggered if:
 // - Force is set to true, or
 // - Last report occurred earlier than Now() - HarvestPeriod, or
 // - The number of metrics is above MetricCap and MinReportInterval has passed since last report
 // A report will not be triggered in any case if time since last harvest is less than MinReportInterval
+// Unless forced, a report will not be triggered either while harvests are paused
 func (h *boundedHarvester) reportIfNeeded(ctx context.Context, force bool) {
 	h.mtx.Lock()
 	defer h.mtx.Unlock()
 
+	if !force && time.Now().Before(h.pausedUntil) {
+		return
+	}
+
 	if force ||
 		time.Since(h.lastReport) >= h.HarvestPeriod ||
 		(h.storedMetrics > h.MetricCap && time.Since(h.lastReport) > h.MinReportInterval) {
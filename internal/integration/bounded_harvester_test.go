@@ -20,6 +20,10 @@ func (h *mockHarvester) RecordMetric(m telemetry.Metric) {
 	h.metrics++
 }
 
+func (h *mockHarvester) RecordEvent(e telemetry.Event) error {
+	return nil
+}
+
 func (h *mockHarvester) HarvestNow(ctx context.Context) {
 	h.harvests++
 }
@@ -190,3 +194,24 @@ func TestMetricCap(t *testing.T) {
 		t.Fatalf("Stacking metrics did not trigger a harvest")
 	}
 }
+
+// TestGrowMetrics isn't parallel, as it changes the self-metrics.
+func TestGrowMetrics(t *testing.T) {
+	h := bindHarvester(&mockHarvester{}, BoundedHarvesterCfg{
+		HarvestPeriod:            time.Hour,
+		MetricCap:                25,
+		DisablePeriodicReporting: true,
+	}).(*boundedHarvester)
+
+	h.limitMetrics(10)
+	if h.MetricCap != 5 {
+		t.Fatalf("MetricCap was not lowered to half of the rejected payload: %d", h.MetricCap)
+	}
+
+	for _, expected := range []int{7, 9, 11, 13, 15, 17, 19, 21, 23, 25, 25} {
+		h.growMetrics()
+		if h.MetricCap != expected {
+			t.Fatalf("MetricCap grew to %d instead of %d", h.MetricCap, expected)
+		}
+	}
+}
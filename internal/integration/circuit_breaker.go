@@ -0,0 +1,151 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package integration
+
+import (
+	"sync"
+	"time"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
+)
+
+const (
+	defaultCircuitBreakerMinBackoff = time.Minute
+	defaultCircuitBreakerMaxBackoff = 10 * time.Minute
+)
+
+// CircuitBreakerConfig configures when the targets failing to be scraped are
+// no longer scraped on every cycle, but probed less often.
+type CircuitBreakerConfig struct {
+	// Failures is the number of consecutive failed scrapes opening the circuit
+	// of a target. 0 disables the circuit breaker.
+	Failures int
+	// MinBackoff is the time the target isn't scraped for once its circuit
+	// opens, doubled every time the probe fails. Defaults to 1m.
+	MinBackoff time.Duration
+	// MaxBackoff is the maximum time the target isn't scraped for. Defaults
+	// to 10m.
+	MaxBackoff time.Duration
+}
+
+// circuitState is reported by the circuit breaker state self-metric.
+type circuitState int
+
+const (
+	// circuitClosed targets are scraped on every cycle.
+	circuitClosed circuitState = iota
+	// circuitOpen targets aren't scraped until their backoff elapses.
+	circuitOpen
+	// circuitHalfOpen targets are being probed, closing their circuit when
+	// the scrape succeeds.
+	circuitHalfOpen
+)
+
+type targetCircuit struct {
+	name     string
+	failures int
+	state    circuitState
+	backoff  time.Duration
+	retryAt  time.Time
+}
+
+// circuitBreaker tracks the consecutive failures of every target, keyed by
+// its URL, skipping the scrapes of the targets with an open circuit.
+type circuitBreaker struct {
+	cfg      CircuitBreakerConfig
+	lock     sync.Mutex
+	circuits map[string]*targetCircuit
+	now      func() time.Time
+}
+
+func newCircuitBreaker(cfg CircuitBreakerConfig) *circuitBreaker {
+	if cfg.MinBackoff == 0 {
+		cfg.MinBackoff = defaultCircuitBreakerMinBackoff
+	}
+	if cfg.MaxBackoff == 0 {
+		cfg.MaxBackoff = defaultCircuitBreakerMaxBackoff
+	}
+	if cfg.MaxBackoff < cfg.MinBackoff {
+		cfg.MaxBackoff = cfg.MinBackoff
+	}
+	return &circuitBreaker{
+		cfg:      cfg,
+		circuits: map[string]*targetCircuit{},
+		now:      time.Now,
+	}
+}
+
+// allow tells whether the target is scraped in this cycle. Targets with an
+// open circuit are probed once their backoff elapses.
+func (cb *circuitBreaker) allow(t endpoints.Target) bool {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+
+	c, ok := cb.circuits[t.URL.String()]
+	if !ok || c.state != circuitOpen {
+		return true
+	}
+	if cb.now().Before(c.retryAt) {
+		scrapesSkippedMetric.WithLabelValues(t.Name).Inc()
+		return false
+	}
+	c.state = circuitHalfOpen
+	circuitBreakerStateMetric.WithLabelValues(t.Name).Set(float64(circuitHalfOpen))
+	return true
+}
+
+// done records the result of the scrape of the target. Successful scrapes
+// close its circuit, while failed probes open it again for twice as long.
+func (cb *circuitBreaker) done(t endpoints.Target, err error) {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+
+	key := t.URL.String()
+	c, ok := cb.circuits[key]
+	if err == nil {
+		if ok {
+			delete(cb.circuits, key)
+			circuitBreakerStateMetric.WithLabelValues(t.Name).Set(float64(circuitClosed))
+		}
+		return
+	}
+
+	if !ok {
+		c = &targetCircuit{name: t.Name}
+		cb.circuits[key] = c
+	}
+	c.failures++
+	switch {
+	case c.state == circuitHalfOpen:
+		c.backoff *= 2
+		if c.backoff > cb.cfg.MaxBackoff {
+			c.backoff = cb.cfg.MaxBackoff
+		}
+	case c.failures >= cb.cfg.Failures:
+		c.backoff = cb.cfg.MinBackoff
+	default:
+		return
+	}
+	c.state = circuitOpen
+	c.retryAt = cb.now().Add(c.backoff)
+	circuitBreakerStateMetric.WithLabelValues(t.Name).Set(float64(circuitOpen))
+}
+
+// prune forgets the targets that are no longer scraped.
+func (cb *circuitBreaker) prune(targets []endpoints.Target) {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+
+	current := make(map[string]bool, len(targets))
+	for _, t := range targets {
+		current[t.URL.String()] = true
+	}
+	for key, c := range cb.circuits {
+		if !current[key] {
+			delete(cb.circuits, key)
+			circuitBreakerStateMetric.DeleteLabelValues(c.name)
+			scrapesSkippedMetric.DeleteLabelValues(c.name)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package integration
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(1700000000, 0)
+	cb := newCircuitBreaker(CircuitBreakerConfig{Failures: 2, MinBackoff: time.Minute, MaxBackoff: 3 * time.Minute})
+	cb.now = func() time.Time { return now }
+
+	target := endpoints.Target{Name: "circuit-breaker-target", URL: url.URL{Scheme: "http", Host: "circuit-breaker-target:9100"}}
+	state := func() float64 {
+		return testutil.ToFloat64(circuitBreakerStateMetric.WithLabelValues(target.Name))
+	}
+	failed := errors.New("connection refused")
+
+	// The circuit opens after the consecutive failures.
+	assert.True(t, cb.allow(target))
+	cb.done(target, failed)
+	assert.True(t, cb.allow(target), "a single failure doesn't open the circuit")
+	cb.done(target, failed)
+	assert.Equal(t, float64(circuitOpen), state())
+	assert.False(t, cb.allow(target))
+	assert.Equal(t, float64(1), testutil.ToFloat64(scrapesSkippedMetric.WithLabelValues(target.Name)))
+
+	// The target is probed once the backoff elapses, doubling it when the
+	// probe fails, up to the maximum.
+	for _, backoff := range []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute, 3 * time.Minute} {
+		now = now.Add(backoff - time.Second)
+		assert.False(t, cb.allow(target), "backoff of %s", backoff)
+		now = now.Add(time.Second)
+		assert.True(t, cb.allow(target), "backoff of %s", backoff)
+		assert.Equal(t, float64(circuitHalfOpen), state())
+		cb.done(target, failed)
+		assert.Equal(t, float64(circuitOpen), state())
+	}
+
+	// A successful probe closes the circuit.
+	now = now.Add(3 * time.Minute)
+	assert.True(t, cb.allow(target))
+	cb.done(target, nil)
+	assert.Equal(t, float64(circuitClosed), state())
+	cb.done(target, failed)
+	assert.True(t, cb.allow(target), "the failures are counted again from zero")
+
+	// Removed targets are forgotten.
+	cb.prune(nil)
+	assert.Empty(t, cb.circuits)
+	assert.False(t, circuitBreakerStateMetric.DeleteLabelValues(target.Name), "the state is no longer reported")
+}
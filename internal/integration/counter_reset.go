@@ -0,0 +1,141 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package integration
+
+import (
+	"sync"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/prometheus"
+)
+
+// processStartTimeMetric is the gauge exporters set to the time their process
+// started, in seconds since the epoch.
+const processStartTimeMetric = "process_start_time_seconds"
+
+// seriesStartTime returns the time a counter, histogram or summary started
+// counting, set by the exporter with OpenMetrics `_created` samples or the
+// created timestamps of the protobuf format. It returns the zero time when
+// the exporter didn't set it.
+func seriesStartTime(m *dto.Metric) time.Time {
+	switch {
+	case m.GetCounter().GetCreatedTimestamp() != nil:
+		return m.GetCounter().GetCreatedTimestamp().AsTime()
+	case m.GetHistogram().GetCreatedTimestamp() != nil:
+		return m.GetHistogram().GetCreatedTimestamp().AsTime()
+	case m.GetSummary().GetCreatedTimestamp() != nil:
+		return m.GetSummary().GetCreatedTimestamp().AsTime()
+	}
+	return time.Time{}
+}
+
+// processStartTime returns the time the process of the target started, when
+// the metrics are the ones of the family exposing it.
+func processStartTime(name string, metrics []Metric) (time.Time, bool) {
+	if name != processStartTimeMetric || len(metrics) == 0 {
+		return time.Time{}, false
+	}
+	v, ok := metrics[0].value.(float64)
+	if !ok || v <= 0 {
+		return time.Time{}, false
+	}
+	return prometheus.FloatSecondsToTime(v), true
+}
+
+// setProcessStartTimes sets the start time of the cumulative metrics lacking
+// one to the time the process of the target started, when it exposes it. All
+// the series of a process are reset when it restarts. It is only a fallback
+// for the series without a `_created` sample or created timestamp, as it
+// isn't accurate for the series created after the process started: the delta
+// reported after a restart is counted since the process started, so its
+// interval is too long.
+func setProcessStartTimes(metrics []Metric, processStart time.Time) {
+	if processStart.IsZero() {
+		return
+	}
+	for i := range metrics {
+		if isCumulative(metrics[i].metricType) && metrics[i].startTime.IsZero() {
+			metrics[i].startTime = processStart
+		}
+	}
+}
+
+func isCumulative(t metricType) bool {
+	return t == metricType_COUNTER || t == metricType_HISTOGRAM || t == metricType_SUMMARY
+}
+
+type seriesStart struct {
+	start    time.Time
+	lastSeen time.Time
+}
+
+// resetDetector tracks the start time of the cumulative series, detecting
+// they were reset when it moves forward. Counters may grow past their
+// previous value after a reset, so it can't be told from their values.
+type resetDetector struct {
+	lock                    sync.Mutex
+	series                  map[string]seriesStart
+	lastClean               time.Time
+	expirationAge           time.Duration
+	expirationCheckInterval time.Duration
+	now                     func() time.Time
+}
+
+func newResetDetector(expirationAge, expirationCheckInterval time.Duration) *resetDetector {
+	return &resetDetector{
+		series:                  map[string]seriesStart{},
+		expirationAge:           expirationAge,
+		expirationCheckInterval: expirationCheckInterval,
+		now:                     time.Now,
+	}
+}
+
+// reset returns the time the series was reset at when its start time moved
+// forward since it was last seen, or the zero time otherwise. Series without
+// a start time are never detected as reset. The start times expire on
+// wall-clock time, as the timestamps of the samples depend on the clocks of
+// the targets.
+func (d *resetDetector) reset(m Metric) time.Time {
+	if d == nil || m.startTime.IsZero() {
+		return time.Time{}
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	now := d.now()
+	if now.Sub(d.lastClean) > d.expirationCheckInterval {
+		cutoff := now.Add(-d.expirationAge)
+		for k, s := range d.series {
+			if s.lastSeen.Before(cutoff) {
+				delete(d.series, k)
+			}
+		}
+		d.lastClean = now
+	}
+
+	key := seriesKey(m.name, m.attributes)
+	last, ok := d.series[key]
+	d.series[key] = seriesStart{start: m.startTime, lastSeen: now}
+	if !ok || !m.startTime.After(last.start) {
+		return time.Time{}
+	}
+
+	counterResetsMetric.WithLabelValues(metricTarget(m)).Inc()
+	return m.startTime
+}
+
+// forget removes the start time of the series with the given key.
+func (d *resetDetector) forget(key string) {
+	if d == nil {
+		return
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	delete(d.series, key)
+}
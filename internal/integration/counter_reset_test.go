@@ -0,0 +1,190 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package integration
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/newrelic/newrelic-telemetry-sdk-go/telemetry"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+)
+
+func TestFetcher_StartTimes(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name        string
+		contentType string
+		payload     string
+		expected    map[string]time.Time
+	}{
+		{
+			name:        "created samples",
+			contentType: "application/openmetrics-text; version=1.0.0; charset=utf-8",
+			payload: `# TYPE requests counter
+requests_total 10
+requests_created 1520872607.123
+# TYPE errors counter
+errors_total 1
+# EOF
+`,
+			expected: map[string]time.Time{
+				"requests_total": time.Unix(1520872607, 123000000),
+				"errors_total":   {},
+			},
+		},
+		{
+			name: "process start time",
+			payload: `# TYPE requests_total counter
+requests_total 10
+# TYPE process_start_time_seconds gauge
+process_start_time_seconds 1520870000.123456
+`,
+			expected: map[string]time.Time{
+				"requests_total":             time.Unix(1520870000, 123456000),
+				"process_start_time_seconds": {},
+			},
+		},
+		{
+			name:        "created samples and process start time",
+			contentType: "application/openmetrics-text; version=1.0.0; charset=utf-8",
+			payload: `# TYPE requests counter
+requests_total 10
+requests_created 1520872607.123
+# TYPE errors counter
+errors_total 1
+# TYPE process_start_time_seconds gauge
+process_start_time_seconds 1520870000.5
+# EOF
+`,
+			expected: map[string]time.Time{
+				"requests_total": time.Unix(1520872607, 123000000),
+				"errors_total":   time.Unix(1520870000, 500000000),
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tc.contentType != "" {
+					w.Header().Set("Content-Type", tc.contentType)
+				}
+				_, _ = io.WriteString(w, tc.payload)
+			}))
+			defer ts.Close()
+
+			retriever, err := endpoints.FixedRetriever(endpoints.TargetConfig{URLs: []string{ts.URL}})
+			require.NoError(t, err)
+			targets, err := retriever.GetTargets()
+			require.NoError(t, err)
+
+			fetcher := NewFetcher(fetchDuration, fetchTimeout, "", workerThreads, "", "", true, queueLength)
+			pairs := collectTargetMetrics(t, fetcher.Fetch(targets))
+			require.Len(t, pairs, 1)
+
+			got := map[string]time.Time{}
+			for _, m := range pairs[0].Metrics {
+				got[m.name] = m.startTime.Local()
+			}
+			for name, start := range tc.expected {
+				assert.True(t, start.Equal(got[name]), "start time of %s: %s", name, got[name])
+			}
+		})
+	}
+}
+
+func TestTelemetryEmitter_CounterResets(t *testing.T) {
+	t.Parallel()
+
+	target := "counter-resets-test"
+	attrs := labels.Set{"targetName": target}
+	start := time.Unix(1520870000, 0)
+	restart := start.Add(time.Hour)
+	scrape := func(value float64, startTime, timestamp time.Time) []Metric {
+		return []Metric{{
+			name:       "requests_total",
+			metricType: metricType_COUNTER,
+			value:      value,
+			attributes: attrs,
+			timestamp:  timestamp,
+			startTime:  startTime,
+		}}
+	}
+
+	h := &recordingHarvester{}
+	e := &TelemetryEmitter{
+		harvester:       h,
+		deltaCalculator: newDeltaCalculator(defaultDeltaExpirationAge, defaultDeltaExpirationCheckInterval),
+		resets:          newResetDetector(time.Hour, time.Hour),
+	}
+
+	resets := testutil.ToFloat64(counterResetsMetric.WithLabelValues(target))
+	require.NoError(t, e.Emit(scrape(10, start, restart.Add(-time.Minute))))
+	assert.Empty(t, h.metrics, "the first value of a series has no delta")
+
+	// The counter was reset and grew past its previous value, so the whole
+	// value is counted since the restart.
+	require.NoError(t, e.Emit(scrape(15, restart, restart.Add(time.Minute))))
+	require.Len(t, h.metrics, 1)
+	count := h.metrics[0].(telemetry.Count)
+	assert.Equal(t, 15.0, count.Value)
+	assert.Equal(t, restart, count.Timestamp)
+	assert.Equal(t, time.Minute, count.Interval)
+	assert.Equal(t, resets+1, testutil.ToFloat64(counterResetsMetric.WithLabelValues(target)))
+
+	// Later values are counted from the value after the reset.
+	require.NoError(t, e.Emit(scrape(18, restart, restart.Add(2*time.Minute))))
+	require.Len(t, h.metrics, 2)
+	assert.Equal(t, 3.0, h.metrics[1].(telemetry.Count).Value)
+	assert.Equal(t, resets+1, testutil.ToFloat64(counterResetsMetric.WithLabelValues(target)))
+}
+
+func TestResetDetector_SkewedClocks(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC)
+	d := newResetDetector(5*time.Minute, time.Minute)
+	d.now = func() time.Time { return now }
+	series := func(target string, start time.Time) Metric {
+		return Metric{
+			name:       "requests_total",
+			metricType: metricType_COUNTER,
+			attributes: labels.Set{"targetName": "skewed-clocks-" + target},
+			startTime:  start,
+		}
+	}
+
+	start := now.Add(-time.Hour)
+	assert.True(t, d.reset(series("normal", start)).IsZero())
+	assert.True(t, d.reset(series("behind", start.Add(-24*time.Hour))).IsZero())
+
+	// A target with its clock a day ahead doesn't expire the start times of
+	// the other targets, whose resets are still detected.
+	now = now.Add(2 * time.Minute)
+	assert.True(t, d.reset(series("ahead", start.Add(24*time.Hour))).IsZero())
+	restart := now.Add(-time.Minute)
+	assert.Equal(t, restart, d.reset(series("normal", restart)))
+	assert.Equal(t, restart.Add(-24*time.Hour), d.reset(series("behind", restart.Add(-24*time.Hour))))
+
+	// Start times expire on wall-clock time, even the ones of a target with
+	// its clock behind.
+	now = now.Add(10 * time.Minute)
+	assert.True(t, d.reset(series("normal", now)).IsZero())
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	assert.Len(t, d.series, 1)
+}
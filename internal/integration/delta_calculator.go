@@ -0,0 +1,99 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package integration
+
+import (
+	"sync"
+	"time"
+
+	"github.com/newrelic/newrelic-telemetry-sdk-go/telemetry"
+)
+
+type lastValue struct {
+	when  time.Time
+	value float64
+	// seen is the wall-clock time the value was recorded at, which the
+	// expiration is based on.
+	seen time.Time
+}
+
+// deltaCalculator creates Count metrics from cumulative values, like the
+// DeltaCalculator of the telemetry SDK, but allows forgetting the values of
+// the series that are known to be gone before they expire.
+type deltaCalculator struct {
+	lock                    sync.Mutex
+	datapoints              map[string]lastValue
+	lastClean               time.Time
+	expirationAge           time.Duration
+	expirationCheckInterval time.Duration
+	now                     func() time.Time
+}
+
+func newDeltaCalculator(expirationAge, expirationCheckInterval time.Duration) *deltaCalculator {
+	return &deltaCalculator{
+		datapoints:              map[string]lastValue{},
+		expirationAge:           expirationAge,
+		expirationCheckInterval: expirationCheckInterval,
+		now:                     time.Now,
+	}
+}
+
+// CountMetric creates a count metric from the difference between the value
+// and the previous one of the series, at the given timestamp. It returns
+// false the first time the series is seen, when the value decreased or when
+// the timestamps are out of order. The values expire on wall-clock time, so
+// the timestamps set by targets with skewed clocks don't expire the values
+// of the other targets.
+func (dc *deltaCalculator) CountMetric(name string, attributes map[string]interface{}, val float64, timestamp time.Time) (telemetry.Count, bool) {
+	key := seriesKey(name, attributes)
+
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+
+	now := dc.now()
+	if now.Sub(dc.lastClean) > dc.expirationCheckInterval {
+		cutoff := now.Add(-dc.expirationAge)
+		for k, v := range dc.datapoints {
+			if v.seen.Before(cutoff) {
+				delete(dc.datapoints, k)
+			}
+		}
+		dc.lastClean = now
+	}
+
+	last, ok := dc.datapoints[key]
+	if ok && !timestamp.After(last.when) {
+		return telemetry.Count{}, false
+	}
+	dc.datapoints[key] = lastValue{when: timestamp, value: val, seen: now}
+
+	if !ok || val < last.value {
+		return telemetry.Count{}, false
+	}
+	return telemetry.Count{
+		Name:       name,
+		Attributes: attributes,
+		Value:      val - last.value,
+		Timestamp:  last.when,
+		Interval:   timestamp.Sub(last.when),
+	}, true
+}
+
+// forget removes the values of the series with the given keys.
+func (dc *deltaCalculator) forget(keys []string) {
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+
+	for _, k := range keys {
+		delete(dc.datapoints, k)
+	}
+}
+
+// len returns the number of series with a value.
+func (dc *deltaCalculator) len() int {
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+
+	return len(dc.datapoints)
+}
@@ -0,0 +1,58 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package integration
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeltaCalculator_SkewedClocks(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC)
+	dc := newDeltaCalculator(5*time.Minute, time.Minute)
+	dc.now = func() time.Time { return now }
+
+	normal := map[string]interface{}{"target": "normal"}
+	ahead := map[string]interface{}{"target": "ahead"}
+	behind := map[string]interface{}{"target": "behind"}
+	record := func(attributes map[string]interface{}, val float64, timestamp time.Time) (float64, bool) {
+		count, ok := dc.CountMetric("requests", attributes, val, timestamp)
+		return count.Value, ok
+	}
+
+	_, ok := record(normal, 1, now)
+	assert.False(t, ok)
+	_, ok = record(behind, 1, now.Add(-24*time.Hour))
+	assert.False(t, ok)
+
+	// A target with its clock a day ahead doesn't expire the values of the
+	// other targets.
+	now = now.Add(2 * time.Minute)
+	_, ok = record(ahead, 1, now.Add(24*time.Hour))
+	assert.False(t, ok)
+	delta, ok := record(normal, 3, now)
+	require.True(t, ok)
+	assert.Equal(t, float64(2), delta)
+	delta, ok = record(behind, 4, now.Add(-24*time.Hour))
+	require.True(t, ok)
+	assert.Equal(t, float64(3), delta)
+
+	// The Count of a target with a skewed clock keeps its timestamps.
+	count, ok := dc.CountMetric("requests", ahead, 5, now.Add(24*time.Hour+time.Minute))
+	require.True(t, ok)
+	assert.Equal(t, now.Add(24*time.Hour), count.Timestamp)
+	assert.Equal(t, time.Minute, count.Interval)
+
+	// Values expire on wall-clock time, even the ones of a target with its
+	// clock behind.
+	now = now.Add(10 * time.Minute)
+	_, ok = record(normal, 6, now)
+	assert.False(t, ok)
+	assert.Equal(t, 1, dc.len())
+}
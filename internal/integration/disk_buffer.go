@@ -0,0 +1,394 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package integration
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultDiskBufferMaxSize    = 100 << 20
+	defaultDiskBufferMinBackoff = time.Second
+	defaultDiskBufferMaxBackoff = time.Minute
+	diskBufferFileExt           = ".batch"
+)
+
+// credentialHeaders aren't stored in the buffer. The API key is set again
+// when the batches are replayed.
+var credentialHeaders = []string{"Api-Key", "X-License-Key", "X-Insert-Key", "Authorization"}
+
+// DiskBufferConfig configures the buffer on disk storing the payloads the
+// telemetry emitter fails to send, so they are sent once the Metric and
+// Event APIs are reachable again.
+type DiskBufferConfig struct {
+	// Dir is the directory the payloads are stored in. The buffer is
+	// disabled when empty.
+	Dir string
+	// MaxSize is the maximum size in bytes of the stored payloads. The
+	// oldest ones are dropped to make room for new ones. Defaults to 100MiB.
+	MaxSize int64
+	// MinBackoff is the initial wait between replays while they fail,
+	// doubled on every attempt. Defaults to 1s.
+	MinBackoff time.Duration
+	// MaxBackoff is the maximum wait between replays. Defaults to 1m.
+	MaxBackoff time.Duration
+}
+
+// bufferedRequest is the header of a stored payload, followed by its body.
+type bufferedRequest struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Header http.Header `json:"header"`
+}
+
+type bufferedBatch struct {
+	file string
+	size int64
+}
+
+// diskBuffer is a round tripper sending the requests through the wrapped one
+// and storing on disk the ones failing because of connection errors or 5xx,
+// 429 and 408 responses, answering them as accepted. Once a request is
+// stored, the following ones are stored after it, and all of them are
+// replayed in order in the background.
+type diskBuffer struct {
+	cfg    DiskBufferConfig
+	rt     http.RoundTripper
+	apiKey string
+	log    *logrus.Entry
+
+	lock    sync.Mutex
+	batches []bufferedBatch
+	size    int64
+	next    uint64
+
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+// newDiskBuffer returns the buffer wrapping the round tripper, loading the
+// payloads stored in the directory by previous runs and replaying them in
+// the background.
+func newDiskBuffer(cfg DiskBufferConfig, rt http.RoundTripper, apiKey string) (*diskBuffer, error) {
+	if cfg.MaxSize <= 0 {
+		cfg.MaxSize = defaultDiskBufferMaxSize
+	}
+	if cfg.MinBackoff <= 0 {
+		cfg.MinBackoff = defaultDiskBufferMinBackoff
+	}
+	if cfg.MaxBackoff < cfg.MinBackoff {
+		cfg.MaxBackoff = defaultDiskBufferMaxBackoff
+		if cfg.MaxBackoff < cfg.MinBackoff {
+			cfg.MaxBackoff = cfg.MinBackoff
+		}
+	}
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	if err := os.MkdirAll(cfg.Dir, 0o700); err != nil {
+		return nil, fmt.Errorf("creating disk buffer directory: %w", err)
+	}
+
+	b := &diskBuffer{
+		cfg:    cfg,
+		rt:     rt,
+		apiKey: apiKey,
+		log:    logrus.WithField("component", "DiskBuffer"),
+		wake:   make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	if err := b.load(); err != nil {
+		return nil, err
+	}
+	go b.replay()
+	b.signal()
+	return b, nil
+}
+
+// load reads the batches stored in the directory, in the order they were
+// stored.
+func (b *diskBuffer) load() error {
+	entries, err := ioutil.ReadDir(b.cfg.Dir)
+	if err != nil {
+		return fmt.Errorf("reading disk buffer directory: %w", err)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, diskBufferFileExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, diskBufferFileExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		b.batches = append(b.batches, bufferedBatch{file: filepath.Join(b.cfg.Dir, name), size: e.Size()})
+		b.size += e.Size()
+		if seq >= b.next {
+			b.next = seq + 1
+		}
+	}
+	diskBufferBytesMetric.Set(float64(b.size))
+	if len(b.batches) > 0 {
+		b.log.Infof("replaying %d batches stored by a previous run", len(b.batches))
+	}
+	return nil
+}
+
+// RoundTrip sends the request, storing it when it fails or when there are
+// stored requests waiting to be replayed before it.
+func (b *diskBuffer) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := readRequestBody(req)
+	if err != nil {
+		return nil, err
+	}
+
+	b.lock.Lock()
+	pending := len(b.batches) > 0
+	b.lock.Unlock()
+
+	if !pending {
+		// The request is cloned, as round trippers must not modify it.
+		resp, err := b.rt.RoundTrip(requestWithBody(req, body))
+		if !shouldBuffer(resp, err) {
+			return resp, err
+		}
+		if resp != nil {
+			discardResponse(resp)
+		}
+		b.log.WithError(err).Debug("storing the payload that failed to be sent")
+	}
+
+	if err := b.store(req, body); err != nil {
+		return nil, fmt.Errorf("storing the payload in the disk buffer: %w", err)
+	}
+	b.signal()
+	return acceptedResponse(req), nil
+}
+
+// shouldBuffer tells whether the request failed for a reason that can be
+// transient.
+func shouldBuffer(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests ||
+		resp.StatusCode == http.StatusRequestTimeout
+}
+
+func readRequestBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil {
+		return nil, nil
+	}
+	defer req.Body.Close()
+	return ioutil.ReadAll(req.Body)
+}
+
+// store writes the request to a new file, dropping the oldest batches when
+// the buffer is full.
+func (b *diskBuffer) store(req *http.Request, body []byte) error {
+	header := req.Header.Clone()
+	for _, h := range credentialHeaders {
+		header.Del(h)
+	}
+	meta, err := json.Marshal(bufferedRequest{Method: req.Method, URL: req.URL.String(), Header: header})
+	if err != nil {
+		return err
+	}
+	size := int64(len(meta) + 1 + len(body))
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if size > b.cfg.MaxSize {
+		diskBufferDroppedMetric.Inc()
+		return fmt.Errorf("the payload has %d bytes, more than the buffer size of %d", size, b.cfg.MaxSize)
+	}
+	for b.size+size > b.cfg.MaxSize && len(b.batches) > 0 {
+		b.log.Warn("disk buffer is full, dropping the oldest batch")
+		b.removeLocked()
+		diskBufferDroppedMetric.Inc()
+	}
+
+	file := filepath.Join(b.cfg.Dir, fmt.Sprintf("%020d%s", b.next, diskBufferFileExt))
+	if err := writeFileSync(file, append(append(meta, '\n'), body...)); err != nil {
+		return err
+	}
+	b.next++
+	b.batches = append(b.batches, bufferedBatch{file: file, size: size})
+	b.size += size
+	diskBufferBytesMetric.Set(float64(b.size))
+	return nil
+}
+
+// writeFileSync writes the file atomically, so partially written batches are
+// never replayed.
+func writeFileSync(file string, data []byte) error {
+	tmp := file + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// removeLocked removes the oldest batch. The lock must be held.
+func (b *diskBuffer) removeLocked() {
+	oldest := b.batches[0]
+	b.batches = b.batches[1:]
+	b.size -= oldest.size
+	if err := os.Remove(oldest.file); err != nil && !os.IsNotExist(err) {
+		b.log.WithError(err).Warn("removing batch from the disk buffer")
+	}
+	diskBufferBytesMetric.Set(float64(b.size))
+}
+
+func (b *diskBuffer) signal() {
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+}
+
+// replay sends the stored batches in order, waiting an exponential backoff
+// while they fail.
+func (b *diskBuffer) replay() {
+	defer close(b.done)
+
+	backoff := b.cfg.MinBackoff
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-b.wake:
+		}
+
+		for {
+			b.lock.Lock()
+			if len(b.batches) == 0 {
+				b.lock.Unlock()
+				break
+			}
+			oldest := b.batches[0]
+			b.lock.Unlock()
+
+			retry, err := b.send(oldest.file)
+			if retry {
+				b.log.WithError(err).Debugf("replaying stored batch failed, retrying in %s", backoff)
+				select {
+				case <-b.stop:
+					return
+				case <-time.After(backoff):
+				}
+				backoff *= 2
+				if backoff > b.cfg.MaxBackoff {
+					backoff = b.cfg.MaxBackoff
+				}
+				continue
+			}
+			backoff = b.cfg.MinBackoff
+			if err != nil {
+				b.log.WithError(err).Warn("dropping stored batch that can't be sent")
+				diskBufferDroppedMetric.Inc()
+			} else {
+				diskBufferReplayedMetric.Inc()
+			}
+
+			b.lock.Lock()
+			// The batch could have been dropped to make room for new ones.
+			if len(b.batches) > 0 && b.batches[0].file == oldest.file {
+				b.removeLocked()
+			}
+			b.lock.Unlock()
+		}
+	}
+}
+
+// send replays the stored batch. It returns whether it is worth retrying
+// when it fails.
+func (b *diskBuffer) send(file string) (bool, error) {
+	req, err := b.readBatch(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	resp, err := b.rt.RoundTrip(req)
+	if shouldBuffer(resp, err) {
+		if err == nil {
+			resp.Body.Close()
+			err = fmt.Errorf("endpoint returned %d", resp.StatusCode)
+		}
+		return true, err
+	}
+	discardResponse(resp)
+	if resp.StatusCode/100 != 2 {
+		return false, fmt.Errorf("endpoint returned %d", resp.StatusCode)
+	}
+	return false, nil
+}
+
+func (b *diskBuffer) readBatch(file string) (*http.Request, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(bytes.NewReader(data))
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return nil, fmt.Errorf("reading stored batch %s: %w", file, err)
+	}
+	var meta bufferedRequest
+	if err := json.Unmarshal(line, &meta); err != nil {
+		return nil, fmt.Errorf("decoding stored batch %s: %w", file, err)
+	}
+	body := data[len(line):]
+
+	req, err := http.NewRequest(meta.Method, meta.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("decoding stored batch %s: %w", file, err)
+	}
+	req.Header = meta.Header
+	if req.Header == nil {
+		req.Header = http.Header{}
+	}
+	if b.apiKey != "" {
+		req.Header.Set("Api-Key", b.apiKey)
+	}
+	return req, nil
+}
+
+// close stops replaying the stored batches, which stay on disk.
+func (b *diskBuffer) close() {
+	close(b.stop)
+	<-b.done
+}
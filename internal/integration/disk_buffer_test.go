@@ -0,0 +1,259 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package integration
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/newrelic/newrelic-telemetry-sdk-go/telemetry"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testAPIKey = "secret-key"
+
+// testIngest is an API endpoint failing with a 503 while down, recording the
+// bodies and API keys of the requests it accepts.
+type testIngest struct {
+	down int32
+	// status is the one of the accepted requests, 202 when unset.
+	status int32
+
+	lock    sync.Mutex
+	bodies  []string
+	apiKeys []string
+}
+
+func (i *testIngest) roundTripper() roundTripperFunc {
+	return func(req *http.Request) (*http.Response, error) {
+		if atomic.LoadInt32(&i.down) == 1 {
+			return emptyResponse(http.StatusServiceUnavailable), nil
+		}
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		i.lock.Lock()
+		defer i.lock.Unlock()
+		i.bodies = append(i.bodies, string(body))
+		i.apiKeys = append(i.apiKeys, req.Header.Get("Api-Key")+req.Header.Get("X-License-Key"))
+		if status := atomic.LoadInt32(&i.status); status != 0 {
+			return emptyResponse(int(status)), nil
+		}
+		return emptyResponse(http.StatusAccepted), nil
+	}
+}
+
+func (i *testIngest) received() []string {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	return append([]string(nil), i.bodies...)
+}
+
+func newTestDiskBuffer(t *testing.T, cfg DiskBufferConfig, rt http.RoundTripper) *diskBuffer {
+	t.Helper()
+
+	if cfg.MinBackoff == 0 {
+		cfg.MinBackoff = 10 * time.Millisecond
+		cfg.MaxBackoff = 50 * time.Millisecond
+	}
+	b, err := newDiskBuffer(cfg, rt, testAPIKey)
+	require.NoError(t, err)
+	return b
+}
+
+func sendPayload(t *testing.T, rt http.RoundTripper, body string) {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodPost, "https://metric-api.newrelic.com/metric/v1", strings.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set("Api-Key", testAPIKey)
+	req.Header.Set("Content-Encoding", "gzip")
+	resp, err := rt.RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+}
+
+func storedBatches(t *testing.T, dir string) []string {
+	t.Helper()
+
+	files, err := filepath.Glob(filepath.Join(dir, "*"+diskBufferFileExt))
+	require.NoError(t, err)
+	return files
+}
+
+func TestDiskBuffer_Replay(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	ingest := &testIngest{down: 1}
+	buffer := newTestDiskBuffer(t, DiskBufferConfig{Dir: dir}, ingest.roundTripper())
+	t.Cleanup(buffer.close)
+
+	sendPayload(t, buffer, "first")
+	sendPayload(t, buffer, "second")
+
+	// Payloads sent while others are waiting are stored after them, even if
+	// the endpoint is back.
+	atomic.StoreInt32(&ingest.down, 0)
+	sendPayload(t, buffer, "third")
+
+	require.Eventually(t, func() bool {
+		return len(ingest.received()) == 3
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"first", "second", "third"}, ingest.received())
+	assert.Equal(t, []string{testAPIKey, testAPIKey, testAPIKey}, ingest.apiKeys)
+	require.Eventually(t, func() bool {
+		return len(storedBatches(t, dir)) == 0
+	}, 5*time.Second, 10*time.Millisecond, "replayed batches are removed")
+
+	// Nothing is stored while the endpoint is up.
+	sendPayload(t, buffer, "fourth")
+	assert.Equal(t, []string{"first", "second", "third", "fourth"}, ingest.received())
+	assert.Empty(t, storedBatches(t, dir))
+}
+
+// Round trippers must not modify the requests of their callers.
+func TestDiskBuffer_RequestNotModified(t *testing.T) {
+	t.Parallel()
+
+	ingest := &testIngest{}
+	buffer := newTestDiskBuffer(t, DiskBufferConfig{Dir: t.TempDir()}, ingest.roundTripper())
+	t.Cleanup(buffer.close)
+
+	body := ioutil.NopCloser(strings.NewReader("payload"))
+	req, err := http.NewRequest(http.MethodPost, "https://metric-api.newrelic.com/metric/v1", body)
+	require.NoError(t, err)
+	resp, err := buffer.RoundTrip(req)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+
+	assert.Equal(t, []string{"payload"}, ingest.received())
+	assert.Equal(t, body, req.Body)
+}
+
+func TestDiskBuffer_Restart(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	ingest := &testIngest{down: 1}
+	buffer := newTestDiskBuffer(t, DiskBufferConfig{Dir: dir}, ingest.roundTripper())
+	sendPayload(t, buffer, "first")
+	sendPayload(t, buffer, "second")
+	buffer.close()
+
+	files := storedBatches(t, dir)
+	require.Len(t, files, 2)
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		require.NoError(t, err)
+		assert.NotContains(t, string(data), testAPIKey, "credentials aren't stored")
+		assert.Contains(t, string(data), "gzip", "other headers are stored")
+	}
+
+	// The batches of the previous run are replayed in order.
+	atomic.StoreInt32(&ingest.down, 0)
+	buffer = newTestDiskBuffer(t, DiskBufferConfig{Dir: dir}, ingest.roundTripper())
+	t.Cleanup(buffer.close)
+	require.Eventually(t, func() bool {
+		return len(ingest.received()) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"first", "second"}, ingest.received())
+	assert.Equal(t, []string{testAPIKey, testAPIKey}, ingest.apiKeys)
+}
+
+// TestDiskBuffer_MaxSize isn't parallel, as it checks the self-metrics.
+func TestDiskBuffer_MaxSize(t *testing.T) {
+	dir := t.TempDir()
+	ingest := &testIngest{down: 1}
+	// Replays are retried after the test checks the buffer.
+	buffer := newTestDiskBuffer(t, DiskBufferConfig{Dir: dir, MinBackoff: time.Minute}, ingest.roundTripper())
+	sendPayload(t, buffer, "first")
+	files := storedBatches(t, dir)
+	require.Len(t, files, 1)
+	info, err := os.Stat(files[0])
+	require.NoError(t, err)
+	buffer.close()
+
+	dropped := testutil.ToFloat64(diskBufferDroppedMetric)
+	replayed := testutil.ToFloat64(diskBufferReplayedMetric)
+
+	// The buffer fits two batches.
+	buffer = newTestDiskBuffer(t, DiskBufferConfig{Dir: dir, MaxSize: 2*info.Size() + 1, MinBackoff: time.Minute}, ingest.roundTripper())
+	sendPayload(t, buffer, "other")
+	sendPayload(t, buffer, "third")
+	assert.Len(t, storedBatches(t, dir), 2)
+	assert.Equal(t, float64(2*info.Size()), testutil.ToFloat64(diskBufferBytesMetric))
+	assert.Equal(t, dropped+1, testutil.ToFloat64(diskBufferDroppedMetric), "the oldest batch is dropped")
+
+	// Payloads larger than the buffer can't be stored.
+	req, err := http.NewRequest(http.MethodPost, "https://metric-api.newrelic.com/metric/v1", strings.NewReader(strings.Repeat("x", int(3*info.Size()))))
+	require.NoError(t, err)
+	_, err = buffer.RoundTrip(req)
+	assert.Error(t, err)
+	assert.Equal(t, dropped+2, testutil.ToFloat64(diskBufferDroppedMetric))
+	buffer.close()
+
+	// Batches rejected by the endpoint are dropped, and the next ones are
+	// still replayed.
+	atomic.StoreInt32(&ingest.down, 0)
+	atomic.StoreInt32(&ingest.status, http.StatusBadRequest)
+	buffer = newTestDiskBuffer(t, DiskBufferConfig{Dir: dir}, ingest.roundTripper())
+	t.Cleanup(buffer.close)
+	require.Eventually(t, func() bool {
+		return len(storedBatches(t, dir)) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"other", "third"}, ingest.received())
+	assert.Equal(t, dropped+4, testutil.ToFloat64(diskBufferDroppedMetric))
+	assert.Equal(t, replayed, testutil.ToFloat64(diskBufferReplayedMetric))
+	assert.Equal(t, float64(0), testutil.ToFloat64(diskBufferBytesMetric))
+}
+
+func TestTelemetryEmitter_DiskBuffer(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	ingest := &testIngest{down: 1}
+	emitter, err := NewTelemetryEmitter(TelemetryEmitterConfig{
+		HarvesterOpts: []TelemetryHarvesterOpt{
+			func(cfg *telemetry.Config) {
+				cfg.Client.Transport = ingest.roundTripper()
+			},
+			telemetry.ConfigAPIKey("license key"),
+			TelemetryHarvesterWithMetricsURL("https://metric-api.newrelic.com/metric/v1"),
+			TelemetryHarvesterWithLicenseKeyRoundTripper("license key"),
+		},
+		DiskBuffer: DiskBufferConfig{
+			Dir:        dir,
+			MinBackoff: 10 * time.Millisecond,
+			MaxBackoff: 50 * time.Millisecond,
+		},
+		DisableBoundedHarvester: true,
+	})
+	require.NoError(t, err)
+	t.Cleanup(emitter.buffer.close)
+
+	require.NoError(t, emitter.Emit([]Metric{{name: "up", metricType: metricType_GAUGE, value: float64(1)}}))
+	emitter.harvester.HarvestNow(context.Background())
+	require.Len(t, storedBatches(t, dir), 1)
+	assert.Empty(t, ingest.received())
+
+	atomic.StoreInt32(&ingest.down, 0)
+	require.Eventually(t, func() bool {
+		return len(ingest.received()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	// The license key round tripper sets the key of the replayed batches.
+	assert.Equal(t, []string{"license key"}, ingest.apiKeys)
+}
@@ -4,9 +4,16 @@
 package integration
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"os"
 	"time"
+
+	"github.com/prometheus/common/expfmt"
+	"github.com/sirupsen/logrus"
 )
 
 const (
@@ -20,6 +27,58 @@ type Emitter interface {
 	Emit([]Metric) error
 }
 
+// ChunkEmitter is implemented by the emitters keeping state about the series
+// of every scrape, which need to know which target the metrics were scraped
+// from and when a scrape emitted in chunks is complete.
+type ChunkEmitter interface {
+	// EmitChunk emits a chunk of the metrics of a scrape of the target. The
+	// last chunk completes the scrape, even when it is empty.
+	EmitChunk(target string, metrics []Metric, last bool) error
+}
+
+// ChunkAborter is implemented by the ChunkEmitters that drop the chunks of a
+// scrape which failed after some of them were emitted.
+type ChunkAborter interface {
+	// AbortChunks drops the scrape of the target in progress.
+	AbortChunks(target string)
+}
+
+// ContextEmitter is an Emitter whose emissions can be cancelled.
+type ContextEmitter interface {
+	Emitter
+	// EmitContext is like Emit, but it gives up once the context is done.
+	EmitContext(ctx context.Context, metrics []Metric) error
+}
+
+// ContextChunkEmitter is a ChunkEmitter whose emissions can be cancelled.
+type ContextChunkEmitter interface {
+	ChunkEmitter
+	// EmitChunkContext is like EmitChunk, but it gives up once the context is
+	// done.
+	EmitChunkContext(ctx context.Context, target string, metrics []Metric, last bool) error
+}
+
+// EmitterWithContext returns the emitter as a ContextEmitter. Emitters that
+// aren't context-aware emit the metrics with Emit unless the context is
+// already done, as their emissions can't be cancelled.
+func EmitterWithContext(e Emitter) ContextEmitter {
+	if ce, ok := e.(ContextEmitter); ok {
+		return ce
+	}
+	return contextEmitter{e}
+}
+
+type contextEmitter struct {
+	Emitter
+}
+
+func (e contextEmitter) EmitContext(ctx context.Context, metrics []Metric) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return e.Emit(metrics)
+}
+
 // copyAttrs returns a (shallow) copy of the passed attrs.
 func copyAttrs(attrs map[string]interface{}) map[string]interface{} {
 	duplicate := make(map[string]interface{}, len(attrs))
@@ -29,16 +88,49 @@ func copyAttrs(attrs map[string]interface{}) map[string]interface{} {
 	return duplicate
 }
 
+// Formats supported by the StdoutEmitter.
+const (
+	StdoutFormatJSON        = "json"
+	StdoutFormatPrometheus  = "prometheus"
+	StdoutFormatOpenMetrics = "openmetrics"
+	StdoutFormatInflux      = "influx"
+)
+
+// StdoutEmitterConfig is the configuration of the `StdoutEmitter`.
+type StdoutEmitterConfig struct {
+	// Format of the output: `json` (default), `prometheus` for the
+	// Prometheus text exposition format, `openmetrics` or `influx` for the
+	// InfluxDB line protocol.
+	Format string `mapstructure:"format"`
+}
+
 // StdoutEmitter emits metrics to stdout.
 type StdoutEmitter struct {
-	name string
+	name   string
+	format string
+	out    io.Writer
+	now    func() time.Time
+	log    *logrus.Entry
 }
 
 // NewStdoutEmitter returns a NewStdoutEmitter.
-func NewStdoutEmitter() *StdoutEmitter {
-	return &StdoutEmitter{
-		name: "stdout",
+func NewStdoutEmitter(cfg StdoutEmitterConfig) (*StdoutEmitter, error) {
+	format := cfg.Format
+	switch format {
+	case "":
+		format = StdoutFormatJSON
+	case StdoutFormatJSON, StdoutFormatPrometheus, StdoutFormatOpenMetrics, StdoutFormatInflux:
+	default:
+		return nil, fmt.Errorf("unknown stdout emitter format %q", cfg.Format)
 	}
+
+	return &StdoutEmitter{
+		name:   "stdout",
+		format: format,
+		out:    os.Stdout,
+		now:    time.Now,
+		log:    logrus.WithField("component", "StdoutEmitter"),
+	}, nil
 }
 
 // Name is the StdoutEmitter name.
@@ -46,13 +138,40 @@ func (se *StdoutEmitter) Name() string {
 	return se.name
 }
 
-// Emit prints the metrics into stdout.
-// Note: histograms not supported due json not supporting Inf values which are present in the last bucket
+// Emit prints the metrics into stdout in the configured format.
 func (se *StdoutEmitter) Emit(metrics []Metric) error {
-	b, err := json.Marshal(metrics)
-	if err != nil {
-		return err
+	var buf bytes.Buffer
+	switch se.format {
+	case StdoutFormatPrometheus, StdoutFormatOpenMetrics:
+		b := newFamiliesBuilder()
+		for _, m := range metrics {
+			if _, err := b.add(m); err != nil {
+				se.log.WithError(err).Debug("skipping metric")
+			}
+		}
+		format := expfmt.NewFormat(expfmt.TypeTextPlain)
+		if se.format == StdoutFormatOpenMetrics {
+			format = expfmt.NewFormat(expfmt.TypeOpenMetrics)
+		}
+		if err := encodeFamilies(&buf, format, b.result()); err != nil {
+			return err
+		}
+	case StdoutFormatInflux:
+		now := se.now()
+		for _, m := range metrics {
+			if err := writeInfluxLine(&buf, m, metricTimestamp(m, now)); err != nil {
+				se.log.WithError(err).Debug("skipping metric")
+			}
+		}
+	default:
+		b, err := json.Marshal(metrics)
+		if err != nil {
+			return err
+		}
+		buf.Write(b)
+		buf.WriteByte('\n')
 	}
-	fmt.Println(string(b))
-	return nil
+
+	_, err := se.out.Write(buf.Bytes())
+	return err
 }
@@ -0,0 +1,351 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package integration
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const defaultEmitterQueueSize = 100
+
+// emitterQueueFlushTimeout bounds the shutdown of the wrapped emitter once the
+// queued metrics couldn't be emitted before the shutdown deadline, so it can
+// still send the metrics it already holds.
+const emitterQueueFlushTimeout = 5 * time.Second
+
+// Overflow policies of the EmitterQueue, applied when the metrics are emitted
+// while it is full.
+const (
+	// EmitterQueueBlock waits until there is room in the queue, slowing down
+	// the processing of the scrapes. It is the default.
+	EmitterQueueBlock = "block"
+	// EmitterQueueDropOldest drops the oldest metrics waiting in the queue.
+	EmitterQueueDropOldest = "drop_oldest"
+	// EmitterQueueDropNewest drops the metrics being emitted.
+	EmitterQueueDropNewest = "drop_newest"
+)
+
+// EmitterQueueConfig is the configuration of the `EmitterQueue`.
+type EmitterQueueConfig struct {
+	// Size is the number of scrapes, or chunks of them, waiting to be emitted.
+	// Defaults to 100.
+	Size int
+	// OverflowPolicy is applied when the queue is full: `block` (default),
+	// `drop_oldest` or `drop_newest`.
+	OverflowPolicy string
+}
+
+type emitterQueueItem struct {
+	target   string
+	metrics  []Metric
+	last     bool
+	forget   bool
+	abort    bool
+	enqueued time.Time
+}
+
+// EmitterQueue emits the metrics with the wrapped emitter in the background,
+// so a slow emitter doesn't stall the processing of the scrapes nor the other
+// emitters. The metrics are emitted by a single goroutine, in the order they
+// were queued, as emitters keeping state about the series of the targets
+// expect.
+type EmitterQueue struct {
+	emitter Emitter
+	cfg     EmitterQueueConfig
+	log     *logrus.Entry
+
+	lock sync.Mutex
+	// cond is signaled whenever the items, busy or stopped change.
+	cond  *sync.Cond
+	items []emitterQueueItem
+	// busy tells whether an item is being emitted.
+	busy    bool
+	stopped bool
+	done    chan struct{}
+	// cancel cancels the emissions of the queue, once the queued metrics
+	// can't be emitted before a shutdown deadline.
+	cancel context.CancelFunc
+}
+
+// NewEmitterQueue returns the queue of the emitter, and starts emitting the
+// metrics queued in it.
+func NewEmitterQueue(emitter Emitter, cfg EmitterQueueConfig) (*EmitterQueue, error) {
+	if cfg.Size <= 0 {
+		cfg.Size = defaultEmitterQueueSize
+	}
+	switch cfg.OverflowPolicy {
+	case "":
+		cfg.OverflowPolicy = EmitterQueueBlock
+	case EmitterQueueBlock, EmitterQueueDropOldest, EmitterQueueDropNewest:
+	default:
+		return nil, fmt.Errorf("unknown emitter queue overflow policy %q", cfg.OverflowPolicy)
+	}
+
+	q := &EmitterQueue{
+		emitter: emitter,
+		cfg:     cfg,
+		log:     logrus.WithField("component", "EmitterQueue").WithField("emitter", emitter.Name()),
+		done:    make(chan struct{}),
+	}
+	q.cond = sync.NewCond(&q.lock)
+	emitterQueueLengthMetric.WithLabelValues(emitter.Name()).Set(0)
+	ctx, cancel := context.WithCancel(context.Background())
+	q.cancel = cancel
+	go q.run(ctx)
+	return q, nil
+}
+
+// Name returns the name of the wrapped emitter.
+func (q *EmitterQueue) Name() string {
+	return q.emitter.Name()
+}
+
+// Emit queues the metrics.
+func (q *EmitterQueue) Emit(metrics []Metric) error {
+	return q.EmitContext(context.Background(), metrics)
+}
+
+// EmitContext is like Emit, but it stops waiting for room in a full queue
+// once the context is done.
+func (q *EmitterQueue) EmitContext(ctx context.Context, metrics []Metric) error {
+	return q.push(ctx, emitterQueueItem{metrics: metrics, last: true})
+}
+
+// EmitChunk queues a chunk of the metrics of a scrape of the target. They are
+// emitted with Emit when the wrapped emitter isn't a ChunkEmitter.
+func (q *EmitterQueue) EmitChunk(target string, metrics []Metric, last bool) error {
+	return q.EmitChunkContext(context.Background(), target, metrics, last)
+}
+
+// EmitChunkContext is like EmitChunk, but it stops waiting for room in a full
+// queue once the context is done.
+func (q *EmitterQueue) EmitChunkContext(ctx context.Context, target string, metrics []Metric, last bool) error {
+	return q.push(ctx, emitterQueueItem{target: target, metrics: metrics, last: last})
+}
+
+// ForgetTarget queues the removal of the target, after the metrics already
+// queued. It is never dropped.
+func (q *EmitterQueue) ForgetTarget(name string) {
+	if _, ok := q.emitter.(TargetForgetter); !ok {
+		return
+	}
+	if err := q.push(context.Background(), emitterQueueItem{target: name, forget: true}); err != nil {
+		q.log.WithError(err).Debug("forgetting target")
+	}
+}
+
+// AbortChunks queues the abort of the scrape of the target in progress, after
+// its chunks already queued. It is never dropped.
+func (q *EmitterQueue) AbortChunks(target string) {
+	if _, ok := q.emitter.(ChunkAborter); !ok {
+		return
+	}
+	if err := q.push(context.Background(), emitterQueueItem{target: target, abort: true}); err != nil {
+		q.log.WithError(err).Debug("aborting chunks")
+	}
+}
+
+func (q *EmitterQueue) push(ctx context.Context, item emitterQueueItem) error {
+	// Waits for room in the queue end once the context is done.
+	stop := context.AfterFunc(ctx, func() {
+		q.lock.Lock()
+		defer q.lock.Unlock()
+		q.cond.Broadcast()
+	})
+	defer stop()
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.stopped {
+		return fmt.Errorf("emitter queue is stopped")
+	}
+	if !item.forget && !item.abort {
+		for q.full() && q.cfg.OverflowPolicy == EmitterQueueBlock && !q.stopped && ctx.Err() == nil {
+			q.cond.Wait()
+		}
+		if q.stopped {
+			return fmt.Errorf("emitter queue is stopped")
+		}
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("waiting for room in the queue: %w", err)
+		}
+		if q.full() {
+			switch q.cfg.OverflowPolicy {
+			case EmitterQueueDropNewest:
+				q.drop(item)
+				return nil
+			case EmitterQueueDropOldest:
+				q.dropOldest()
+			}
+		}
+	}
+
+	item.enqueued = time.Now()
+	q.items = append(q.items, item)
+	emitterQueueLengthMetric.WithLabelValues(q.Name()).Set(float64(len(q.items)))
+	q.cond.Broadcast()
+	return nil
+}
+
+// full tells whether the queue is full. The lock must be held.
+func (q *EmitterQueue) full() bool {
+	return len(q.items) >= q.cfg.Size
+}
+
+// dropOldest drops the oldest metrics of the queue, keeping the removals of
+// the targets and the aborts of their scrapes. The lock must be held.
+func (q *EmitterQueue) dropOldest() {
+	for i, item := range q.items {
+		if item.forget || item.abort {
+			continue
+		}
+		q.drop(item)
+		q.items = append(q.items[:i], q.items[i+1:]...)
+		return
+	}
+}
+
+func (q *EmitterQueue) drop(item emitterQueueItem) {
+	q.log.Debugf("queue is full, dropping %d metrics", len(item.metrics))
+	emitterQueueDroppedMetric.WithLabelValues(q.Name()).Add(float64(len(item.metrics)))
+}
+
+// run emits the queued items in order until the queue is stopped and empty.
+// Once the context is done, the items left are dropped.
+func (q *EmitterQueue) run(ctx context.Context) {
+	defer close(q.done)
+
+	for {
+		q.lock.Lock()
+		for len(q.items) == 0 && !q.stopped {
+			q.cond.Wait()
+		}
+		if len(q.items) == 0 {
+			q.lock.Unlock()
+			return
+		}
+		item := q.items[0]
+		q.items[0] = emitterQueueItem{}
+		q.items = q.items[1:]
+		q.busy = true
+		emitterQueueLengthMetric.WithLabelValues(q.Name()).Set(float64(len(q.items)))
+		q.cond.Broadcast()
+		q.lock.Unlock()
+
+		q.emit(ctx, item)
+
+		q.lock.Lock()
+		q.busy = false
+		q.cond.Broadcast()
+		q.lock.Unlock()
+	}
+}
+
+func (q *EmitterQueue) emit(ctx context.Context, item emitterQueueItem) {
+	if ctx.Err() != nil {
+		if !item.forget && !item.abort {
+			q.log.Debugf("queue is shut down, dropping %d metrics", len(item.metrics))
+			emitterQueueDroppedMetric.WithLabelValues(q.Name()).Add(float64(len(item.metrics)))
+		}
+		return
+	}
+	if item.forget {
+		q.emitter.(TargetForgetter).ForgetTarget(item.target)
+		return
+	}
+	if item.abort {
+		q.emitter.(ChunkAborter).AbortChunks(item.target)
+		return
+	}
+
+	emitterQueueLatencyMetric.WithLabelValues(q.Name()).Observe(time.Since(item.enqueued).Seconds())
+	var err error
+	switch ce := q.emitter.(type) {
+	case ContextChunkEmitter:
+		if item.target == "" {
+			err = EmitterWithContext(q.emitter).EmitContext(ctx, item.metrics)
+		} else {
+			err = ce.EmitChunkContext(ctx, item.target, item.metrics, item.last)
+		}
+	case ChunkEmitter:
+		if item.target == "" {
+			err = EmitterWithContext(q.emitter).EmitContext(ctx, item.metrics)
+		} else {
+			err = ce.EmitChunk(item.target, item.metrics, item.last)
+		}
+	default:
+		err = EmitterWithContext(q.emitter).EmitContext(ctx, item.metrics)
+	}
+	if err != nil {
+		q.log.WithError(err).Warn("error emitting metrics")
+	}
+}
+
+// Flush waits until the queued metrics are emitted.
+func (q *EmitterQueue) Flush() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for len(q.items) > 0 || q.busy {
+		q.cond.Wait()
+	}
+}
+
+// Stop emits the queued metrics, and stops the wrapped emitter when it can be
+// stopped. Metrics emitted afterwards are discarded.
+func (q *EmitterQueue) Stop() {
+	_ = q.Shutdown(context.Background())
+}
+
+// Shutdown is like Stop, but it waits for the queued metrics to be emitted
+// until the context is done, cancelling then the emission in progress and
+// dropping the metrics left. The wrapped emitter is shut down with the same
+// context when it implements Shutdown, or else stopped when it can be. It is
+// shut down even after the context is done, within a short timeout of its own.
+func (q *EmitterQueue) Shutdown(ctx context.Context) error {
+	q.lock.Lock()
+	if q.stopped {
+		q.lock.Unlock()
+		return nil
+	}
+	q.stopped = true
+	q.cond.Broadcast()
+	q.lock.Unlock()
+
+	select {
+	case <-q.done:
+		q.cancel()
+		return q.shutdownEmitter(ctx)
+	case <-ctx.Done():
+	}
+
+	q.cancel()
+	err := fmt.Errorf("emitting the queued metrics: %w", ctx.Err())
+	flushCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), emitterQueueFlushTimeout)
+	defer cancel()
+	select {
+	case <-q.done:
+	case <-flushCtx.Done():
+		return err
+	}
+	return errors.Join(err, q.shutdownEmitter(flushCtx))
+}
+
+// shutdownEmitter shuts down the wrapped emitter, or stops it when it can be.
+func (q *EmitterQueue) shutdownEmitter(ctx context.Context) error {
+	switch e := q.emitter.(type) {
+	case interface{ Shutdown(context.Context) error }:
+		return e.Shutdown(ctx)
+	case interface{ Stop() }:
+		e.Stop()
+	}
+	return nil
+}
@@ -0,0 +1,267 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package integration
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingEmitter records the name of the first metric of every emission,
+// waiting for the gate to be open or the emission to be cancelled.
+type recordingEmitter struct {
+	name string
+	gate chan struct{}
+
+	lock    sync.Mutex
+	emitted []string
+	stopped bool
+}
+
+func newRecordingEmitter(name string) *recordingEmitter {
+	return &recordingEmitter{name: name, gate: make(chan struct{})}
+}
+
+func (e *recordingEmitter) Name() string {
+	return e.name
+}
+
+func (e *recordingEmitter) Emit(metrics []Metric) error {
+	return e.EmitContext(context.Background(), metrics)
+}
+
+func (e *recordingEmitter) EmitContext(ctx context.Context, metrics []Metric) error {
+	return e.record(ctx, "emit", metrics)
+}
+
+func (e *recordingEmitter) EmitChunk(target string, metrics []Metric, last bool) error {
+	return e.EmitChunkContext(context.Background(), target, metrics, last)
+}
+
+func (e *recordingEmitter) EmitChunkContext(ctx context.Context, target string, metrics []Metric, last bool) error {
+	if last {
+		return e.record(ctx, target+" last", metrics)
+	}
+	return e.record(ctx, target, metrics)
+}
+
+func (e *recordingEmitter) ForgetTarget(name string) {
+	_ = e.record(context.Background(), "forget "+name, nil)
+}
+
+func (e *recordingEmitter) AbortChunks(target string) {
+	_ = e.record(context.Background(), "abort "+target, nil)
+}
+
+func (e *recordingEmitter) Stop() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.stopped = true
+}
+
+func (e *recordingEmitter) record(ctx context.Context, kind string, metrics []Metric) error {
+	select {
+	case <-e.gate:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	for _, m := range metrics {
+		kind += " " + m.name
+	}
+	e.emitted = append(e.emitted, kind)
+	return nil
+}
+
+func (e *recordingEmitter) records() []string {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return append([]string(nil), e.emitted...)
+}
+
+func queueMetrics(name string) []Metric {
+	return []Metric{{name: name}}
+}
+
+// waitQueued waits until the queue has the given number of items waiting.
+func waitQueued(t *testing.T, q *EmitterQueue, n int) {
+	t.Helper()
+
+	require.Eventually(t, func() bool {
+		q.lock.Lock()
+		defer q.lock.Unlock()
+		return len(q.items) == n && q.busy
+	}, 5*time.Second, time.Millisecond)
+}
+
+func TestEmitterQueue_Order(t *testing.T) {
+	t.Parallel()
+
+	e := newRecordingEmitter("queue-order")
+	q, err := NewEmitterQueue(e, EmitterQueueConfig{})
+	require.NoError(t, err)
+
+	// The metrics are queued while the emitter is blocked.
+	require.NoError(t, q.EmitChunk("a", queueMetrics("1"), false))
+	require.NoError(t, q.EmitChunk("a", queueMetrics("2"), true))
+	q.ForgetTarget("b")
+	require.NoError(t, q.EmitChunk("c", queueMetrics("3"), false))
+	q.AbortChunks("c")
+	require.NoError(t, q.Emit(queueMetrics("4")))
+	waitQueued(t, q, 5)
+	assert.Equal(t, float64(5), testutil.ToFloat64(emitterQueueLengthMetric.WithLabelValues("queue-order")))
+
+	close(e.gate)
+	q.Flush()
+	assert.Equal(t, []string{"a 1", "a last 2", "forget b", "c 3", "abort c", "emit 4"}, e.records())
+	assert.Equal(t, float64(0), testutil.ToFloat64(emitterQueueLengthMetric.WithLabelValues("queue-order")))
+
+	q.Stop()
+	e.lock.Lock()
+	assert.True(t, e.stopped, "the wrapped emitter is stopped")
+	e.lock.Unlock()
+	assert.Error(t, q.Emit(queueMetrics("5")), "metrics emitted once stopped are discarded")
+}
+
+func TestEmitterQueue_OverflowPolicies(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		policy  string
+		emitted []string
+	}{
+		{
+			policy:  EmitterQueueDropOldest,
+			emitted: []string{"emit 1", "emit 3", "forget a", "emit 4"},
+		},
+		{
+			policy:  EmitterQueueDropNewest,
+			emitted: []string{"emit 1", "emit 2", "emit 3", "forget a"},
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.policy, func(t *testing.T) {
+			t.Parallel()
+
+			e := newRecordingEmitter("queue-" + tc.policy)
+			q, err := NewEmitterQueue(e, EmitterQueueConfig{Size: 2, OverflowPolicy: tc.policy})
+			require.NoError(t, err)
+			t.Cleanup(q.Stop)
+			dropped := testutil.ToFloat64(emitterQueueDroppedMetric.WithLabelValues(e.Name()))
+
+			require.NoError(t, q.Emit(queueMetrics("1")))
+			waitQueued(t, q, 0)
+			// Removals of targets are queued even when the queue is full.
+			require.NoError(t, q.Emit(queueMetrics("2")))
+			require.NoError(t, q.Emit(queueMetrics("3")))
+			q.ForgetTarget("a")
+			require.NoError(t, q.Emit(queueMetrics("4")))
+
+			close(e.gate)
+			q.Flush()
+			assert.Equal(t, tc.emitted, e.records())
+			assert.Equal(t, dropped+1, testutil.ToFloat64(emitterQueueDroppedMetric.WithLabelValues(e.Name())))
+		})
+	}
+}
+
+func TestEmitterQueue_Block(t *testing.T) {
+	t.Parallel()
+
+	e := newRecordingEmitter("queue-block")
+	q, err := NewEmitterQueue(e, EmitterQueueConfig{Size: 1, OverflowPolicy: EmitterQueueBlock})
+	require.NoError(t, err)
+	t.Cleanup(q.Stop)
+	dropped := testutil.ToFloat64(emitterQueueDroppedMetric.WithLabelValues(e.Name()))
+
+	require.NoError(t, q.Emit(queueMetrics("1")))
+	waitQueued(t, q, 0)
+	require.NoError(t, q.Emit(queueMetrics("2")))
+
+	emitted := make(chan error)
+	go func() {
+		emitted <- q.Emit(queueMetrics("3"))
+	}()
+	select {
+	case <-emitted:
+		t.Fatal("metrics were queued while the queue was full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(e.gate)
+	require.NoError(t, <-emitted)
+	q.Flush()
+	assert.Equal(t, []string{"emit 1", "emit 2", "emit 3"}, e.records())
+	assert.Equal(t, dropped, testutil.ToFloat64(emitterQueueDroppedMetric.WithLabelValues(e.Name())))
+}
+
+func TestEmitterQueue_EmitContext(t *testing.T) {
+	t.Parallel()
+
+	e := newRecordingEmitter("queue-context")
+	q, err := NewEmitterQueue(e, EmitterQueueConfig{Size: 1, OverflowPolicy: EmitterQueueBlock})
+	require.NoError(t, err)
+	t.Cleanup(q.Stop)
+
+	require.NoError(t, q.Emit(queueMetrics("1")))
+	waitQueued(t, q, 0)
+	require.NoError(t, q.Emit(queueMetrics("2")))
+
+	// Waiting for room in the full queue ends with the context.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, q.EmitChunkContext(ctx, "a", queueMetrics("3"), true), context.DeadlineExceeded)
+
+	close(e.gate)
+	q.Flush()
+	assert.Equal(t, []string{"emit 1", "emit 2"}, e.records())
+}
+
+func TestNewEmitterQueue_UnknownPolicy(t *testing.T) {
+	t.Parallel()
+
+	_, err := NewEmitterQueue(&nilEmit{}, EmitterQueueConfig{OverflowPolicy: "drop_all"})
+	assert.Error(t, err)
+}
+
+func TestEmitterQueue_Shutdown(t *testing.T) {
+	t.Parallel()
+
+	e := newRecordingEmitter("queue-shutdown")
+	q, err := NewEmitterQueue(e, EmitterQueueConfig{})
+	require.NoError(t, err)
+	require.NoError(t, q.Emit(queueMetrics("1")))
+	require.NoError(t, q.Emit(queueMetrics("2")))
+
+	dropped := testutil.ToFloat64(emitterQueueDroppedMetric.WithLabelValues("queue-shutdown"))
+
+	// The queued metrics can't be emitted before the deadline, so the
+	// emission in progress is cancelled and the metrics left are dropped. The
+	// wrapped emitter is stopped anyway.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Error(t, q.Shutdown(ctx))
+	assert.Error(t, q.Emit(queueMetrics("3")), "metrics emitted once stopped are discarded")
+
+	select {
+	case <-q.done:
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "the queue didn't stop emitting after the deadline")
+	}
+	assert.Empty(t, e.records())
+	assert.Equal(t, dropped+1, testutil.ToFloat64(emitterQueueDroppedMetric.WithLabelValues("queue-shutdown")))
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	assert.True(t, e.stopped, "the wrapped emitter is stopped after the deadline")
+}
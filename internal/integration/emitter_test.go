@@ -4,10 +4,14 @@
 package integration
 
 import (
+	"bytes"
+	"math"
 	"testing"
+	"time"
 
 	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func Test_EmitterCanEmit(t *testing.T) {
@@ -60,9 +64,104 @@ func Test_EmitterCanEmit(t *testing.T) {
 		},
 	}
 
-	e := NewStdoutEmitter()
+	e, err := NewStdoutEmitter(StdoutEmitterConfig{})
+	assert.NoError(t, err)
 	assert.NotNil(t, e)
+	e.out = &bytes.Buffer{}
 
 	err = e.Emit(metrics)
 	assert.NoError(t, err)
 }
+
+func TestStdoutEmitter_Formats(t *testing.T) {
+	t.Parallel()
+
+	hist, err := newHistogram([]int64{1, 2, 3})
+	require.NoError(t, err)
+	metrics := []Metric{
+		{
+			name:       "redis_commands_total",
+			metricType: metricType_COUNTER,
+			value:      float64(10),
+			attributes: labels.Set{"cmd": "get", "targetName": "redis a", "nrMetricType": "count"},
+		},
+		{
+			name:       "request_duration_seconds",
+			metricType: metricType_HISTOGRAM,
+			value:      hist,
+			attributes: labels.Set{},
+		},
+		{
+			name:       "temperature",
+			metricType: metricType_GAUGE,
+			value:      math.NaN(),
+			attributes: labels.Set{},
+		},
+	}
+
+	testCases := []struct {
+		format   string
+		expected string
+	}{
+		{
+			format: StdoutFormatJSON,
+			expected: `[{"name":"redis_commands_total","type":"count","value":10,"attributes":{"cmd":"get","nrMetricType":"count","targetName":"redis a"}},` +
+				`{"name":"request_duration_seconds","type":"histogram","value":{"count":3,"sum":3,"buckets":[{"upper_bound":0,"cumulative_count":1},{"upper_bound":1,"cumulative_count":2},{"upper_bound":"+Inf","cumulative_count":3}]},"attributes":{}},` +
+				`{"name":"temperature","type":"gauge","value":"NaN","attributes":{}}]` + "\n",
+		},
+		{
+			format: StdoutFormatPrometheus,
+			expected: `# TYPE redis_commands_total counter
+redis_commands_total{cmd="get",targetName="redis a"} 10
+# TYPE request_duration_seconds histogram
+request_duration_seconds_bucket{le="0"} 1
+request_duration_seconds_bucket{le="1"} 2
+request_duration_seconds_bucket{le="+Inf"} 3
+request_duration_seconds_sum 3
+request_duration_seconds_count 3
+# TYPE temperature gauge
+temperature NaN
+`,
+		},
+		{
+			format: StdoutFormatOpenMetrics,
+			expected: `# TYPE redis_commands counter
+redis_commands_total{cmd="get",targetName="redis a"} 10.0
+# TYPE request_duration_seconds histogram
+request_duration_seconds_bucket{le="0.0"} 1
+request_duration_seconds_bucket{le="1.0"} 2
+request_duration_seconds_bucket{le="+Inf"} 3
+request_duration_seconds_sum 3.0
+request_duration_seconds_count 3
+# TYPE temperature gauge
+temperature NaN
+# EOF
+`,
+		},
+		{
+			format: StdoutFormatInflux,
+			expected: `redis_commands_total,cmd=get,targetName=redis\ a value=10 1000000000
+request_duration_seconds count=3,sum=3,0=1,1=2,+Inf=3 1000000000
+`,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.format, func(t *testing.T) {
+			t.Parallel()
+
+			e, err := NewStdoutEmitter(StdoutEmitterConfig{Format: tc.format})
+			require.NoError(t, err)
+			out := &bytes.Buffer{}
+			e.out = out
+			e.now = func() time.Time { return time.Unix(1, 0) }
+
+			require.NoError(t, e.Emit(metrics))
+			assert.Equal(t, tc.expected, out.String())
+		})
+	}
+
+	_, err = NewStdoutEmitter(StdoutEmitterConfig{Format: "xml"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,100 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package integration
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+)
+
+// exemplarEventType is the type of the events reporting exemplars.
+const exemplarEventType = "PrometheusExemplar"
+
+// exemplar is a sampled observation of a counter or a histogram, with labels
+// identifying it, usually the trace it was observed in.
+type exemplar struct {
+	labels    labels.Set
+	value     float64
+	timestamp time.Time
+	// upperBound is the upper bound of the bucket the exemplar belongs to,
+	// for histograms with classic buckets.
+	upperBound *float64
+}
+
+// metricExemplars returns the exemplars of a counter or of the buckets of a
+// histogram. Exporters only expose them in the OpenMetrics and protobuf
+// formats.
+func metricExemplars(m *dto.Metric) []exemplar {
+	var exemplars []exemplar
+	if e := m.GetCounter().GetExemplar(); e != nil {
+		exemplars = append(exemplars, newExemplar(e, nil))
+	}
+	for _, b := range m.GetHistogram().GetBucket() {
+		if e := b.GetExemplar(); e != nil {
+			exemplars = append(exemplars, newExemplar(e, proto.Float64(b.GetUpperBound())))
+		}
+	}
+	// Native histograms keep their exemplars apart from the buckets.
+	for _, e := range m.GetHistogram().GetExemplars() {
+		exemplars = append(exemplars, newExemplar(e, nil))
+	}
+	return exemplars
+}
+
+func newExemplar(e *dto.Exemplar, upperBound *float64) exemplar {
+	ex := exemplar{
+		labels:     labels.Set{},
+		value:      e.GetValue(),
+		upperBound: upperBound,
+	}
+	for _, l := range e.GetLabel() {
+		ex.labels[l.GetName()] = l.GetValue()
+	}
+	if e.GetTimestamp() != nil {
+		ex.timestamp = e.GetTimestamp().AsTime()
+	}
+	return ex
+}
+
+// exemplarTimestamp returns the time the exemplar was observed, or the given
+// default time when the exporter didn't set it.
+func exemplarTimestamp(e exemplar, def time.Time) time.Time {
+	if e.timestamp.IsZero() {
+		return def
+	}
+	return e.timestamp
+}
+
+// exemplarAttributes returns the attributes of the event reporting an
+// exemplar: the ones of its metric, the metric name, the exemplar value and
+// bucket, and the exemplar labels. The trace and span IDs are also copied to
+// the attributes New Relic links distributed traces with.
+func exemplarAttributes(m Metric, e exemplar) (map[string]interface{}, error) {
+	if math.IsNaN(e.value) || math.IsInf(e.value, 0) {
+		return nil, fmt.Errorf("exemplar of %q has a non-finite value", m.name)
+	}
+
+	attrs := copyAttrs(m.attributes)
+	attrs["metricName"] = m.name
+	attrs["value"] = e.value
+	if e.upperBound != nil {
+		attrs["le"] = fmt.Sprintf("%g", *e.upperBound)
+	}
+	for k, v := range e.labels {
+		attrs[k] = v
+	}
+	if traceID, ok := e.labels["trace_id"]; ok {
+		attrs["trace.id"] = traceID
+	}
+	if spanID, ok := e.labels["span_id"]; ok {
+		attrs["span.id"] = spanID
+	}
+	return attrs, nil
+}
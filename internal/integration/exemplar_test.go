@@ -0,0 +1,110 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package integration
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
+)
+
+const exemplarsPayload = `# TYPE requests counter
+requests_total{code="200"} 10 # {trace_id="4bf92f3577b34da6",span_id="00f067aa0ba902b7"} 1 1520879607.789
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 2
+latency_seconds_bucket{le="1"} 3 # {trace_id="a3ce929d0e0e4736"} 0.7
+latency_seconds_bucket{le="+Inf"} 3
+latency_seconds_count 3
+latency_seconds_sum 1.2
+# EOF
+`
+
+func fetchExemplars(t *testing.T) []Metric {
+	t.Helper()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+		_, _ = io.WriteString(w, exemplarsPayload)
+	}))
+	defer ts.Close()
+
+	retriever, err := endpoints.FixedRetriever(endpoints.TargetConfig{URLs: []string{ts.URL}})
+	require.NoError(t, err)
+	targets, err := retriever.GetTargets()
+	require.NoError(t, err)
+
+	fetcher := NewFetcher(fetchDuration, fetchTimeout, "", workerThreads, "", "", true, queueLength)
+	pairs := collectTargetMetrics(t, fetcher.Fetch(targets))
+	require.Len(t, pairs, 1)
+	require.Len(t, pairs[0].Metrics, 2)
+	return pairs[0].Metrics
+}
+
+func TestFetcher_Exemplars(t *testing.T) {
+	t.Parallel()
+
+	metrics := fetchExemplars(t)
+	latency, requests := metrics[0], metrics[1]
+
+	require.Len(t, requests.exemplars, 1)
+	e := requests.exemplars[0]
+	assert.Equal(t, "4bf92f3577b34da6", e.labels["trace_id"])
+	assert.Equal(t, 1.0, e.value)
+	assert.Equal(t, time.Unix(1520879607, 789000000), e.timestamp.Local())
+	assert.Nil(t, e.upperBound)
+
+	require.Len(t, latency.exemplars, 1)
+	e = latency.exemplars[0]
+	assert.Equal(t, "a3ce929d0e0e4736", e.labels["trace_id"])
+	assert.Equal(t, 0.7, e.value)
+	assert.True(t, e.timestamp.IsZero())
+	require.NotNil(t, e.upperBound)
+	assert.Equal(t, 1.0, *e.upperBound)
+
+	// Exemplars are kept by the emitters recording the metrics.
+	jm, err := newJSONMetric(latency)
+	require.NoError(t, err)
+	b, err := json.Marshal(jm)
+	require.NoError(t, err)
+	decoded, err := parseJSONMetric(b)
+	require.NoError(t, err)
+	assert.Equal(t, latency.exemplars, decoded.exemplars)
+}
+
+func TestTelemetryEmitter_Exemplars(t *testing.T) {
+	t.Parallel()
+
+	metrics := fetchExemplars(t)
+
+	h := &recordingHarvester{}
+	e := &TelemetryEmitter{harvester: h, deltaCalculator: newDeltaCalculator(defaultDeltaExpirationAge, defaultDeltaExpirationCheckInterval)}
+	require.NoError(t, e.Emit(metrics))
+	assert.Empty(t, h.events, "exemplars are only reported when enabled")
+
+	e.exemplars = true
+	require.NoError(t, e.Emit(metrics))
+	require.Len(t, h.events, 2)
+
+	bucket, counter := h.events[0], h.events[1]
+	assert.Equal(t, exemplarEventType, counter.EventType)
+	assert.Equal(t, time.Unix(1520879607, 789000000), counter.Timestamp.Local())
+	assert.Equal(t, "requests_total", counter.Attributes["metricName"])
+	assert.Equal(t, 1.0, counter.Attributes["value"])
+	assert.Equal(t, "200", counter.Attributes["code"])
+	assert.Equal(t, "4bf92f3577b34da6", counter.Attributes["trace.id"])
+	assert.Equal(t, "00f067aa0ba902b7", counter.Attributes["span.id"])
+
+	assert.Equal(t, "latency_seconds", bucket.Attributes["metricName"])
+	assert.Equal(t, "1", bucket.Attributes["le"])
+	assert.Equal(t, "a3ce929d0e0e4736", bucket.Attributes["trace.id"])
+	assert.False(t, bucket.Timestamp.IsZero())
+}
@@ -0,0 +1,131 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package integration
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"google.golang.org/protobuf/proto"
+)
+
+// familiesBuilder groups metrics by name into Prometheus metric families so
+// they can be written back in any of the Prometheus exposition formats.
+type familiesBuilder struct {
+	families map[string]*dto.MetricFamily
+}
+
+func newFamiliesBuilder() *familiesBuilder {
+	return &familiesBuilder{families: map[string]*dto.MetricFamily{}}
+}
+
+// add converts the metric and appends it to its family. Metrics whose type
+// doesn't match the type of the family they belong to are rejected, since
+// exposition formats only allow one type per metric name.
+func (b *familiesBuilder) add(m Metric) (*dto.Metric, error) {
+	var mtype dto.MetricType
+	dm := &dto.Metric{Label: exposedLabels(m.attributes)}
+
+	switch m.metricType {
+	case metricType_GAUGE:
+		mtype = dto.MetricType_GAUGE
+		dm.Gauge = &dto.Gauge{Value: proto.Float64(m.value.(float64))}
+	case metricType_COUNTER:
+		mtype = dto.MetricType_COUNTER
+		dm.Counter = &dto.Counter{Value: proto.Float64(m.value.(float64))}
+	case metricType_SUMMARY:
+		summary, ok := m.value.(*dto.Summary)
+		if !ok {
+			return nil, fmt.Errorf("unknown summary metric type for %q: %T", m.name, m.value)
+		}
+		mtype = dto.MetricType_SUMMARY
+		dm.Summary = summary
+	case metricType_HISTOGRAM, metricType_GAUGEHISTOGRAM:
+		hist, ok := m.value.(*dto.Histogram)
+		if !ok {
+			return nil, fmt.Errorf("unknown histogram metric type for %q: %T", m.name, m.value)
+		}
+		mtype = dto.MetricType_HISTOGRAM
+		if m.metricType == metricType_GAUGEHISTOGRAM {
+			mtype = dto.MetricType_GAUGE_HISTOGRAM
+		}
+		// The text formats can only represent classic buckets.
+		dm.Histogram = classicHistogram(hist)
+	default:
+		return nil, fmt.Errorf("unknown metric type %q", m.metricType)
+	}
+
+	mf, ok := b.families[m.name]
+	if !ok {
+		mf = &dto.MetricFamily{Name: proto.String(m.name), Type: mtype.Enum()}
+		b.families[m.name] = mf
+	}
+	if mf.GetType() != mtype {
+		return nil, fmt.Errorf("metric %q has type %s but it was already exposed as %s", m.name, mtype, mf.GetType())
+	}
+	mf.Metric = append(mf.Metric, dm)
+	return dm, nil
+}
+
+// result returns the metric families sorted by name, with their metrics
+// sorted by label set so the output is stable.
+func (b *familiesBuilder) result() []*dto.MetricFamily {
+	families := make([]*dto.MetricFamily, 0, len(b.families))
+	for _, mf := range b.families {
+		sort.Slice(mf.Metric, func(i, j int) bool {
+			return labelPairsString(mf.Metric[i].Label) < labelPairsString(mf.Metric[j].Label)
+		})
+		families = append(families, mf)
+	}
+	sort.Slice(families, func(i, j int) bool { return families[i].GetName() < families[j].GetName() })
+	return families
+}
+
+// exposedLabels converts the metric attributes into label pairs with valid
+// Prometheus label names. The attributes added only for New Relic are left
+// out.
+func exposedLabels(attributes map[string]interface{}) []*dto.LabelPair {
+	lbls := make([]*dto.LabelPair, 0, len(attributes))
+	for k, v := range attributes {
+		if _, ok := removedAttributes[k]; ok {
+			continue
+		}
+		lbls = append(lbls, &dto.LabelPair{
+			Name:  proto.String(sanitizeLabelName(k)),
+			Value: proto.String(fmt.Sprint(v)),
+		})
+	}
+	sort.Slice(lbls, func(i, j int) bool { return lbls[i].GetName() < lbls[j].GetName() })
+	return lbls
+}
+
+func labelPairsString(lbls []*dto.LabelPair) string {
+	var sb strings.Builder
+	for _, l := range lbls {
+		sb.WriteString(l.GetName())
+		sb.WriteByte('=')
+		sb.WriteString(l.GetValue())
+		sb.WriteByte(',')
+	}
+	return sb.String()
+}
+
+// encodeFamilies writes the metric families in the given exposition format,
+// including the trailing `# EOF` of OpenMetrics.
+func encodeFamilies(w io.Writer, format expfmt.Format, families []*dto.MetricFamily) error {
+	enc := expfmt.NewEncoder(w, format)
+	for _, mf := range families {
+		if err := enc.Encode(mf); err != nil {
+			return err
+		}
+	}
+	if closer, ok := enc.(expfmt.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
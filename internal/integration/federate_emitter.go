@@ -0,0 +1,308 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package integration
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/proto"
+)
+
+const defaultFederateExpiration = 5 * time.Minute
+
+// FederateEmitterConfig is the configuration of the `FederateEmitter`.
+type FederateEmitterConfig struct {
+	// Expiration is the time after which a series that has not been emitted
+	// again is not exposed anymore. Defaults to 5m.
+	Expiration time.Duration `mapstructure:"expiration"`
+}
+
+// FederateEmitter keeps the latest processed value of every series and
+// exposes them in the Prometheus text or OpenMetrics format, so a Prometheus
+// server or a person debugging the transformations can read exactly what is
+// being sent.
+type FederateEmitter struct {
+	name       string
+	expiration time.Duration
+
+	mtx    sync.Mutex
+	series map[string]federatedSeries
+}
+
+type federatedSeries struct {
+	metric  Metric
+	updated time.Time
+}
+
+// NewFederateEmitter returns a FederateEmitter.
+func NewFederateEmitter(cfg FederateEmitterConfig) *FederateEmitter {
+	expiration := defaultFederateExpiration
+	if cfg.Expiration != 0 {
+		expiration = cfg.Expiration
+	}
+	return &FederateEmitter{
+		name:       "federate",
+		expiration: expiration,
+		series:     map[string]federatedSeries{},
+	}
+}
+
+// Name returns the emitter name.
+func (fe *FederateEmitter) Name() string {
+	return fe.name
+}
+
+// Emit stores the metrics, replacing the previous value of their series.
+func (fe *FederateEmitter) Emit(metrics []Metric) error {
+	now := time.Now()
+
+	fe.mtx.Lock()
+	defer fe.mtx.Unlock()
+	for _, m := range metrics {
+		fe.series[seriesKey(m.name, m.attributes)] = federatedSeries{metric: m, updated: now}
+	}
+	return nil
+}
+
+// ServeHTTP exposes the stored series. Series can be filtered with one or
+// more `match[]` series selectors, e.g. `match[]={__name__=~"redis_.*"}`, as
+// in the Prometheus /federate endpoint. All the series are returned when no
+// selector is given.
+func (fe *FederateEmitter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, fmt.Sprintf("error parsing form values: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	var selectors []seriesSelector
+	for _, s := range r.Form["match[]"] {
+		selector, err := parseSeriesSelector(s)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		selectors = append(selectors, selector)
+	}
+
+	format := expfmt.NegotiateIncludingOpenMetrics(r.Header)
+	w.Header().Set("Content-Type", string(format))
+	if err := encodeFamilies(w, format, fe.families(selectors)); err != nil {
+		logrus.WithError(err).WithField("emitter", fe.name).Warn("error encoding federated metrics")
+	}
+}
+
+// families removes the expired series and returns the ones matching any of
+// the selectors grouped in metric families.
+func (fe *FederateEmitter) families(selectors []seriesSelector) []*dto.MetricFamily {
+	fe.mtx.Lock()
+	defer fe.mtx.Unlock()
+
+	b := newFamiliesBuilder()
+	now := time.Now()
+	for key, s := range fe.series {
+		if now.Sub(s.updated) > fe.expiration {
+			delete(fe.series, key)
+			continue
+		}
+
+		dm, err := b.add(s.metric)
+		if err != nil {
+			logrus.WithError(err).WithField("emitter", fe.name).Debug("skipping federated series")
+			continue
+		}
+		dm.TimestampMs = proto.Int64(metricTimestamp(s.metric, s.updated).UnixMilli())
+	}
+
+	families := b.result()
+	if len(selectors) == 0 {
+		return families
+	}
+
+	filtered := families[:0]
+	for _, mf := range families {
+		metrics := mf.Metric[:0]
+		for _, m := range mf.Metric {
+			for _, s := range selectors {
+				if s.matches(mf.GetName(), m.Label) {
+					metrics = append(metrics, m)
+					break
+				}
+			}
+		}
+		if len(metrics) > 0 {
+			mf.Metric = metrics
+			filtered = append(filtered, mf)
+		}
+	}
+	return filtered
+}
+
+// seriesKey identifies a series by its name and attributes.
+func seriesKey(name string, attributes map[string]interface{}) string {
+	keys := make([]string, 0, len(attributes))
+	for k := range attributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var sb strings.Builder
+	sb.WriteString(name)
+	for _, k := range keys {
+		sb.WriteByte(0xff)
+		sb.WriteString(k)
+		sb.WriteByte(0xff)
+		sb.WriteString(fmt.Sprint(attributes[k]))
+	}
+	return sb.String()
+}
+
+// seriesSelector is a set of label matchers, like `name{label="value"}` in
+// PromQL. The metric name is matched as the `__name__` label.
+type seriesSelector []labelMatcher
+
+type labelMatcher struct {
+	name  string
+	op    string
+	value string
+	re    *regexp.Regexp
+}
+
+func (s seriesSelector) matches(name string, lbls []*dto.LabelPair) bool {
+	for _, m := range s {
+		value := ""
+		if m.name == "__name__" {
+			value = name
+		} else {
+			for _, l := range lbls {
+				if l.GetName() == m.name {
+					value = l.GetValue()
+					break
+				}
+			}
+		}
+		if !m.matches(value) {
+			return false
+		}
+	}
+	return true
+}
+
+func (m labelMatcher) matches(value string) bool {
+	switch m.op {
+	case "=":
+		return value == m.value
+	case "!=":
+		return value != m.value
+	case "=~":
+		return m.re.MatchString(value)
+	case "!~":
+		return !m.re.MatchString(value)
+	}
+	return false
+}
+
+// parseSeriesSelector parses a PromQL series selector, e.g.
+// `http_requests_total{job=~"api.*",code!="200"}`.
+func parseSeriesSelector(input string) (seriesSelector, error) {
+	s := strings.TrimSpace(input)
+	var selector seriesSelector
+
+	name := s
+	if i := strings.IndexByte(s, '{'); i >= 0 {
+		name = strings.TrimSpace(s[:i])
+		if !strings.HasSuffix(s, "}") {
+			return nil, fmt.Errorf("invalid selector %q: missing closing brace", input)
+		}
+		matchers, err := parseLabelMatchers(s[i+1 : len(s)-1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid selector %q: %w", input, err)
+		}
+		selector = matchers
+	}
+	if name != "" {
+		selector = append(selector, labelMatcher{name: "__name__", op: "=", value: name})
+	}
+	if len(selector) == 0 {
+		return nil, fmt.Errorf("invalid selector %q: at least one matcher is required", input)
+	}
+	return selector, nil
+}
+
+func parseLabelMatchers(s string) ([]labelMatcher, error) {
+	var matchers []labelMatcher
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		if s == "" {
+			return matchers, nil
+		}
+
+		i := strings.IndexAny(s, "=!")
+		if i <= 0 {
+			return nil, fmt.Errorf("expected a label matcher at %q", s)
+		}
+		m := labelMatcher{name: strings.TrimSpace(s[:i])}
+		s = s[i:]
+		for _, op := range []string{"=~", "!~", "!=", "="} {
+			if strings.HasPrefix(s, op) {
+				m.op = op
+				break
+			}
+		}
+		if m.op == "" {
+			return nil, fmt.Errorf("unknown operator at %q", s)
+		}
+		s = strings.TrimSpace(s[len(m.op):])
+
+		value, rest, err := unquoteLabelValue(s)
+		if err != nil {
+			return nil, err
+		}
+		m.value = value
+		s = rest
+
+		if m.op == "=~" || m.op == "!~" {
+			// Regular expressions are fully anchored, as in PromQL.
+			if m.re, err = regexp.Compile("^(?:" + m.value + ")$"); err != nil {
+				return nil, fmt.Errorf("invalid regular expression %q: %w", m.value, err)
+			}
+		}
+		matchers = append(matchers, m)
+	}
+}
+
+// unquoteLabelValue parses the quoted label value at the start of s and
+// returns it together with the rest of the string.
+func unquoteLabelValue(s string) (string, string, error) {
+	if s == "" || (s[0] != '"' && s[0] != '\'') {
+		return "", "", fmt.Errorf("expected a quoted label value at %q", s)
+	}
+	quote := s[0]
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case quote:
+			raw := s[1:i]
+			if quote == '\'' {
+				raw = strings.ReplaceAll(strings.ReplaceAll(raw, `\'`, `'`), `"`, `\"`)
+			}
+			value, err := strconv.Unquote(`"` + raw + `"`)
+			if err != nil {
+				return "", "", fmt.Errorf("invalid label value %q: %w", s[:i+1], err)
+			}
+			return value, s[i+1:], nil
+		}
+	}
+	return "", "", fmt.Errorf("unterminated label value %q", s)
+}
@@ -0,0 +1,153 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package integration
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+)
+
+// timestampRE matches the timestamps at the end of the exposed samples, in
+// milliseconds for the text format and in seconds for OpenMetrics.
+var timestampRE = regexp.MustCompile(`(?m) (\d{13}|\d\.\d+e\+09)$`)
+
+func federate(t *testing.T, fe *FederateEmitter, query url.Values, accept string) string {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodGet, "/federate?"+query.Encode(), nil)
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	rec := httptest.NewRecorder()
+	fe.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	body, err := ioutil.ReadAll(rec.Body)
+	require.NoError(t, err)
+	return timestampRE.ReplaceAllString(string(body), "")
+}
+
+func TestFederateEmitter(t *testing.T) {
+	t.Parallel()
+
+	hist, err := newHistogram([]int64{1, 2, 3})
+	require.NoError(t, err)
+
+	fe := NewFederateEmitter(FederateEmitterConfig{})
+	require.NoError(t, fe.Emit([]Metric{
+		{name: "redis_up", metricType: metricType_GAUGE, value: float64(1), attributes: labels.Set{"targetName": "redis-a", "nrMetricType": "gauge"}},
+		{name: "redis_up", metricType: metricType_GAUGE, value: float64(0), attributes: labels.Set{"targetName": "redis-b", "nrMetricType": "gauge"}},
+		{name: "redis_commands_total", metricType: metricType_COUNTER, value: float64(10), attributes: labels.Set{"k8s.cluster.name": "test"}},
+		{name: "request_duration_seconds", metricType: metricType_HISTOGRAM, value: hist, attributes: labels.Set{}},
+	}))
+	// Emitting a series again replaces its previous value.
+	require.NoError(t, fe.Emit([]Metric{
+		{name: "redis_up", metricType: metricType_GAUGE, value: float64(1), attributes: labels.Set{"targetName": "redis-b", "nrMetricType": "gauge"}},
+	}))
+
+	t.Run("all series", func(t *testing.T) {
+		t.Parallel()
+
+		assert.Equal(t, `# TYPE redis_commands_total counter
+redis_commands_total{k8s_cluster_name="test"} 10
+# TYPE redis_up gauge
+redis_up{targetName="redis-a"} 1
+redis_up{targetName="redis-b"} 1
+# TYPE request_duration_seconds histogram
+request_duration_seconds_bucket{le="0"} 1
+request_duration_seconds_bucket{le="1"} 2
+request_duration_seconds_bucket{le="+Inf"} 3
+request_duration_seconds_sum 3
+request_duration_seconds_count 3
+`, federate(t, fe, nil, ""))
+	})
+
+	t.Run("filtered series", func(t *testing.T) {
+		t.Parallel()
+
+		query := url.Values{"match[]": []string{`redis_up{targetName=~".*-a"}`, `{__name__="redis_commands_total"}`}}
+		assert.Equal(t, `# TYPE redis_commands_total counter
+redis_commands_total{k8s_cluster_name="test"} 10
+# TYPE redis_up gauge
+redis_up{targetName="redis-a"} 1
+`, federate(t, fe, query, ""))
+	})
+
+	t.Run("openmetrics format", func(t *testing.T) {
+		t.Parallel()
+
+		query := url.Values{"match[]": []string{`redis_commands_total`}}
+		assert.Equal(t, `# TYPE redis_commands counter
+redis_commands_total{k8s_cluster_name="test"} 10.0
+# EOF
+`, federate(t, fe, query, "application/openmetrics-text; version=1.0.0"))
+	})
+}
+
+func TestFederateEmitter_Expiration(t *testing.T) {
+	t.Parallel()
+
+	fe := NewFederateEmitter(FederateEmitterConfig{Expiration: time.Millisecond})
+	require.NoError(t, fe.Emit([]Metric{
+		{name: "redis_up", metricType: metricType_GAUGE, value: float64(1), attributes: labels.Set{}},
+	}))
+	time.Sleep(5 * time.Millisecond)
+
+	assert.Empty(t, federate(t, fe, nil, ""))
+}
+
+func TestFederateEmitter_InvalidSelector(t *testing.T) {
+	t.Parallel()
+
+	fe := NewFederateEmitter(FederateEmitterConfig{})
+	req := httptest.NewRequest(http.MethodGet, "/federate?"+url.Values{"match[]": []string{`{job=}`}}.Encode(), nil)
+	rec := httptest.NewRecorder()
+	fe.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestParseSeriesSelector(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		selector string
+		name     string
+		labels   labels.Set
+		matches  bool
+	}{
+		{selector: `up`, name: "up", matches: true},
+		{selector: `up`, name: "down", matches: false},
+		{selector: `up{job="api"}`, name: "up", labels: labels.Set{"job": "api"}, matches: true},
+		{selector: `up{job="api"}`, name: "up", labels: labels.Set{"job": "web"}, matches: false},
+		{selector: `{job!="api"}`, name: "up", labels: labels.Set{"job": "web"}, matches: true},
+		{selector: `{__name__=~"redis_.*", job!~'web|db'}`, name: "redis_up", labels: labels.Set{"job": "api"}, matches: true},
+		{selector: `{__name__=~"redis_.*", job!~'web|db'}`, name: "redis_up", labels: labels.Set{"job": "db"}, matches: false},
+		// Regular expressions are anchored.
+		{selector: `{job=~"ap"}`, name: "up", labels: labels.Set{"job": "api"}, matches: false},
+		// Missing labels are matched as empty.
+		{selector: `{job=""}`, name: "up", matches: true},
+		{selector: `{path="/a\"b"}`, name: "up", labels: labels.Set{"path": `/a"b`}, matches: true},
+	}
+
+	for _, tc := range testCases {
+		selector, err := parseSeriesSelector(tc.selector)
+		require.NoError(t, err, tc.selector)
+		assert.Equal(t, tc.matches, selector.matches(tc.name, exposedLabels(tc.labels)), tc.selector)
+	}
+
+	for _, invalid := range []string{``, `{}`, `up{job="api"`, `{job="api}`, `{job~"api"}`, `{job=~"("}`, `{job=api}`} {
+		_, err := parseSeriesSelector(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
@@ -4,21 +4,27 @@
 package integration
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	dto "github.com/prometheus/client_model/go"
 
 	promcli "github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/net/http/httpproxy"
 
 	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
 	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
@@ -32,10 +38,52 @@ type Fetcher interface {
 	Fetch(t []endpoints.Target) <-chan TargetMetrics
 }
 
+// ContextFetcher is a Fetcher whose scrapes can be cancelled, or bounded by a
+// deadline, as a whole.
+type ContextFetcher interface {
+	Fetcher
+	// FetchContext is like Fetch, but it stops scraping the targets once the
+	// context is done, closing the channel when the scrapes in progress are
+	// cancelled.
+	FetchContext(ctx context.Context, t []endpoints.Target) <-chan TargetMetrics
+}
+
+// FetcherWithContext returns the fetcher as a ContextFetcher. Fetchers that
+// aren't context-aware fetch the targets with Fetch, unless the context is
+// already done, as their scrapes can't be cancelled.
+func FetcherWithContext(f Fetcher) ContextFetcher {
+	if cf, ok := f.(ContextFetcher); ok {
+		return cf
+	}
+	return contextFetcher{f}
+}
+
+type contextFetcher struct {
+	Fetcher
+}
+
+func (f contextFetcher) FetchContext(ctx context.Context, t []endpoints.Target) <-chan TargetMetrics {
+	if ctx.Err() != nil {
+		results := make(chan TargetMetrics)
+		close(results)
+		return results
+	}
+	return f.Fetch(t)
+}
+
 // TargetMetrics holds a pair of fetched metrics with the Target where they have been targetted from
 type TargetMetrics struct {
 	Metrics []Metric
 	Target  endpoints.Target
+	// ScrapeTime is the time the scrape of the target started.
+	ScrapeTime time.Time
+	// Partial is set on every chunk of the metrics of a scrape but the last
+	// one, when the Fetcher emits them in chunks.
+	Partial bool
+	// Failed is set, without metrics, on the last chunk of a scrape that
+	// failed after some of its chunks were emitted, so the emitters drop them
+	// from the scrape in progress.
+	Failed bool
 }
 
 // NewTLSConfig creates a TLS configuration. If a CA cert is provided it is
@@ -57,20 +105,23 @@ func NewTLSConfig(CAFile string, InsecureSkipVerify bool) (*tls.Config, error) {
 
 // newRoundTripper creates a new roundtripper with the specified TLS
 // configuration.
-func newRoundTripper(CaFile string, InsecureSkipVerify bool) (http.RoundTripper, error) {
+func newRoundTripper(CaFile string, InsecureSkipVerify bool, proxy endpoints.Proxy) (http.RoundTripper, error) {
 	tlsConfig, err := NewTLSConfig(CaFile, InsecureSkipVerify)
 	if err != nil {
 		return nil, err
 	}
-	return newDefaultRoundTripper(tlsConfig), nil
+	return newDefaultRoundTripper(tlsConfig, proxy), nil
 }
 
-func newDefaultRoundTripper(tlsConfig *tls.Config) http.RoundTripper {
+func newDefaultRoundTripper(tlsConfig *tls.Config, proxy endpoints.Proxy) http.RoundTripper {
 	var rt http.RoundTripper = &http.Transport{
+		Proxy:               proxyFunc(proxy),
 		MaxIdleConns:        20000,
 		MaxIdleConnsPerHost: 1000, // see https://github.com/golang/go/issues/13801
 		DisableKeepAlives:   false,
-		DisableCompression:  true,
+		// Compressed responses are requested and decoded by the scrapes, which
+		// account for their compressed and decompressed sizes.
+		DisableCompression: true,
 		// 5 minutes is typically above the maximum sane scrape interval. So we can
 		// use keepalive for all configurations.
 		IdleConnTimeout: 5 * time.Minute,
@@ -79,6 +130,23 @@ func newDefaultRoundTripper(tlsConfig *tls.Config) http.RoundTripper {
 	return rt
 }
 
+// proxyFunc returns the function choosing the proxy of the requests, or nil
+// when no proxy is configured. The proxy environment variables are ignored.
+func proxyFunc(proxy endpoints.Proxy) func(*http.Request) (*url.URL, error) {
+	if proxy.URL == "" {
+		return nil
+	}
+	cfg := httpproxy.Config{
+		HTTPProxy:  proxy.URL,
+		HTTPSProxy: proxy.URL,
+		NoProxy:    proxy.NoProxy,
+	}
+	fn := cfg.ProxyFunc()
+	return func(req *http.Request) (*url.URL, error) {
+		return fn(req.URL)
+	}
+}
+
 // NewBearerAuthFileRoundTripper adds the bearer token read from the provided file to a request unless
 // the authorization header has already been set. This file is read for every request.
 func NewBearerAuthFileRoundTripper(bearerFile string, rt http.RoundTripper) http.RoundTripper {
@@ -119,9 +187,157 @@ func cloneRequest(r *http.Request) *http.Request {
 	return r2
 }
 
+const (
+	defaultScrapeRetryMinBackoff = 100 * time.Millisecond
+	defaultScrapeRetryMaxBackoff = time.Second
+)
+
+// ScrapeRetries configures how the failed scrapes are retried within a cycle.
+type ScrapeRetries struct {
+	// Max is the number of times a scrape is retried. 0 disables retries.
+	Max int
+	// MinBackoff is the initial wait between attempts, doubled on every
+	// retry. Defaults to 100ms.
+	MinBackoff time.Duration
+	// MaxBackoff is the maximum wait between attempts. Defaults to 1s.
+	MaxBackoff time.Duration
+}
+
+// retriableScrapeError tells whether the scrape failed for a reason that can
+// be transient: the connection was refused or dropped, or the exporter
+// answered with a 5xx or 429 status. Timeouts aren't retried, since the
+// attempt already took the whole scrape timeout.
+func retriableScrapeError(err error) bool {
+	var statusErr *prometheus.StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 500 || statusErr.StatusCode == http.StatusTooManyRequests
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return false
+	}
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// FetcherOption configures optional behaviour of the Fetcher returned by NewFetcher.
+type FetcherOption func(*prometheusFetcher)
+
+// WithScrapeRecorder makes the Fetcher store the raw body of every scrape with
+// the given recorder.
+func WithScrapeRecorder(recorder *ScrapeRecorder) FetcherOption {
+	return func(pf *prometheusFetcher) {
+		pf.recorder = recorder
+	}
+}
+
+// WithIgnoredExporterTimestamps makes the Fetcher stamp every metric with the
+// scrape time, ignoring the timestamps exporters set on their samples.
+func WithIgnoredExporterTimestamps() FetcherOption {
+	return func(pf *prometheusFetcher) {
+		pf.ignoreTimestamps = true
+	}
+}
+
+// WithUnitAttribute makes the Fetcher add the unit declared by OpenMetrics and
+// protobuf payloads to the metrics of the family, as the `unit` attribute.
+func WithUnitAttribute() FetcherOption {
+	return func(pf *prometheusFetcher) {
+		pf.units = true
+	}
+}
+
+// WithScrapeLimits makes the Fetcher fail the scrapes exceeding the limits.
+func WithScrapeLimits(limits prometheus.ScrapeLimits) FetcherOption {
+	return func(pf *prometheusFetcher) {
+		pf.limits = limits
+	}
+}
+
+// WithCompression makes the Fetcher accept the scrape responses compressed
+// with the given encodings, a comma separated list of them in order of
+// preference. Targets can override it.
+func WithCompression(compression string) FetcherOption {
+	return func(pf *prometheusFetcher) {
+		pf.compression = compression
+	}
+}
+
+// WithIgnoreRules makes the Fetcher skip the metric families that the rules
+// would drop, so they aren't decoded nor converted. The same rules are still
+// applied by the RuleProcessor, so the metrics it returns don't change.
+func WithIgnoreRules(rules []IgnoreRule) FetcherOption {
+	return func(pf *prometheusFetcher) {
+		pf.ignoreRules = rules
+	}
+}
+
+// WithProxy makes the Fetcher scrape the targets through the proxy, unless
+// they are excluded by its no_proxy list. Targets can override it.
+func WithProxy(proxy endpoints.Proxy) FetcherOption {
+	return func(pf *prometheusFetcher) {
+		pf.proxy = proxy
+	}
+}
+
+// WithScrapeRetries makes the Fetcher retry the scrapes failing because of
+// connection errors or 5xx and 429 responses, waiting an exponential backoff
+// between attempts.
+func WithScrapeRetries(retries ScrapeRetries) FetcherOption {
+	return func(pf *prometheusFetcher) {
+		if retries.MinBackoff == 0 {
+			retries.MinBackoff = defaultScrapeRetryMinBackoff
+		}
+		if retries.MaxBackoff == 0 {
+			retries.MaxBackoff = defaultScrapeRetryMaxBackoff
+		}
+		pf.retries = retries
+	}
+}
+
+// WithCircuitBreaker makes the Fetcher stop scraping the targets on every
+// cycle after a number of consecutive failures, probing them after a backoff
+// instead.
+func WithCircuitBreaker(cfg CircuitBreakerConfig) FetcherOption {
+	return func(pf *prometheusFetcher) {
+		if cfg.Failures > 0 {
+			pf.breaker = newCircuitBreaker(cfg)
+		}
+	}
+}
+
+// WithChunkSize makes the Fetcher emit the metrics of a target in chunks of
+// about the given number of metrics while the scrape is decoded, instead of
+// all of them at once. Chunks hold whole metric families, so they can be
+// larger. The processing rules, such as copy_attributes, and the decoration
+// of the metrics only see the metrics of the same chunk.
+func WithChunkSize(size int) FetcherOption {
+	return func(pf *prometheusFetcher) {
+		pf.chunkSize = size
+	}
+}
+
 // NewFetcher returns the default Fetcher implementation
-func NewFetcher(fetchDuration time.Duration, fetchTimeout time.Duration, acceptHeader string, workerThreads int, BearerTokenFile string, CaFile string, InsecureSkipVerify bool, queueLength int) Fetcher {
-	roundTripper, _ := newRoundTripper(CaFile, InsecureSkipVerify)
+func NewFetcher(fetchDuration time.Duration, fetchTimeout time.Duration, acceptHeader string, workerThreads int, BearerTokenFile string, CaFile string, InsecureSkipVerify bool, queueLength int, opts ...FetcherOption) Fetcher {
+	pf := &prometheusFetcher{
+		workerThreads:      workerThreads,
+		queueLength:        queueLength,
+		duration:           fetchDuration,
+		fetchTimeout:       fetchTimeout,
+		acceptHeader:       acceptHeader,
+		transports:         newTargetTransports(),
+		caFile:             CaFile,
+		insecureSkipVerify: InsecureSkipVerify,
+		bearerTokenFile:    BearerTokenFile,
+		now:                time.Now,
+		scrape:             prometheus.ScrapeContext,
+		log:                logrus.WithField("component", "Fetcher"),
+	}
+	for _, opt := range opts {
+		opt(pf)
+	}
+
+	roundTripper, _ := newRoundTripper(CaFile, InsecureSkipVerify, pf.proxy)
 	client := &http.Client{
 		Transport: roundTripper,
 		Timeout:   fetchTimeout,
@@ -134,17 +350,10 @@ func NewFetcher(fetchDuration time.Duration, fetchTimeout time.Duration, acceptH
 		Timeout:   fetchTimeout,
 	}
 
-	return &prometheusFetcher{
-		workerThreads: workerThreads,
-		queueLength:   queueLength,
-		duration:      fetchDuration,
-		fetchTimeout:  fetchTimeout,
-		acceptHeader:  acceptHeader,
-		httpClient:    client,
-		bearerClient:  bearerTokenClient,
-		getMetrics:    prometheus.Get,
-		log:           logrus.WithField("component", "Fetcher"),
-	}
+	pf.httpClient = client
+	pf.bearerClient = bearerTokenClient
+	pf.tokens = newTokenSources(client)
+	return pf
 }
 
 type prometheusFetcher struct {
@@ -155,14 +364,67 @@ type prometheusFetcher struct {
 	acceptHeader  string
 	httpClient    prometheus.HTTPDoer
 	bearerClient  prometheus.HTTPDoer
-	// Provides IoC for better testability. Its usual value is 'prometheus.Get'.
-	getMetrics func(httpClient prometheus.HTTPDoer, url string, acceptHeader string, fetchTimeout string) (prometheus.MetricFamiliesByName, error)
-	log        *logrus.Entry
+	// tokens are the OAuth2 token sources of the targets.
+	tokens *tokenSources
+	// transports are the transports of the targets with their own TLS
+	// configuration or proxy.
+	transports *targetTransports
+	// caFile and insecureSkipVerify are the TLS configuration of the targets
+	// without their own. The CA is also used by the ones without a CA.
+	caFile             string
+	insecureSkipVerify bool
+	// bearerTokenFile is the token of the targets using the bearer token,
+	// which is added to their own transports.
+	bearerTokenFile string
+	// proxy is the proxy the targets are scraped through by default.
+	proxy endpoints.Proxy
+	// retries configures how the failed scrapes are retried within a cycle.
+	retries ScrapeRetries
+	// breaker skips the scrapes of the failing targets when set.
+	breaker *circuitBreaker
+	// now returns the time a scrape starts at. Its usual value is 'time.Now'.
+	now func() time.Time
+	// Provides IoC for better testability. Its usual value is 'prometheus.Scrape'.
+	scrape func(ctx context.Context, httpClient prometheus.HTTPDoer, url string, acceptHeader string, fetchTimeout string, opts prometheus.ScrapeOptions, fn func(*dto.MetricFamily) error) error
+	limits prometheus.ScrapeLimits
+	// compression is the default compression the responses are accepted
+	// with.
+	compression string
+	// ignoreRules are the rules of the processor dropping metrics, which are
+	// applied early to skip decoding the families they drop.
+	ignoreRules ignoreRules
+	// chunkSize is the number of metrics emitted at once, or 0 to emit all
+	// the metrics of a target at once.
+	chunkSize int
+	// recorder stores the raw scrapes when set.
+	recorder *ScrapeRecorder
+	// units adds the unit of the families to their metrics.
+	units bool
+	// ignoreTimestamps discards the timestamps set by the exporters.
+	ignoreTimestamps bool
+	log              *logrus.Entry
 }
 
 // Fetch implementation runs the connections to many targets in parallel, limited by the maxTargetConnections constant,
 // and submits TargetMetrics entries by the buffered channel, as long as they are retrieved
 func (pf *prometheusFetcher) Fetch(targets []endpoints.Target) <-chan TargetMetrics {
+	return pf.FetchContext(context.Background(), targets)
+}
+
+// FetchContext is like Fetch, but the targets aren't scraped anymore once the
+// context is done, and the scrapes in progress are cancelled.
+func (pf *prometheusFetcher) FetchContext(ctx context.Context, targets []endpoints.Target) <-chan TargetMetrics {
+	if pf.breaker != nil {
+		pf.breaker.prune(targets)
+		allowed := make([]endpoints.Target, 0, len(targets))
+		for _, t := range targets {
+			if pf.breaker.allow(t) {
+				allowed = append(allowed, t)
+			}
+		}
+		targets = allowed
+	}
+
 	results := make(chan TargetMetrics, pf.queueLength)
 	finishedTasks := sync.WaitGroup{}
 	finishedTasks.Add(len(targets))
@@ -176,7 +438,7 @@ func (pf *prometheusFetcher) Fetch(targets []endpoints.Target) <-chan TargetMetr
 	}).Debug("Starting fetch worker threads...")
 
 	for i := 0; i < pf.workerThreads; i++ {
-		go pf.work(targetChan, &finishedTasks, results)
+		go pf.work(ctx, targetChan, &finishedTasks, results)
 	}
 
 	go func() {
@@ -200,9 +462,15 @@ func (pf *prometheusFetcher) Fetch(targets []endpoints.Target) <-chan TargetMetr
 		// After 15 seconds all targets are added to the queue, with 15 seconds left in the cycle
 		ticker := time.NewTicker((pf.duration / 2) / time.Duration(nTargets))
 		defer ticker.Stop()
-		for _, target := range targets {
+		for i, target := range targets {
 			targetChan <- target
-			<-ticker.C
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				// The targets that weren't released are done.
+				finishedTasks.Add(-(nTargets - i - 1))
+				return
+			}
 		}
 	}()
 
@@ -210,6 +478,7 @@ func (pf *prometheusFetcher) Fetch(targets []endpoints.Target) <-chan TargetMetr
 		// The result channel needs to be closed so the rule processor knows when to stop
 		// reading from it.
 		finishedTasks.Wait()
+		pf.transports.prune()
 		pf.log.WithField("component", "fetcher").Debug("Finished fetch process.")
 		close(targetChan)
 		close(results)
@@ -218,30 +487,66 @@ func (pf *prometheusFetcher) Fetch(targets []endpoints.Target) <-chan TargetMetr
 }
 
 // work fetch the metrics of targets, pushing results to a channel and marking work as done.
-func (pf *prometheusFetcher) work(targets <-chan endpoints.Target, wg *sync.WaitGroup, results chan<- TargetMetrics) {
+// Targets aren't scraped once the context is done, and the cancelled scrapes
+// don't count as failures of the targets.
+func (pf *prometheusFetcher) work(ctx context.Context, targets <-chan endpoints.Target, wg *sync.WaitGroup, results chan<- TargetMetrics) {
 	for target := range targets {
-		if mfs, err := pf.fetch(target); err == nil {
-			results <- TargetMetrics{
-				Metrics: convertPromMetrics(pf.log, target.Name, mfs),
-				Target:  target,
-			}
-		} else {
+		if ctx.Err() != nil {
+			wg.Done()
+			continue
+		}
+		err := pf.fetch(ctx, target, results)
+		if err != nil && ctx.Err() == nil {
 			pf.log.WithError(err).Warn("error while scraping target")
 		}
+		if pf.breaker != nil && ctx.Err() == nil {
+			pf.breaker.done(target, err)
+		}
 		wg.Done()
 	}
 }
 
-func (pf *prometheusFetcher) fetch(t endpoints.Target) (prometheus.MetricFamiliesByName, error) {
+// fetch scrapes the target, converting its metric families as they are
+// decoded and pushing the metrics to the channel once the scrape is done, or
+// in chunks while it goes on.
+func (pf *prometheusFetcher) fetch(ctx context.Context, t endpoints.Target, results chan<- TargetMetrics) error {
 	pf.log.WithField("target", t.Name).Debug("fetching URL: ", t.URL)
+	compression := pf.compression
+	if t.Compression != "" {
+		compression = t.Compression
+	}
+	acceptEncoding, err := prometheus.AcceptEncoding(compression)
+	if err != nil {
+		fetchErrorsTotalMetric.WithLabelValues(t.Name).Set(1)
+		return fmt.Errorf("compression of target %s: %w", t.Name, err)
+	}
+
 	timer := promcli.NewTimer(promcli.ObserverFunc(fetchTargetDurationMetric.WithLabelValues(t.Name).Set))
 	httpClient := pf.httpClient
+	// If this target needs the bearer token, we will use the authenticated client to make the request.
+	if t.UseBearer {
+		httpClient = pf.bearerClient
+	}
 
-	if isMutualTLSTarget(t) {
-		rt, err := NewMutualTLSRoundTripper(t.TLSConfig)
+	// Targets with their own TLS configuration or proxy use their own
+	// transport, which the bearer token is added to.
+	proxy := t.Proxy.Or(pf.proxy)
+	if isMutualTLSTarget(t) || proxy != pf.proxy {
+		tlsConfig := t.TLSConfig
+		if tlsConfig.IsZero() {
+			tlsConfig.InsecureSkipVerify = pf.insecureSkipVerify
+		}
+		if tlsConfig.CaFilePath == "" {
+			tlsConfig.CaFilePath = pf.caFile
+		}
+		rt, err := pf.transports.get(tlsConfig, proxy)
 		if err != nil {
-			pf.log.WithError(err).Warnf("Error reading mTLS certs for %s (%s) ", t.Name, t.URL.String())
+			timer.ObserveDuration()
 			fetchErrorsTotalMetric.WithLabelValues(t.Name).Set(1)
+			return fmt.Errorf("reading TLS certs of target %s (%s): %w", t.Name, t.URL.String(), err)
+		}
+		if t.UseBearer {
+			rt = NewBearerAuthFileRoundTripper(pf.bearerTokenFile, rt)
 		}
 		httpClient = &http.Client{
 			Transport: rt,
@@ -249,56 +554,125 @@ func (pf *prometheusFetcher) fetch(t endpoints.Target) (prometheus.MetricFamilie
 		}
 	}
 
-	// If this target needs the bearer token, we will use the authenticated client to make the request.
-	if t.UseBearer {
-		httpClient = pf.bearerClient
+	// The credentials of the target take precedence over the bearer token.
+	if !t.Auth.IsZero() {
+		if c, ok := httpClient.(*http.Client); ok {
+			rt, err := newAuthRoundTripper(t.Auth, c.Transport, pf.tokens)
+			if err != nil {
+				timer.ObserveDuration()
+				fetchErrorsTotalMetric.WithLabelValues(t.Name).Set(1)
+				return fmt.Errorf("authenticating target %s: %w", t.Name, err)
+			}
+			httpClient = &http.Client{
+				Transport: rt,
+				Timeout:   c.Timeout,
+			}
+		}
+	}
+
+	// Scrapes are recorded once they succeed, so the ones exceeding the
+	// limits aren't.
+	var recording *recordingDoer
+	if pf.recorder != nil {
+		recording = pf.recorder.doer(t, httpClient)
+		httpClient = recording
+	}
+
+	var scrapeTime time.Time
+	converter := &metricsConverter{log: pf.log, targetName: t.Name, units: pf.units}
+	var metrics []Metric
+	var chunked bool
+	emit := func(partial bool) {
+		setTimestamps(metrics, scrapeTime, pf.ignoreTimestamps)
+		results <- TargetMetrics{
+			Metrics:    metrics,
+			Target:     t,
+			ScrapeTime: scrapeTime,
+			Partial:    partial,
+		}
+		metrics = nil
+		chunked = chunked || partial
 	}
 
 	ft := strconv.FormatFloat(pf.fetchTimeout.Seconds(), 'f', -1, 64)
-	mfs, err := pf.getMetrics(httpClient, t.URL.String(), pf.acceptHeader, ft)
+	opts := prometheus.ScrapeOptions{Limits: pf.limits, AcceptEncoding: acceptEncoding}
+	if len(pf.ignoreRules) > 0 {
+		opts.Keep = pf.keepFamily
+	}
+	// Scrapes are only retried when they failed before decoding any family,
+	// so no metrics are emitted twice.
+	backoff := pf.retries.MinBackoff
+	for attempt := 0; ; attempt++ {
+		var decoded bool
+		scrapeTime = pf.now()
+		err = pf.scrape(ctx, httpClient, t.URL.String(), pf.acceptHeader, ft, opts, func(mf *dto.MetricFamily) error {
+			decoded = true
+			metrics = converter.convert(mf.GetName(), mf, metrics)
+			if pf.chunkSize > 0 && len(metrics) >= pf.chunkSize {
+				emit(true)
+			}
+			return nil
+		})
+		if err == nil || decoded || attempt >= pf.retries.Max || !retriableScrapeError(err) {
+			break
+		}
+		pf.log.WithError(err).Debugf("scrape of %s failed, retrying in %s", t.URL.String(), backoff)
+		scrapeRetriesMetric.WithLabelValues(t.Name).Inc()
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+		}
+		backoff *= 2
+		if backoff > pf.retries.MaxBackoff {
+			backoff = pf.retries.MaxBackoff
+		}
+	}
 	timer.ObserveDuration()
+	fetchesTotalMetric.WithLabelValues(t.Name).Set(1)
 	if err != nil {
 		pf.log.WithError(err).Warnf("fetching Prometheus metrics: %s (%s)", t.URL.String(), t.Object.Name)
 		fetchErrorsTotalMetric.WithLabelValues(t.Name).Set(1)
+		if chunked {
+			results <- TargetMetrics{Target: t, ScrapeTime: scrapeTime, Failed: true}
+		}
+		return err
 	}
-	fetchesTotalMetric.WithLabelValues(t.Name).Set(1)
-	return mfs, err
+	if recording != nil {
+		recording.save()
+	}
+	emit(false)
+	return nil
+}
+
+// keepFamily tells whether the metrics of the family would be kept by the
+// ignore rules of the processor. The family of the process start time is
+// always kept, since it tells the start time of the other ones.
+func (pf *prometheusFetcher) keepFamily(name string, t dto.MetricType) bool {
+	if name == processStartTimeMetric {
+		return true
+	}
+	nrType, ok := nrMetricTypes[t]
+	if !ok {
+		return true
+	}
+	return !pf.ignoreRules.shouldIgnore(name, nrType)
 }
 
 func isMutualTLSTarget(t endpoints.Target) bool {
 	// If any of these is present it means we're looking at an mTLS-enabled target.
 	// These targets need their own HTTP client because of very unique and different TLS
 	// configuration.
-	return t.TLSConfig != endpoints.TLSConfig{}
+	return !t.TLSConfig.IsZero()
 }
 
 // NewMutualTLSRoundTripper creates a new roundtripper with the specified Mutual TLS
-// configuration.
-func NewMutualTLSRoundTripper(cfg endpoints.TLSConfig) (http.RoundTripper, error) {
-	// Load our TLS key pair to use for authentication
-	cert, err := tls.LoadX509KeyPair(cfg.CertFilePath, cfg.KeyFilePath)
+// configuration, sending the requests through the proxy when it is set.
+func NewMutualTLSRoundTripper(cfg endpoints.TLSConfig, proxy endpoints.Proxy) (http.RoundTripper, error) {
+	tlsConfig, err := newMutualTLSConfig(cfg)
 	if err != nil {
 		return nil, err
 	}
-
-	// Load our CA certificate
-	clientCACert, err := ioutil.ReadFile(cfg.CaFilePath)
-	if err != nil {
-		return nil, err
-	}
-
-	clientCertPool := x509.NewCertPool()
-	clientCertPool.AppendCertsFromPEM(clientCACert)
-
-	tlsConfig := &tls.Config{
-		Certificates:       []tls.Certificate{cert},
-		RootCAs:            clientCertPool,
-		InsecureSkipVerify: cfg.InsecureSkipVerify,
-	}
-	tlsConfig.BuildNameToCertificate()
-
-	rt := newDefaultRoundTripper(tlsConfig)
-	return rt, nil
+	return newDefaultRoundTripper(tlsConfig, proxy), nil
 }
 
 type (
@@ -312,6 +686,9 @@ const (
 	metricType_GAUGE     metricType = "gauge"
 	metricType_SUMMARY   metricType = "summary"
 	metricType_HISTOGRAM metricType = "histogram"
+	// Gauge histograms have the same value as histograms, but their buckets,
+	// count and sum can go down, so they are emitted as gauges.
+	metricType_GAUGEHISTOGRAM metricType = "gaugehistogram"
 )
 
 // Metric represents a Prometheus metric.
@@ -321,95 +698,169 @@ type Metric struct {
 	value      metricValue
 	metricType metricType
 	attributes labels.Set
+	exemplars  []exemplar
+	// timestamp is the time of the sample, set by the exporter or else the
+	// time the target was scraped.
+	timestamp time.Time
+	// startTime is the time cumulative metrics started counting from zero,
+	// when known. It is the one set by the exporter or, lacking it, the start
+	// time of the process of the target.
+	startTime time.Time
+}
+
+// setTimestamps stamps the metrics without a timestamp, or all of them when
+// the exporter timestamps are ignored, with the scrape time.
+func setTimestamps(metrics []Metric, scrapeTime time.Time, ignoreExporterTimestamps bool) {
+	for i := range metrics {
+		if ignoreExporterTimestamps || metrics[i].timestamp.IsZero() {
+			metrics[i].timestamp = scrapeTime
+		}
+	}
+}
+
+// metricTimestamp returns the timestamp of the metric, or the given default
+// time for the metrics built without one.
+func metricTimestamp(m Metric, def time.Time) time.Time {
+	if m.timestamp.IsZero() {
+		return def
+	}
+	return m.timestamp
 }
 
 var supportedMetricTypes = map[dto.MetricType]string{
-	dto.MetricType_COUNTER:   "counter",
-	dto.MetricType_GAUGE:     "gauge",
-	dto.MetricType_HISTOGRAM: "histogram",
-	dto.MetricType_SUMMARY:   "summary",
-	dto.MetricType_UNTYPED:   "untyped",
+	dto.MetricType_COUNTER:         "counter",
+	dto.MetricType_GAUGE:           "gauge",
+	dto.MetricType_HISTOGRAM:       "histogram",
+	dto.MetricType_GAUGE_HISTOGRAM: "gaugehistogram",
+	dto.MetricType_SUMMARY:         "summary",
+	dto.MetricType_UNTYPED:         "untyped",
+	prometheus.MetricTypeStateset:  "stateset",
+	prometheus.MetricTypeInfo:      "info",
+}
+
+// nrMetricTypes are the types the metrics of each supported family type are
+// converted to.
+var nrMetricTypes = map[dto.MetricType]metricType{
+	dto.MetricType_COUNTER:         metricType_COUNTER,
+	dto.MetricType_GAUGE:           metricType_GAUGE,
+	dto.MetricType_HISTOGRAM:       metricType_HISTOGRAM,
+	dto.MetricType_GAUGE_HISTOGRAM: metricType_GAUGEHISTOGRAM,
+	dto.MetricType_SUMMARY:         metricType_SUMMARY,
+	dto.MetricType_UNTYPED:         metricType_GAUGE,
+	prometheus.MetricTypeStateset:  metricType_GAUGE,
+	prometheus.MetricTypeInfo:      metricType_GAUGE,
+}
+
+// sampleTimestamp returns the timestamp the exporter set on the sample, or the
+// zero time when it didn't.
+func sampleTimestamp(m *dto.Metric) time.Time {
+	if m.TimestampMs == nil {
+		return time.Time{}
+	}
+	return time.Unix(0, m.GetTimestampMs()*int64(time.Millisecond))
 }
 
+// convertPromMetrics converts the metric families of a whole scrape.
 func convertPromMetrics(log *logrus.Entry, targetName string, mfs prometheus.MetricFamiliesByName) []Metric {
 	var metricsCap int
 	for _, mf := range mfs {
-		mtype, ok := supportedMetricTypes[mf.GetType()]
-		if !ok {
-			continue
-		}
-		metricsCap += len(mf.Metric)
-		totalTimeseriesByTargetAndTypeMetric.WithLabelValues(mtype, targetName).Add(float64(len(mf.Metric)))
-		totalTimeseriesByTypeMetric.WithLabelValues(mtype).Add(float64(len(mf.Metric)))
-		totalTimeseriesByTargetMetric.WithLabelValues(targetName).Add(float64(len(mf.Metric)))
+		metricsCap += len(mf.GetMetric())
 	}
-	totalTimeseriesMetric.Add(float64(metricsCap))
 
+	converter := &metricsConverter{log: log, targetName: targetName}
 	metrics := make([]Metric, 0, metricsCap)
 	for mname, mf := range mfs {
-		ntype := mf.GetType()
-		mtype, ok := supportedMetricTypes[ntype]
-		if !ok {
+		metrics = converter.convert(mname, mf, metrics)
+	}
+	return metrics
+}
+
+// metricsConverter converts the metric families of a scrape as they are
+// decoded.
+type metricsConverter struct {
+	log        *logrus.Entry
+	targetName string
+	// units adds the unit of the families to their metrics.
+	units bool
+	// processStart is the start time of the process of the target, once its
+	// family is converted.
+	processStart time.Time
+}
+
+// convert appends the metrics of the family to the given ones, which are the
+// metrics of the scrape still to be emitted.
+func (c *metricsConverter) convert(mname string, mf *dto.MetricFamily, metrics []Metric) []Metric {
+	ntype := mf.GetType()
+	mtype, ok := supportedMetricTypes[ntype]
+	if !ok {
+		return metrics
+	}
+	totalTimeseriesByTargetAndTypeMetric.WithLabelValues(mtype, c.targetName).Add(float64(len(mf.Metric)))
+	totalTimeseriesByTypeMetric.WithLabelValues(mtype).Add(float64(len(mf.Metric)))
+	totalTimeseriesByTargetMetric.WithLabelValues(c.targetName).Add(float64(len(mf.Metric)))
+	totalTimeseriesMetric.Add(float64(len(mf.Metric)))
+
+	first := len(metrics)
+	for _, m := range mf.GetMetric() {
+		var value interface{}
+		nrType := nrMetricTypes[ntype]
+		switch ntype {
+		case dto.MetricType_UNTYPED:
+			value = m.GetUntyped().GetValue()
+		case dto.MetricType_COUNTER:
+			value = m.GetCounter().GetValue()
+		case dto.MetricType_GAUGE:
+			value = m.GetGauge().GetValue()
+		case dto.MetricType_SUMMARY:
+			value = m.GetSummary()
+		case dto.MetricType_HISTOGRAM, dto.MetricType_GAUGE_HISTOGRAM:
+			value = m.GetHistogram()
+		case prometheus.MetricTypeStateset:
+			// Every state is a metric with a label named after the family,
+			// so they are emitted as one gauge per state.
+			value = m.GetGauge().GetValue()
+		case prometheus.MetricTypeInfo:
+			// Info metrics carry their information in their labels, which
+			// become the attributes of a gauge of 1.
+			value = float64(1)
+		default:
+			if c.log.Level <= logrus.DebugLevel {
+				c.log.WithField("target", c.targetName).Debugf("metric type not supported: %s", mtype)
+			}
 			continue
 		}
-		for _, m := range mf.GetMetric() {
-			var value interface{}
-			var nrType metricType
-			switch ntype {
-			case dto.MetricType_UNTYPED:
-				value = m.GetUntyped().GetValue()
-				nrType = metricType_GAUGE
-			case dto.MetricType_COUNTER:
-				value = m.GetCounter().GetValue()
-				nrType = metricType_COUNTER
-			case dto.MetricType_GAUGE:
-				value = m.GetGauge().GetValue()
-				nrType = metricType_GAUGE
-			case dto.MetricType_SUMMARY:
-				value = m.GetSummary()
-				nrType = metricType_SUMMARY
-			case dto.MetricType_HISTOGRAM:
-				value = m.GetHistogram()
-				nrType = metricType_HISTOGRAM
-			default:
-				if log.Level <= logrus.DebugLevel {
-					log.WithField("target", targetName).Debugf("metric type not supported: %s", mtype)
-				}
-				continue
-			}
-			attrs := map[string]interface{}{}
-			attrs["targetName"] = targetName
-			for _, l := range m.GetLabel() {
-				attrs[l.GetName()] = l.GetValue()
-			}
-			// nrMetricType and promMetricType attributes were created as a debugging tool, because some prometheus metric types weren't supported natively by NR.
-			attrs["nrMetricType"] = string(nrType)
-			attrs["promMetricType"] = mtype
-			metrics = append(
-				metrics,
-				Metric{
-					name:       mname,
-					metricType: nrType,
-					value:      value,
-					attributes: attrs,
-				},
-			)
+		attrs := map[string]interface{}{}
+		attrs["targetName"] = c.targetName
+		// OpenMetrics and protobuf payloads can declare the unit of the family.
+		if unit := mf.GetUnit(); c.units && unit != "" {
+			attrs["unit"] = unit
+		}
+		for _, l := range m.GetLabel() {
+			attrs[l.GetName()] = l.GetValue()
 		}
+		// nrMetricType and promMetricType attributes were created as a debugging tool, because some prometheus metric types weren't supported natively by NR.
+		attrs["nrMetricType"] = string(nrType)
+		attrs["promMetricType"] = mtype
+		metrics = append(
+			metrics,
+			Metric{
+				name:       mname,
+				metricType: nrType,
+				value:      value,
+				attributes: attrs,
+				exemplars:  metricExemplars(m),
+				timestamp:  sampleTimestamp(m),
+				startTime:  seriesStartTime(m),
+			},
+		)
 	}
-	return metrics
-}
 
-// MarshalJSON marshals a metric to json
-func (m *Metric) MarshalJSON() ([]byte, error) {
-	return json.Marshal(struct {
-		Name       string      `json:"name"`
-		Value      metricValue `json:"value"`
-		Type       metricType  `json:"type"`
-		Attributes labels.Set  `json:"attributes"`
-	}{
-		Name:       m.name,
-		Value:      m.value,
-		Type:       m.metricType,
-		Attributes: m.attributes,
-	})
+	// The metrics converted before the start time of the process are given
+	// it too, as long as they were not emitted yet.
+	if start, ok := processStartTime(mname, metrics[first:]); ok {
+		c.processStart = start
+		first = 0
+	}
+	setProcessStartTimes(metrics[first:], c.processStart)
+	return metrics
 }
@@ -5,19 +5,28 @@ package integration
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
+	"github.com/klauspost/compress/gzip"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
 
 	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
 	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
@@ -78,11 +87,9 @@ func TestFetcher(t *testing.T) {
 	// Given a fetcher
 	fetcher := NewFetcher(fetchDuration, fetchTimeout, "", workerThreads, "", "", true, queueLength)
 	var invokedURL string
-	fetcher.(*prometheusFetcher).getMetrics = func(client prometheus.HTTPDoer, url string, _ string, _ string) (names prometheus.MetricFamiliesByName, e error) {
+	fetcher.(*prometheusFetcher).scrape = func(_ context.Context, client prometheus.HTTPDoer, url string, _ string, _ string, _ prometheus.ScrapeOptions, fn func(*dto.MetricFamily) error) error {
 		invokedURL = url
-		return prometheus.MetricFamiliesByName{
-			"some-name": dto.MetricFamily{},
-		}, nil
+		return fn(&dto.MetricFamily{Name: proto.String("some-name")})
 	}
 
 	// When it fetches data synchronously
@@ -117,14 +124,12 @@ func TestFetcher_Error(t *testing.T) {
 
 	// That fails retrieving data from one of the metrics endpoint
 	invokedURLs := make([]string, 0)
-	fetcher.(*prometheusFetcher).getMetrics = func(client prometheus.HTTPDoer, url string, _ string, _ string) (names prometheus.MetricFamiliesByName, e error) {
+	fetcher.(*prometheusFetcher).scrape = func(_ context.Context, client prometheus.HTTPDoer, url string, _ string, _ string, _ prometheus.ScrapeOptions, fn func(*dto.MetricFamily) error) error {
 		if strings.Contains(url, "fail") {
-			return nil, errors.New("catapun")
+			return errors.New("catapun")
 		}
 		invokedURLs = append(invokedURLs, url)
-		return prometheus.MetricFamiliesByName{
-			"some-name": dto.MetricFamily{},
-		}, nil
+		return fn(&dto.MetricFamily{Name: proto.String("some-name")})
 	}
 
 	fail := url.URL{Scheme: "http", Path: "fail/metrics"}
@@ -169,12 +174,12 @@ func TestFetcher_ConcurrencyLimit(t *testing.T) {
 	// Given a Fetcher
 	fetcher := NewFetcher(time.Millisecond, fetchTimeout, "", workerThreads, "", "", true, queueLength)
 
-	fetcher.(*prometheusFetcher).getMetrics = func(client prometheus.HTTPDoer, url string, _ string, _ string) (names prometheus.MetricFamiliesByName, e error) {
+	fetcher.(*prometheusFetcher).scrape = func(_ context.Context, client prometheus.HTTPDoer, url string, _ string, _ string, _ prometheus.ScrapeOptions, fn func(*dto.MetricFamily) error) error {
 		defer atomic.AddInt32(&parallelTasks, -1)
 		atomic.AddInt32(&parallelTasks, 1)
 		reportedParallel <- atomic.LoadInt32(&parallelTasks)
 		time.Sleep(10 * time.Millisecond)
-		return prometheus.MetricFamiliesByName{"some-name": dto.MetricFamily{}}, nil
+		return fn(&dto.MetricFamily{Name: proto.String("some-name")})
 	}
 
 	// WHEN it fetches data from a big number of targets
@@ -213,7 +218,7 @@ func TestConvertPromMetrics(t *testing.T) {
 		{
 			"hotdog-stand",
 			prometheus.MetricFamiliesByName{
-				"sales": dto.MetricFamily{
+				"sales": &dto.MetricFamily{
 					// use anonymous struct to return *dto.MetricType literal.
 					Type: &(&struct{ x dto.MetricType }{dto.MetricType_COUNTER}).x,
 					Metric: []*dto.Metric{
@@ -232,7 +237,7 @@ func TestConvertPromMetrics(t *testing.T) {
 						},
 					},
 				},
-				"temperature": dto.MetricFamily{
+				"temperature": &dto.MetricFamily{
 					Type: &(&struct{ x dto.MetricType }{dto.MetricType_GAUGE}).x,
 					Metric: []*dto.Metric{
 						{
@@ -248,7 +253,7 @@ func TestConvertPromMetrics(t *testing.T) {
 						},
 					},
 				},
-				"histogram_example": dto.MetricFamily{
+				"histogram_example": &dto.MetricFamily{
 					// use anonymous struct to return *dto.MetricType literal.
 					Type: &(&struct{ x dto.MetricType }{dto.MetricType_HISTOGRAM}).x,
 					Metric: []*dto.Metric{
@@ -278,7 +283,7 @@ func TestConvertPromMetrics(t *testing.T) {
 						},
 					},
 				},
-				"summary_example": dto.MetricFamily{
+				"summary_example": &dto.MetricFamily{
 					// use anonymous struct to return *dto.MetricType literal.
 					Type: &(&struct{ x dto.MetricType }{dto.MetricType_SUMMARY}).x,
 					Metric: []*dto.Metric{
@@ -387,7 +392,7 @@ func TestConvertPromMetrics(t *testing.T) {
 		{
 			"hotdog-stand",
 			prometheus.MetricFamiliesByName{
-				"sales": dto.MetricFamily{
+				"sales": &dto.MetricFamily{
 					// use anonymous struct to return *dto.MetricType literal.
 					Type: &(&struct{ x dto.MetricType }{dto.MetricType_COUNTER}).x,
 					Metric: []*dto.Metric{
@@ -404,7 +409,7 @@ func TestConvertPromMetrics(t *testing.T) {
 						},
 					},
 				},
-				"temperature": dto.MetricFamily{
+				"temperature": &dto.MetricFamily{
 					Type: &(&struct{ x dto.MetricType }{dto.MetricType_GAUGE}).x,
 					Metric: []*dto.Metric{
 						{
@@ -420,7 +425,7 @@ func TestConvertPromMetrics(t *testing.T) {
 						},
 					},
 				},
-				"histogram_example": dto.MetricFamily{
+				"histogram_example": &dto.MetricFamily{
 					// use anonymous struct to return *dto.MetricType literal.
 					Type: &(&struct{ x dto.MetricType }{dto.MetricType_HISTOGRAM}).x,
 					Metric: []*dto.Metric{
@@ -450,7 +455,7 @@ func TestConvertPromMetrics(t *testing.T) {
 						},
 					},
 				},
-				"summary_example": dto.MetricFamily{
+				"summary_example": &dto.MetricFamily{
 					// use anonymous struct to return *dto.MetricType literal.
 					Type: &(&struct{ x dto.MetricType }{dto.MetricType_SUMMARY}).x,
 					Metric: []*dto.Metric{
@@ -587,7 +592,7 @@ func TestConvertPromMetricsMultiTargetCollisions(t *testing.T) {
 	}
 
 	mfbn := prometheus.MetricFamiliesByName{
-		"common-name": dto.MetricFamily{
+		"common-name": &dto.MetricFamily{
 			// use anonymous struct to return *dto.MetricType literal.
 			Type:   &(&struct{ x dto.MetricType }{dto.MetricType_COUNTER}).x,
 			Metric: []*dto.Metric{&metric},
@@ -625,3 +630,655 @@ func TestConvertPromMetricsMultiTargetCollisions(t *testing.T) {
 	}
 	assert.Equal(t, nrMetrics[0], want)
 }
+
+func TestFetcher_OpenMetrics(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+		_, _ = io.WriteString(w, `# TYPE requests counter
+requests_total{code="200"} 10
+requests_created{code="200"} 1520872607.123
+# TYPE temperature gauge
+# UNIT temperature celsius
+temperature 21.5
+# EOF
+`)
+	}))
+	defer ts.Close()
+
+	retriever, err := endpoints.FixedRetriever(endpoints.TargetConfig{URLs: []string{ts.URL}})
+	require.NoError(t, err)
+	targets, err := retriever.GetTargets()
+	require.NoError(t, err)
+
+	fetcher := NewFetcher(fetchDuration, fetchTimeout, "", workerThreads, "", "", true, queueLength, WithUnitAttribute())
+	pairs := collectTargetMetrics(t, fetcher.Fetch(targets))
+	require.Len(t, pairs, 1)
+	require.Len(t, pairs[0].Metrics, 2)
+
+	requests, temperature := pairs[0].Metrics[0], pairs[0].Metrics[1]
+	assert.Equal(t, "requests_total", requests.name)
+	assert.Equal(t, metricType_COUNTER, requests.metricType)
+	assert.Equal(t, 10.0, requests.value)
+	assert.Equal(t, "200", requests.attributes["code"])
+
+	assert.Equal(t, "temperature", temperature.name)
+	assert.Equal(t, 21.5, temperature.value)
+	assert.Equal(t, "celsius", temperature.attributes["unit"])
+
+	// The unit is only added when enabled.
+	fetcher = NewFetcher(fetchDuration, fetchTimeout, "", workerThreads, "", "", true, queueLength)
+	pairs = collectTargetMetrics(t, fetcher.Fetch(targets))
+	require.Len(t, pairs, 1)
+	require.Len(t, pairs[0].Metrics, 2)
+	assert.NotContains(t, pairs[0].Metrics[1].attributes, "unit")
+}
+
+func TestFetcher_OpenMetricsTypes(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+		_, _ = io.WriteString(w, `# TYPE build info
+build_info{version="1.2.3",revision="abc"} 1
+# TYPE door stateset
+door{door="closed"} 0
+door{door="open"} 1
+# TYPE queue_size gaugehistogram
+queue_size_bucket{le="10"} 3
+queue_size_bucket{le="+Inf"} 5
+queue_size_gcount 5
+queue_size_gsum 42
+# EOF
+`)
+	}))
+	defer ts.Close()
+
+	retriever, err := endpoints.FixedRetriever(endpoints.TargetConfig{URLs: []string{ts.URL}})
+	require.NoError(t, err)
+	targets, err := retriever.GetTargets()
+	require.NoError(t, err)
+
+	fetcher := NewFetcher(fetchDuration, fetchTimeout, "", workerThreads, "", "", true, queueLength)
+	pairs := collectTargetMetrics(t, fetcher.Fetch(targets))
+	require.Len(t, pairs, 1)
+	require.Len(t, pairs[0].Metrics, 4)
+
+	info := pairs[0].Metrics[0]
+	assert.Equal(t, "build_info", info.name)
+	assert.Equal(t, metricType_GAUGE, info.metricType)
+	assert.Equal(t, 1.0, info.value)
+	assert.Equal(t, "1.2.3", info.attributes["version"])
+	assert.Equal(t, "info", info.attributes["promMetricType"])
+
+	for i, state := range []string{"closed", "open"} {
+		m := pairs[0].Metrics[1+i]
+		assert.Equal(t, "door", m.name)
+		assert.Equal(t, metricType_GAUGE, m.metricType)
+		assert.Equal(t, float64(i), m.value)
+		assert.Equal(t, state, m.attributes["door"])
+		assert.Equal(t, "stateset", m.attributes["promMetricType"])
+	}
+
+	gh := pairs[0].Metrics[3]
+	assert.Equal(t, "queue_size", gh.name)
+	assert.Equal(t, metricType_GAUGEHISTOGRAM, gh.metricType)
+	hist, ok := gh.value.(*dto.Histogram)
+	require.True(t, ok)
+	assert.Equal(t, uint64(5), hist.GetSampleCount())
+	assert.Equal(t, 42.0, hist.GetSampleSum())
+}
+
+func TestFetcher_Timestamps(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, `# TYPE stamped gauge
+stamped 1 1520872607123
+# TYPE unstamped gauge
+unstamped 2
+`)
+	}))
+	t.Cleanup(ts.Close)
+
+	retriever, err := endpoints.FixedRetriever(endpoints.TargetConfig{URLs: []string{ts.URL}})
+	require.NoError(t, err)
+	targets, err := retriever.GetTargets()
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name     string
+		opts     []FetcherOption
+		expected func(scrapeTime time.Time) map[string]time.Time
+	}{
+		{
+			name: "exporter timestamps",
+			expected: func(scrapeTime time.Time) map[string]time.Time {
+				return map[string]time.Time{
+					"stamped":   time.Unix(1520872607, 123000000),
+					"unstamped": scrapeTime,
+				}
+			},
+		},
+		{
+			name: "ignored exporter timestamps",
+			opts: []FetcherOption{WithIgnoredExporterTimestamps()},
+			expected: func(scrapeTime time.Time) map[string]time.Time {
+				return map[string]time.Time{
+					"stamped":   scrapeTime,
+					"unstamped": scrapeTime,
+				}
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			before := time.Now()
+			fetcher := NewFetcher(fetchDuration, fetchTimeout, "", workerThreads, "", "", true, queueLength, tc.opts...)
+			pairs := collectTargetMetrics(t, fetcher.Fetch(targets))
+			require.Len(t, pairs, 1)
+
+			scrapeTime := pairs[0].ScrapeTime
+			assert.False(t, scrapeTime.Before(before))
+			got := map[string]time.Time{}
+			for _, m := range pairs[0].Metrics {
+				got[m.name] = m.timestamp
+			}
+			assert.Equal(t, tc.expected(scrapeTime), got)
+		})
+	}
+}
+
+func TestFetcher_Chunks(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, `# TYPE a gauge
+a{x="1"} 1
+a{x="2"} 2
+# TYPE b gauge
+b{x="1"} 1
+b{x="2"} 2
+# TYPE c gauge
+c{x="1"} 1
+c{x="2"} 2
+`)
+	}))
+	defer ts.Close()
+
+	retriever, err := endpoints.FixedRetriever(endpoints.TargetConfig{URLs: []string{ts.URL}})
+	require.NoError(t, err)
+	targets, err := retriever.GetTargets()
+	require.NoError(t, err)
+
+	fetcher := NewFetcher(fetchDuration, fetchTimeout, "", workerThreads, "", "", true, queueLength, WithChunkSize(3))
+	pairs := collectTargetMetrics(t, fetcher.Fetch(targets))
+
+	// Chunks are emitted once they have whole families with 3 metrics or more.
+	require.Len(t, pairs, 2)
+	assert.True(t, pairs[0].Partial)
+	assert.Len(t, pairs[0].Metrics, 4)
+	assert.False(t, pairs[1].Partial)
+	assert.Len(t, pairs[1].Metrics, 2)
+	assert.Equal(t, pairs[0].ScrapeTime, pairs[1].ScrapeTime)
+}
+
+func TestFetcher_ChunksFailed(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, `# TYPE a gauge
+a{x="1"} 1
+a{x="2"} 2
+a{x="3"} 3
+# TYPE b gauge
+b{x="1"} 1
+b{x="2"} 2
+`)
+	}))
+	defer ts.Close()
+
+	retriever, err := endpoints.FixedRetriever(endpoints.TargetConfig{URLs: []string{ts.URL}})
+	require.NoError(t, err)
+	targets, err := retriever.GetTargets()
+	require.NoError(t, err)
+
+	fetcher := NewFetcher(fetchDuration, fetchTimeout, "", workerThreads, "", "", true, queueLength,
+		WithChunkSize(3), WithScrapeLimits(prometheus.ScrapeLimits{MaxSamples: 4}))
+	pairs := collectTargetMetrics(t, fetcher.Fetch(targets))
+
+	// The scrape failing after a chunk was emitted ends with a failed one.
+	require.Len(t, pairs, 2)
+	assert.True(t, pairs[0].Partial)
+	assert.Len(t, pairs[0].Metrics, 3)
+	assert.False(t, pairs[1].Partial)
+	assert.True(t, pairs[1].Failed)
+	assert.Empty(t, pairs[1].Metrics)
+}
+
+func TestFetcher_ScrapeLimits(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "a 1\nb 2\n")
+	}))
+	defer ts.Close()
+
+	retriever, err := endpoints.FixedRetriever(endpoints.TargetConfig{URLs: []string{ts.URL}})
+	require.NoError(t, err)
+	targets, err := retriever.GetTargets()
+	require.NoError(t, err)
+
+	limits := prometheus.ScrapeLimits{MaxSamples: 1}
+	fetcher := NewFetcher(fetchDuration, fetchTimeout, "", workerThreads, "", "", true, queueLength, WithScrapeLimits(limits))
+	assert.Empty(t, collectTargetMetrics(t, fetcher.Fetch(targets)), "scrapes over the limits fail")
+}
+
+func TestFetcher_IgnoreRules(t *testing.T) {
+	t.Parallel()
+
+	const payload = `# TYPE go_goroutines gauge
+go_goroutines 10
+# TYPE go_threads gauge
+go_threads 5
+# TYPE requests_total counter
+requests_total{code="200"} 7
+# TYPE rpc_latency summary
+rpc_latency{quantile="0.5"} 0.2
+rpc_latency_sum 3
+rpc_latency_count 10
+# TYPE process_start_time_seconds gauge
+process_start_time_seconds 1520870000
+`
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, payload)
+	}))
+	t.Cleanup(ts.Close)
+
+	retriever, err := endpoints.FixedRetriever(endpoints.TargetConfig{URLs: []string{ts.URL}})
+	require.NoError(t, err)
+	targets, err := retriever.GetTargets()
+	require.NoError(t, err)
+
+	rules := []IgnoreRule{
+		{Prefixes: []string{"go_", "process_"}, Except: []string{"go_goroutines"}},
+		{MetricTypes: []string{"summary"}},
+	}
+	processingRules := []ProcessingRule{{IgnoreMetrics: rules}}
+
+	type series struct {
+		name      string
+		startTime time.Time
+	}
+	fetch := func(opts ...FetcherOption) (fetched, processed []series) {
+		fetcher := NewFetcher(fetchDuration, fetchTimeout, "", workerThreads, "", "", true, queueLength, opts...)
+		pairs := collectTargetMetrics(t, fetcher.Fetch(targets))
+		require.Len(t, pairs, 1)
+		for _, m := range pairs[0].Metrics {
+			fetched = append(fetched, series{m.name, m.startTime})
+		}
+
+		in := make(chan TargetMetrics, 1)
+		in <- pairs[0]
+		close(in)
+		for pair := range RuleProcessor(processingRules, queueLength)(in) {
+			for _, m := range pair.Metrics {
+				processed = append(processed, series{m.name, m.startTime})
+			}
+		}
+		return fetched, processed
+	}
+
+	allFetched, expected := fetch()
+	fetched, processed := fetch(WithIgnoreRules(rules))
+
+	// The families the rules drop are not converted, except the one with the
+	// start time of the process, which the other ones still get.
+	assert.Len(t, allFetched, 5)
+	start := time.Unix(1520870000, 0)
+	assert.ElementsMatch(t, []series{
+		{"go_goroutines", time.Time{}},
+		{"process_start_time_seconds", time.Time{}},
+		{"requests_total", start},
+	}, fetched)
+	assert.Equal(t, expected, processed)
+}
+
+func TestFetcher_Compression(t *testing.T) {
+	t.Parallel()
+
+	// The servers compress their responses with gzip when it is accepted.
+	newServer := func(acceptEncoding *atomic.Value) *httptest.Server {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			acceptEncoding.Store(r.Header.Get("Accept-Encoding"))
+			if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+				_, _ = io.WriteString(w, "requests_total 1\n")
+				return
+			}
+			w.Header().Set("Content-Encoding", "gzip")
+			gw := gzip.NewWriter(w)
+			_, _ = io.WriteString(gw, "requests_total 1\n")
+			_ = gw.Close()
+		}))
+		t.Cleanup(ts.Close)
+		return ts
+	}
+
+	var defaultAccepted, overriddenAccepted atomic.Value
+	defaultServer := newServer(&defaultAccepted)
+	overriddenServer := newServer(&overriddenAccepted)
+
+	retriever, err := endpoints.FixedRetriever(
+		endpoints.TargetConfig{URLs: []string{defaultServer.URL}},
+		endpoints.TargetConfig{URLs: []string{overriddenServer.URL}, Compression: "none"},
+		endpoints.TargetConfig{URLs: []string{"http://invalid-compression"}, Compression: "br"},
+	)
+	require.NoError(t, err)
+	targets, err := retriever.GetTargets()
+	require.NoError(t, err)
+
+	fetcher := NewFetcher(fetchDuration, fetchTimeout, "", workerThreads, "", "", true, queueLength, WithCompression("gzip"))
+	pairs := collectTargetMetrics(t, fetcher.Fetch(targets))
+
+	// The target with an invalid compression is not scraped.
+	require.Len(t, pairs, 2)
+	for _, pair := range pairs {
+		require.Len(t, pair.Metrics, 1)
+		assert.Equal(t, 1.0, pair.Metrics[0].value)
+	}
+	assert.Equal(t, "gzip;q=1.0", defaultAccepted.Load())
+	assert.Equal(t, "", overriddenAccepted.Load())
+}
+
+func TestProxyFunc(t *testing.T) {
+	t.Parallel()
+
+	assert.Nil(t, proxyFunc(endpoints.Proxy{}), "no proxy is used unless configured")
+
+	proxy := proxyFunc(endpoints.Proxy{
+		URL:     "socks5://proxy.example.com:1080",
+		NoProxy: "internal.example.com,10.0.0.0/8",
+	})
+	testCases := []struct {
+		url     string
+		proxied bool
+	}{
+		{url: "http://exporter.example.com:9100/metrics", proxied: true},
+		{url: "https://exporter.example.com:9100/metrics", proxied: true},
+		{url: "http://exporter.internal.example.com:9100/metrics"},
+		{url: "http://10.1.2.3:9100/metrics"},
+		{url: "http://127.0.0.1:9100/metrics"},
+	}
+	for _, tc := range testCases {
+		req, err := http.NewRequest(http.MethodGet, tc.url, nil)
+		require.NoError(t, err)
+		u, err := proxy(req)
+		require.NoError(t, err)
+		if tc.proxied {
+			require.NotNil(t, u, tc.url)
+			assert.Equal(t, "socks5://proxy.example.com:1080", u.String(), tc.url)
+		} else {
+			assert.Nil(t, u, tc.url)
+		}
+	}
+}
+
+func TestFetcher_Proxy(t *testing.T) {
+	t.Parallel()
+
+	// The proxies answer the requests themselves, counting the ones for each
+	// target.
+	newProxy := func() (*httptest.Server, *sync.Map) {
+		requests := &sync.Map{}
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			count, _ := requests.LoadOrStore(r.URL.Host, new(int32))
+			atomic.AddInt32(count.(*int32), 1)
+			_, _ = io.WriteString(w, "up 1\n")
+		}))
+		t.Cleanup(ts.Close)
+		return ts, requests
+	}
+	global, globalRequests := newProxy()
+	own, ownRequests := newProxy()
+
+	retriever, err := endpoints.FixedRetriever(
+		endpoints.TargetConfig{URLs: []string{"http://exporter.example.com:9100"}},
+		endpoints.TargetConfig{
+			URLs:  []string{"http://other.example.com:9100"},
+			Proxy: endpoints.Proxy{URL: own.URL},
+		},
+	)
+	require.NoError(t, err)
+	targets, err := retriever.GetTargets()
+	require.NoError(t, err)
+
+	fetcher := NewFetcher(fetchDuration, fetchTimeout, "", workerThreads, "", "", true, queueLength,
+		WithProxy(endpoints.Proxy{URL: global.URL}))
+	pairs := collectTargetMetrics(t, fetcher.Fetch(targets))
+	assert.Len(t, pairs, 2)
+
+	requests := func(m *sync.Map, host string) int32 {
+		count, ok := m.Load(host)
+		if !ok {
+			return 0
+		}
+		return atomic.LoadInt32(count.(*int32))
+	}
+	assert.Equal(t, int32(1), requests(globalRequests, "exporter.example.com:9100"))
+	assert.Equal(t, int32(0), requests(globalRequests, "other.example.com:9100"))
+	assert.Equal(t, int32(1), requests(ownRequests, "other.example.com:9100"))
+}
+
+// The bearer token is added to the own transport of the targets, keeping
+// their proxy.
+func TestFetcher_BearerWithTargetProxy(t *testing.T) {
+	t.Parallel()
+
+	var authorization atomic.Value
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization.Store(r.Header.Get("Authorization"))
+		_, _ = io.WriteString(w, "up 1\n")
+	}))
+	defer proxy.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("secret"), 0o600))
+
+	retriever, err := endpoints.FixedRetriever(endpoints.TargetConfig{
+		URLs:  []string{"http://exporter.example.com:9100"},
+		Proxy: endpoints.Proxy{URL: proxy.URL},
+	})
+	require.NoError(t, err)
+	targets, err := retriever.GetTargets()
+	require.NoError(t, err)
+	targets[0].UseBearer = true
+
+	fetcher := NewFetcher(fetchDuration, fetchTimeout, "", workerThreads, tokenFile, "", true, queueLength)
+	pairs := collectTargetMetrics(t, fetcher.Fetch(targets))
+	require.Len(t, pairs, 1)
+	assert.Len(t, pairs[0].Metrics, 1)
+	assert.Equal(t, "Bearer secret", authorization.Load())
+}
+
+func TestFetcher_Retries(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name     string
+		failures int
+		status   int
+		retries  int
+		scraped  bool
+		attempts int32
+	}{
+		{
+			name:     "retried until it succeeds",
+			failures: 2,
+			status:   http.StatusServiceUnavailable,
+			retries:  2,
+			scraped:  true,
+			attempts: 3,
+		},
+		{
+			name:     "too many failures",
+			failures: 3,
+			status:   http.StatusTooManyRequests,
+			retries:  2,
+			attempts: 3,
+		},
+		{
+			name:     "not retriable",
+			failures: 1,
+			status:   http.StatusNotFound,
+			retries:  2,
+			attempts: 1,
+		},
+		{
+			name:     "retries disabled",
+			failures: 1,
+			status:   http.StatusBadGateway,
+			attempts: 1,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			var attempts int32
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if atomic.AddInt32(&attempts, 1) <= int32(tc.failures) {
+					w.WriteHeader(tc.status)
+					return
+				}
+				_, _ = io.WriteString(w, "up 1\n")
+			}))
+			t.Cleanup(ts.Close)
+
+			retriever, err := endpoints.FixedRetriever(endpoints.TargetConfig{URLs: []string{ts.URL}})
+			require.NoError(t, err)
+			targets, err := retriever.GetTargets()
+			require.NoError(t, err)
+
+			fetcher := NewFetcher(fetchDuration, fetchTimeout, "", workerThreads, "", "", true, queueLength,
+				WithScrapeRetries(ScrapeRetries{Max: tc.retries, MinBackoff: time.Millisecond}))
+			pairs := collectTargetMetrics(t, fetcher.Fetch(targets))
+			if tc.scraped {
+				assert.Len(t, pairs, 1)
+			} else {
+				assert.Empty(t, pairs)
+			}
+			assert.Equal(t, tc.attempts, atomic.LoadInt32(&attempts))
+		})
+	}
+}
+
+func TestFetcher_RetriesConnectionErrors(t *testing.T) {
+	t.Parallel()
+
+	// The server closes the first connection without answering.
+	var attempts int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			conn, _, err := w.(http.Hijacker).Hijack()
+			require.NoError(t, err)
+			_ = conn.Close()
+			return
+		}
+		_, _ = io.WriteString(w, "up 1\n")
+	}))
+	t.Cleanup(ts.Close)
+
+	retriever, err := endpoints.FixedRetriever(endpoints.TargetConfig{URLs: []string{ts.URL}})
+	require.NoError(t, err)
+	targets, err := retriever.GetTargets()
+	require.NoError(t, err)
+
+	fetcher := NewFetcher(fetchDuration, fetchTimeout, "", workerThreads, "", "", true, queueLength,
+		WithScrapeRetries(ScrapeRetries{Max: 1, MinBackoff: time.Millisecond}))
+	pairs := collectTargetMetrics(t, fetcher.Fetch(targets))
+	assert.Len(t, pairs, 1)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&attempts))
+}
+
+func TestFetcher_CircuitBreaker(t *testing.T) {
+	t.Parallel()
+
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	t.Cleanup(ts.Close)
+
+	retriever, err := endpoints.FixedRetriever(endpoints.TargetConfig{URLs: []string{ts.URL}})
+	require.NoError(t, err)
+	targets, err := retriever.GetTargets()
+	require.NoError(t, err)
+
+	fetcher := NewFetcher(fetchDuration, fetchTimeout, "", workerThreads, "", "", true, queueLength,
+		WithCircuitBreaker(CircuitBreakerConfig{Failures: 2, MinBackoff: time.Hour}))
+	for i := 0; i < 4; i++ {
+		assert.Empty(t, collectTargetMetrics(t, fetcher.Fetch(targets)))
+	}
+
+	// The target is no longer scraped once its circuit opens.
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+	assert.Equal(t, float64(circuitOpen), testutil.ToFloat64(circuitBreakerStateMetric.WithLabelValues(targets[0].Name)))
+	assert.Equal(t, float64(2), testutil.ToFloat64(scrapesSkippedMetric.WithLabelValues(targets[0].Name)))
+}
+
+func TestFetcher_Cancel(t *testing.T) {
+	t.Parallel()
+
+	var requests int32
+	cancelled := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		<-r.Context().Done()
+		close(cancelled)
+	}))
+	t.Cleanup(ts.Close)
+
+	retriever, err := endpoints.FixedRetriever(endpoints.TargetConfig{URLs: []string{ts.URL + "/a", ts.URL + "/b", ts.URL + "/c"}})
+	require.NoError(t, err)
+	targets, err := retriever.GetTargets()
+	require.NoError(t, err)
+
+	// The targets are released slowly, so only the first one is scraped
+	// before the fetch is cancelled.
+	fetcher := NewFetcher(time.Hour, fetchTimeout, "", workerThreads, "", "", true, queueLength,
+		WithCircuitBreaker(CircuitBreakerConfig{Failures: 1, MinBackoff: time.Hour}))
+	ctx, cancel := context.WithCancel(context.Background())
+	pairs := fetcher.(ContextFetcher).FetchContext(ctx, targets)
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(&requests) == 1
+	}, 5*time.Second, time.Millisecond)
+	cancel()
+
+	select {
+	case <-cancelled:
+	case <-time.After(fetchTimeout):
+		t.Fatal("the scrape in progress wasn't cancelled")
+	}
+	assert.Empty(t, collectTargetMetrics(t, pairs))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+	assert.Equal(t, float64(circuitClosed), testutil.ToFloat64(circuitBreakerStateMetric.WithLabelValues(targets[0].Name)),
+		"cancelled scrapes aren't failures")
+}
+
+func TestRetriableScrapeError(t *testing.T) {
+	t.Parallel()
+
+	assert.True(t, retriableScrapeError(&prometheus.StatusError{StatusCode: http.StatusServiceUnavailable}))
+	assert.True(t, retriableScrapeError(&prometheus.StatusError{StatusCode: http.StatusTooManyRequests}))
+	assert.False(t, retriableScrapeError(&prometheus.StatusError{StatusCode: http.StatusUnauthorized}))
+	assert.True(t, retriableScrapeError(&url.Error{Op: "Get", URL: "http://target", Err: syscall.ECONNREFUSED}))
+	assert.False(t, retriableScrapeError(prometheus.ErrSampleLimit))
+}
@@ -0,0 +1,294 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package integration
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultFileEmitterMaxSizeBytes = 100 * 1024 * 1024
+	defaultFileEmitterMaxFiles     = 10
+
+	fileEmitterPrefix     = "metrics"
+	fileEmitterExtension  = ".ndjson"
+	fileEmitterTimeLayout = "20060102T150405.000000000"
+)
+
+// FileEmitterConfig is the configuration of the `FileEmitter`.
+type FileEmitterConfig struct {
+	// Directory where the files are written. It is created if it doesn't exist.
+	Directory string `mapstructure:"directory"`
+	// MaxSizeBytes is the size after which the current file is rotated. Defaults to 100MiB.
+	MaxSizeBytes int64 `mapstructure:"max_size_bytes"`
+	// RotationInterval is the maximum time the current file is written before
+	// being rotated. Time based rotation is disabled by default.
+	RotationInterval time.Duration `mapstructure:"rotation_interval"`
+	// MaxFiles is the number of rotated files kept. The oldest ones are
+	// removed. Defaults to 10.
+	MaxFiles int `mapstructure:"max_files"`
+	// Compress rotated files with gzip.
+	Compress bool `mapstructure:"compress"`
+}
+
+// FileEmitter writes the metrics as newline delimited JSON to a local file
+// that is rotated by size and time, keeping a limited number of rotated files.
+// The current file is always named metrics.ndjson, and rotated ones are
+// suffixed with the time they were rotated at.
+type FileEmitter struct {
+	name string
+	cfg  FileEmitterConfig
+	log  *logrus.Entry
+	now  func() time.Time
+	// rename moves the current file when it's rotated.
+	rename func(oldpath, newpath string) error
+
+	mtx    sync.Mutex
+	file   *os.File
+	writer *bufio.Writer
+	size   int64
+	opened time.Time
+}
+
+// NewFileEmitter returns a FileEmitter writing to the configured directory.
+func NewFileEmitter(cfg FileEmitterConfig) (*FileEmitter, error) {
+	if cfg.Directory == "" {
+		return nil, fmt.Errorf("file emitter directory is required")
+	}
+	if cfg.MaxSizeBytes <= 0 {
+		cfg.MaxSizeBytes = defaultFileEmitterMaxSizeBytes
+	}
+	if cfg.MaxFiles <= 0 {
+		cfg.MaxFiles = defaultFileEmitterMaxFiles
+	}
+
+	if err := os.MkdirAll(cfg.Directory, 0o755); err != nil {
+		return nil, fmt.Errorf("creating file emitter directory: %w", err)
+	}
+
+	fe := &FileEmitter{
+		name:   "file",
+		cfg:    cfg,
+		log:    logrus.WithField("component", "FileEmitter"),
+		now:    time.Now,
+		rename: os.Rename,
+	}
+	if err := fe.open(); err != nil {
+		return nil, err
+	}
+	return fe, nil
+}
+
+// Name returns the emitter name.
+func (fe *FileEmitter) Name() string {
+	return fe.name
+}
+
+// Emit writes one JSON line per metric to the current file, rotating it when
+// it exceeds the configured size or age.
+func (fe *FileEmitter) Emit(metrics []Metric) error {
+	fe.mtx.Lock()
+	defer fe.mtx.Unlock()
+
+	if fe.file == nil {
+		return fmt.Errorf("file emitter is stopped")
+	}
+
+	now := fe.now()
+	if fe.cfg.RotationInterval > 0 && now.Sub(fe.opened) >= fe.cfg.RotationInterval && fe.size > 0 {
+		if err := fe.rotate(); err != nil {
+			return err
+		}
+	}
+
+	for _, m := range metrics {
+		jm, err := newJSONMetric(m)
+		if err != nil {
+			fe.log.WithError(err).Warn("skipping metric")
+			continue
+		}
+		jm.Timestamp = metricTimestamp(m, now).UnixMilli()
+		line, err := json.Marshal(jm)
+		if err != nil {
+			fe.log.WithError(err).WithField("metric", m.name).Warn("skipping metric")
+			continue
+		}
+		line = append(line, '\n')
+
+		if fe.size > 0 && fe.size+int64(len(line)) > fe.cfg.MaxSizeBytes {
+			if err := fe.rotate(); err != nil {
+				return err
+			}
+		}
+		n, err := fe.writer.Write(line)
+		fe.size += int64(n)
+		if err != nil {
+			return fmt.Errorf("writing metrics file: %w", err)
+		}
+	}
+
+	if err := fe.writer.Flush(); err != nil {
+		return fmt.Errorf("writing metrics file: %w", err)
+	}
+	return nil
+}
+
+// Stop flushes and closes the current file. Metrics emitted afterwards are
+// rejected.
+func (fe *FileEmitter) Stop() {
+	fe.mtx.Lock()
+	defer fe.mtx.Unlock()
+	if err := fe.close(); err != nil {
+		fe.log.WithError(err).Warn("stopping file emitter")
+	}
+}
+
+func (fe *FileEmitter) currentPath() string {
+	return filepath.Join(fe.cfg.Directory, fileEmitterPrefix+fileEmitterExtension)
+}
+
+// open opens the current file, appending to it if it already exists.
+func (fe *FileEmitter) open() error {
+	f, err := os.OpenFile(fe.currentPath(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("opening metrics file: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return fmt.Errorf("opening metrics file: %w", err)
+	}
+
+	fe.file = f
+	fe.writer = bufio.NewWriter(f)
+	fe.size = info.Size()
+	fe.opened = fe.now()
+	return nil
+}
+
+func (fe *FileEmitter) close() error {
+	if fe.file == nil {
+		return nil
+	}
+	err := fe.writer.Flush()
+	if cerr := fe.file.Close(); err == nil {
+		err = cerr
+	}
+	fe.file = nil
+	fe.writer = nil
+	if err != nil {
+		return fmt.Errorf("closing metrics file: %w", err)
+	}
+	return nil
+}
+
+// rotate renames the current file after the rotation time, compresses it if
+// configured, removes the rotated files exceeding the retention and opens a
+// new current file. When the current file can't be rotated, it is opened
+// again to keep appending to it.
+func (fe *FileEmitter) rotate() error {
+	if err := fe.close(); err != nil {
+		return fe.reopen(err)
+	}
+
+	// Rotations within the same nanosecond would overwrite each other.
+	t := fe.now().UTC()
+	var rotated string
+	for {
+		rotated = filepath.Join(fe.cfg.Directory, fileEmitterPrefix+"-"+t.Format(fileEmitterTimeLayout)+fileEmitterExtension)
+		if !fileExists(rotated) && !fileExists(rotated+".gz") {
+			break
+		}
+		t = t.Add(time.Nanosecond)
+	}
+	if err := fe.rename(fe.currentPath(), rotated); err != nil {
+		return fe.reopen(fmt.Errorf("rotating metrics file: %w", err))
+	}
+
+	if fe.cfg.Compress {
+		if err := gzipFile(rotated); err != nil {
+			fe.log.WithError(err).Warn("compressing rotated metrics file")
+		}
+	}
+	fe.removeOldFiles()
+
+	return fe.open()
+}
+
+// reopen opens the current file again after it failed to be rotated with the
+// given error, which is returned along with the one opening it, if any.
+func (fe *FileEmitter) reopen(rotateErr error) error {
+	if err := fe.open(); err != nil {
+		return fmt.Errorf("%v, and reopening it: %w", rotateErr, err)
+	}
+	return rotateErr
+}
+
+// removeOldFiles keeps only the newest MaxFiles rotated files. The rotation
+// time in their names makes the lexical order chronological.
+func (fe *FileEmitter) removeOldFiles() {
+	pattern := filepath.Join(fe.cfg.Directory, fileEmitterPrefix+"-*"+fileEmitterExtension+"*")
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		fe.log.WithError(err).Warn("listing rotated metrics files")
+		return
+	}
+	if len(files) <= fe.cfg.MaxFiles {
+		return
+	}
+
+	sort.Strings(files)
+	for _, f := range files[:len(files)-fe.cfg.MaxFiles] {
+		if err := os.Remove(f); err != nil {
+			fe.log.WithError(err).WithField("file", f).Warn("removing rotated metrics file")
+		}
+	}
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return !os.IsNotExist(err)
+}
+
+// gzipFile compresses the file into a new file with the `.gz` extension and
+// removes the original.
+func gzipFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(dst)
+	if _, err := io.Copy(gz, src); err != nil {
+		_ = dst.Close()
+		_ = os.Remove(dst.Name())
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		_ = dst.Close()
+		_ = os.Remove(dst.Name())
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		_ = os.Remove(dst.Name())
+		return err
+	}
+	return os.Remove(path)
+}
@@ -0,0 +1,255 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package integration
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+)
+
+func readNDJSON(t *testing.T, path string) []Metric {
+	t.Helper()
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		require.NoError(t, err)
+		r = gz
+	}
+
+	var metrics []Metric
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		m, err := parseJSONMetric(scanner.Bytes())
+		require.NoError(t, err)
+		metrics = append(metrics, m)
+	}
+	require.NoError(t, scanner.Err())
+	return metrics
+}
+
+func rotatedFiles(t *testing.T, dir string) []string {
+	t.Helper()
+
+	files, err := filepath.Glob(filepath.Join(dir, "metrics-*"))
+	require.NoError(t, err)
+	sort.Strings(files)
+	return files
+}
+
+func TestJSONMetric(t *testing.T) {
+	t.Parallel()
+
+	hist := &dto.Histogram{
+		SampleCount: proto.Uint64(3),
+		SampleSum:   proto.Float64(math.NaN()),
+		Bucket: []*dto.Bucket{
+			{UpperBound: proto.Float64(1), CumulativeCount: proto.Uint64(2)},
+			{UpperBound: proto.Float64(math.Inf(1)), CumulativeCount: proto.Uint64(3)},
+		},
+	}
+	summary, err := newSummary(3, 10, []*quantile{{0.5, 10}, {0.999, 100}})
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name     string
+		metric   Metric
+		expected string
+	}{
+		{
+			name:     "gauge",
+			metric:   Metric{name: "a_gauge", metricType: metricType_GAUGE, value: float64(1.5), attributes: labels.Set{"a": "b"}},
+			expected: `{"name":"a_gauge","type":"gauge","value":1.5,"attributes":{"a":"b"}}`,
+		},
+		{
+			name:     "infinite counter",
+			metric:   Metric{name: "a_counter", metricType: metricType_COUNTER, value: math.Inf(-1), attributes: labels.Set{}},
+			expected: `{"name":"a_counter","type":"count","value":"-Inf","attributes":{}}`,
+		},
+		{
+			name:     "histogram",
+			metric:   Metric{name: "a_histogram", metricType: metricType_HISTOGRAM, value: hist, attributes: labels.Set{}},
+			expected: `{"name":"a_histogram","type":"histogram","value":{"count":3,"sum":"NaN","buckets":[{"upper_bound":1,"cumulative_count":2},{"upper_bound":"+Inf","cumulative_count":3}]},"attributes":{}}`,
+		},
+		{
+			name:     "summary",
+			metric:   Metric{name: "a_summary", metricType: metricType_SUMMARY, value: summary, attributes: labels.Set{}},
+			expected: `{"name":"a_summary","type":"summary","value":{"count":3,"sum":10,"quantiles":[{"quantile":0.5,"value":10},{"quantile":0.999,"value":100}]},"attributes":{}}`,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			jm, err := newJSONMetric(tc.metric)
+			require.NoError(t, err)
+			b, err := json.Marshal(jm)
+			require.NoError(t, err)
+			assert.JSONEq(t, tc.expected, string(b))
+
+			decoded, err := parseJSONMetric(b)
+			require.NoError(t, err)
+			jm, err = newJSONMetric(decoded)
+			require.NoError(t, err)
+			again, err := json.Marshal(jm)
+			require.NoError(t, err)
+			assert.JSONEq(t, tc.expected, string(again))
+		})
+	}
+}
+
+func TestFileEmitter(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	fe, err := NewFileEmitter(FileEmitterConfig{Directory: dir})
+	require.NoError(t, err)
+
+	hist, err := newHistogram([]int64{1, 2, 3})
+	require.NoError(t, err)
+	metrics := []Metric{
+		{name: "a_gauge", metricType: metricType_GAUGE, value: float64(1), attributes: labels.Set{"a": "b"}},
+		{name: "a_histogram", metricType: metricType_HISTOGRAM, value: hist, attributes: labels.Set{}},
+	}
+	require.NoError(t, fe.Emit(metrics))
+	fe.Stop()
+
+	written := readNDJSON(t, filepath.Join(dir, "metrics.ndjson"))
+	require.Len(t, written, 2)
+	assert.Equal(t, metrics[0], written[0])
+	assert.Equal(t, "a_histogram", written[1].name)
+	assert.True(t, proto.Equal(hist, written[1].value.(*dto.Histogram)))
+	assert.Empty(t, rotatedFiles(t, dir))
+
+	assert.Error(t, fe.Emit(metrics), "stopped emitters must reject metrics")
+
+	// A new emitter appends to the current file.
+	fe, err = NewFileEmitter(FileEmitterConfig{Directory: dir})
+	require.NoError(t, err)
+	require.NoError(t, fe.Emit(metrics[:1]))
+	fe.Stop()
+	assert.Len(t, readNDJSON(t, filepath.Join(dir, "metrics.ndjson")), 3)
+}
+
+func TestFileEmitter_SizeRotation(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	fe, err := NewFileEmitter(FileEmitterConfig{
+		Directory:    dir,
+		MaxSizeBytes: 150,
+		MaxFiles:     2,
+		Compress:     true,
+	})
+	require.NoError(t, err)
+
+	// Each line is about 100 bytes long, so every line ends in its own file.
+	for i := 0; i < 5; i++ {
+		require.NoError(t, fe.Emit([]Metric{
+			{name: "a_gauge", metricType: metricType_GAUGE, value: float64(i), attributes: labels.Set{}},
+		}))
+	}
+	fe.Stop()
+
+	files := rotatedFiles(t, dir)
+	require.Len(t, files, 2)
+	for i, f := range files {
+		assert.True(t, strings.HasSuffix(f, ".ndjson.gz"), f)
+		written := readNDJSON(t, f)
+		require.Len(t, written, 1)
+		assert.Equal(t, float64(i+2), written[0].value)
+	}
+	current := readNDJSON(t, filepath.Join(dir, "metrics.ndjson"))
+	require.Len(t, current, 1)
+	assert.Equal(t, float64(4), current[0].value)
+}
+
+func TestFileEmitter_TimeRotation(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	dir := t.TempDir()
+	fe, err := NewFileEmitter(FileEmitterConfig{Directory: dir, RotationInterval: time.Hour})
+	require.NoError(t, err)
+	fe.now = func() time.Time { return now }
+	fe.opened = now
+
+	metrics := []Metric{{name: "a_gauge", metricType: metricType_GAUGE, value: float64(1), attributes: labels.Set{}}}
+	require.NoError(t, fe.Emit(metrics))
+	now = now.Add(30 * time.Minute)
+	require.NoError(t, fe.Emit(metrics))
+	assert.Empty(t, rotatedFiles(t, dir))
+
+	now = now.Add(31 * time.Minute)
+	require.NoError(t, fe.Emit(metrics))
+	fe.Stop()
+
+	files := rotatedFiles(t, dir)
+	require.Len(t, files, 1)
+	assert.Equal(t, filepath.Join(dir, "metrics-20260101T010100.000000000.ndjson"), files[0])
+	assert.Len(t, readNDJSON(t, files[0]), 2)
+	assert.Len(t, readNDJSON(t, filepath.Join(dir, "metrics.ndjson")), 1)
+}
+
+func TestFileEmitter_RotationFails(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	fe, err := NewFileEmitter(FileEmitterConfig{Directory: dir, MaxSizeBytes: 150})
+	require.NoError(t, err)
+	renameErr := errors.New("rename failed")
+	fe.rename = func(oldpath, newpath string) error { return renameErr }
+
+	metrics := func(value float64) []Metric {
+		return []Metric{{name: "a_gauge", metricType: metricType_GAUGE, value: value, attributes: labels.Set{}}}
+	}
+	require.NoError(t, fe.Emit(metrics(0)))
+	assert.ErrorIs(t, fe.Emit(metrics(1)), renameErr)
+
+	// The current file is opened again, so the metrics keep being appended to
+	// it and it's rotated once renaming it works.
+	require.NotNil(t, fe.file)
+	fe.rename = os.Rename
+	require.NoError(t, fe.Emit(metrics(2)))
+	fe.Stop()
+
+	files := rotatedFiles(t, dir)
+	require.Len(t, files, 1)
+	rotated := readNDJSON(t, files[0])
+	require.Len(t, rotated, 1)
+	assert.Equal(t, float64(0), rotated[0].value)
+	current := readNDJSON(t, filepath.Join(dir, "metrics.ndjson"))
+	require.Len(t, current, 1)
+	assert.Equal(t, float64(2), current[0].value)
+}
+
+func TestFileEmitter_RequiresDirectory(t *testing.T) {
+	t.Parallel()
+
+	_, err := NewFileEmitter(FileEmitterConfig{})
+	assert.Error(t, err)
+}
@@ -30,6 +30,10 @@ func (ha harvesterDecorator) RecordMetric(m telemetry.Metric) {
 	}
 }
 
+func (ha harvesterDecorator) RecordEvent(e telemetry.Event) error {
+	return ha.innerHarvester.RecordEvent(e)
+}
+
 func (ha harvesterDecorator) HarvestNow(ctx context.Context) {
 	ha.innerHarvester.HarvestNow(ctx)
 }
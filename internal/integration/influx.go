@@ -0,0 +1,99 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package integration
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+var (
+	influxMeasurementEscaper = strings.NewReplacer(`,`, `\,`, ` `, `\ `, "\n", `\n`)
+	influxKeyEscaper         = strings.NewReplacer(`,`, `\,`, `=`, `\=`, ` `, `\ `, "\n", `\n`)
+)
+
+type influxField struct {
+	key   string
+	value float64
+}
+
+// writeInfluxLine writes the metric in the InfluxDB line protocol. The metric
+// name is the measurement and its attributes the tags. Gauges and counters
+// have a single `value` field, while histograms and summaries have `count`
+// and `sum` fields plus a field per bucket upper bound or quantile, as
+// Telegraf does for Prometheus metrics. Non-finite values can't be
+// represented in the line protocol, so those fields are left out.
+func writeInfluxLine(buf *bytes.Buffer, m Metric, ts time.Time) error {
+	var fields []influxField
+	switch v := m.value.(type) {
+	case float64:
+		fields = append(fields, influxField{"value", v})
+	case *dto.Histogram:
+		fields = append(fields, influxField{"count", float64(histogramCount(v))}, influxField{"sum", v.GetSampleSum()})
+		for _, b := range histogramBuckets(v) {
+			fields = append(fields, influxField{formatFloat(b.GetUpperBound()), float64(b.GetCumulativeCount())})
+		}
+	case *dto.Summary:
+		fields = append(fields, influxField{"count", float64(v.GetSampleCount())}, influxField{"sum", v.GetSampleSum()})
+		for _, q := range v.GetQuantile() {
+			fields = append(fields, influxField{formatFloat(q.GetQuantile()), q.GetValue()})
+		}
+	default:
+		return fmt.Errorf("unknown value type for metric %q: %T", m.name, m.value)
+	}
+
+	finite := fields[:0]
+	for _, f := range fields {
+		if !math.IsNaN(f.value) && !math.IsInf(f.value, 0) {
+			finite = append(finite, f)
+		}
+	}
+	if len(finite) == 0 {
+		return fmt.Errorf("metric %q has no finite values", m.name)
+	}
+
+	buf.WriteString(influxMeasurementEscaper.Replace(m.name))
+
+	keys := make([]string, 0, len(m.attributes))
+	for k := range m.attributes {
+		if _, ok := removedAttributes[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		// Tags with empty values are not allowed.
+		value := fmt.Sprint(m.attributes[k])
+		if value == "" {
+			continue
+		}
+		buf.WriteByte(',')
+		buf.WriteString(influxKeyEscaper.Replace(k))
+		buf.WriteByte('=')
+		buf.WriteString(influxKeyEscaper.Replace(value))
+	}
+
+	for i, f := range finite {
+		if i == 0 {
+			buf.WriteByte(' ')
+		} else {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(influxKeyEscaper.Replace(f.key))
+		buf.WriteByte('=')
+		buf.WriteString(strconv.FormatFloat(f.value, 'g', -1, 64))
+	}
+
+	buf.WriteByte(' ')
+	buf.WriteString(strconv.FormatInt(ts.UnixNano(), 10))
+	buf.WriteByte('\n')
+	return nil
+}
@@ -9,6 +9,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/newrelic/infra-integrations-sdk/v4/data/event"
 	infra "github.com/newrelic/infra-integrations-sdk/v4/data/metric"
 	sdk "github.com/newrelic/infra-integrations-sdk/v4/integration"
 	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
@@ -38,6 +39,7 @@ var removedAttributes = map[string]struct{}{
 type InfraSdkEmitter struct {
 	integrationMetadata Metadata
 	hostID              string
+	exemplars           bool
 }
 
 // Metadata contains the name and version of the exporter that is being scraped.
@@ -72,6 +74,12 @@ func (e *InfraSdkEmitter) SetIntegrationMetadata(integrationMetadata Metadata) e
 	return nil
 }
 
+// SetExemplars enables or disables reporting the exemplars of the metrics as
+// events of the PrometheusExemplar category.
+func (e *InfraSdkEmitter) SetExemplars(enabled bool) {
+	e.exemplars = enabled
+}
+
 // Name is the InfraSdkEmitter name.
 func (e *InfraSdkEmitter) Name() string {
 	return "infra-sdk"
@@ -90,20 +98,26 @@ func (e *InfraSdkEmitter) Emit(metrics []Metric) error {
 	// will cause the agent to send them unattached to any entity
 	i.HostEntity.SetIgnoreEntity(true)
 
+	// Metrics are emitted at the time they were scraped, or the one set by
+	// the exporter.
 	now := time.Now()
 	for _, me := range metrics {
+		timestamp := metricTimestamp(me, now)
 		switch me.metricType {
 		case metricType_GAUGE:
-			err = e.emitGauge(i, me, now)
+			err = e.emitGauge(i, me, timestamp)
 			break
 		case metricType_COUNTER:
-			err = e.emitCumulativeCounter(i, me, now)
+			err = e.emitCumulativeCounter(i, me, timestamp)
 			break
 		case metricType_SUMMARY:
-			err = e.emitSummary(i, me, now)
+			err = e.emitSummary(i, me, timestamp)
 			break
 		case metricType_HISTOGRAM:
-			err = e.emitHistogram(i, me, now)
+			err = e.emitHistogram(i, me, timestamp)
+			break
+		case metricType_GAUGEHISTOGRAM:
+			err = e.emitGaugeHistogram(i, me, timestamp)
 			break
 		default:
 			err = fmt.Errorf("unknown metric type %q", me.metricType)
@@ -112,6 +126,10 @@ func (e *InfraSdkEmitter) Emit(metrics []Metric) error {
 		if err != nil {
 			logrus.WithError(err).Errorf("failed to create metric from '%s'", me.name)
 		}
+
+		if e.exemplars {
+			e.emitExemplars(i, me, timestamp)
+		}
 	}
 	logrus.Debugf("%d metrics processed", len(metrics))
 
@@ -142,19 +160,46 @@ func (e *InfraSdkEmitter) emitHistogram(i *sdk.Integration, metric Metric, times
 		return fmt.Errorf("unknown histogram metric type for %q: %T", metric.name, metric.value)
 	}
 
-	ph, err := infra.NewPrometheusHistogram(timestamp, metric.name, *hist.SampleCount, *hist.SampleSum)
+	ph, err := infra.NewPrometheusHistogram(timestamp, metric.name, histogramCount(hist), hist.GetSampleSum())
 	if err != nil {
 		return fmt.Errorf("failed to create histogram metric for %q", metric.name)
 	}
 
-	buckets := hist.Bucket
+	// Native histograms are reported as classic buckets.
+	buckets := histogramBuckets(hist)
 	for _, b := range buckets {
-		ph.AddBucket(*b.CumulativeCount, *b.UpperBound)
+		ph.AddBucket(b.GetCumulativeCount(), b.GetUpperBound())
 	}
 
 	return e.addMetricToEntity(i, metric, ph)
 }
 
+// emitGaugeHistogram emits the buckets, count and sum of a gauge histogram as
+// gauges, since the agent would compute deltas for a Prometheus histogram.
+func (e *InfraSdkEmitter) emitGaugeHistogram(i *sdk.Integration, metric Metric, timestamp time.Time) error {
+	hist, ok := metric.value.(*dto.Histogram)
+	if !ok {
+		return fmt.Errorf("unknown gauge histogram metric type for %q: %T", metric.name, metric.value)
+	}
+
+	gauges := []Metric{
+		{name: metric.name + "_gsum", value: hist.GetSampleSum(), attributes: metric.attributes},
+		{name: metric.name + "_gcount", value: float64(histogramCount(hist)), attributes: metric.attributes},
+	}
+	for _, b := range histogramBuckets(hist) {
+		bucketAttrs := copyAttrs(metric.attributes)
+		bucketAttrs["le"] = fmt.Sprintf("%g", b.GetUpperBound())
+		gauges = append(gauges, Metric{name: metric.name + "_bucket", value: float64(b.GetCumulativeCount()), attributes: bucketAttrs})
+	}
+
+	for _, g := range gauges {
+		if err := e.emitGauge(i, g, timestamp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (e *InfraSdkEmitter) emitSummary(i *sdk.Integration, metric Metric, timestamp time.Time) error {
 	summary, ok := metric.value.(*dto.Summary)
 	if !ok {
@@ -174,6 +219,29 @@ func (e *InfraSdkEmitter) emitSummary(i *sdk.Integration, metric Metric, timesta
 	return e.addMetricToEntity(i, metric, ps)
 }
 
+// emitExemplars adds the exemplars of the metric as events, which can hold
+// the trace IDs without adding them to the dimensions of the metric.
+func (e *InfraSdkEmitter) emitExemplars(i *sdk.Integration, metric Metric, timestamp time.Time) {
+	for _, ex := range metric.exemplars {
+		attrs, err := exemplarAttributes(metric, ex)
+		if err != nil {
+			logrus.WithError(err).Debug("ignoring exemplar")
+			continue
+		}
+		ev, err := event.New(exemplarTimestamp(ex, timestamp), fmt.Sprintf("exemplar of %s", metric.name), exemplarEventType)
+		if err != nil {
+			logrus.WithError(err).Debugf("failed to create exemplar event of %q", metric.name)
+			continue
+		}
+		for k, v := range attrs {
+			if err := ev.AddAttribute(k, v); err != nil {
+				logrus.WithError(err).Debugf("failed to add attribute %q to exemplar event", k)
+			}
+		}
+		i.HostEntity.AddEvent(ev)
+	}
+}
+
 func (e *InfraSdkEmitter) addMetricToEntity(i *sdk.Integration, metric Metric, m infra.Metric) error {
 	e.addDimensions(m, metric.attributes, i.HostEntity)
 	i.HostEntity.AddMetric(m)
@@ -12,6 +12,7 @@ import (
 
 	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestInfraSdkEmitter_Name(t *testing.T) {
@@ -170,6 +171,61 @@ func TestInfraSdkEmitter_HistogramEmitsCorrectValue(t *testing.T) {
 	}
 }
 
+func TestInfraSdkEmitter_GaugeHistogramEmitsGauges(t *testing.T) {
+	e := NewInfraSdkEmitter("")
+
+	metrics := scrapeString(t, `
+# TYPE queue_size gaugehistogram
+queue_size_bucket{le="10",env="dev"} 3
+queue_size_bucket{le="+Inf",env="dev"} 5
+queue_size_count{env="dev"} 5
+queue_size_sum{env="dev"} 42
+`).Metrics
+
+	rescueStdout := os.Stdout
+	r, w, _ := os.Pipe()
+	os.Stdout = w
+
+	// when
+	err := e.Emit(metrics)
+	_ = w.Close()
+
+	// then
+	assert.NoError(t, err)
+	bytes, _ := ioutil.ReadAll(r)
+	os.Stdout = rescueStdout
+
+	var result struct {
+		Data []struct {
+			Metrics []struct {
+				Name       string            `json:"name"`
+				Type       string            `json:"type"`
+				Attributes map[string]string `json:"attributes"`
+				Value      float64           `json:"value"`
+			} `json:"metrics"`
+		} `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal(bytes, &result))
+	require.Len(t, result.Data, 1)
+
+	values := map[string]float64{}
+	for _, m := range result.Data[0].Metrics {
+		assert.Equal(t, "gauge", m.Type)
+		assert.Equal(t, "dev", m.Attributes["env"])
+		key := m.Name
+		if le, ok := m.Attributes["le"]; ok {
+			key += "{le=" + le + "}"
+		}
+		values[key] = m.Value
+	}
+	assert.Equal(t, map[string]float64{
+		"queue_size_gsum":            42,
+		"queue_size_gcount":          5,
+		"queue_size_bucket{le=10}":   3,
+		"queue_size_bucket{le=+Inf}": 5,
+	}, values)
+}
+
 func TestInfraSdkEmitter_SummaryEmitsCorrectValue(t *testing.T) {
 	t.Parallel()
 
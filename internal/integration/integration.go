@@ -5,6 +5,8 @@
 package integration
 
 import (
+	"context"
+	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -24,28 +26,98 @@ var Version = "dev"
 
 var ilog = logrus.WithField("component", "integration.Execute")
 
+// ExecuteOption configures optional behaviour of Execute.
+type ExecuteOption func(*executeConfig)
+
+type executeConfig struct {
+	cycleTimeout time.Duration
+	gracePeriod  time.Duration
+}
+
+// WithCycleTimeout bounds every scrape cycle, cancelling the scrapes and
+// emissions still in progress once the timeout elapses.
+func WithCycleTimeout(timeout time.Duration) ExecuteOption {
+	return func(c *executeConfig) {
+		c.cycleTimeout = timeout
+	}
+}
+
+// WithCycleGracePeriod lets the cycle in progress when the context of Execute
+// is done finish within the grace period, instead of being cancelled right
+// away.
+func WithCycleGracePeriod(gracePeriod time.Duration) ExecuteOption {
+	return func(c *executeConfig) {
+		c.gracePeriod = gracePeriod
+	}
+}
+
+// cycleContext returns the context of a scrape cycle, which is cancelled
+// once the cycle times out or the grace period elapses after ctx is done.
+func (c executeConfig) cycleContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	var cycleCtx context.Context
+	var cancel context.CancelFunc
+	if c.cycleTimeout > 0 {
+		cycleCtx, cancel = context.WithTimeout(context.WithoutCancel(ctx), c.cycleTimeout)
+	} else {
+		cycleCtx, cancel = context.WithCancel(context.WithoutCancel(ctx))
+	}
+	// The grace period timer is stopped with the cycle, so it doesn't outlive
+	// it.
+	var mtx sync.Mutex
+	var grace *time.Timer
+	var done bool
+	stop := context.AfterFunc(ctx, func() {
+		mtx.Lock()
+		defer mtx.Unlock()
+		if !done {
+			grace = time.AfterFunc(c.gracePeriod, cancel)
+		}
+	})
+	return cycleCtx, func() {
+		stop()
+		mtx.Lock()
+		done = true
+		if grace != nil {
+			grace.Stop()
+		}
+		mtx.Unlock()
+		cancel()
+	}
+}
+
 // Execute the integration loop. It sets the retrievers to start watching for
 // new targets and starts the processing pipeline. The pipeline fetches
 // metrics from the registered targets, transforms them according to a set
-// of rules and emits them.
+// of rules and emits them. It returns once the context is done and the
+// current cycle finished, or was cancelled.
 //
 // with first-class functions
 func Execute(
+	ctx context.Context,
 	scrapeDuration time.Duration,
 	selfRetriever endpoints.TargetRetriever,
 	retrievers []endpoints.TargetRetriever,
 	fetcher Fetcher,
 	processor Processor,
 	emitters []Emitter,
+	opts ...ExecuteOption,
 ) {
+	var cfg executeConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
 	for _, retriever := range retrievers {
-		err := retriever.Watch()
+		err := endpoints.WithContext(retriever).WatchContext(ctx)
 		if err != nil {
 			ilog.WithError(err).WithField("retriever", retriever.Name()).Error("while getting the initial list of targets")
 		}
 	}
 
-	for {
+	// Targets removed by the retrievers are forgotten by the emitters
+	// keeping state about their series.
+	knownTargets := map[string]struct{}{}
+	for ctx.Err() == nil {
 		totalTimeseriesMetric.Set(0)
 		totalTimeseriesByTargetMetric.Reset()
 		totalTimeseriesByTargetAndTypeMetric.Reset()
@@ -56,18 +128,28 @@ func Execute(
 		nrprom.ResetTargetSize()
 
 		startTime := time.Now()
-		process(retrievers, fetcher, processor, emitters)
+		cycleCtx, cancel := cfg.cycleContext(ctx)
+		if targets, ok := process(cycleCtx, retrievers, fetcher, processor, emitters); ok {
+			forgetRemovedTargets(knownTargets, targets, emitters)
+		}
+		cancel()
 		totalExecutionsMetric.Inc()
 		if duration := time.Since(startTime); duration < scrapeDuration {
-			time.Sleep(scrapeDuration - duration)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(scrapeDuration - duration):
+			}
 		}
-		processWithoutTelemetry(selfRetriever, fetcher, processor, emitters)
+		cycleCtx, cancel = cfg.cycleContext(ctx)
+		processWithoutTelemetry(cycleCtx, selfRetriever, fetcher, processor, emitters)
+		cancel()
 	}
 }
 
 // ExecuteOnce executes the integration once. The pipeline fetches
 // metrics from the registered targets, transforms them according to a set
-// of rules and emits them.
+// of rules and emits them. Queued emitters are flushed before returning.
 func ExecuteOnce(retrievers []endpoints.TargetRetriever, fetcher Fetcher, processor Processor, emitters []Emitter) {
 	for _, retriever := range retrievers {
 		err := retriever.Watch()
@@ -77,13 +159,19 @@ func ExecuteOnce(retrievers []endpoints.TargetRetriever, fetcher Fetcher, proces
 	}
 
 	for _, retriever := range retrievers {
-		processWithoutTelemetry(retriever, fetcher, processor, emitters)
+		processWithoutTelemetry(context.Background(), retriever, fetcher, processor, emitters)
+	}
+	for _, e := range emitters {
+		if f, ok := e.(interface{ Flush() }); ok {
+			f.Flush()
+		}
 	}
 }
 
 // processWithoutTelemetry processes a target retriever without doing any
 // kind of telemetry calculation.
 func processWithoutTelemetry(
+	ctx context.Context,
 	retriever endpoints.TargetRetriever,
 	fetcher Fetcher,
 	processor Processor,
@@ -94,19 +182,18 @@ func processWithoutTelemetry(
 		ilog.WithError(err).Error("error getting targets")
 		return
 	}
-	pairs := fetcher.Fetch(targets)
-	processed := processor(pairs)
+	pairs := FetcherWithContext(fetcher).FetchContext(ctx, targets)
+	processed := ProcessorWithContext(processor)(ctx, pairs)
 	for pair := range processed {
-		for _, e := range emitters {
-			err := e.Emit(pair.Metrics)
-			if err != nil {
-				ilog.WithField("emitter", e.Name()).WithError(err).Warn("error emitting metrics")
-			}
-		}
+		emit(ctx, emitters, pair)
 	}
 }
 
-func process(retrievers []endpoints.TargetRetriever, fetcher Fetcher, processor Processor, emitters []Emitter) {
+// process fetches, processes and emits the metrics of the targets of the
+// retrievers, and returns the targets. It returns false when the targets
+// couldn't be retrieved. The fetches, processing and emissions are cancelled
+// once the context is done.
+func process(ctx context.Context, retrievers []endpoints.TargetRetriever, fetcher Fetcher, processor Processor, emitters []Emitter) ([]endpoints.Target, bool) {
 	ptimer := prometheus.NewTimer(prometheus.ObserverFunc(processDurationMetric.Set))
 
 	targets := make([]endpoints.Target, 0)
@@ -116,24 +203,19 @@ func process(retrievers []endpoints.TargetRetriever, fetcher Fetcher, processor
 		if err != nil {
 			ilog.WithError(err).Error("error getting targets")
 			totalErrorsDiscoveryMetric.WithLabelValues(retriever.Name()).Set(1)
-			return
+			return nil, false
 		}
 		totalTargetsMetric.WithLabelValues(retriever.Name()).Set(float64(len(t)))
 		targets = append(targets, t...)
 	}
-	pairs := fetcher.Fetch(targets) // fetch metrics from /metrics endpoints
-	processed := processor(pairs)   // apply processing
+	pairs := FetcherWithContext(fetcher).FetchContext(ctx, targets) // fetch metrics from /metrics endpoints
+	processed := ProcessorWithContext(processor)(ctx, pairs)        // apply processing
 
 	emittedMetrics := 0
 	for pair := range processed {
 		emittedMetrics += len(pair.Metrics)
 
-		for _, e := range emitters {
-			err := e.Emit(pair.Metrics)
-			if err != nil {
-				ilog.WithField("emitter", e.Name()).WithError(err).Warn("error emitting metrics")
-			}
-		}
+		emit(ctx, emitters, pair)
 	}
 
 	duration := ptimer.ObserveDuration()
@@ -144,4 +226,33 @@ func process(retrievers []endpoints.TargetRetriever, fetcher Fetcher, processor
 		"emitterCount":        len(emitters),
 		"emittedMetricsCount": emittedMetrics,
 	}).Debug("Processing metrics finished.")
+	return targets, true
+}
+
+// emit emits the metrics of a target with every emitter, unless the context
+// is done. The scrapes that failed after emitting some chunks are aborted.
+func emit(ctx context.Context, emitters []Emitter, pair TargetMetrics) {
+	for _, e := range emitters {
+		if ctx.Err() != nil {
+			return
+		}
+		if pair.Failed {
+			if a, ok := e.(ChunkAborter); ok {
+				a.AbortChunks(pair.Target.Name)
+			}
+			continue
+		}
+		var err error
+		switch ce := e.(type) {
+		case ContextChunkEmitter:
+			err = ce.EmitChunkContext(ctx, pair.Target.Name, pair.Metrics, !pair.Partial)
+		case ChunkEmitter:
+			err = ce.EmitChunk(pair.Target.Name, pair.Metrics, !pair.Partial)
+		default:
+			err = EmitterWithContext(e).EmitContext(ctx, pair.Metrics)
+		}
+		if err != nil {
+			ilog.WithField("emitter", e.Name()).WithError(err).Warn("error emitting metrics")
+		}
+	}
 }
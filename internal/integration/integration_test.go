@@ -4,15 +4,18 @@
 package integration
 
 import (
+	"context"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"strconv"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 type nilEmit struct{}
@@ -55,6 +58,7 @@ func BenchmarkIntegration(b *testing.B) {
 func do(b *testing.B, retrievers []endpoints.TargetRetriever) {
 	b.ReportAllocs()
 	process(
+		context.Background(),
 		retrievers,
 		NewFetcher(30*time.Second, 5000000000, "", 4, "", "", false, queueLength),
 		RuleProcessor([]ProcessingRule{}, queueLength),
@@ -95,3 +99,95 @@ func BenchmarkIntegrationInfraSDKEmitter(b *testing.B) {
 			emitters)
 	}
 }
+
+func TestCycleContext(t *testing.T) {
+	t.Parallel()
+
+	c := executeConfig{gracePeriod: 50 * time.Millisecond}
+
+	// The cycle is cancelled once the grace period elapses after the context
+	// is done.
+	ctx, cancel := context.WithCancel(context.Background())
+	cycleCtx, cancelCycle := c.cycleContext(ctx)
+	defer cancelCycle()
+	cancel()
+	assert.NoError(t, cycleCtx.Err())
+	select {
+	case <-cycleCtx.Done():
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "the cycle wasn't cancelled after the grace period")
+	}
+
+	// Cycles finishing within the grace period cancel it.
+	ctx, cancel = context.WithCancel(context.Background())
+	cycleCtx, cancelCycle = c.cycleContext(ctx)
+	cancel()
+	cancelCycle()
+	assert.Error(t, cycleCtx.Err())
+}
+
+func TestExecute_Cancel(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name string
+		opts []ExecuteOption
+		// cycles is the number of scrapes cancelled before the context is.
+		cycles int32
+	}{
+		{
+			name:   "context cancelled",
+			cycles: 0,
+		},
+		{
+			name:   "cycle timed out",
+			opts:   []ExecuteOption{WithCycleTimeout(10 * time.Millisecond)},
+			cycles: 1,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			var requests, cancelled int32
+			// The target never answers, until the scrape is cancelled.
+			server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+				atomic.AddInt32(&requests, 1)
+				<-req.Context().Done()
+				atomic.AddInt32(&cancelled, 1)
+			}))
+			t.Cleanup(server.Close)
+			retriever, err := endpoints.FixedRetriever(endpoints.TargetConfig{URLs: []string{server.URL}})
+			require.NoError(t, err)
+			self, err := endpoints.FixedRetriever()
+			require.NoError(t, err)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			executed := make(chan struct{})
+			go func() {
+				defer close(executed)
+				Execute(ctx, time.Hour, self, []endpoints.TargetRetriever{retriever},
+					NewFetcher(time.Hour, time.Hour, "", 4, "", "", false, queueLength),
+					RuleProcessor(nil, queueLength),
+					[]Emitter{&nilEmit{}},
+					tc.opts...)
+			}()
+
+			require.Eventually(t, func() bool {
+				return atomic.LoadInt32(&requests) == 1 && atomic.LoadInt32(&cancelled) == tc.cycles
+			}, 5*time.Second, time.Millisecond)
+			cancel()
+			select {
+			case <-executed:
+			case <-time.After(5 * time.Second):
+				t.Fatal("the execution didn't end with the context")
+			}
+			assert.Eventually(t, func() bool {
+				return atomic.LoadInt32(&cancelled) == 1
+			}, 5*time.Second, time.Millisecond, "the scrape is cancelled")
+		})
+	}
+}
@@ -0,0 +1,327 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package integration
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+)
+
+// jsonFloat is a float64 encoded as a JSON number when it is finite and as
+// one of the strings "+Inf", "-Inf" or "NaN" otherwise, since JSON has no
+// literal for them.
+type jsonFloat float64
+
+func (f jsonFloat) MarshalJSON() ([]byte, error) {
+	v := float64(f)
+	switch {
+	case math.IsNaN(v):
+		return []byte(`"NaN"`), nil
+	case math.IsInf(v, 1):
+		return []byte(`"+Inf"`), nil
+	case math.IsInf(v, -1):
+		return []byte(`"-Inf"`), nil
+	}
+	return []byte(strconv.FormatFloat(v, 'g', -1, 64)), nil
+}
+
+func (f *jsonFloat) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return fmt.Errorf("invalid float value %q: %w", s, err)
+		}
+		*f = jsonFloat(v)
+		return nil
+	}
+
+	var v float64
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	*f = jsonFloat(v)
+	return nil
+}
+
+// jsonMetric is the JSON representation of a Metric. Histograms and
+// summaries are encoded as structures holding their count, sum and
+// buckets or quantiles.
+type jsonMetric struct {
+	// Timestamp is the time of the sample, in milliseconds since the epoch.
+	// It is only set by the emitters that record metrics.
+	Timestamp  int64          `json:"timestamp,omitempty"`
+	Name       string         `json:"name"`
+	Type       metricType     `json:"type"`
+	Value      interface{}    `json:"value"`
+	Attributes labels.Set     `json:"attributes"`
+	Exemplars  []jsonExemplar `json:"exemplars,omitempty"`
+}
+
+type jsonExemplar struct {
+	Labels     labels.Set `json:"labels"`
+	Value      jsonFloat  `json:"value"`
+	Timestamp  *time.Time `json:"timestamp,omitempty"`
+	UpperBound *jsonFloat `json:"upper_bound,omitempty"`
+}
+
+func newJSONExemplars(exemplars []exemplar) []jsonExemplar {
+	if len(exemplars) == 0 {
+		return nil
+	}
+	je := make([]jsonExemplar, 0, len(exemplars))
+	for _, e := range exemplars {
+		ex := jsonExemplar{Labels: e.labels, Value: jsonFloat(e.value)}
+		if !e.timestamp.IsZero() {
+			ts := e.timestamp
+			ex.Timestamp = &ts
+		}
+		if e.upperBound != nil {
+			ub := jsonFloat(*e.upperBound)
+			ex.UpperBound = &ub
+		}
+		je = append(je, ex)
+	}
+	return je
+}
+
+func exemplarsFromJSON(je []jsonExemplar) []exemplar {
+	var exemplars []exemplar
+	for _, e := range je {
+		ex := exemplar{labels: e.Labels, value: float64(e.Value)}
+		if e.Timestamp != nil {
+			ex.timestamp = *e.Timestamp
+		}
+		if e.UpperBound != nil {
+			ex.upperBound = proto.Float64(float64(*e.UpperBound))
+		}
+		exemplars = append(exemplars, ex)
+	}
+	return exemplars
+}
+
+type jsonHistogram struct {
+	Count   uint64       `json:"count"`
+	Sum     jsonFloat    `json:"sum"`
+	Buckets []jsonBucket `json:"buckets"`
+	// Native histograms keep their schema, zero bucket, spans and deltas
+	// (or absolute counts when they are float histograms).
+	CountFloat     jsonFloat   `json:"count_float,omitempty"`
+	Schema         *int32      `json:"schema,omitempty"`
+	ZeroThreshold  jsonFloat   `json:"zero_threshold,omitempty"`
+	ZeroCount      uint64      `json:"zero_count,omitempty"`
+	ZeroCountFloat jsonFloat   `json:"zero_count_float,omitempty"`
+	NegativeSpans  []jsonSpan  `json:"negative_spans,omitempty"`
+	NegativeDeltas []int64     `json:"negative_deltas,omitempty"`
+	NegativeCounts []jsonFloat `json:"negative_counts,omitempty"`
+	PositiveSpans  []jsonSpan  `json:"positive_spans,omitempty"`
+	PositiveDeltas []int64     `json:"positive_deltas,omitempty"`
+	PositiveCounts []jsonFloat `json:"positive_counts,omitempty"`
+}
+
+type jsonSpan struct {
+	Offset int32  `json:"offset"`
+	Length uint32 `json:"length"`
+}
+
+func newJSONSpans(spans []*dto.BucketSpan) []jsonSpan {
+	if len(spans) == 0 {
+		return nil
+	}
+	js := make([]jsonSpan, 0, len(spans))
+	for _, s := range spans {
+		js = append(js, jsonSpan{Offset: s.GetOffset(), Length: s.GetLength()})
+	}
+	return js
+}
+
+func dtoSpans(spans []jsonSpan) []*dto.BucketSpan {
+	var ds []*dto.BucketSpan
+	for _, s := range spans {
+		ds = append(ds, &dto.BucketSpan{Offset: proto.Int32(s.Offset), Length: proto.Uint32(s.Length)})
+	}
+	return ds
+}
+
+func newJSONFloats(fs []float64) []jsonFloat {
+	if len(fs) == 0 {
+		return nil
+	}
+	jf := make([]jsonFloat, 0, len(fs))
+	for _, f := range fs {
+		jf = append(jf, jsonFloat(f))
+	}
+	return jf
+}
+
+func dtoFloats(fs []jsonFloat) []float64 {
+	var df []float64
+	for _, f := range fs {
+		df = append(df, float64(f))
+	}
+	return df
+}
+
+type jsonBucket struct {
+	UpperBound      jsonFloat `json:"upper_bound"`
+	CumulativeCount uint64    `json:"cumulative_count"`
+}
+
+type jsonSummary struct {
+	Count     uint64         `json:"count"`
+	Sum       jsonFloat      `json:"sum"`
+	Quantiles []jsonQuantile `json:"quantiles"`
+}
+
+type jsonQuantile struct {
+	Quantile jsonFloat `json:"quantile"`
+	Value    jsonFloat `json:"value"`
+}
+
+func newJSONMetric(m Metric) (jsonMetric, error) {
+	jm := jsonMetric{
+		Name:       m.name,
+		Type:       m.metricType,
+		Attributes: m.attributes,
+		Exemplars:  newJSONExemplars(m.exemplars),
+	}
+
+	switch v := m.value.(type) {
+	case float64:
+		jm.Value = jsonFloat(v)
+	case *dto.Histogram:
+		hist := jsonHistogram{
+			Count:   v.GetSampleCount(),
+			Sum:     jsonFloat(v.GetSampleSum()),
+			Buckets: make([]jsonBucket, 0, len(v.GetBucket())),
+		}
+		for _, b := range v.GetBucket() {
+			hist.Buckets = append(hist.Buckets, jsonBucket{
+				UpperBound:      jsonFloat(b.GetUpperBound()),
+				CumulativeCount: b.GetCumulativeCount(),
+			})
+		}
+		if isNativeHistogram(v) {
+			hist.CountFloat = jsonFloat(v.GetSampleCountFloat())
+			hist.Schema = proto.Int32(v.GetSchema())
+			hist.ZeroThreshold = jsonFloat(v.GetZeroThreshold())
+			hist.ZeroCount = v.GetZeroCount()
+			hist.ZeroCountFloat = jsonFloat(v.GetZeroCountFloat())
+			hist.NegativeSpans = newJSONSpans(v.GetNegativeSpan())
+			hist.NegativeDeltas = v.GetNegativeDelta()
+			hist.NegativeCounts = newJSONFloats(v.GetNegativeCount())
+			hist.PositiveSpans = newJSONSpans(v.GetPositiveSpan())
+			hist.PositiveDeltas = v.GetPositiveDelta()
+			hist.PositiveCounts = newJSONFloats(v.GetPositiveCount())
+		}
+		jm.Value = hist
+	case *dto.Summary:
+		summary := jsonSummary{
+			Count:     v.GetSampleCount(),
+			Sum:       jsonFloat(v.GetSampleSum()),
+			Quantiles: make([]jsonQuantile, 0, len(v.GetQuantile())),
+		}
+		for _, q := range v.GetQuantile() {
+			summary.Quantiles = append(summary.Quantiles, jsonQuantile{
+				Quantile: jsonFloat(q.GetQuantile()),
+				Value:    jsonFloat(q.GetValue()),
+			})
+		}
+		jm.Value = summary
+	default:
+		return jm, fmt.Errorf("unknown value type for metric %q: %T", m.name, m.value)
+	}
+	return jm, nil
+}
+
+// MarshalJSON marshals a metric to json
+func (m *Metric) MarshalJSON() ([]byte, error) {
+	jm, err := newJSONMetric(*m)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(jm)
+}
+
+// parseJSONMetric parses a metric marshaled with MarshalJSON.
+func parseJSONMetric(b []byte) (Metric, error) {
+	var jm struct {
+		jsonMetric
+		Value json.RawMessage `json:"value"`
+	}
+	var m Metric
+	if err := json.Unmarshal(b, &jm); err != nil {
+		return m, err
+	}
+
+	switch jm.Type {
+	case metricType_GAUGE, metricType_COUNTER:
+		var v jsonFloat
+		if err := json.Unmarshal(jm.Value, &v); err != nil {
+			return m, fmt.Errorf("invalid value for metric %q: %w", jm.Name, err)
+		}
+		m.value = float64(v)
+	case metricType_HISTOGRAM, metricType_GAUGEHISTOGRAM:
+		var v jsonHistogram
+		if err := json.Unmarshal(jm.Value, &v); err != nil {
+			return m, fmt.Errorf("invalid histogram for metric %q: %w", jm.Name, err)
+		}
+		hist := &dto.Histogram{
+			SampleCount: proto.Uint64(v.Count),
+			SampleSum:   proto.Float64(float64(v.Sum)),
+		}
+		for _, b := range v.Buckets {
+			hist.Bucket = append(hist.Bucket, &dto.Bucket{
+				UpperBound:      proto.Float64(float64(b.UpperBound)),
+				CumulativeCount: proto.Uint64(b.CumulativeCount),
+			})
+		}
+		if v.Schema != nil {
+			hist.SampleCountFloat = proto.Float64(float64(v.CountFloat))
+			hist.Schema = v.Schema
+			hist.ZeroThreshold = proto.Float64(float64(v.ZeroThreshold))
+			hist.ZeroCount = proto.Uint64(v.ZeroCount)
+			hist.ZeroCountFloat = proto.Float64(float64(v.ZeroCountFloat))
+			hist.NegativeSpan = dtoSpans(v.NegativeSpans)
+			hist.NegativeDelta = v.NegativeDeltas
+			hist.NegativeCount = dtoFloats(v.NegativeCounts)
+			hist.PositiveSpan = dtoSpans(v.PositiveSpans)
+			hist.PositiveDelta = v.PositiveDeltas
+			hist.PositiveCount = dtoFloats(v.PositiveCounts)
+		}
+		m.value = hist
+	case metricType_SUMMARY:
+		var v jsonSummary
+		if err := json.Unmarshal(jm.Value, &v); err != nil {
+			return m, fmt.Errorf("invalid summary for metric %q: %w", jm.Name, err)
+		}
+		summary := &dto.Summary{
+			SampleCount: proto.Uint64(v.Count),
+			SampleSum:   proto.Float64(float64(v.Sum)),
+		}
+		for _, q := range v.Quantiles {
+			summary.Quantile = append(summary.Quantile, &dto.Quantile{
+				Quantile: proto.Float64(float64(q.Quantile)),
+				Value:    proto.Float64(float64(q.Value)),
+			})
+		}
+		m.value = summary
+	default:
+		return m, fmt.Errorf("unknown type %q for metric %q", jm.Type, jm.Name)
+	}
+
+	m.name = jm.Name
+	m.metricType = jm.Type
+	m.attributes = jm.Attributes
+	m.exemplars = exemplarsFromJSON(jm.Exemplars)
+	return m, nil
+}
@@ -109,6 +109,159 @@ var (
 		Name:      "total_executions",
 		Help:      "The number of times the integration is executed",
 	})
+	tlsCertificateExpiryMetric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "nr_stats",
+		Subsystem: "integration",
+		Name:      "tls_certificate_expiry_timestamp_seconds",
+		Help:      "Time when the client certificate used to scrape Mutual TLS targets expires, in seconds since the epoch",
+	},
+		[]string{
+			"cert_file",
+		},
+	)
+	scrapeRetriesMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nr_stats",
+		Subsystem: "integration",
+		Name:      "scrape_retries_total",
+		Help:      "Number of scrapes retried within a cycle, by target",
+	},
+		[]string{
+			"target",
+		},
+	)
+	circuitBreakerStateMetric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "nr_stats",
+		Subsystem: "integration",
+		Name:      "circuit_breaker_state",
+		Help:      "State of the circuit breaker of the targets that failed to be scraped: 0 closed, 1 open and 2 half-open",
+	},
+		[]string{
+			"target",
+		},
+	)
+	scrapesSkippedMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nr_stats",
+		Subsystem: "integration",
+		Name:      "scrapes_skipped_total",
+		Help:      "Number of scrapes skipped because the circuit breaker of the target was open, by target",
+	},
+		[]string{
+			"target",
+		},
+	)
+	diskBufferBytesMetric = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "nr_stats",
+		Subsystem: "disk_buffer",
+		Name:      "bytes",
+		Help:      "Size in bytes of the payloads stored by the telemetry emitter to be sent later",
+	})
+	diskBufferReplayedMetric = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "nr_stats",
+		Subsystem: "disk_buffer",
+		Name:      "replayed_batches_total",
+		Help:      "Number of payloads stored by the telemetry emitter that were sent later",
+	})
+	diskBufferDroppedMetric = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "nr_stats",
+		Subsystem: "disk_buffer",
+		Name:      "dropped_batches_total",
+		Help:      "Number of payloads stored by the telemetry emitter that were dropped because the buffer was full or they were rejected",
+	})
+	apiRateLimitedMetric = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "nr_stats",
+		Subsystem: "telemetry",
+		Name:      "rate_limited_total",
+		Help:      "Number of 429 responses of the New Relic APIs pausing the harvests of the telemetry emitter",
+	})
+	apiPayloadsSplitMetric = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "nr_stats",
+		Subsystem: "telemetry",
+		Name:      "payloads_split_total",
+		Help:      "Number of payloads of the telemetry emitter split in halves after a 413 response of the New Relic APIs",
+	})
+	apiPayloadsDroppedMetric = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "nr_stats",
+		Subsystem: "telemetry",
+		Name:      "payloads_dropped_total",
+		Help:      "Number of payloads of the telemetry emitter too large for the New Relic APIs that couldn't be split, and of halves of split payloads rejected for good",
+	})
+	harvestMetricCapMetric = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "nr_stats",
+		Subsystem: "telemetry",
+		Name:      "metric_cap",
+		Help:      "Number of metrics triggering a harvest of the telemetry emitter, lowered when payloads are too large for the New Relic APIs and raised back as they are accepted",
+	})
+	emitterQueueLengthMetric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "nr_stats",
+		Subsystem: "emitter",
+		Name:      "queue_length",
+		Help:      "Number of scrapes, or chunks of them, waiting to be emitted, by emitter",
+	},
+		[]string{
+			"emitter",
+		},
+	)
+	emitterQueueLatencyMetric = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "nr_stats",
+		Subsystem: "emitter",
+		Name:      "queue_latency_seconds",
+		Help:      "Time in seconds the metrics waited in the queue of the emitter before being emitted",
+		Buckets:   prometheus.DefBuckets,
+	},
+		[]string{
+			"emitter",
+		},
+	)
+	emitterQueueDroppedMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nr_stats",
+		Subsystem: "emitter",
+		Name:      "dropped_metrics_total",
+		Help:      "Number of metrics dropped because the queue of the emitter was full or shut down, by emitter",
+	},
+		[]string{
+			"emitter",
+		},
+	)
+	counterResetsMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nr_stats",
+		Subsystem: "metrics",
+		Name:      "counter_resets_total",
+		Help:      "Number of resets of cumulative metrics detected from their start time, by target",
+	},
+		[]string{
+			"target",
+		},
+	)
+	remoteWriteQueueLengthMetric = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "nr_stats",
+		Subsystem: "remote_write",
+		Name:      "queue_length",
+		Help:      "Number of samples waiting to be sent by the remote_write emitter",
+	})
+	remoteWriteSamplesSentMetric = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "nr_stats",
+		Subsystem: "remote_write",
+		Name:      "samples_sent_total",
+		Help:      "Number of samples successfully sent by the remote_write emitter",
+	})
+	remoteWriteSamplesFailedMetric = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "nr_stats",
+		Subsystem: "remote_write",
+		Name:      "samples_failed_total",
+		Help:      "Number of samples dropped by the remote_write emitter after failing to send them",
+	})
+	remoteWriteSamplesDroppedMetric = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "nr_stats",
+		Subsystem: "remote_write",
+		Name:      "samples_dropped_total",
+		Help:      "Number of samples dropped by the remote_write emitter because its queue was full",
+	})
+	remoteWriteRetriesMetric = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "nr_stats",
+		Subsystem: "remote_write",
+		Name:      "retries_total",
+		Help:      "Number of remote_write requests retried",
+	})
 )
 
 func init() {
@@ -124,4 +277,24 @@ func init() {
 	prometheus.MustRegister(fetchTargetDurationMetric)
 	prometheus.MustRegister(processDurationMetric)
 	prometheus.MustRegister(totalExecutionsMetric)
+	prometheus.MustRegister(tlsCertificateExpiryMetric)
+	prometheus.MustRegister(scrapeRetriesMetric)
+	prometheus.MustRegister(circuitBreakerStateMetric)
+	prometheus.MustRegister(scrapesSkippedMetric)
+	prometheus.MustRegister(diskBufferBytesMetric)
+	prometheus.MustRegister(diskBufferReplayedMetric)
+	prometheus.MustRegister(diskBufferDroppedMetric)
+	prometheus.MustRegister(apiRateLimitedMetric)
+	prometheus.MustRegister(apiPayloadsSplitMetric)
+	prometheus.MustRegister(apiPayloadsDroppedMetric)
+	prometheus.MustRegister(harvestMetricCapMetric)
+	prometheus.MustRegister(emitterQueueLengthMetric)
+	prometheus.MustRegister(emitterQueueLatencyMetric)
+	prometheus.MustRegister(emitterQueueDroppedMetric)
+	prometheus.MustRegister(counterResetsMetric)
+	prometheus.MustRegister(remoteWriteQueueLengthMetric)
+	prometheus.MustRegister(remoteWriteSamplesSentMetric)
+	prometheus.MustRegister(remoteWriteSamplesFailedMetric)
+	prometheus.MustRegister(remoteWriteSamplesDroppedMetric)
+	prometheus.MustRegister(remoteWriteRetriesMetric)
 }
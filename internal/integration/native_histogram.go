@@ -0,0 +1,147 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package integration
+
+import (
+	"math"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+// isNativeHistogram returns true if the histogram has native (sparse)
+// buckets. Exporters always set the zero threshold or a span on them, even
+// when they have no observations.
+func isNativeHistogram(h *dto.Histogram) bool {
+	return len(h.GetPositiveSpan()) > 0 ||
+		len(h.GetNegativeSpan()) > 0 ||
+		h.GetZeroThreshold() > 0 ||
+		h.GetZeroCount() > 0 ||
+		h.GetZeroCountFloat() > 0
+}
+
+// histogramCount returns the number of observations of the histogram, which
+// native histograms with float counts store in a different field.
+func histogramCount(h *dto.Histogram) uint64 {
+	if h.GetSampleCountFloat() > 0 {
+		return uint64(math.Round(h.GetSampleCountFloat()))
+	}
+	return h.GetSampleCount()
+}
+
+// histogramBuckets returns the classic buckets of the histogram. Native
+// histograms exposed without classic buckets are converted to them, so they
+// can be reported to backends lacking native histogram support.
+func histogramBuckets(h *dto.Histogram) []*dto.Bucket {
+	if len(h.GetBucket()) > 0 || !isNativeHistogram(h) {
+		return h.GetBucket()
+	}
+	return nativeToClassicBuckets(h)
+}
+
+// classicHistogram returns the histogram itself when it has classic buckets
+// or a copy with the native buckets converted to classic ones.
+func classicHistogram(h *dto.Histogram) *dto.Histogram {
+	if len(h.GetBucket()) > 0 || !isNativeHistogram(h) {
+		return h
+	}
+	classic := proto.Clone(h).(*dto.Histogram)
+	classic.Bucket = nativeToClassicBuckets(h)
+	return classic
+}
+
+type nativeBucket struct {
+	index int32
+	count float64
+}
+
+// nativeToClassicBuckets converts the exponential buckets of a native
+// histogram into cumulative buckets. With schema s, the positive bucket of
+// index i holds the observations in (base^(i-1), base^i], where
+// base = 2^(2^-s), and the negative ones mirror them. The zero bucket holds
+// the observations in [-zero_threshold, zero_threshold].
+func nativeToClassicBuckets(h *dto.Histogram) []*dto.Bucket {
+	isFloat := h.GetSampleCountFloat() > 0
+	schema := h.GetSchema()
+
+	var buckets []*dto.Bucket
+	var cumulative float64
+	add := func(upperBound float64) {
+		b := &dto.Bucket{
+			UpperBound:      proto.Float64(upperBound),
+			CumulativeCount: proto.Uint64(uint64(math.Round(cumulative))),
+		}
+		if isFloat {
+			b.CumulativeCountFloat = proto.Float64(cumulative)
+		}
+		buckets = append(buckets, b)
+	}
+
+	// Negative buckets go first, from the highest to the lowest magnitude.
+	negative := nativeBucketCounts(h.GetNegativeSpan(), h.GetNegativeDelta(), h.GetNegativeCount())
+	for i := len(negative) - 1; i >= 0; i-- {
+		cumulative += negative[i].count
+		add(-nativeBucketUpperBound(schema, negative[i].index-1))
+	}
+
+	zeroCount := float64(h.GetZeroCount())
+	if isFloat {
+		zeroCount = h.GetZeroCountFloat()
+	}
+	if zeroCount > 0 || len(negative) > 0 {
+		cumulative += zeroCount
+		add(h.GetZeroThreshold())
+	}
+
+	for _, b := range nativeBucketCounts(h.GetPositiveSpan(), h.GetPositiveDelta(), h.GetPositiveCount()) {
+		cumulative += b.count
+		add(nativeBucketUpperBound(schema, b.index))
+	}
+
+	if isFloat {
+		cumulative = h.GetSampleCountFloat()
+	} else {
+		cumulative = float64(h.GetSampleCount())
+	}
+	add(math.Inf(1))
+	return buckets
+}
+
+// nativeBucketCounts returns the index and absolute count of every bucket
+// described by the spans. Integer histograms encode each count as a delta to
+// the previous bucket, while float histograms store absolute counts.
+func nativeBucketCounts(spans []*dto.BucketSpan, deltas []int64, counts []float64) []nativeBucket {
+	var buckets []nativeBucket
+	var index int32
+	var count int64
+	n := 0
+	for i, span := range spans {
+		if i == 0 {
+			index = span.GetOffset()
+		} else {
+			index += span.GetOffset()
+		}
+		for j := uint32(0); j < span.GetLength(); j++ {
+			var c float64
+			switch {
+			case n < len(deltas):
+				count += deltas[n]
+				c = float64(count)
+			case n < len(counts):
+				c = counts[n]
+			default:
+				return buckets
+			}
+			buckets = append(buckets, nativeBucket{index: index, count: c})
+			index++
+			n++
+		}
+	}
+	return buckets
+}
+
+// nativeBucketUpperBound returns base^index for the schema.
+func nativeBucketUpperBound(schema int32, index int32) float64 {
+	return math.Exp2(float64(index) * math.Exp2(-float64(schema)))
+}
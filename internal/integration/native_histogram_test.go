@@ -0,0 +1,196 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package integration
+
+import (
+	"math"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	promcli "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
+	"github.com/newrelic/nri-prometheus/internal/pkg/prometheus"
+)
+
+// classicBuckets returns the buckets as upper bound => cumulative count.
+func classicBuckets(buckets []*dto.Bucket) map[float64]uint64 {
+	m := map[float64]uint64{}
+	for _, b := range buckets {
+		m[b.GetUpperBound()] = b.GetCumulativeCount()
+	}
+	return m
+}
+
+func TestNativeToClassicBuckets(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name     string
+		hist     *dto.Histogram
+		expected map[float64]uint64
+	}{
+		{
+			name: "integer counts",
+			hist: &dto.Histogram{
+				SampleCount:   proto.Uint64(10),
+				SampleSum:     proto.Float64(12),
+				Schema:        proto.Int32(0),
+				ZeroThreshold: proto.Float64(0.001),
+				ZeroCount:     proto.Uint64(1),
+				// Buckets (-4,-2] and (-2,-1].
+				NegativeSpan:  []*dto.BucketSpan{{Offset: proto.Int32(1), Length: proto.Uint32(2)}},
+				NegativeDelta: []int64{1, 1},
+				// Buckets (0.5,1], (1,2] and (4,8], with 2, 1 and 3 observations.
+				PositiveSpan: []*dto.BucketSpan{
+					{Offset: proto.Int32(0), Length: proto.Uint32(2)},
+					{Offset: proto.Int32(1), Length: proto.Uint32(1)},
+				},
+				PositiveDelta: []int64{2, -1, 2},
+			},
+			expected: map[float64]uint64{
+				-2:          2,
+				-1:          3,
+				0.001:       4,
+				1:           6,
+				2:           7,
+				8:           10,
+				math.Inf(1): 10,
+			},
+		},
+		{
+			name: "float counts and schema 1",
+			hist: &dto.Histogram{
+				SampleCountFloat: proto.Float64(3.5),
+				SampleSum:        proto.Float64(5),
+				Schema:           proto.Int32(1),
+				ZeroThreshold:    proto.Float64(0),
+				PositiveSpan:     []*dto.BucketSpan{{Offset: proto.Int32(1), Length: proto.Uint32(2)}},
+				PositiveCount:    []float64{1.5, 2},
+			},
+			expected: map[float64]uint64{
+				math.Sqrt2:  2,
+				2:           4,
+				math.Inf(1): 4,
+			},
+		},
+		{
+			name: "no observations",
+			hist: &dto.Histogram{
+				SampleCount:   proto.Uint64(0),
+				SampleSum:     proto.Float64(0),
+				Schema:        proto.Int32(3),
+				ZeroThreshold: proto.Float64(math.Pow(2, -128)),
+				PositiveSpan:  []*dto.BucketSpan{{Offset: proto.Int32(0), Length: proto.Uint32(0)}},
+			},
+			expected: map[float64]uint64{
+				math.Inf(1): 0,
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			require.True(t, isNativeHistogram(tc.hist))
+			buckets := histogramBuckets(tc.hist)
+			got := classicBuckets(buckets)
+			require.Len(t, got, len(tc.expected))
+			for bound, count := range tc.expected {
+				assert.InDelta(t, bound, findBound(got, bound), 1e-9)
+				assert.Equal(t, count, got[findBound(got, bound)], "bucket le=%g", bound)
+			}
+			for i := 1; i < len(buckets); i++ {
+				assert.Less(t, buckets[i-1].GetUpperBound(), buckets[i].GetUpperBound())
+			}
+		})
+	}
+}
+
+// findBound returns the key of the map closest to the bound, to compare
+// computed bounds without depending on rounding.
+func findBound(m map[float64]uint64, bound float64) float64 {
+	closest := math.NaN()
+	for k := range m {
+		if math.IsNaN(closest) || math.Abs(k-bound) < math.Abs(closest-bound) || k == bound {
+			closest = k
+		}
+	}
+	return closest
+}
+
+func TestHistogramBuckets_Classic(t *testing.T) {
+	t.Parallel()
+
+	hist, err := newHistogram([]int64{1, 2, 3})
+	require.NoError(t, err)
+	assert.False(t, isNativeHistogram(hist))
+	assert.Equal(t, hist.GetBucket(), histogramBuckets(hist))
+	assert.Same(t, hist, classicHistogram(hist))
+}
+
+func TestFetcher_NativeHistograms(t *testing.T) {
+	t.Parallel()
+
+	reg := promcli.NewRegistry()
+	h := promcli.NewHistogram(promcli.HistogramOpts{
+		Name:                        "request_duration_seconds",
+		Help:                        "A native histogram.",
+		NativeHistogramBucketFactor: 2,
+	})
+	reg.MustRegister(h)
+	for _, v := range []float64{0.3, 1.5, 1.5, 3} {
+		h.Observe(v)
+	}
+
+	ts := httptest.NewServer(promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	defer ts.Close()
+
+	retriever, err := endpoints.FixedRetriever(endpoints.TargetConfig{URLs: []string{ts.URL}})
+	require.NoError(t, err)
+	targets, err := retriever.GetTargets()
+	require.NoError(t, err)
+
+	accept := prometheus.ProtobufAcceptHeader + ",text/plain;version=0.0.4;q=0.5"
+	dir := t.TempDir()
+	recorder, err := NewScrapeRecorder(dir)
+	require.NoError(t, err)
+	fetcher := NewFetcher(time.Millisecond, time.Second, accept, workerThreads, "", "", true, queueLength, WithScrapeRecorder(recorder))
+	pairs := collectTargetMetrics(t, fetcher.Fetch(targets))
+	require.Len(t, pairs, 1)
+	require.Len(t, pairs[0].Metrics, 1)
+
+	m := pairs[0].Metrics[0]
+	assert.Equal(t, metricType_HISTOGRAM, m.metricType)
+	hist, ok := m.value.(*dto.Histogram)
+	require.True(t, ok)
+	require.True(t, isNativeHistogram(hist), "the native buckets must be kept in the metric")
+	assert.Equal(t, int32(0), hist.GetSchema())
+
+	// Exporters join spans separated by small gaps with empty buckets.
+	assert.Equal(t, map[float64]uint64{
+		0.5:         1,
+		1:           1,
+		2:           3,
+		4:           4,
+		math.Inf(1): 4,
+	}, classicBuckets(histogramBuckets(hist)))
+
+	// Protobuf payloads survive being recorded and replayed.
+	replay, err := NewScrapeReplay(dir, 0)
+	require.NoError(t, err)
+	replayTargets, err := replay.Retriever().GetTargets()
+	require.NoError(t, err)
+	replayed := collectTargetMetrics(t, replay.Fetcher().Fetch(replayTargets))
+	require.Len(t, replayed, 1)
+	assert.Equal(t, classicBuckets(histogramBuckets(hist)), classicBuckets(histogramBuckets(replayed[0].Metrics[0].value.(*dto.Histogram))))
+}
@@ -0,0 +1,537 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package integration
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	defaultRemoteWriteConcurrency       = 4
+	defaultRemoteWriteQueueCapacity     = 10000
+	defaultRemoteWriteMaxSamplesPerSend = 2000
+	defaultRemoteWriteBatchSendDeadline = 5 * time.Second
+	defaultRemoteWriteTimeout           = 30 * time.Second
+	defaultRemoteWriteMaxRetries        = 10
+	defaultRemoteWriteMinBackoff        = 30 * time.Millisecond
+	defaultRemoteWriteMaxBackoff        = 5 * time.Second
+)
+
+// RemoteWriteEmitterConfig is the configuration required for the
+// `RemoteWriteEmitter`.
+type RemoteWriteEmitterConfig struct {
+	// URL of the remote_write endpoint, e.g. http://prometheus:9090/api/v1/write
+	URL string `mapstructure:"url"`
+	// Timeout for each remote_write request. Defaults to 30s.
+	Timeout time.Duration `mapstructure:"remote_timeout"`
+	// Concurrency is the number of shards sending requests in parallel. Samples of the same series
+	// always go through the same shard so they are delivered in order. Defaults to 4.
+	Concurrency int `mapstructure:"concurrency"`
+	// QueueCapacity is the number of samples buffered per shard. Samples emitted while the queue
+	// is full are dropped. Defaults to 10000.
+	QueueCapacity int `mapstructure:"queue_capacity"`
+	// MaxSamplesPerSend is the maximum number of samples sent in a single request. Defaults to 2000.
+	MaxSamplesPerSend int `mapstructure:"max_samples_per_send"`
+	// BatchSendDeadline is the maximum time a sample waits in the queue before being sent. Defaults to 5s.
+	BatchSendDeadline time.Duration `mapstructure:"batch_send_deadline"`
+	// MaxRetries is the number of times a failed request is retried before its samples are dropped.
+	// Defaults to 10 when unset, and 0 disables the retries.
+	MaxRetries *int `mapstructure:"max_retries"`
+	// MinBackoff is the initial wait between retries, doubled on every attempt. Defaults to 30ms.
+	MinBackoff time.Duration `mapstructure:"min_backoff"`
+	// MaxBackoff is the maximum wait between retries. Defaults to 5s.
+	MaxBackoff time.Duration `mapstructure:"max_backoff"`
+
+	BasicAuth       BasicAuthConfig   `mapstructure:"basic_auth"`
+	BearerToken     string            `mapstructure:"bearer_token"`
+	BearerTokenFile string            `mapstructure:"bearer_token_file"`
+	Headers         map[string]string `mapstructure:"headers"`
+
+	CaFile             string `mapstructure:"ca_file"`
+	InsecureSkipVerify bool   `mapstructure:"insecure_skip_verify"`
+}
+
+// BasicAuthConfig holds the credentials used for HTTP basic authentication.
+// PasswordFile takes precedence over Password and is read on every request.
+type BasicAuthConfig struct {
+	Username     string `mapstructure:"username"`
+	Password     string `mapstructure:"password"`
+	PasswordFile string `mapstructure:"password_file"`
+}
+
+// RemoteWriteEmitter sends metrics to a Prometheus remote_write compatible
+// endpoint. Metrics are queued and sent asynchronously in batches.
+type RemoteWriteEmitter struct {
+	name   string
+	cfg    RemoteWriteEmitterConfig
+	client *http.Client
+	shards []chan rwSample
+	wg     sync.WaitGroup
+	log    *logrus.Entry
+	// ctx is the stop context of the shards, cancelling their requests and
+	// retries once the shutdown deadline passes.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// rwSample is a single remote_write sample with its full label set. Labels are sorted by name
+// and include the `__name__` label.
+type rwSample struct {
+	labels    []rwLabel
+	value     float64
+	timestamp int64
+}
+
+type rwLabel struct {
+	name  string
+	value string
+}
+
+// NewRemoteWriteEmitter returns a RemoteWriteEmitter and starts its sending shards.
+func NewRemoteWriteEmitter(cfg RemoteWriteEmitterConfig) (*RemoteWriteEmitter, error) {
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("remote_write url is required")
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = defaultRemoteWriteTimeout
+	}
+	if cfg.Concurrency <= 0 {
+		cfg.Concurrency = defaultRemoteWriteConcurrency
+	}
+	if cfg.QueueCapacity <= 0 {
+		cfg.QueueCapacity = defaultRemoteWriteQueueCapacity
+	}
+	if cfg.MaxSamplesPerSend <= 0 {
+		cfg.MaxSamplesPerSend = defaultRemoteWriteMaxSamplesPerSend
+	}
+	if cfg.BatchSendDeadline == 0 {
+		cfg.BatchSendDeadline = defaultRemoteWriteBatchSendDeadline
+	}
+	if cfg.MaxRetries == nil {
+		maxRetries := defaultRemoteWriteMaxRetries
+		cfg.MaxRetries = &maxRetries
+	}
+	if cfg.MinBackoff == 0 {
+		cfg.MinBackoff = defaultRemoteWriteMinBackoff
+	}
+	if cfg.MaxBackoff == 0 {
+		cfg.MaxBackoff = defaultRemoteWriteMaxBackoff
+	}
+
+	tlsConfig, err := NewTLSConfig(cfg.CaFile, cfg.InsecureSkipVerify)
+	if err != nil {
+		return nil, fmt.Errorf("invalid remote_write TLS configuration: %w", err)
+	}
+	var rt http.RoundTripper = &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		MaxIdleConns:    cfg.Concurrency,
+		IdleConnTimeout: 5 * time.Minute,
+		TLSClientConfig: tlsConfig,
+	}
+	switch {
+	case cfg.BasicAuth.Username != "":
+		rt = newBasicAuthRoundTripper(cfg.BasicAuth, rt)
+	case cfg.BearerTokenFile != "":
+		rt = NewBearerAuthFileRoundTripper(cfg.BearerTokenFile, rt)
+	case cfg.BearerToken != "":
+		rt = newHeadersRoundTripper(map[string]string{"Authorization": "Bearer " + cfg.BearerToken}, rt)
+	}
+	if len(cfg.Headers) > 0 {
+		rt = newHeadersRoundTripper(cfg.Headers, rt)
+	}
+
+	e := &RemoteWriteEmitter{
+		name: "remote_write",
+		cfg:  cfg,
+		client: &http.Client{
+			Transport: rt,
+			Timeout:   cfg.Timeout,
+		},
+		shards: make([]chan rwSample, cfg.Concurrency),
+		log:    logrus.WithField("component", "RemoteWriteEmitter"),
+	}
+	e.ctx, e.cancel = context.WithCancel(context.Background())
+	for i := range e.shards {
+		e.shards[i] = make(chan rwSample, cfg.QueueCapacity)
+		e.wg.Add(1)
+		go e.runShard(e.ctx, e.shards[i])
+	}
+	return e, nil
+}
+
+// Name returns the emitter name.
+func (e *RemoteWriteEmitter) Name() string {
+	return e.name
+}
+
+// Emit converts the metrics into remote_write samples and queues them to be
+// sent. Histograms and summaries are expanded into their `_bucket`, `_sum`,
+// `_count` and quantile series. It never blocks: samples that don't fit in
+// the queue are dropped and reported in the self-metrics.
+func (e *RemoteWriteEmitter) Emit(metrics []Metric) error {
+	now := time.Now()
+
+	var dropped int
+	for _, metric := range metrics {
+		samples, err := remoteWriteSamples(metric, metricTimestamp(metric, now).UnixMilli())
+		if err != nil {
+			e.log.WithError(err).Debug("skipping metric")
+			continue
+		}
+		for _, s := range samples {
+			select {
+			case e.shards[s.shard(len(e.shards))] <- s:
+				remoteWriteQueueLengthMetric.Inc()
+			default:
+				dropped++
+			}
+		}
+	}
+
+	if dropped > 0 {
+		remoteWriteSamplesDroppedMetric.Add(float64(dropped))
+		return fmt.Errorf("remote_write queue is full, %d samples dropped", dropped)
+	}
+	return nil
+}
+
+// remoteWriteSamples expands a metric into the series it is made of in the
+// Prometheus data model.
+func remoteWriteSamples(metric Metric, timestamp int64) ([]rwSample, error) {
+	var lbls []rwLabel
+	switch metric.metricType {
+	case metricType_SUMMARY:
+		lbls = remoteWriteLabels(metric.attributes, "quantile")
+	case metricType_HISTOGRAM, metricType_GAUGEHISTOGRAM:
+		lbls = remoteWriteLabels(metric.attributes, "le")
+	default:
+		lbls = remoteWriteLabels(metric.attributes)
+	}
+	sample := func(name string, value float64, extra ...rwLabel) rwSample {
+		return newRWSample(name, lbls, extra, value, timestamp)
+	}
+
+	switch metric.metricType {
+	case metricType_GAUGE, metricType_COUNTER:
+		return []rwSample{sample(metric.name, metric.value.(float64))}, nil
+	case metricType_SUMMARY:
+		summary, ok := metric.value.(*dto.Summary)
+		if !ok {
+			return nil, fmt.Errorf("unknown summary metric type for %q: %T", metric.name, metric.value)
+		}
+		samples := make([]rwSample, 0, len(summary.GetQuantile())+2)
+		for _, q := range summary.GetQuantile() {
+			samples = append(samples, sample(metric.name, q.GetValue(), rwLabel{"quantile", formatFloat(q.GetQuantile())}))
+		}
+		samples = append(samples,
+			sample(metric.name+"_sum", summary.GetSampleSum()),
+			sample(metric.name+"_count", float64(summary.GetSampleCount())),
+		)
+		return samples, nil
+	case metricType_HISTOGRAM, metricType_GAUGEHISTOGRAM:
+		hist, ok := metric.value.(*dto.Histogram)
+		if !ok {
+			return nil, fmt.Errorf("unknown histogram metric type for %q: %T", metric.name, metric.value)
+		}
+		// Gauge histograms name their sum and count as OpenMetrics does.
+		sumName, countName := metric.name+"_sum", metric.name+"_count"
+		if metric.metricType == metricType_GAUGEHISTOGRAM {
+			sumName, countName = metric.name+"_gsum", metric.name+"_gcount"
+		}
+		// Native histograms are sent as classic buckets.
+		buckets := histogramBuckets(hist)
+		samples := make([]rwSample, 0, len(buckets)+3)
+		hasInf := false
+		for _, b := range buckets {
+			if math.IsInf(b.GetUpperBound(), +1) {
+				hasInf = true
+			}
+			samples = append(samples, sample(metric.name+"_bucket", float64(b.GetCumulativeCount()), rwLabel{"le", formatFloat(b.GetUpperBound())}))
+		}
+		// The +Inf bucket is mandatory in the Prometheus data model, but it can be omitted by some exporters.
+		if !hasInf {
+			samples = append(samples, sample(metric.name+"_bucket", float64(histogramCount(hist)), rwLabel{"le", "+Inf"}))
+		}
+		samples = append(samples,
+			sample(sumName, hist.GetSampleSum()),
+			sample(countName, float64(histogramCount(hist))),
+		)
+		return samples, nil
+	default:
+		return nil, fmt.Errorf("unknown metric type %q", metric.metricType)
+	}
+}
+
+// remoteWriteLabels converts the metric attributes into valid Prometheus labels.
+// The attributes added only for New Relic are left out, and so are the empty
+// ones, which Prometheus doesn't tell from missing labels. As Prometheus does:
+//   - the values of the attributes whose names are sanitized into the same
+//     label are joined with `;`, in the order of the attribute names.
+//   - the attributes named as `__name__` or as the reserved labels the series
+//     of the metric get, such as `le`, are renamed with the `exported_` prefix.
+func remoteWriteLabels(attributes map[string]interface{}, reserved ...string) []rwLabel {
+	keys := make([]string, 0, len(attributes))
+	for k := range attributes {
+		if _, ok := removedAttributes[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	lbls := make([]rwLabel, 0, len(keys))
+	indexes := make(map[string]int, len(keys))
+	for _, k := range keys {
+		value := fmt.Sprint(attributes[k])
+		if value == "" {
+			continue
+		}
+		name := sanitizeLabelName(k)
+		if name == "__name__" || contains(reserved, name) {
+			name = "exported_" + name
+		}
+		if i, ok := indexes[name]; ok {
+			lbls[i].value += ";" + value
+			continue
+		}
+		indexes[name] = len(lbls)
+		lbls = append(lbls, rwLabel{name: name, value: value})
+	}
+	return lbls
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func newRWSample(name string, lbls, extra []rwLabel, value float64, timestamp int64) rwSample {
+	all := make([]rwLabel, 0, len(lbls)+len(extra)+1)
+	all = append(all, rwLabel{name: "__name__", value: name})
+	all = append(all, lbls...)
+	all = append(all, extra...)
+	sort.Slice(all, func(i, j int) bool { return all[i].name < all[j].name })
+	return rwSample{labels: all, value: value, timestamp: timestamp}
+}
+
+// shard returns the shard index for the sample series, so all the samples of
+// a series are sent in order by the same shard.
+func (s rwSample) shard(n int) int {
+	h := fnv.New32a()
+	for _, l := range s.labels {
+		_, _ = h.Write([]byte(l.name))
+		_, _ = h.Write([]byte{0xff})
+		_, _ = h.Write([]byte(l.value))
+		_, _ = h.Write([]byte{0xff})
+	}
+	return int(h.Sum32() % uint32(n))
+}
+
+// sanitizeLabelName replaces the characters not allowed in a Prometheus label
+// name with underscores, e.g. `k8s.cluster.name` becomes `k8s_cluster_name`.
+func sanitizeLabelName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+func formatFloat(f float64) string {
+	return fmt.Sprintf("%g", f)
+}
+
+// runShard batches the samples received from the queue and sends them when
+// MaxSamplesPerSend is reached or BatchSendDeadline has passed.
+func (e *RemoteWriteEmitter) runShard(ctx context.Context, queue <-chan rwSample) {
+	defer e.wg.Done()
+
+	ticker := time.NewTicker(e.cfg.BatchSendDeadline)
+	defer ticker.Stop()
+
+	pending := make([]rwSample, 0, e.cfg.MaxSamplesPerSend)
+	for {
+		select {
+		case s, ok := <-queue:
+			if !ok {
+				if len(pending) > 0 {
+					e.send(ctx, pending)
+				}
+				return
+			}
+			remoteWriteQueueLengthMetric.Dec()
+			pending = append(pending, s)
+			if len(pending) >= e.cfg.MaxSamplesPerSend {
+				e.send(ctx, pending)
+				pending = pending[:0]
+			}
+		case <-ticker.C:
+			if len(pending) > 0 {
+				e.send(ctx, pending)
+				pending = pending[:0]
+			}
+		}
+	}
+}
+
+// send writes the batch to the remote endpoint, retrying with an exponential
+// backoff on network errors and on 5xx and 429 responses. The Retry-After
+// header of 429 responses takes precedence over the backoff. It gives up once
+// the context is done.
+func (e *RemoteWriteEmitter) send(ctx context.Context, samples []rwSample) {
+	body := snappy.Encode(nil, encodeWriteRequest(samples))
+
+	backoff := e.cfg.MinBackoff
+	for attempt := 0; ; attempt++ {
+		retry, retryAfter, err := e.post(ctx, body)
+		if err == nil {
+			remoteWriteSamplesSentMetric.Add(float64(len(samples)))
+			return
+		}
+		if !retry || attempt >= *e.cfg.MaxRetries || ctx.Err() != nil {
+			e.log.WithError(err).Warnf("dropping %d samples after %d attempts", len(samples), attempt+1)
+			remoteWriteSamplesFailedMetric.Add(float64(len(samples)))
+			return
+		}
+		wait := backoff
+		if retryAfter > 0 {
+			wait = retryAfter
+		}
+		e.log.WithError(err).Debugf("remote_write request failed, retrying in %s", wait)
+		remoteWriteRetriesMetric.Inc()
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			e.log.WithError(ctx.Err()).Warnf("dropping %d samples after %d attempts", len(samples), attempt+1)
+			remoteWriteSamplesFailedMetric.Add(float64(len(samples)))
+			return
+		}
+		backoff *= 2
+		if backoff > e.cfg.MaxBackoff {
+			backoff = e.cfg.MaxBackoff
+		}
+	}
+}
+
+// post sends a single remote_write request. It returns whether the request
+// is worth retrying when it fails, and the time to wait before retrying set
+// by the endpoint, if any.
+func (e *RemoteWriteEmitter) post(ctx context.Context, body []byte) (bool, time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, 0, err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", Name+"/"+Version)
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return true, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 == 2 {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		return false, 0, nil
+	}
+
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("remote_write endpoint returned %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	if resp.StatusCode == http.StatusTooManyRequests {
+		var retryAfter time.Duration
+		if value := resp.Header.Get("Retry-After"); value != "" {
+			retryAfter = parseRetryAfter(value, time.Now())
+		}
+		return true, retryAfter, err
+	}
+	return resp.StatusCode/100 == 5, 0, err
+}
+
+// encodeWriteRequest encodes the samples as a remote_write WriteRequest
+// protobuf message:
+//
+//	message WriteRequest { repeated TimeSeries timeseries = 1; }
+//	message TimeSeries   { repeated Label labels = 1; repeated Sample samples = 2; }
+//	message Label        { string name = 1; string value = 2; }
+//	message Sample       { double value = 1; int64 timestamp = 2; }
+func encodeWriteRequest(samples []rwSample) []byte {
+	var req, ts, buf []byte
+	for _, s := range samples {
+		ts = ts[:0]
+		for _, l := range s.labels {
+			buf = buf[:0]
+			buf = protowire.AppendTag(buf, 1, protowire.BytesType)
+			buf = protowire.AppendString(buf, l.name)
+			buf = protowire.AppendTag(buf, 2, protowire.BytesType)
+			buf = protowire.AppendString(buf, l.value)
+			ts = protowire.AppendTag(ts, 1, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, buf)
+		}
+		buf = buf[:0]
+		buf = protowire.AppendTag(buf, 1, protowire.Fixed64Type)
+		buf = protowire.AppendFixed64(buf, math.Float64bits(s.value))
+		buf = protowire.AppendTag(buf, 2, protowire.VarintType)
+		buf = protowire.AppendVarint(buf, uint64(s.timestamp))
+		ts = protowire.AppendTag(ts, 2, protowire.BytesType)
+		ts = protowire.AppendBytes(ts, buf)
+
+		req = protowire.AppendTag(req, 1, protowire.BytesType)
+		req = protowire.AppendBytes(req, ts)
+	}
+	return req
+}
+
+// Stop stops the emitter shards after sending the samples that are already
+// queued. The emitter must not be used after calling Stop.
+func (e *RemoteWriteEmitter) Stop() {
+	_ = e.Shutdown(context.Background())
+}
+
+// Shutdown is like Stop, but it waits for the queued samples to be sent until
+// the context is done, cancelling then the requests and retries in progress
+// and dropping the samples left.
+func (e *RemoteWriteEmitter) Shutdown(ctx context.Context) error {
+	for _, shard := range e.shards {
+		close(shard)
+	}
+	stopped := make(chan struct{})
+	go func() {
+		e.wg.Wait()
+		close(stopped)
+	}()
+
+	defer e.cancel()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		e.cancel()
+		<-stopped
+		return fmt.Errorf("sending the queued samples: %w", ctx.Err())
+	}
+}
@@ -0,0 +1,368 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package integration
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+)
+
+// remoteWriteReceiver is a fake remote_write endpoint that stores the
+// received series as `name{label="value",...}` => value.
+type remoteWriteReceiver struct {
+	mtx      sync.Mutex
+	series   map[string]float64
+	requests []*http.Request
+	status   func(n int) int
+}
+
+func (r *remoteWriteReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	r.requests = append(r.requests, req)
+	if r.status != nil {
+		if status := r.status(len(r.requests)); status != http.StatusNoContent {
+			w.WriteHeader(status)
+			return
+		}
+	}
+
+	compressed, _ := ioutil.ReadAll(req.Body)
+	body, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	for name, value := range decodeWriteRequest(body) {
+		r.series[name] = value
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (r *remoteWriteReceiver) received() map[string]float64 {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.series
+}
+
+func decodeWriteRequest(b []byte) map[string]float64 {
+	series := map[string]float64{}
+	forEachField(b, func(_ protowire.Number, ts []byte) {
+		var name string
+		var lbls []string
+		var value float64
+		forEachField(ts, func(num protowire.Number, v []byte) {
+			switch num {
+			case 1:
+				var l [2]string
+				forEachField(v, func(num protowire.Number, v []byte) { l[num-1] = string(v) })
+				if l[0] == "__name__" {
+					name = l[1]
+				} else {
+					lbls = append(lbls, fmt.Sprintf("%s=%q", l[0], l[1]))
+				}
+			case 2:
+				_, typ, n := protowire.ConsumeTag(v)
+				if typ == protowire.Fixed64Type {
+					bits, _ := protowire.ConsumeFixed64(v[n:])
+					value = math.Float64frombits(bits)
+				}
+			}
+		})
+		sort.Strings(lbls)
+		series[name+"{"+strings.Join(lbls, ",")+"}"] = value
+	})
+	return series
+}
+
+// forEachField calls fn with the content of every length-delimited field of the message.
+func forEachField(b []byte, fn func(protowire.Number, []byte)) {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		b = b[n:]
+		if typ != protowire.BytesType {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			b = b[n:]
+			continue
+		}
+		v, n := protowire.ConsumeBytes(b)
+		fn(num, v)
+		b = b[n:]
+	}
+}
+
+func TestRemoteWriteEmitter_Emit(t *testing.T) {
+	t.Parallel()
+
+	receiver := &remoteWriteReceiver{series: map[string]float64{}}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	hist, err := newHistogram([]int64{1, 2, 3})
+	require.NoError(t, err)
+	summary, err := newSummary(3, 10, []*quantile{{0.5, 10}, {0.999, 100}})
+	require.NoError(t, err)
+
+	attrs := labels.Set{
+		"k8s.cluster.name": "my-cluster",
+		"nrMetricType":     "gauge",
+		"promMetricType":   "gauge",
+	}
+	metrics := []Metric{
+		{name: "a_gauge", metricType: metricType_GAUGE, value: float64(3), attributes: attrs},
+		{name: "a_counter_total", metricType: metricType_COUNTER, value: float64(42), attributes: attrs},
+		{name: "a_histogram", metricType: metricType_HISTOGRAM, value: hist, attributes: attrs},
+		{name: "a_summary", metricType: metricType_SUMMARY, value: summary, attributes: attrs},
+	}
+
+	e, err := NewRemoteWriteEmitter(RemoteWriteEmitterConfig{
+		URL:       server.URL,
+		BasicAuth: BasicAuthConfig{Username: "user", Password: "pass"},
+		Headers:   map[string]string{"X-Scope-OrgID": "tenant"},
+	})
+	require.NoError(t, err)
+	require.NoError(t, e.Emit(metrics))
+	e.Stop()
+
+	assert.Equal(t, map[string]float64{
+		`a_gauge{k8s_cluster_name="my-cluster"}`:                      3,
+		`a_counter_total{k8s_cluster_name="my-cluster"}`:              42,
+		`a_histogram_bucket{k8s_cluster_name="my-cluster",le="0"}`:    1,
+		`a_histogram_bucket{k8s_cluster_name="my-cluster",le="1"}`:    2,
+		`a_histogram_bucket{k8s_cluster_name="my-cluster",le="+Inf"}`: 3,
+		`a_histogram_sum{k8s_cluster_name="my-cluster"}`:              3,
+		`a_histogram_count{k8s_cluster_name="my-cluster"}`:            3,
+		`a_summary{k8s_cluster_name="my-cluster",quantile="0.5"}`:     10,
+		`a_summary{k8s_cluster_name="my-cluster",quantile="0.999"}`:   100,
+		`a_summary_sum{k8s_cluster_name="my-cluster"}`:                10,
+		`a_summary_count{k8s_cluster_name="my-cluster"}`:              3,
+	}, receiver.received())
+
+	require.NotEmpty(t, receiver.requests)
+	req := receiver.requests[0]
+	assert.Equal(t, "snappy", req.Header.Get("Content-Encoding"))
+	assert.Equal(t, "application/x-protobuf", req.Header.Get("Content-Type"))
+	assert.Equal(t, "tenant", req.Header.Get("X-Scope-OrgID"))
+	user, pass, ok := req.BasicAuth()
+	assert.True(t, ok)
+	assert.Equal(t, "user", user)
+	assert.Equal(t, "pass", pass)
+}
+
+func TestRemoteWriteSamples_Labels(t *testing.T) {
+	t.Parallel()
+
+	hist, err := newHistogram([]int64{1, 2})
+	require.NoError(t, err)
+	summary, err := newSummary(1, 10, []*quantile{{0.5, 10}})
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name       string
+		metricType metricType
+		value      interface{}
+		attributes labels.Set
+		expected   []string
+	}{
+		{
+			name:       "sanitized names colliding are joined",
+			metricType: metricType_GAUGE,
+			value:      float64(1),
+			attributes: labels.Set{"a.b": "1", "a_b": "2", "a-b": "3"},
+			expected:   []string{`a{a_b="3;1;2"}`},
+		},
+		{
+			name:       "empty values are dropped",
+			metricType: metricType_GAUGE,
+			value:      float64(1),
+			attributes: labels.Set{"empty": "", "c": "d"},
+			expected:   []string{`a{c="d"}`},
+		},
+		{
+			name:       "reserved names are exported",
+			metricType: metricType_GAUGE,
+			value:      float64(1),
+			attributes: labels.Set{"__name__": "b", "le": "10"},
+			expected:   []string{`a{exported___name__="b",le="10"}`},
+		},
+		{
+			name:       "bucket labels take precedence",
+			metricType: metricType_HISTOGRAM,
+			value:      hist,
+			attributes: labels.Set{"le": "10"},
+			expected: []string{
+				`a_bucket{exported_le="10",le="0"}`,
+				`a_bucket{exported_le="10",le="+Inf"}`,
+				`a_sum{exported_le="10"}`,
+				`a_count{exported_le="10"}`,
+			},
+		},
+		{
+			name:       "quantile labels take precedence",
+			metricType: metricType_SUMMARY,
+			value:      summary,
+			attributes: labels.Set{"quantile": "0.9"},
+			expected: []string{
+				`a{exported_quantile="0.9",quantile="0.5"}`,
+				`a_sum{exported_quantile="0.9"}`,
+				`a_count{exported_quantile="0.9"}`,
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			samples, err := remoteWriteSamples(Metric{name: "a", metricType: tc.metricType, value: tc.value, attributes: tc.attributes}, 0)
+			require.NoError(t, err)
+			series := make([]string, 0, len(samples))
+			for s := range decodeWriteRequest(encodeWriteRequest(samples)) {
+				series = append(series, s)
+			}
+			assert.ElementsMatch(t, tc.expected, series)
+		})
+	}
+}
+
+func TestRemoteWriteEmitter_Retries(t *testing.T) {
+	t.Parallel()
+
+	noRetries := 0
+	testCases := []struct {
+		name       string
+		status     int
+		maxRetries *int
+		requests   int
+		received   int
+	}{
+		{name: "server errors are retried", status: http.StatusServiceUnavailable, requests: 3, received: 1},
+		{name: "rate limits are retried", status: http.StatusTooManyRequests, requests: 3, received: 1},
+		{name: "client errors are not retried", status: http.StatusBadRequest, requests: 1, received: 0},
+		{name: "retries are disabled", status: http.StatusServiceUnavailable, maxRetries: &noRetries, requests: 1, received: 0},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			var calls int32
+			receiver := &remoteWriteReceiver{
+				series: map[string]float64{},
+				status: func(n int) int {
+					atomic.AddInt32(&calls, 1)
+					if n < 3 {
+						return tc.status
+					}
+					return http.StatusNoContent
+				},
+			}
+			server := httptest.NewServer(receiver)
+			defer server.Close()
+
+			e, err := NewRemoteWriteEmitter(RemoteWriteEmitterConfig{
+				URL:        server.URL,
+				MaxRetries: tc.maxRetries,
+				MinBackoff: time.Millisecond,
+				MaxBackoff: time.Millisecond,
+			})
+			require.NoError(t, err)
+			require.NoError(t, e.Emit([]Metric{
+				{name: "a_gauge", metricType: metricType_GAUGE, value: float64(1), attributes: labels.Set{}},
+			}))
+			e.Stop()
+
+			assert.EqualValues(t, tc.requests, atomic.LoadInt32(&calls))
+			assert.Len(t, receiver.received(), tc.received)
+		})
+	}
+}
+
+func TestRemoteWriteEmitter_RetryAfter(t *testing.T) {
+	t.Parallel()
+
+	var times []time.Time
+	var lock sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		times = append(times, time.Now())
+		if len(times) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	e, err := NewRemoteWriteEmitter(RemoteWriteEmitterConfig{
+		URL:        server.URL,
+		MinBackoff: time.Millisecond,
+		MaxBackoff: time.Millisecond,
+	})
+	require.NoError(t, err)
+	require.NoError(t, e.Emit([]Metric{
+		{name: "a_gauge", metricType: metricType_GAUGE, value: float64(1), attributes: labels.Set{}},
+	}))
+	e.Stop()
+
+	lock.Lock()
+	defer lock.Unlock()
+	require.Len(t, times, 2)
+	assert.GreaterOrEqual(t, times[1].Sub(times[0]), time.Second, "the retry waits for Retry-After instead of the backoff")
+}
+
+func TestRemoteWriteEmitter_Shutdown(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	e, err := NewRemoteWriteEmitter(RemoteWriteEmitterConfig{
+		URL:        server.URL,
+		MinBackoff: time.Hour,
+		MaxBackoff: time.Hour,
+	})
+	require.NoError(t, err)
+	require.NoError(t, e.Emit([]Metric{
+		{name: "a_gauge", metricType: metricType_GAUGE, value: float64(1), attributes: labels.Set{}},
+	}))
+
+	// The retries waiting for the backoff are cancelled at the deadline.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	assert.Error(t, e.Shutdown(ctx))
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestRemoteWriteEmitter_RequiresURL(t *testing.T) {
+	t.Parallel()
+
+	_, err := NewRemoteWriteEmitter(RemoteWriteEmitterConfig{})
+	assert.Error(t, err)
+}
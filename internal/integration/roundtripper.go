@@ -3,7 +3,14 @@
 
 package integration
 
-import "net/http"
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
 
 // licenseKeyRoundTripper adds the infra license key to every request.
 type licenseKeyRoundTripper struct {
@@ -34,3 +41,89 @@ func newLicenseKeyRoundTripper(
 		rt:         rt,
 	}
 }
+
+// headersRoundTripper sets a fixed set of headers to every request, unless
+// they have already been set.
+type headersRoundTripper struct {
+	headers map[string]string
+	rt      http.RoundTripper
+}
+
+// newHeadersRoundTripper wraps the given http.RoundTripper adding the headers
+// to every request.
+func newHeadersRoundTripper(headers map[string]string, rt http.RoundTripper) http.RoundTripper {
+	return &headersRoundTripper{headers: headers, rt: rt}
+}
+
+func (t *headersRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = cloneRequest(req)
+	for k, v := range t.headers {
+		if req.Header.Get(k) == "" {
+			req.Header.Set(k, v)
+		}
+	}
+	return t.rt.RoundTrip(req)
+}
+
+// basicAuthRoundTripper adds HTTP basic authentication to every request
+// unless the authorization header has already been set. If a password file
+// is configured it is read for every request, so rotated credentials are
+// picked up without restarting.
+type basicAuthRoundTripper struct {
+	cfg BasicAuthConfig
+	rt  http.RoundTripper
+}
+
+// newBasicAuthRoundTripper wraps the given http.RoundTripper adding the basic
+// auth credentials to every request.
+func newBasicAuthRoundTripper(cfg BasicAuthConfig, rt http.RoundTripper) http.RoundTripper {
+	return &basicAuthRoundTripper{cfg: cfg, rt: rt}
+}
+
+func (t *basicAuthRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if len(req.Header.Get("Authorization")) != 0 {
+		return t.rt.RoundTrip(req)
+	}
+
+	password := t.cfg.Password
+	if t.cfg.PasswordFile != "" {
+		b, err := ioutil.ReadFile(t.cfg.PasswordFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read basic auth password file %s: %s", t.cfg.PasswordFile, err)
+		}
+		password = strings.TrimSpace(string(b))
+	}
+
+	req = cloneRequest(req)
+	req.SetBasicAuth(t.cfg.Username, password)
+	return t.rt.RoundTrip(req)
+}
+
+// oauth2RoundTripper adds the token of an OAuth2 source to every request
+// unless the authorization header has already been set. Sources cache their
+// tokens until they expire.
+type oauth2RoundTripper struct {
+	source oauth2.TokenSource
+	rt     http.RoundTripper
+}
+
+// newOAuth2RoundTripper wraps the given http.RoundTripper adding the tokens
+// of the source to every request.
+func newOAuth2RoundTripper(source oauth2.TokenSource, rt http.RoundTripper) http.RoundTripper {
+	return &oauth2RoundTripper{source: source, rt: rt}
+}
+
+func (t *oauth2RoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if len(req.Header.Get("Authorization")) != 0 {
+		return t.rt.RoundTrip(req)
+	}
+
+	token, err := t.source.Token()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get oauth2 token: %w", err)
+	}
+
+	req = cloneRequest(req)
+	token.SetAuthHeader(req)
+	return t.rt.RoundTrip(req)
+}
@@ -4,6 +4,7 @@
 package integration
 
 import (
+	"context"
 	"strings"
 
 	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
@@ -273,6 +274,42 @@ func filter(targetMetrics *TargetMetrics, rules ignoreRules) {
 // by another channel
 type Processor func(pairs <-chan TargetMetrics) <-chan TargetMetrics
 
+// A ContextProcessor is a Processor that stops processing the metrics once the
+// context is done, closing the channel it returns.
+type ContextProcessor func(ctx context.Context, pairs <-chan TargetMetrics) <-chan TargetMetrics
+
+// ProcessorWithContext returns the processor as a ContextProcessor. The metrics
+// received once the context is done aren't passed to the processor, but they
+// are still read so the fetcher sending them isn't blocked.
+func ProcessorWithContext(p Processor) ContextProcessor {
+	return func(ctx context.Context, pairs <-chan TargetMetrics) <-chan TargetMetrics {
+		forwarded := make(chan TargetMetrics)
+		go func() {
+			defer close(forwarded)
+			for {
+				select {
+				case pair, ok := <-pairs:
+					if !ok {
+						return
+					}
+					select {
+					case forwarded <- pair:
+						continue
+					case <-ctx.Done():
+					}
+				case <-ctx.Done():
+				}
+				go func() {
+					for range pairs {
+					}
+				}()
+				return
+			}
+		}()
+		return p(forwarded)
+	}
+}
+
 // RuleProcessor process apply the Rename, Decorate and Filter metrics
 // processing and returns them through a channel.
 func RuleProcessor(processingRules []ProcessingRule, queueLength int) Processor {
@@ -5,10 +5,12 @@
 package integration
 
 import (
+	"context"
 	"fmt"
 	"net/url"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -613,3 +615,30 @@ func TestIgnoreRules_MatchingExceptRulesTakesPriorityOverOtherRules(t *testing.T
 	assert.Len(t, actual, 1)
 	assert.Contains(t, actual, "redis_instance_info")
 }
+
+func TestProcessorWithContext(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	pairs := make(chan TargetMetrics)
+	processed := ProcessorWithContext(RuleProcessor(nil, 0))(ctx, pairs)
+
+	pairs <- TargetMetrics{Metrics: []Metric{{name: "first"}}}
+	pair := <-processed
+	assert.Equal(t, "first", pair.Metrics[0].name)
+
+	// Once cancelled, the metrics are discarded but still read.
+	cancel()
+	select {
+	case _, ok := <-processed:
+		assert.False(t, ok, "no metrics are processed once cancelled")
+	case <-time.After(5 * time.Second):
+		t.Fatal("the processor didn't stop")
+	}
+	select {
+	case pairs <- TargetMetrics{Metrics: []Metric{{name: "second"}}}:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the metrics aren't read once cancelled")
+	}
+	close(pairs)
+}
@@ -0,0 +1,207 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package integration
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+	"unicode/utf8"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+	"github.com/newrelic/nri-prometheus/internal/pkg/prometheus"
+)
+
+const (
+	scrapeRecordingExtension  = ".json"
+	scrapeRecordingTimeLayout = "20060102T150405.000000000"
+)
+
+var invalidPathChars = regexp.MustCompile(`[^a-zA-Z0-9._-]`)
+
+// scrapeRecording is a raw scrape response together with the target it was
+// scraped from, as stored by the ScrapeRecorder.
+type scrapeRecording struct {
+	Timestamp   time.Time      `json:"timestamp"`
+	Target      recordedTarget `json:"target"`
+	StatusCode  int            `json:"status_code"`
+	ContentType string         `json:"content_type,omitempty"`
+	// ContentEncoding is the encoding the body is compressed with, if any.
+	ContentEncoding string `json:"content_encoding,omitempty"`
+	Body            string `json:"body"`
+	// BinaryBody holds bodies that aren't valid UTF-8, like protobuf
+	// payloads, which JSON strings can't hold. It is encoded as base64.
+	BinaryBody []byte `json:"binary_body,omitempty"`
+}
+
+func (r scrapeRecording) body() []byte {
+	if r.BinaryBody != nil {
+		return r.BinaryBody
+	}
+	return []byte(r.Body)
+}
+
+type recordedTarget struct {
+	Name       string     `json:"name"`
+	URL        string     `json:"url"`
+	ObjectName string     `json:"object_name"`
+	ObjectKind string     `json:"object_kind"`
+	Labels     labels.Set `json:"labels,omitempty"`
+	UseBearer  bool       `json:"use_bearer,omitempty"`
+}
+
+func newRecordedTarget(t endpoints.Target) recordedTarget {
+	// The password is redacted in the metadata, so the recordings don't
+	// store credentials.
+	targetURL, _ := t.Metadata()["scrapedTargetURL"].(string)
+	return recordedTarget{
+		Name:       t.Name,
+		URL:        targetURL,
+		ObjectName: t.Object.Name,
+		ObjectKind: t.Object.Kind,
+		Labels:     t.Object.Labels,
+		UseBearer:  t.UseBearer,
+	}
+}
+
+func (rt recordedTarget) target() (endpoints.Target, error) {
+	u, err := url.Parse(rt.URL)
+	if err != nil {
+		return endpoints.Target{}, fmt.Errorf("invalid recorded target URL %q: %w", rt.URL, err)
+	}
+	lbls := rt.Labels
+	if lbls == nil {
+		lbls = labels.Set{}
+	}
+	return endpoints.Target{
+		Name: rt.Name,
+		Object: endpoints.Object{
+			Name:   rt.ObjectName,
+			Kind:   rt.ObjectKind,
+			Labels: lbls,
+		},
+		URL:       *u,
+		UseBearer: rt.UseBearer,
+	}, nil
+}
+
+// ScrapeRecorder stores the raw body of every successful scrape, together with
+// the time and the target it was scraped from, so the scrapes can be replayed
+// later with a ScrapeReplay. Each recording is written to its own JSON file in
+// a directory per target.
+type ScrapeRecorder struct {
+	dir string
+	log *logrus.Entry
+}
+
+// NewScrapeRecorder returns a ScrapeRecorder storing the recordings in dir.
+func NewScrapeRecorder(dir string) (*ScrapeRecorder, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("creating recordings directory: %w", err)
+	}
+	return &ScrapeRecorder{
+		dir: dir,
+		log: logrus.WithField("component", "ScrapeRecorder"),
+	}, nil
+}
+
+// doer returns an HTTPDoer keeping the responses of the target received
+// through the next HTTPDoer, to be recorded once the scrape succeeds.
+func (sr *ScrapeRecorder) doer(t endpoints.Target, next prometheus.HTTPDoer) *recordingDoer {
+	return &recordingDoer{recorder: sr, target: t, next: next}
+}
+
+func (sr *ScrapeRecorder) record(rec scrapeRecording) error {
+	dir := filepath.Join(sr.dir, invalidPathChars.ReplaceAllString(rec.Target.Name, "_"))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	name := rec.Timestamp.UTC().Format(scrapeRecordingTimeLayout) + scrapeRecordingExtension
+	return ioutil.WriteFile(filepath.Join(dir, name), b, 0o644)
+}
+
+type recordingDoer struct {
+	recorder *ScrapeRecorder
+	target   endpoints.Target
+	next     prometheus.HTTPDoer
+	// last is the body of the last response.
+	last *recordingBody
+}
+
+// Do keeps a copy of the body of the response as the scrape reads it, so it
+// goes through the same body and sample limits.
+func (d *recordingDoer) Do(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	d.last = nil
+	resp, err := d.next.Do(req)
+	if err != nil {
+		return resp, err
+	}
+
+	d.last = &recordingBody{
+		ReadCloser: resp.Body,
+		rec: scrapeRecording{
+			Timestamp:   start,
+			Target:      newRecordedTarget(d.target),
+			StatusCode:  resp.StatusCode,
+			ContentType: resp.Header.Get("Content-Type"),
+			// Bodies are recorded as received, so compressed ones stay so.
+			ContentEncoding: resp.Header.Get("Content-Encoding"),
+		},
+	}
+	resp.Body = d.last
+	return resp, nil
+}
+
+// save records the last response, once the scrape succeeded. Bodies that
+// weren't read to the end aren't recorded.
+func (d *recordingDoer) save() {
+	if d.last == nil || !d.last.eof {
+		return
+	}
+	rec := d.last.rec
+	body := d.last.buf.Bytes()
+	if utf8.Valid(body) {
+		rec.Body = string(body)
+	} else {
+		rec.BinaryBody = body
+	}
+	if err := d.recorder.record(rec); err != nil {
+		d.recorder.log.WithError(err).WithField("target", d.target.Name).Warn("error recording scrape")
+	}
+	d.last = nil
+}
+
+// recordingBody keeps a copy of the body read.
+type recordingBody struct {
+	io.ReadCloser
+	rec scrapeRecording
+	buf bytes.Buffer
+	eof bool
+}
+
+func (b *recordingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.buf.Write(p[:n])
+	if err == io.EOF {
+		b.eof = true
+	}
+	return n, err
+}
@@ -0,0 +1,282 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package integration
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
+	"github.com/newrelic/nri-prometheus/internal/pkg/prometheus"
+)
+
+// ScrapeReplay serves the scrapes stored by a ScrapeRecorder through a
+// TargetRetriever and Fetcher pair, so the processing rules and emitters can
+// be run offline against real payloads. Every fetch of a target returns its
+// next recording, and the recordings are released at the pace they were
+// recorded at, divided by the replay speed.
+type ScrapeReplay struct {
+	speed float64
+	log   *logrus.Entry
+	sleep func(time.Duration)
+
+	mtx        sync.Mutex
+	targets    []endpoints.Target
+	recordings map[string][]scrapeRecording
+	// origin is the time of the first recording and start the time it was
+	// replayed at.
+	origin time.Time
+	start  time.Time
+}
+
+// NewScrapeReplay loads the recordings stored in dir. A speed of 1 replays
+// them at the original pace, 10 ten times faster, and 0 or less as fast as
+// possible.
+func NewScrapeReplay(dir string, speed float64) (*ScrapeReplay, error) {
+	var files []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && filepath.Ext(path) == scrapeRecordingExtension {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading recordings directory: %w", err)
+	}
+
+	var recordings []scrapeRecording
+	for _, f := range files {
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("reading recording: %w", err)
+		}
+		var rec scrapeRecording
+		if err := json.Unmarshal(b, &rec); err != nil {
+			return nil, fmt.Errorf("decoding recording %s: %w", f, err)
+		}
+		recordings = append(recordings, rec)
+	}
+	if len(recordings) == 0 {
+		return nil, fmt.Errorf("no recordings found in %s", dir)
+	}
+	sort.SliceStable(recordings, func(i, j int) bool {
+		return recordings[i].Timestamp.Before(recordings[j].Timestamp)
+	})
+
+	sr := &ScrapeReplay{
+		speed:      speed,
+		log:        logrus.WithField("component", "ScrapeReplay"),
+		sleep:      time.Sleep,
+		recordings: map[string][]scrapeRecording{},
+		origin:     recordings[0].Timestamp,
+	}
+	for _, rec := range recordings {
+		key := replayKey(rec.Target.Name, rec.Target.URL)
+		if _, ok := sr.recordings[key]; !ok {
+			t, err := rec.Target.target()
+			if err != nil {
+				return nil, err
+			}
+			sr.targets = append(sr.targets, t)
+		}
+		sr.recordings[key] = append(sr.recordings[key], rec)
+	}
+	return sr, nil
+}
+
+func replayKey(name, url string) string {
+	return name + "\xff" + url
+}
+
+// Done returns true when all the recordings have been replayed.
+func (sr *ScrapeReplay) Done() bool {
+	sr.mtx.Lock()
+	defer sr.mtx.Unlock()
+	for _, recs := range sr.recordings {
+		if len(recs) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Retriever returns a TargetRetriever returning the recorded targets that
+// still have recordings to replay.
+func (sr *ScrapeReplay) Retriever() endpoints.TargetRetriever {
+	return &replayRetriever{replay: sr}
+}
+
+// Fetcher returns a Fetcher serving the recordings of the targets. The
+// recordings go through the same decoding, limits, ignore rules and chunking
+// as the original scrapes, as configured by the options. They aren't
+// recorded again nor retried.
+func (sr *ScrapeReplay) Fetcher(opts ...FetcherOption) Fetcher {
+	pf := &prometheusFetcher{
+		transports: newTargetTransports(),
+		now:        time.Now,
+		scrape:     prometheus.ScrapeContext,
+		log:        sr.log,
+	}
+	for _, opt := range opts {
+		opt(pf)
+	}
+	pf.recorder = nil
+	pf.retries = ScrapeRetries{}
+	return &replayFetcher{replay: sr, fetcher: pf}
+}
+
+// next returns the next recording of the target, if any.
+func (sr *ScrapeReplay) next(t endpoints.Target) (scrapeRecording, bool) {
+	sr.mtx.Lock()
+	defer sr.mtx.Unlock()
+
+	key := replayKey(t.Name, newRecordedTarget(t).URL)
+	recs := sr.recordings[key]
+	if len(recs) == 0 {
+		return scrapeRecording{}, false
+	}
+	sr.recordings[key] = recs[1:]
+	return recs[0], true
+}
+
+// wait blocks until the recording is due at the replay speed.
+func (sr *ScrapeReplay) wait(rec scrapeRecording) {
+	if sr.speed <= 0 {
+		return
+	}
+
+	sr.mtx.Lock()
+	offset := time.Duration(float64(rec.Timestamp.Sub(sr.origin)) / sr.speed)
+	due := sr.started().Add(offset)
+	sr.mtx.Unlock()
+
+	if d := time.Until(due); d > 0 {
+		sr.sleep(d)
+	}
+}
+
+// scrapeTime returns the time the recording is replayed as scraped at: the
+// time it was recorded at, shifted by the time between the first recording
+// and the start of the replay. The time between the recordings is kept
+// whatever the replay speed.
+func (sr *ScrapeReplay) scrapeTime(rec scrapeRecording) time.Time {
+	sr.mtx.Lock()
+	defer sr.mtx.Unlock()
+	return rec.Timestamp.Add(sr.started().Sub(sr.origin))
+}
+
+// started returns the time the replay started at, starting it if it didn't.
+// The lock must be held.
+func (sr *ScrapeReplay) started() time.Time {
+	if sr.start.IsZero() {
+		sr.start = time.Now()
+	}
+	return sr.start
+}
+
+type replayRetriever struct {
+	replay *ScrapeReplay
+}
+
+func (r *replayRetriever) GetTargets() ([]endpoints.Target, error) {
+	r.replay.mtx.Lock()
+	defer r.replay.mtx.Unlock()
+
+	var targets []endpoints.Target
+	for _, t := range r.replay.targets {
+		if len(r.replay.recordings[replayKey(t.Name, newRecordedTarget(t).URL)]) > 0 {
+			targets = append(targets, t)
+		}
+	}
+	return targets, nil
+}
+
+func (r *replayRetriever) Watch() error {
+	// NOOP
+	return nil
+}
+
+func (r *replayRetriever) Name() string {
+	return "replay"
+}
+
+type replayFetcher struct {
+	replay  *ScrapeReplay
+	fetcher *prometheusFetcher
+}
+
+// Fetch serves the next recording of every target in the order they were
+// recorded. Targets without pending recordings are ignored.
+func (f *replayFetcher) Fetch(targets []endpoints.Target) <-chan TargetMetrics {
+	type replayed struct {
+		target    endpoints.Target
+		recording scrapeRecording
+	}
+	var pending []replayed
+	for _, t := range targets {
+		if rec, ok := f.replay.next(t); ok {
+			pending = append(pending, replayed{target: t, recording: rec})
+		}
+	}
+	sort.SliceStable(pending, func(i, j int) bool {
+		return pending[i].recording.Timestamp.Before(pending[j].recording.Timestamp)
+	})
+
+	results := make(chan TargetMetrics, len(pending))
+	go func() {
+		defer close(results)
+		for _, p := range pending {
+			f.replay.wait(p.recording)
+
+			// The recording is fetched like the original scrape, from a
+			// client answering with it. Replayed scrapes are emitted as
+			// current data, at the time of the recording shifted to the
+			// replay.
+			pf := *f.fetcher
+			pf.httpClient = &recordingServer{p.recording}
+			pf.bearerClient = pf.httpClient
+			scrapeTime := f.replay.scrapeTime(p.recording)
+			pf.now = func() time.Time { return scrapeTime }
+			if err := pf.fetch(context.Background(), p.target, results); err != nil {
+				f.replay.log.WithError(err).WithField("target", p.target.Name).Warn("error replaying scrape")
+			}
+		}
+	}()
+	return results
+}
+
+// recordingServer is an HTTPDoer answering any request with the recording.
+type recordingServer struct {
+	recording scrapeRecording
+}
+
+func (s *recordingServer) Do(req *http.Request) (*http.Response, error) {
+	header := http.Header{}
+	if s.recording.ContentType != "" {
+		header.Set("Content-Type", s.recording.ContentType)
+	}
+	if s.recording.ContentEncoding != "" {
+		header.Set("Content-Encoding", s.recording.ContentEncoding)
+	}
+	return &http.Response{
+		StatusCode: s.recording.StatusCode,
+		Header:     header,
+		Body:       ioutil.NopCloser(bytes.NewReader(s.recording.body())),
+		Request:    req,
+	}, nil
+}
@@ -0,0 +1,302 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package integration
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
+	"github.com/newrelic/nri-prometheus/internal/pkg/prometheus"
+)
+
+func collectTargetMetrics(t *testing.T, ch <-chan TargetMetrics) []TargetMetrics {
+	t.Helper()
+
+	var pairs []TargetMetrics
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case pair, ok := <-ch:
+			if !ok {
+				sort.Slice(pairs, func(i, j int) bool { return pairs[i].Target.Name < pairs[j].Target.Name })
+				return pairs
+			}
+			sort.Slice(pair.Metrics, func(i, j int) bool {
+				return seriesKey(pair.Metrics[i].name, pair.Metrics[i].attributes) < seriesKey(pair.Metrics[j].name, pair.Metrics[j].attributes)
+			})
+			pairs = append(pairs, pair)
+		case <-timeout:
+			require.FailNow(t, "timeout waiting for the fetched metrics")
+		}
+	}
+}
+
+func withoutTimestamps(metrics []Metric) []Metric {
+	stripped := make([]Metric, 0, len(metrics))
+	for _, m := range metrics {
+		m.timestamp = time.Time{}
+		stripped = append(stripped, m)
+	}
+	return stripped
+}
+
+func TestScrapeRecordAndReplay(t *testing.T) {
+	t.Parallel()
+
+	scrapes := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scrapes++
+		_, _ = fmt.Fprintf(w, "%s# TYPE scrapes_total counter\nscrapes_total %d\n", prometheusInput, scrapes)
+	}))
+	defer ts.Close()
+
+	retriever, err := endpoints.FixedRetriever(endpoints.TargetConfig{URLs: []string{ts.URL}})
+	require.NoError(t, err)
+	targets, err := retriever.GetTargets()
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	recorder, err := NewScrapeRecorder(dir)
+	require.NoError(t, err)
+	fetcher := NewFetcher(time.Millisecond, time.Second, "", workerThreads, "", "", true, queueLength, WithScrapeRecorder(recorder))
+
+	var scraped [][]TargetMetrics
+	for i := 0; i < 2; i++ {
+		scraped = append(scraped, collectTargetMetrics(t, fetcher.Fetch(targets)))
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*", "*.json"))
+	require.NoError(t, err)
+	require.Len(t, files, 2)
+
+	replay, err := NewScrapeReplay(dir, 0)
+	require.NoError(t, err)
+	replayRetriever := replay.Retriever()
+
+	for i := 0; i < 2; i++ {
+		require.False(t, replay.Done())
+		replayTargets, err := replayRetriever.GetTargets()
+		require.NoError(t, err)
+		require.Len(t, replayTargets, 1)
+
+		replayed := collectTargetMetrics(t, replay.Fetcher().Fetch(replayTargets))
+		require.Len(t, replayed, 1)
+		// Replayed metrics are stamped with the recording time shifted to the
+		// replay.
+		assert.Equal(t, withoutTimestamps(scraped[i][0].Metrics), withoutTimestamps(replayed[0].Metrics))
+		assert.Equal(t, scraped[i][0].Target.Metadata(), replayed[0].Target.Metadata())
+	}
+
+	assert.True(t, replay.Done())
+	replayTargets, err := replayRetriever.GetTargets()
+	require.NoError(t, err)
+	assert.Empty(t, replayTargets)
+}
+
+func TestScrapeRecorder_Limits(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, prometheusInput)
+	}))
+	defer ts.Close()
+
+	retriever, err := endpoints.FixedRetriever(endpoints.TargetConfig{URLs: []string{ts.URL}})
+	require.NoError(t, err)
+	targets, err := retriever.GetTargets()
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	recorder, err := NewScrapeRecorder(dir)
+	require.NoError(t, err)
+
+	// Scrapes exceeding the limits aren't recorded.
+	limited := NewFetcher(time.Millisecond, time.Second, "", workerThreads, "", "", true, queueLength,
+		WithScrapeRecorder(recorder), WithScrapeLimits(prometheus.ScrapeLimits{MaxSamples: 1}))
+	assert.Empty(t, collectTargetMetrics(t, limited.Fetch(targets)))
+	files, err := filepath.Glob(filepath.Join(dir, "*", "*.json"))
+	require.NoError(t, err)
+	assert.Empty(t, files)
+
+	fetcher := NewFetcher(time.Millisecond, time.Second, "", workerThreads, "", "", true, queueLength,
+		WithScrapeRecorder(recorder), WithScrapeLimits(prometheus.ScrapeLimits{MaxBodySize: int64(len(prometheusInput))}))
+	require.Len(t, collectTargetMetrics(t, fetcher.Fetch(targets)), 1)
+	files, err = filepath.Glob(filepath.Join(dir, "*", "*.json"))
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+
+	replay, err := NewScrapeReplay(dir, 0)
+	require.NoError(t, err)
+	rec, ok := replay.next(targets[0])
+	require.True(t, ok)
+	assert.Equal(t, prometheusInput, rec.Body)
+}
+
+func TestScrapeReplay_Pace(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	recorder, err := NewScrapeRecorder(dir)
+	require.NoError(t, err)
+
+	start := time.Now()
+	for i, name := range []string{"a", "b", "a"} {
+		require.NoError(t, recorder.record(scrapeRecording{
+			Timestamp:  start.Add(time.Duration(i) * time.Minute),
+			Target:     recordedTarget{Name: name, URL: "http://" + name + "/metrics"},
+			StatusCode: http.StatusOK,
+			Body:       "# TYPE up gauge\nup 1\n",
+		}))
+	}
+
+	replay, err := NewScrapeReplay(dir, 60)
+	require.NoError(t, err)
+	var waits []time.Duration
+	replay.sleep = func(d time.Duration) { waits = append(waits, d) }
+
+	for !replay.Done() {
+		targets, err := replay.Retriever().GetTargets()
+		require.NoError(t, err)
+		collectTargetMetrics(t, replay.Fetcher().Fetch(targets))
+	}
+
+	// Recordings one minute apart are replayed one second apart. The first one
+	// is replayed right away and, since sleep returns immediately, the waits
+	// are counted from the start of the replay.
+	require.Len(t, waits, 2)
+	assert.InDelta(t, time.Second, waits[0], float64(100*time.Millisecond))
+	assert.InDelta(t, 2*time.Second, waits[1], float64(100*time.Millisecond))
+}
+
+func TestScrapeReplay_ScrapeTime(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	recorder, err := NewScrapeRecorder(dir)
+	require.NoError(t, err)
+
+	recorded := time.Now().Add(-24 * time.Hour)
+	for i := 0; i < 2; i++ {
+		require.NoError(t, recorder.record(scrapeRecording{
+			Timestamp:  recorded.Add(time.Duration(i) * time.Minute),
+			Target:     recordedTarget{Name: "a", URL: "http://a/metrics"},
+			StatusCode: http.StatusOK,
+			Body:       "# TYPE up gauge\nup 1\n",
+		}))
+	}
+
+	replay, err := NewScrapeReplay(dir, 0)
+	require.NoError(t, err)
+	var replayed []TargetMetrics
+	start := time.Now()
+	for !replay.Done() {
+		targets, err := replay.Retriever().GetTargets()
+		require.NoError(t, err)
+		replayed = append(replayed, collectTargetMetrics(t, replay.Fetcher().Fetch(targets))...)
+	}
+
+	// The first recording is replayed as scraped when the replay starts, and
+	// the next ones as many time after as they were recorded.
+	require.Len(t, replayed, 2)
+	assert.WithinDuration(t, start, replayed[0].ScrapeTime, time.Second)
+	assert.Equal(t, time.Minute, replayed[1].ScrapeTime.Sub(replayed[0].ScrapeTime))
+	assert.Equal(t, replayed[1].ScrapeTime, replayed[1].Metrics[0].timestamp)
+}
+
+func TestScrapeReplay_Compressed(t *testing.T) {
+	t.Parallel()
+
+	var body bytes.Buffer
+	gw := gzip.NewWriter(&body)
+	_, err := gw.Write([]byte("# TYPE up gauge\nup 1\n"))
+	require.NoError(t, err)
+	require.NoError(t, gw.Close())
+
+	dir := t.TempDir()
+	recorder, err := NewScrapeRecorder(dir)
+	require.NoError(t, err)
+	require.NoError(t, recorder.record(scrapeRecording{
+		Timestamp:       time.Now(),
+		Target:          recordedTarget{Name: "a", URL: "http://a/metrics"},
+		StatusCode:      http.StatusOK,
+		ContentEncoding: "gzip",
+		BinaryBody:      body.Bytes(),
+	}))
+
+	replay, err := NewScrapeReplay(dir, 0)
+	require.NoError(t, err)
+	targets, err := replay.Retriever().GetTargets()
+	require.NoError(t, err)
+	replayed := collectTargetMetrics(t, replay.Fetcher().Fetch(targets))
+	require.Len(t, replayed, 1)
+	require.Len(t, replayed[0].Metrics, 1)
+	assert.Equal(t, "up", replayed[0].Metrics[0].name)
+}
+
+func TestScrapeReplay_FetcherOptions(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	recorder, err := NewScrapeRecorder(dir)
+	require.NoError(t, err)
+	bodies := map[string]string{
+		"a": "# TYPE up gauge\nup 1\n# TYPE ignored_total counter\nignored_total 2\n# TYPE temperature gauge\ntemperature 20\n",
+		"b": "# TYPE temperature gauge\ntemperature{room=\"1\"} 20\ntemperature{room=\"2\"} 21\ntemperature{room=\"3\"} 22\ntemperature{room=\"4\"} 23\n",
+	}
+	for name, body := range bodies {
+		require.NoError(t, recorder.record(scrapeRecording{
+			Timestamp:  time.Now(),
+			Target:     recordedTarget{Name: name, URL: "http://" + name + "/metrics"},
+			StatusCode: http.StatusOK,
+			Body:       body,
+		}))
+	}
+
+	replay, err := NewScrapeReplay(dir, 0)
+	require.NoError(t, err)
+	targets, err := replay.Retriever().GetTargets()
+	require.NoError(t, err)
+	fetcher := replay.Fetcher(
+		WithIgnoreRules([]IgnoreRule{{Prefixes: []string{"ignored"}}}),
+		WithChunkSize(2),
+		WithScrapeLimits(prometheus.ScrapeLimits{MaxSamples: 3}),
+	)
+
+	// The ignore rules, chunks and limits apply as they do to the scrapes.
+	// The recording of b exceeds the limits, so nothing is emitted for it.
+	replayed := collectTargetMetrics(t, fetcher.Fetch(targets))
+	require.Len(t, replayed, 2)
+	assert.Equal(t, "a", replayed[0].Target.Name)
+	assert.True(t, replayed[0].Partial)
+	require.Len(t, replayed[0].Metrics, 2)
+	assert.ElementsMatch(t, []string{"temperature", "up"}, []string{replayed[0].Metrics[0].name, replayed[0].Metrics[1].name})
+	assert.Equal(t, "a", replayed[1].Target.Name)
+	assert.False(t, replayed[1].Partial)
+	assert.Empty(t, replayed[1].Metrics)
+	assert.True(t, replay.Done())
+}
+
+func TestScrapeReplay_Empty(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	_, err := NewScrapeReplay(dir, 1)
+	assert.Error(t, err)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "broken.json"), []byte("{"), 0o644))
+	_, err = NewScrapeReplay(dir, 1)
+	assert.Error(t, err)
+}
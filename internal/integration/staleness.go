@@ -0,0 +1,194 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package integration
+
+import (
+	"fmt"
+	"sync"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
+)
+
+// staleSeriesEventType is the type of the events reporting that a series is
+// no longer exposed by its target, or that its target is gone.
+const staleSeriesEventType = "PrometheusStaleSeries"
+
+// TargetForgetter is implemented by the emitters that keep state about the
+// series of the targets, which they release when a target is removed.
+type TargetForgetter interface {
+	ForgetTarget(name string)
+}
+
+// forgetRemovedTargets tells the emitters about the known targets that are
+// not in the given ones, and replaces the known targets with them.
+func forgetRemovedTargets(known map[string]struct{}, targets []endpoints.Target, emitters []Emitter) {
+	current := make(map[string]struct{}, len(targets))
+	for _, t := range targets {
+		current[t.Name] = struct{}{}
+	}
+
+	for name := range known {
+		if _, ok := current[name]; ok {
+			continue
+		}
+		delete(known, name)
+		for _, e := range emitters {
+			if f, ok := e.(TargetForgetter); ok {
+				f.ForgetTarget(name)
+			}
+		}
+	}
+	for name := range current {
+		known[name] = struct{}{}
+	}
+}
+
+// seriesTracker keeps the series each target exposed in its last scrape, to
+// tell the ones that vanished since.
+type seriesTracker struct {
+	lock    sync.Mutex
+	targets map[string]map[string]Metric
+	// scraping has the series of the scrapes in progress, which can be
+	// emitted in chunks.
+	scraping map[string]map[string]Metric
+}
+
+func newSeriesTracker() *seriesTracker {
+	return &seriesTracker{
+		targets:  map[string]map[string]Metric{},
+		scraping: map[string]map[string]Metric{},
+	}
+}
+
+// add adds metrics to the scrape of the target in progress.
+func (st *seriesTracker) add(target string, metrics []Metric) {
+	if st == nil {
+		return
+	}
+
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	series := st.scraping[target]
+	if series == nil {
+		series = make(map[string]Metric, len(metrics))
+		st.scraping[target] = series
+	}
+	for _, m := range metrics {
+		series[seriesKey(m.name, m.attributes)] = m
+	}
+}
+
+// complete replaces the series of the target with the ones of the scrape in
+// progress, and returns the ones that are not in it anymore.
+func (st *seriesTracker) complete(target string) []Metric {
+	if st == nil {
+		return nil
+	}
+
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	series := st.scraping[target]
+	delete(st.scraping, target)
+
+	var vanished []Metric
+	for key, m := range st.targets[target] {
+		if _, ok := series[key]; !ok {
+			vanished = append(vanished, m)
+		}
+	}
+	st.targets[target] = series
+	return vanished
+}
+
+// abort drops the scrape of the target in progress.
+func (st *seriesTracker) abort(target string) {
+	if st == nil {
+		return
+	}
+
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	delete(st.scraping, target)
+}
+
+// update replaces the series of the targets of the metrics, which are
+// expected to hold all the series of a scrape, and returns the series of
+// those targets that are not in the metrics anymore.
+func (st *seriesTracker) update(metrics []Metric) []Metric {
+	if st == nil {
+		return nil
+	}
+
+	byTarget := map[string][]Metric{}
+	for _, m := range metrics {
+		target := metricTarget(m)
+		byTarget[target] = append(byTarget[target], m)
+	}
+
+	var vanished []Metric
+	for target, ms := range byTarget {
+		st.add(target, ms)
+		vanished = append(vanished, st.complete(target)...)
+	}
+	return vanished
+}
+
+// remove forgets a target and returns its series.
+func (st *seriesTracker) remove(target string) []Metric {
+	if st == nil {
+		return nil
+	}
+
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	series := st.targets[target]
+	delete(st.targets, target)
+	delete(st.scraping, target)
+
+	removed := make([]Metric, 0, len(series))
+	for _, m := range series {
+		removed = append(removed, m)
+	}
+	return removed
+}
+
+// metricTarget returns the name of the target the metric was scraped from.
+func metricTarget(m Metric) string {
+	target, _ := m.attributes["targetName"].(string)
+	return target
+}
+
+// deltaKeys returns the keys the deltaCalculator stores the values of the
+// cumulative metric with.
+func deltaKeys(m Metric) []string {
+	switch m.metricType {
+	case metricType_COUNTER:
+		return []string{seriesKey(m.name, m.attributes)}
+	case metricType_SUMMARY:
+		return []string{
+			seriesKey(m.name+"_sum", m.attributes),
+			seriesKey(m.name+"_count", m.attributes),
+		}
+	case metricType_HISTOGRAM:
+		keys := []string{
+			seriesKey(m.name+"_sum", m.attributes),
+			seriesKey(m.name+"_count", m.attributes),
+		}
+		if hist, ok := m.value.(*dto.Histogram); ok {
+			for _, b := range histogramBuckets(hist) {
+				bucketAttrs := copyAttrs(m.attributes)
+				bucketAttrs["le"] = fmt.Sprintf("%g", b.GetUpperBound())
+				keys = append(keys, seriesKey(m.name+"_bucket", bucketAttrs))
+			}
+		}
+		return keys
+	}
+	return nil
+}
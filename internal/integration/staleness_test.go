@@ -0,0 +1,148 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package integration
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+)
+
+type forgettingEmitter struct {
+	nilEmit
+	forgotten []string
+}
+
+func (e *forgettingEmitter) ForgetTarget(name string) {
+	e.forgotten = append(e.forgotten, name)
+}
+
+func TestForgetRemovedTargets(t *testing.T) {
+	t.Parallel()
+
+	e := &forgettingEmitter{}
+	known := map[string]struct{}{}
+	targets := func(names ...string) []endpoints.Target {
+		var ts []endpoints.Target
+		for _, n := range names {
+			ts = append(ts, endpoints.Target{Name: n})
+		}
+		return ts
+	}
+
+	forgetRemovedTargets(known, targets("a", "b"), []Emitter{e, &nilEmit{}})
+	assert.Empty(t, e.forgotten)
+
+	forgetRemovedTargets(known, targets("b", "c"), []Emitter{e, &nilEmit{}})
+	assert.Equal(t, []string{"a"}, e.forgotten)
+
+	forgetRemovedTargets(known, nil, []Emitter{e, &nilEmit{}})
+	assert.ElementsMatch(t, []string{"a", "b", "c"}, e.forgotten)
+	assert.Empty(t, known)
+}
+
+func TestTelemetryEmitter_Staleness(t *testing.T) {
+	t.Parallel()
+
+	counter := func(name, target string, value float64) Metric {
+		return Metric{
+			name:       name,
+			metricType: metricType_COUNTER,
+			value:      value,
+			attributes: labels.Set{"targetName": target},
+		}
+	}
+	hist, err := newHistogram([]int64{1, 2})
+	require.NoError(t, err)
+	histogram := Metric{
+		name:       "latency",
+		metricType: metricType_HISTOGRAM,
+		value:      hist,
+		attributes: labels.Set{"targetName": "first"},
+	}
+
+	h := &recordingHarvester{}
+	e := &TelemetryEmitter{
+		harvester:       h,
+		deltaCalculator: newDeltaCalculator(time.Hour, time.Hour),
+		series:          newSeriesTracker(),
+		staleness:       true,
+	}
+
+	require.NoError(t, e.Emit([]Metric{counter("requests", "first", 1), counter("errors", "first", 1), histogram}))
+	require.NoError(t, e.Emit([]Metric{counter("requests", "second", 1)}))
+	// Three counters, and the sum, count and buckets of the histogram.
+	assert.Equal(t, 3+2+len(histogramBuckets(hist)), e.deltaCalculator.len())
+	assert.Empty(t, h.events)
+
+	// The series that vanished from the target are released at once.
+	time.Sleep(time.Millisecond)
+	require.NoError(t, e.Emit([]Metric{counter("requests", "first", 2)}))
+	assert.Equal(t, 2, e.deltaCalculator.len())
+	require.Len(t, h.events, 2)
+	var stale []string
+	for _, ev := range h.events {
+		assert.Equal(t, staleSeriesEventType, ev.EventType)
+		assert.Equal(t, "first", ev.Attributes["targetName"])
+		stale = append(stale, ev.Attributes["metricName"].(string))
+	}
+	assert.ElementsMatch(t, []string{"errors", "latency"}, stale)
+
+	// And so are the ones of removed targets.
+	e.ForgetTarget("second")
+	assert.Equal(t, 1, e.deltaCalculator.len())
+	require.Len(t, h.events, 3)
+	assert.Equal(t, "second", h.events[2].Attributes["targetName"])
+
+	// Series coming back start over.
+	h.metrics = nil
+	require.NoError(t, e.Emit([]Metric{counter("requests", "second", 5)}))
+	assert.Empty(t, h.metrics)
+}
+
+func TestTelemetryEmitter_StalenessInChunks(t *testing.T) {
+	t.Parallel()
+
+	gauge := func(name string) Metric {
+		return Metric{
+			name:       name,
+			metricType: metricType_GAUGE,
+			value:      1.0,
+			attributes: labels.Set{"targetName": "target"},
+		}
+	}
+
+	h := &recordingHarvester{}
+	e := &TelemetryEmitter{
+		harvester:       h,
+		deltaCalculator: newDeltaCalculator(time.Hour, time.Hour),
+		series:          newSeriesTracker(),
+		staleness:       true,
+	}
+
+	require.NoError(t, e.EmitChunk("target", []Metric{gauge("a")}, false))
+	require.NoError(t, e.EmitChunk("target", []Metric{gauge("b")}, true))
+	assert.Empty(t, h.events)
+
+	// The series of every chunk are in the scrape, which completes with the
+	// last chunk even when it is empty.
+	require.NoError(t, e.EmitChunk("target", []Metric{gauge("a")}, false))
+	assert.Empty(t, h.events)
+	require.NoError(t, e.EmitChunk("target", nil, true))
+	require.Len(t, h.events, 1)
+	assert.Equal(t, "b", h.events[0].Attributes["metricName"])
+
+	// A failed scrape drops the series of its chunks, keeping the ones of the
+	// last scrape.
+	require.NoError(t, e.EmitChunk("target", []Metric{gauge("c")}, false))
+	e.AbortChunks("target")
+	require.NoError(t, e.EmitChunk("target", nil, true))
+	require.Len(t, h.events, 2)
+	assert.Equal(t, "a", h.events[1].Attributes["metricName"])
+}
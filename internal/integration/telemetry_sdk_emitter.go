@@ -12,7 +12,6 @@ import (
 	"net/url"
 	"time"
 
-	"github.com/newrelic/newrelic-telemetry-sdk-go/cumulative"
 	"github.com/newrelic/newrelic-telemetry-sdk-go/telemetry"
 	"github.com/pkg/errors"
 	dto "github.com/prometheus/client_model/go"
@@ -22,6 +21,7 @@ import (
 // Harvester aggregates and reports metrics and spans
 type harvester interface {
 	RecordMetric(m telemetry.Metric)
+	RecordEvent(e telemetry.Event) error
 	HarvestNow(ct context.Context)
 }
 
@@ -29,7 +29,18 @@ type harvester interface {
 type TelemetryEmitter struct {
 	name            string
 	harvester       harvester
-	deltaCalculator *cumulative.DeltaCalculator
+	deltaCalculator *deltaCalculator
+	resets          *resetDetector
+	series          *seriesTracker
+	exemplars       bool
+	staleness       bool
+	// sender is the harvester sending the recorded metrics, harvested when
+	// the emitter is shut down.
+	sender harvester
+	// bounded triggers the harvests, unless disabled.
+	bounded *boundedHarvester
+	// buffer stores the payloads that failed to be sent, when enabled.
+	buffer *diskBuffer
 }
 
 // TelemetryEmitterConfig is the configuration required for the
@@ -46,6 +57,19 @@ type TelemetryEmitterConfig struct {
 	// duration between checking for expirations. Defaults to 30s.
 	DeltaExpirationCheckInternval time.Duration
 
+	// Exemplars enables reporting the exemplars of the metrics as
+	// PrometheusExemplar events.
+	Exemplars bool
+
+	// StalenessEvents enables reporting the series that are no longer
+	// exposed by their targets, or whose targets were removed, as
+	// PrometheusStaleSeries events.
+	StalenessEvents bool
+
+	// DiskBuffer stores on disk the payloads that failed to be sent, and
+	// sends them once the APIs are reachable again.
+	DiskBuffer DiskBufferConfig
+
 	// boundedHarvester configuration
 	DisableBoundedHarvester bool
 	BoundedHarvesterCfg
@@ -62,6 +86,13 @@ func TelemetryHarvesterWithMetricsURL(url string) TelemetryHarvesterOpt {
 	}
 }
 
+// TelemetryHarvesterWithEventsURL sets the url to use for the events endpoint.
+func TelemetryHarvesterWithEventsURL(url string) TelemetryHarvesterOpt {
+	return func(config *telemetry.Config) {
+		config.EventsURLOverride = url
+	}
+}
+
 // TelemetryHarvesterWithHarvestPeriod sets harvest period.
 func telemetryHarvesterZeroPeriod(config *telemetry.Config) {
 	config.HarvestPeriod = 0
@@ -135,13 +166,10 @@ func TelemetryHarvesterWithProxy(proxyURL *url.URL) TelemetryHarvesterOpt {
 
 // NewTelemetryEmitter returns a new TelemetryEmitter.
 func NewTelemetryEmitter(cfg TelemetryEmitterConfig) (*TelemetryEmitter, error) {
-	dc := cumulative.NewDeltaCalculator()
-
 	deltaExpirationAge := defaultDeltaExpirationAge
 	if cfg.DeltaExpirationAge != 0 {
 		deltaExpirationAge = cfg.DeltaExpirationAge
 	}
-	dc.SetExpirationAge(deltaExpirationAge)
 	logrus.Debugf(
 		"telemetry emitter configured with delta counter expiration age: %s",
 		deltaExpirationAge,
@@ -151,21 +179,46 @@ func NewTelemetryEmitter(cfg TelemetryEmitterConfig) (*TelemetryEmitter, error)
 	if cfg.DeltaExpirationCheckInternval != 0 {
 		deltaExpirationCheckInterval = cfg.DeltaExpirationCheckInternval
 	}
-	dc.SetExpirationCheckInterval(deltaExpirationCheckInterval)
 	logrus.Debugf(
 		"telemetry emitter configured with delta counter expiration check interval: %s",
 		deltaExpirationCheckInterval,
 	)
 
+	opts := append(cfg.HarvesterOpts, telemetryHarvesterZeroPeriod)
+	// The limits and the buffer wrap the transport set by the other options,
+	// so the split and stored payloads are sent through them.
+	var limits *apiLimitsRoundTripper
+	opts = append(opts, func(config *telemetry.Config) {
+		limits = newAPILimitsRoundTripper(config.Client.Transport)
+		config.Client.Transport = limits
+	})
+	var buffer *diskBuffer
+	var bufferErr error
+	if cfg.DiskBuffer.Dir != "" {
+		opts = append(opts, func(config *telemetry.Config) {
+			buffer, bufferErr = newDiskBuffer(cfg.DiskBuffer, config.Client.Transport, config.APIKey)
+			if bufferErr == nil {
+				config.Client.Transport = buffer
+			}
+		})
+	}
+
 	var h harvester
-	h, err := telemetry.NewHarvester(append(cfg.HarvesterOpts, telemetryHarvesterZeroPeriod)...)
+	h, err := telemetry.NewHarvester(opts...)
 	if err != nil {
 		return nil, errors.Wrap(err, "could not create new Harvester")
 	}
+	if bufferErr != nil {
+		return nil, errors.Wrap(bufferErr, "could not create disk buffer")
+	}
 
+	sender := h
+	var bounded *boundedHarvester
 	if !cfg.DisableBoundedHarvester {
 		// Create a bound harvester based on passed configuration if going to run in a loop
-		h = bindHarvester(h, cfg.BoundedHarvesterCfg)
+		bounded = bindHarvester(h, cfg.BoundedHarvesterCfg).(*boundedHarvester)
+		limits.setLimiter(bounded)
+		h = bounded
 	}
 
 	// Wrap the harvester so we can filter out invalid float values: NaN and Infinity.
@@ -175,10 +228,31 @@ func NewTelemetryEmitter(cfg TelemetryEmitterConfig) (*TelemetryEmitter, error)
 	return &TelemetryEmitter{
 		name:            "telemetry",
 		harvester:       h,
-		deltaCalculator: dc,
+		deltaCalculator: newDeltaCalculator(deltaExpirationAge, deltaExpirationCheckInterval),
+		resets:          newResetDetector(deltaExpirationAge, deltaExpirationCheckInterval),
+		series:          newSeriesTracker(),
+		exemplars:       cfg.Exemplars,
+		staleness:       cfg.StalenessEvents,
+		sender:          sender,
+		bounded:         bounded,
+		buffer:          buffer,
 	}, nil
 }
 
+// Shutdown stops the periodic harvests and sends the recorded metrics,
+// waiting until they are sent or the context is done. When the disk buffer is
+// enabled, the payloads that can't be sent are kept in it for the next run.
+func (te *TelemetryEmitter) Shutdown(ctx context.Context) error {
+	if te.bounded != nil {
+		te.bounded.Stop()
+	}
+	te.sender.HarvestNow(ctx)
+	if te.buffer != nil {
+		te.buffer.close()
+	}
+	return ctx.Err()
+}
+
 // Name returns the emitter name.
 func (te *TelemetryEmitter) Name() string {
 	return te.name
@@ -187,32 +261,60 @@ func (te *TelemetryEmitter) Name() string {
 // Emit makes the mapping between Prometheus and NR metrics and records them
 // into the NR telemetry harvester.
 func (te *TelemetryEmitter) Emit(metrics []Metric) error {
-	var results error
+	// Metrics are recorded at the time they were scraped, or the one set by
+	// the exporter. Those built without one are recorded at a uniform time
+	// so processing is not reflected in the measurement that already took place.
+	now := time.Now()
+	err := te.record(metrics, now)
+	te.evict(te.series.update(metrics), now)
+	return err
+}
 
-	// Record metrics at a uniform time so processing is not reflected in
-	// the measurement that already took place.
+// EmitChunk records a chunk of the metrics of a scrape of the target. The
+// series that vanished from the target are known once the last chunk is
+// emitted.
+func (te *TelemetryEmitter) EmitChunk(target string, metrics []Metric, last bool) error {
 	now := time.Now()
+	err := te.record(metrics, now)
+	te.series.add(target, metrics)
+	if last {
+		te.evict(te.series.complete(target), now)
+	}
+	return err
+}
+
+// AbortChunks drops the series of the failed scrape of the target, keeping
+// the ones of its previous scrape.
+func (te *TelemetryEmitter) AbortChunks(target string) {
+	te.series.abort(target)
+}
+
+func (te *TelemetryEmitter) record(metrics []Metric, now time.Time) error {
+	var results error
 	for _, metric := range metrics {
+		timestamp := metricTimestamp(metric, now)
+		resetAt := te.resets.reset(metric)
 		switch metric.metricType {
 		case metricType_GAUGE:
 			te.harvester.RecordMetric(telemetry.Gauge{
 				Name:       metric.name,
 				Attributes: metric.attributes,
 				Value:      metric.value.(float64),
-				Timestamp:  now,
+				Timestamp:  timestamp,
 			})
 		case metricType_COUNTER:
-			m, ok := te.deltaCalculator.CountMetric(
+			m, ok := te.countMetric(
 				metric.name,
 				metric.attributes,
 				metric.value.(float64),
-				now,
+				timestamp,
+				resetAt,
 			)
 			if ok {
 				te.harvester.RecordMetric(m)
 			}
 		case metricType_SUMMARY:
-			if err := te.emitSummary(metric, now); err != nil {
+			if err := te.emitSummary(metric, timestamp, resetAt); err != nil {
 				if results == nil {
 					results = err
 				} else {
@@ -220,7 +322,15 @@ func (te *TelemetryEmitter) Emit(metrics []Metric) error {
 				}
 			}
 		case metricType_HISTOGRAM:
-			if err := te.emitHistogram(metric, now); err != nil {
+			if err := te.emitHistogram(metric, timestamp, resetAt); err != nil {
+				if results == nil {
+					results = err
+				} else {
+					results = fmt.Errorf("%v: %w", err, results)
+				}
+			}
+		case metricType_GAUGEHISTOGRAM:
+			if err := te.emitGaugeHistogram(metric, timestamp); err != nil {
 				if results == nil {
 					results = err
 				} else {
@@ -236,17 +346,88 @@ func (te *TelemetryEmitter) Emit(metrics []Metric) error {
 				}
 			}
 		}
+
+		if te.exemplars {
+			te.emitExemplars(metric, timestamp)
+		}
 	}
 	return results
 }
 
-func (te *TelemetryEmitter) emitSummary(metric Metric, timestamp time.Time) error {
+// ForgetTarget releases the state kept about the series of a removed target.
+func (te *TelemetryEmitter) ForgetTarget(name string) {
+	te.evict(te.series.remove(name), time.Now())
+}
+
+// evict releases the state kept about series that are gone, reporting them
+// as stale when enabled.
+func (te *TelemetryEmitter) evict(series []Metric, now time.Time) {
+	for _, m := range series {
+		te.deltaCalculator.forget(deltaKeys(m))
+		te.resets.forget(seriesKey(m.name, m.attributes))
+
+		if !te.staleness {
+			continue
+		}
+		attrs := copyAttrs(m.attributes)
+		attrs["metricName"] = m.name
+		err := te.harvester.RecordEvent(telemetry.Event{
+			EventType:  staleSeriesEventType,
+			Timestamp:  now,
+			Attributes: attrs,
+		})
+		if err != nil {
+			logrus.WithError(err).Debugf("failed to record stale series %q", m.name)
+		}
+	}
+}
+
+// emitExemplars records the exemplars of the metric as events, which can hold
+// the trace IDs without adding them to the attributes of the metric.
+func (te *TelemetryEmitter) emitExemplars(metric Metric, timestamp time.Time) {
+	for _, e := range metric.exemplars {
+		attrs, err := exemplarAttributes(metric, e)
+		if err != nil {
+			logrus.WithError(err).Debug("ignoring exemplar")
+			continue
+		}
+		err = te.harvester.RecordEvent(telemetry.Event{
+			EventType:  exemplarEventType,
+			Timestamp:  exemplarTimestamp(e, timestamp),
+			Attributes: attrs,
+		})
+		if err != nil {
+			logrus.WithError(err).Debugf("failed to record exemplar of %q", metric.name)
+		}
+	}
+}
+
+// countMetric returns the delta of a cumulative value since it was last
+// recorded. When the series was reset, the delta is the whole value, counted
+// since the reset.
+func (te *TelemetryEmitter) countMetric(name string, attributes map[string]interface{}, val float64, timestamp, resetAt time.Time) (telemetry.Count, bool) {
+	// The delta calculator always keeps the new value to compute the next
+	// delta from, including after a reset.
+	count, ok := te.deltaCalculator.CountMetric(name, attributes, val, timestamp)
+	if resetAt.IsZero() || !timestamp.After(resetAt) {
+		return count, ok
+	}
+	return telemetry.Count{
+		Name:       name,
+		Attributes: attributes,
+		Value:      val,
+		Timestamp:  resetAt,
+		Interval:   timestamp.Sub(resetAt),
+	}, true
+}
+
+func (te *TelemetryEmitter) emitSummary(metric Metric, timestamp, resetAt time.Time) error {
 	summary, ok := metric.value.(*dto.Summary)
 	if !ok {
 		return fmt.Errorf("unknown summary metric type for %q: %T", metric.name, metric.value)
 	}
 
-	if sumCount, ok := te.deltaCalculator.CountMetric(metric.name+"_sum", metric.attributes, float64(summary.GetSampleSum()), timestamp); ok {
+	if sumCount, ok := te.countMetric(metric.name+"_sum", metric.attributes, float64(summary.GetSampleSum()), timestamp, resetAt); ok {
 		te.harvester.RecordMetric(telemetry.Summary{
 			Name:       metric.name + "_sum",
 			Attributes: metric.attributes,
@@ -258,7 +439,7 @@ func (te *TelemetryEmitter) emitSummary(metric Metric, timestamp time.Time) erro
 		})
 	}
 
-	if count, ok := te.deltaCalculator.CountMetric(metric.name+"_count", metric.attributes, float64(summary.GetSampleCount()), timestamp); ok {
+	if count, ok := te.countMetric(metric.name+"_count", metric.attributes, float64(summary.GetSampleCount()), timestamp, resetAt); ok {
 		te.harvester.RecordMetric(count)
 	}
 
@@ -276,13 +457,13 @@ func (te *TelemetryEmitter) emitSummary(metric Metric, timestamp time.Time) erro
 	return nil
 }
 
-func (te *TelemetryEmitter) emitHistogram(metric Metric, timestamp time.Time) error {
+func (te *TelemetryEmitter) emitHistogram(metric Metric, timestamp, resetAt time.Time) error {
 	hist, ok := metric.value.(*dto.Histogram)
 	if !ok {
 		return fmt.Errorf("unknown histogram metric type for %q: %T", metric.name, metric.value)
 	}
 
-	if sumCount, ok := te.deltaCalculator.CountMetric(metric.name+"_sum", metric.attributes, float64(hist.GetSampleSum()), timestamp); ok {
+	if sumCount, ok := te.countMetric(metric.name+"_sum", metric.attributes, float64(hist.GetSampleSum()), timestamp, resetAt); ok {
 		te.harvester.RecordMetric(telemetry.Summary{
 			Name:       metric.name + "_sum",
 			Attributes: metric.attributes,
@@ -294,20 +475,23 @@ func (te *TelemetryEmitter) emitHistogram(metric Metric, timestamp time.Time) er
 		})
 	}
 
-	if count, ok := te.deltaCalculator.CountMetric(metric.name+"_count", metric.attributes, float64(hist.GetSampleCount()), timestamp); ok {
+	if count, ok := te.countMetric(metric.name+"_count", metric.attributes, float64(histogramCount(hist)), timestamp, resetAt); ok {
 		te.harvester.RecordMetric(count)
 	}
 
+	// Native histograms are reported as classic buckets, since the Metric API
+	// has no exponential histogram type.
 	metricName := metric.name + "_bucket"
-	for _, b := range hist.GetBucket() {
+	for _, b := range histogramBuckets(hist) {
 		bucketAttrs := copyAttrs(metric.attributes)
 		bucketAttrs["le"] = fmt.Sprintf("%g", b.GetUpperBound())
 
-		bucketCount, ok := te.deltaCalculator.CountMetric(
+		bucketCount, ok := te.countMetric(
 			metricName,
 			bucketAttrs,
 			float64(b.GetCumulativeCount()),
 			timestamp,
+			resetAt,
 		)
 		if ok {
 			te.harvester.RecordMetric(bucketCount)
@@ -316,3 +500,41 @@ func (te *TelemetryEmitter) emitHistogram(metric Metric, timestamp time.Time) er
 
 	return nil
 }
+
+// emitGaugeHistogram records the buckets, count and sum of a gauge histogram
+// as gauges, since they are current values rather than cumulative ones. The
+// count and sum are named as in OpenMetrics to tell them apart from the ones
+// of histograms.
+func (te *TelemetryEmitter) emitGaugeHistogram(metric Metric, timestamp time.Time) error {
+	hist, ok := metric.value.(*dto.Histogram)
+	if !ok {
+		return fmt.Errorf("unknown gauge histogram metric type for %q: %T", metric.name, metric.value)
+	}
+
+	te.harvester.RecordMetric(telemetry.Gauge{
+		Name:       metric.name + "_gsum",
+		Attributes: metric.attributes,
+		Value:      hist.GetSampleSum(),
+		Timestamp:  timestamp,
+	})
+	te.harvester.RecordMetric(telemetry.Gauge{
+		Name:       metric.name + "_gcount",
+		Attributes: metric.attributes,
+		Value:      float64(histogramCount(hist)),
+		Timestamp:  timestamp,
+	})
+
+	metricName := metric.name + "_bucket"
+	for _, b := range histogramBuckets(hist) {
+		bucketAttrs := copyAttrs(metric.attributes)
+		bucketAttrs["le"] = fmt.Sprintf("%g", b.GetUpperBound())
+		te.harvester.RecordMetric(telemetry.Gauge{
+			Name:       metricName,
+			Attributes: bucketAttrs,
+			Value:      float64(b.GetCumulativeCount()),
+			Timestamp:  timestamp,
+		})
+	}
+
+	return nil
+}
@@ -415,8 +415,8 @@ func decodePromMetrics(src io.Reader) (*prometheus.MetricFamiliesByName, error)
 	mfs := prometheus.MetricFamiliesByName{}
 	d := expfmt.NewDecoder(src, expfmt.FmtText)
 	for {
-		var mf dto.MetricFamily
-		if err := d.Decode(&mf); err != nil {
+		mf := &dto.MetricFamily{}
+		if err := d.Decode(mf); err != nil {
 			if err == io.EOF {
 				break
 			}
@@ -501,3 +501,80 @@ func purgeTimestamps(metrics []interface{}) {
 		delete(assertedM, "interval.ms")
 	}
 }
+
+type recordingHarvester struct {
+	metrics []telemetry.Metric
+	events  []telemetry.Event
+}
+
+func (h *recordingHarvester) RecordMetric(m telemetry.Metric) {
+	h.metrics = append(h.metrics, m)
+}
+
+func (h *recordingHarvester) RecordEvent(e telemetry.Event) error {
+	h.events = append(h.events, e)
+	return nil
+}
+
+func (h *recordingHarvester) HarvestNow(context.Context) {}
+
+func TestTelemetryEmitter_GaugeHistogram(t *testing.T) {
+	t.Parallel()
+
+	input := `# TYPE queue_size gaugehistogram
+queue_size_bucket{le="10"} 3
+queue_size_bucket{le="+Inf"} 5
+queue_size_count 5
+queue_size_sum 42
+`
+	metrics := scrapeString(t, input).Metrics
+	require.Len(t, metrics, 1)
+	assert.Equal(t, metricType_GAUGEHISTOGRAM, metrics[0].metricType)
+	assert.Equal(t, "gaugehistogram", metrics[0].attributes["promMetricType"])
+
+	h := &recordingHarvester{}
+	e := &TelemetryEmitter{harvester: h, deltaCalculator: newDeltaCalculator(defaultDeltaExpirationAge, defaultDeltaExpirationCheckInterval)}
+
+	// Gauge histograms are emitted as gauges, so their values are reported as
+	// they are from the first emission on.
+	for i := 0; i < 2; i++ {
+		h.metrics = nil
+		require.NoError(t, e.Emit(metrics))
+
+		values := map[string]float64{}
+		for _, m := range h.metrics {
+			g, ok := m.(telemetry.Gauge)
+			require.True(t, ok, "expected a gauge, got %T", m)
+			key := g.Name
+			if le, ok := g.Attributes["le"]; ok {
+				key += "{le=" + le.(string) + "}"
+			}
+			values[key] = g.Value
+		}
+		assert.Equal(t, map[string]float64{
+			"queue_size_gsum":            42,
+			"queue_size_gcount":          5,
+			"queue_size_bucket{le=10}":   3,
+			"queue_size_bucket{le=+Inf}": 5,
+		}, values)
+	}
+}
+
+func TestTelemetryEmitter_Timestamps(t *testing.T) {
+	t.Parallel()
+
+	stamped := time.Unix(1520872607, 123000000)
+	metrics := []Metric{
+		{name: "stamped", metricType: metricType_GAUGE, value: 1.0, attributes: labels.Set{}, timestamp: stamped},
+		{name: "unstamped", metricType: metricType_GAUGE, value: 2.0, attributes: labels.Set{}},
+	}
+
+	h := &recordingHarvester{}
+	e := &TelemetryEmitter{harvester: h, deltaCalculator: newDeltaCalculator(defaultDeltaExpirationAge, defaultDeltaExpirationCheckInterval)}
+	before := time.Now()
+	require.NoError(t, e.Emit(metrics))
+	require.Len(t, h.metrics, 2)
+
+	assert.Equal(t, stamped, h.metrics[0].(telemetry.Gauge).Timestamp)
+	assert.False(t, h.metrics[1].(telemetry.Gauge).Timestamp.Before(before))
+}
@@ -0,0 +1,184 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package integration
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
+)
+
+// newMutualTLSConfig reads the certificates of the TLS configuration of a
+// target. The CA certificate is optional, the system ones are used without
+// it, or along with it when AppendSystemCAs is set.
+func newMutualTLSConfig(cfg endpoints.TLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+		ServerName:         cfg.ServerName,
+	}
+
+	var err error
+	if tlsConfig.MinVersion, err = endpoints.ParseTLSVersion(cfg.MinVersion); err != nil {
+		return nil, err
+	}
+	if tlsConfig.MaxVersion, err = endpoints.ParseTLSVersion(cfg.MaxVersion); err != nil {
+		return nil, err
+	}
+	if tlsConfig.CipherSuites, err = endpoints.ParseCipherSuites(cfg.CipherSuites); err != nil {
+		return nil, err
+	}
+
+	if cfg.CertFilePath != "" || cfg.KeyFilePath != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFilePath, cfg.KeyFilePath)
+		if err != nil {
+			return nil, fmt.Errorf("loading certificate %s: %w", cfg.CertFilePath, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if cfg.CaFilePath != "" {
+		caCert, err := ioutil.ReadFile(cfg.CaFilePath)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA certificate: %w", err)
+		}
+		caCertPool := x509.NewCertPool()
+		if cfg.AppendSystemCAs {
+			if caCertPool, err = x509.SystemCertPool(); err != nil {
+				return nil, fmt.Errorf("reading system CA certificates: %w", err)
+			}
+		}
+		if !caCertPool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", cfg.CaFilePath)
+		}
+		tlsConfig.RootCAs = caCertPool
+	}
+	return tlsConfig, nil
+}
+
+// fileStamp tells whether a file changed.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// tlsFileStamps returns the stamps of the certificate, key and CA files.
+func tlsFileStamps(cfg endpoints.TLSConfig) ([3]fileStamp, error) {
+	var stamps [3]fileStamp
+	for i, file := range []string{cfg.CertFilePath, cfg.KeyFilePath, cfg.CaFilePath} {
+		if file == "" {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return stamps, err
+		}
+		stamps[i] = fileStamp{modTime: info.ModTime(), size: info.Size()}
+	}
+	return stamps, nil
+}
+
+type targetTransport struct {
+	cfg       endpoints.TLSConfig
+	transport *http.Transport
+	stamps    [3]fileStamp
+	// used tells whether a target used the transport since the last prune.
+	used bool
+}
+
+// targetTransports keeps a transport for every TLS and proxy configuration of
+// the targets, so their connections are reused across scrapes. Transports are
+// rebuilt when the files of their certificates change, like when they are
+// rotated.
+type targetTransports struct {
+	lock sync.Mutex
+	// transports are keyed by their configuration.
+	transports map[string]*targetTransport
+}
+
+func newTargetTransports() *targetTransports {
+	return &targetTransports{
+		transports: map[string]*targetTransport{},
+	}
+}
+
+// get returns the transport of the configuration, reading its certificates
+// again when their files changed. An error is returned when they can't be
+// read, and the next call tries again.
+func (m *targetTransports) get(cfg endpoints.TLSConfig, proxy endpoints.Proxy) (http.RoundTripper, error) {
+	stamps, err := tlsFileStamps(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	key := fmt.Sprintf("%#v %#v", cfg, proxy)
+	cached, ok := m.transports[key]
+	if ok && cached.stamps == stamps {
+		cached.used = true
+		return cached.transport, nil
+	}
+
+	tlsConfig, err := newMutualTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		cached.transport.CloseIdleConnections()
+	}
+	transport := newDefaultRoundTripper(tlsConfig, proxy).(*http.Transport)
+	m.transports[key] = &targetTransport{cfg: cfg, transport: transport, stamps: stamps, used: true}
+	setCertificateExpiry(cfg.CertFilePath, tlsConfig)
+	return transport, nil
+}
+
+// prune closes the transports no target used since the last prune, and stops
+// reporting the expiry of their certificates.
+func (m *targetTransports) prune() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var removed []string
+	for key, t := range m.transports {
+		if t.used {
+			t.used = false
+			continue
+		}
+		t.transport.CloseIdleConnections()
+		delete(m.transports, key)
+		removed = append(removed, t.cfg.CertFilePath)
+	}
+
+	// Certificates can be shared by several configurations.
+	inUse := map[string]bool{}
+	for _, t := range m.transports {
+		inUse[t.cfg.CertFilePath] = true
+	}
+	for _, certFile := range removed {
+		if certFile != "" && !inUse[certFile] {
+			tlsCertificateExpiryMetric.DeleteLabelValues(certFile)
+		}
+	}
+}
+
+// setCertificateExpiry reports when the client certificate of the
+// configuration expires.
+func setCertificateExpiry(certFile string, tlsConfig *tls.Config) {
+	if len(tlsConfig.Certificates) == 0 {
+		return
+	}
+	leaf := tlsConfig.Certificates[0].Leaf
+	if leaf == nil {
+		return
+	}
+	tlsCertificateExpiryMetric.WithLabelValues(certFile).Set(float64(leaf.NotAfter.Unix()))
+}
@@ -0,0 +1,282 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package integration
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCA{cert: cert, key: key}
+}
+
+// issue returns the PEM encoded certificate and key signed by the CA, for the
+// given DNS names or for 127.0.0.1 without them.
+func (ca *testCA) issue(t *testing.T, serial int64, notAfter time.Time, dnsNames ...string) ([]byte, []byte) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if len(dnsNames) > 0 {
+		template.DNSNames = dnsNames
+	} else {
+		template.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+}
+
+func (ca *testCA) pem() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})
+}
+
+// writeFile writes the file, changing its modification time so the change is
+// seen even within the resolution of the file system.
+func writeFile(t *testing.T, path string, data []byte, modTime time.Time) {
+	t.Helper()
+
+	require.NoError(t, os.WriteFile(path, data, 0o600))
+	require.NoError(t, os.Chtimes(path, modTime, modTime))
+}
+
+func TestTargetTransports_MutualTLS(t *testing.T) {
+	t.Parallel()
+
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	cfg := endpoints.TLSConfig{
+		CaFilePath:   filepath.Join(dir, "ca.crt"),
+		CertFilePath: filepath.Join(dir, "tls.crt"),
+		KeyFilePath:  filepath.Join(dir, "tls.key"),
+	}
+	modTime := time.Now().Add(-time.Minute)
+	notAfter := time.Now().Add(time.Hour).Truncate(time.Second)
+	cert, key := ca.issue(t, 2, notAfter)
+	writeFile(t, cfg.CaFilePath, ca.pem(), modTime)
+	writeFile(t, cfg.CertFilePath, cert, modTime)
+	writeFile(t, cfg.KeyFilePath, key, modTime)
+
+	transports := newTargetTransports()
+	first, err := transports.get(cfg, endpoints.Proxy{})
+	require.NoError(t, err)
+	second, err := transports.get(cfg, endpoints.Proxy{})
+	require.NoError(t, err)
+	assert.Same(t, first, second, "the transport is reused while the files don't change")
+	expiry := tlsCertificateExpiryMetric.WithLabelValues(cfg.CertFilePath)
+	assert.Equal(t, float64(notAfter.Unix()), testutil.ToFloat64(expiry))
+
+	// The rotated certificate is loaded by a new transport.
+	rotatedNotAfter := notAfter.Add(time.Hour)
+	cert, key = ca.issue(t, 3, rotatedNotAfter)
+	writeFile(t, cfg.CertFilePath, cert, modTime.Add(time.Second))
+	writeFile(t, cfg.KeyFilePath, key, modTime.Add(time.Second))
+	rotated, err := transports.get(cfg, endpoints.Proxy{})
+	require.NoError(t, err)
+	assert.NotSame(t, first, rotated)
+	assert.Equal(t, float64(rotatedNotAfter.Unix()), testutil.ToFloat64(expiry))
+
+	// Unreadable certificates fail until they can be read again.
+	require.NoError(t, os.Remove(cfg.KeyFilePath))
+	_, err = transports.get(cfg, endpoints.Proxy{})
+	assert.Error(t, err)
+	writeFile(t, cfg.KeyFilePath, key, modTime.Add(time.Second))
+	again, err := transports.get(cfg, endpoints.Proxy{})
+	require.NoError(t, err)
+	assert.Same(t, rotated, again)
+
+	// Transports are released once no target uses them.
+	transports.prune()
+	assert.Len(t, transports.transports, 1)
+	transports.prune()
+	assert.Empty(t, transports.transports)
+	assert.False(t, tlsCertificateExpiryMetric.DeleteLabelValues(cfg.CertFilePath), "the expiry is no longer reported")
+}
+
+func TestFetcher_MutualTLS(t *testing.T) {
+	t.Parallel()
+
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	serverCert, serverKey := ca.issue(t, 2, time.Now().Add(time.Hour))
+	serverPair, err := tls.X509KeyPair(serverCert, serverKey)
+	require.NoError(t, err)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+
+	var connections int32
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "up 1\n")
+	}))
+	ts.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverPair},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+	ts.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&connections, 1)
+		}
+	}
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+
+	cfg := endpoints.TLSConfig{
+		CaFilePath:   filepath.Join(dir, "ca.crt"),
+		CertFilePath: filepath.Join(dir, "tls.crt"),
+		KeyFilePath:  filepath.Join(dir, "tls.key"),
+	}
+	cert, key := ca.issue(t, 3, time.Now().Add(time.Hour))
+	writeFile(t, cfg.CaFilePath, ca.pem(), time.Now())
+	writeFile(t, cfg.CertFilePath, cert, time.Now())
+	writeFile(t, cfg.KeyFilePath, key, time.Now())
+
+	unreadable := endpoints.TLSConfig{
+		CaFilePath:   cfg.CaFilePath,
+		CertFilePath: filepath.Join(dir, "missing.crt"),
+		KeyFilePath:  filepath.Join(dir, "missing.key"),
+	}
+	retriever, err := endpoints.FixedRetriever(
+		endpoints.TargetConfig{URLs: []string{ts.URL}, TLSConfig: cfg},
+		endpoints.TargetConfig{URLs: []string{ts.URL + "/unreadable"}, TLSConfig: unreadable},
+	)
+	require.NoError(t, err)
+	targets, err := retriever.GetTargets()
+	require.NoError(t, err)
+
+	fetcher := NewFetcher(fetchDuration, fetchTimeout, "", workerThreads, "", "", false, queueLength)
+	for i := 0; i < 2; i++ {
+		pairs := collectTargetMetrics(t, fetcher.Fetch(targets))
+		require.Len(t, pairs, 1)
+		assert.Equal(t, targets[0].URL.String(), pairs[0].Target.URL.String())
+		assert.Equal(t, float64(1), testutil.ToFloat64(fetchErrorsTotalMetric.WithLabelValues(targets[1].Name)))
+	}
+
+	// Both scrapes used the same connection.
+	assert.Equal(t, int32(1), atomic.LoadInt32(&connections))
+}
+
+func TestFetcher_TLSServerName(t *testing.T) {
+	t.Parallel()
+
+	ca := newTestCA(t)
+	// The certificate of the server is issued for the DNS name of its service,
+	// while it is scraped by its IP address.
+	serverCert, serverKey := ca.issue(t, 2, time.Now().Add(time.Hour), "my-service.my-namespace.svc")
+	serverPair, err := tls.X509KeyPair(serverCert, serverKey)
+	require.NoError(t, err)
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "up 1\n")
+	}))
+	ts.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverPair},
+		MinVersion:   tls.VersionTLS13,
+	}
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+
+	caFile := filepath.Join(t.TempDir(), "ca.crt")
+	writeFile(t, caFile, ca.pem(), time.Now())
+
+	testCases := []struct {
+		name      string
+		tlsConfig endpoints.TLSConfig
+		scraped   bool
+	}{
+		{
+			name:      "server name",
+			tlsConfig: endpoints.TLSConfig{ServerName: "my-service.my-namespace.svc"},
+			scraped:   true,
+		},
+		{
+			name:      "server name and version",
+			tlsConfig: endpoints.TLSConfig{ServerName: "my-service.my-namespace.svc", MinVersion: "TLS13"},
+			scraped:   true,
+		},
+		{
+			name:      "verified for the IP address",
+			tlsConfig: endpoints.TLSConfig{CaFilePath: caFile},
+		},
+		{
+			name:      "version not supported by the server",
+			tlsConfig: endpoints.TLSConfig{ServerName: "my-service.my-namespace.svc", MaxVersion: "TLS12"},
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			retriever, err := endpoints.FixedRetriever(endpoints.TargetConfig{URLs: []string{ts.URL}, TLSConfig: tc.tlsConfig})
+			require.NoError(t, err)
+			targets, err := retriever.GetTargets()
+			require.NoError(t, err)
+
+			// Targets without a CA certificate use the one of the fetcher.
+			fetcher := NewFetcher(fetchDuration, fetchTimeout, "", workerThreads, "", caFile, false, queueLength)
+			pairs := collectTargetMetrics(t, fetcher.Fetch(targets))
+			if tc.scraped {
+				assert.Len(t, pairs, 1)
+			} else {
+				assert.Empty(t, pairs)
+			}
+		})
+	}
+}
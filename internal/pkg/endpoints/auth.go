@@ -0,0 +1,119 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package endpoints
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// Auth configures how the requests to a target are authenticated. At most one of basic auth, bearer token and
+// OAuth2 can be set, while headers can be sent with any of them.
+type Auth struct {
+	BasicAuth BasicAuth `mapstructure:"basic_auth"`
+	// Headers are static headers sent with every request, like API keys.
+	Headers map[string]string `mapstructure:"headers"`
+	// BearerToken and BearerTokenFile set the token sent in the Authorization header. The file is read for every
+	// request, so tokens can be rotated.
+	BearerToken     string `mapstructure:"bearer_token"`
+	BearerTokenFile string `mapstructure:"bearer_token_file"`
+	OAuth2          OAuth2 `mapstructure:"oauth2"`
+}
+
+// BasicAuth sets the credentials of the HTTP basic authentication. The password file takes precedence over the
+// password and is read for every request.
+type BasicAuth struct {
+	Username     string `mapstructure:"username"`
+	Password     string `mapstructure:"password"`
+	PasswordFile string `mapstructure:"password_file"`
+}
+
+// OAuth2 configures the OAuth2 client credentials flow, getting tokens from TokenURL which are cached until they
+// expire. The client secret file is read whenever a token is requested.
+type OAuth2 struct {
+	ClientID         string            `mapstructure:"client_id"`
+	ClientSecret     string            `mapstructure:"client_secret"`
+	ClientSecretFile string            `mapstructure:"client_secret_file"`
+	TokenURL         string            `mapstructure:"token_url"`
+	Scopes           []string          `mapstructure:"scopes"`
+	EndpointParams   map[string]string `mapstructure:"endpoint_params"`
+}
+
+// IsZero tells whether no authentication is configured.
+func (a Auth) IsZero() bool {
+	return a.BasicAuth.IsZero() && len(a.Headers) == 0 && a.BearerToken == "" && a.BearerTokenFile == "" &&
+		a.OAuth2.IsZero()
+}
+
+// IsZero tells whether basic authentication is not configured.
+func (b BasicAuth) IsZero() bool {
+	return b == BasicAuth{}
+}
+
+// IsZero tells whether OAuth2 is not configured.
+func (o OAuth2) IsZero() bool {
+	return o.ClientID == "" && o.ClientSecret == "" && o.ClientSecretFile == "" && o.TokenURL == "" &&
+		len(o.Scopes) == 0 && len(o.EndpointParams) == 0
+}
+
+// Validate returns an error when the authentication is not consistent.
+func (a Auth) Validate() error {
+	var methods []string
+	if !a.BasicAuth.IsZero() {
+		methods = append(methods, "basic_auth")
+		if a.BasicAuth.Username == "" {
+			return errors.New("basic_auth requires a username")
+		}
+		if a.BasicAuth.Password != "" && a.BasicAuth.PasswordFile != "" {
+			return errors.New("basic_auth can't have both password and password_file")
+		}
+	}
+	if a.BearerToken != "" || a.BearerTokenFile != "" {
+		methods = append(methods, "bearer_token")
+		if a.BearerToken != "" && a.BearerTokenFile != "" {
+			return errors.New("bearer_token and bearer_token_file can't be both set")
+		}
+	}
+	if !a.OAuth2.IsZero() {
+		methods = append(methods, "oauth2")
+		if a.OAuth2.ClientID == "" || a.OAuth2.TokenURL == "" {
+			return errors.New("oauth2 requires a client_id and a token_url")
+		}
+		if a.OAuth2.ClientSecret != "" && a.OAuth2.ClientSecretFile != "" {
+			return errors.New("oauth2 can't have both client_secret and client_secret_file")
+		}
+	}
+	if len(methods) > 1 {
+		return fmt.Errorf("only one of %s can be set", strings.Join(methods, ", "))
+	}
+
+	for name := range a.Headers {
+		if name == "" {
+			return errors.New("header names can't be empty")
+		}
+		if len(methods) > 0 && http.CanonicalHeaderKey(name) == "Authorization" {
+			return fmt.Errorf("the Authorization header can't be set together with %s", methods[0])
+		}
+	}
+	return nil
+}
+
+// ReadClientSecret returns the client secret, reading it from its file when set.
+func (o OAuth2) ReadClientSecret() (string, error) {
+	return readSecret(o.ClientSecret, o.ClientSecretFile)
+}
+
+func readSecret(value, file string) (string, error) {
+	if file == "" {
+		return value, nil
+	}
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("reading secret file %s: %w", file, err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
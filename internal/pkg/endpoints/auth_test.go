@@ -0,0 +1,92 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package endpoints
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuth_Validate(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name  string
+		auth  Auth
+		valid bool
+	}{
+		{
+			name:  "none",
+			valid: true,
+		},
+		{
+			name: "basic auth with headers",
+			auth: Auth{
+				BasicAuth: BasicAuth{Username: "user", PasswordFile: "/password"},
+				Headers:   map[string]string{"X-Api-Key": "key"},
+			},
+			valid: true,
+		},
+		{
+			name:  "authorization header alone",
+			auth:  Auth{Headers: map[string]string{"authorization": "Token abc"}},
+			valid: true,
+		},
+		{
+			name:  "oauth2",
+			auth:  Auth{OAuth2: OAuth2{ClientID: "id", ClientSecret: "secret", TokenURL: "https://auth/token"}},
+			valid: true,
+		},
+		{
+			name: "basic auth without username",
+			auth: Auth{BasicAuth: BasicAuth{Password: "pass"}},
+		},
+		{
+			name: "password and password file",
+			auth: Auth{BasicAuth: BasicAuth{Username: "user", Password: "pass", PasswordFile: "/password"}},
+		},
+		{
+			name: "bearer token and file",
+			auth: Auth{BearerToken: "token", BearerTokenFile: "/token"},
+		},
+		{
+			name: "oauth2 without token url",
+			auth: Auth{OAuth2: OAuth2{ClientID: "id"}},
+		},
+		{
+			name: "basic auth and bearer token",
+			auth: Auth{BasicAuth: BasicAuth{Username: "user"}, BearerToken: "token"},
+		},
+		{
+			name: "bearer token and authorization header",
+			auth: Auth{BearerToken: "token", Headers: map[string]string{"Authorization": "Token abc"}},
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			err := tc.auth.Validate()
+			if tc.valid {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestFixedRetriever_InvalidAuth(t *testing.T) {
+	t.Parallel()
+
+	_, err := FixedRetriever(TargetConfig{
+		URLs: []string{"localhost:9121"},
+		Auth: Auth{BearerToken: "secret-token", BearerTokenFile: "/token"},
+	})
+	assert.Error(t, err)
+	assert.NotContains(t, err.Error(), "secret-token", "credentials are not printed")
+}
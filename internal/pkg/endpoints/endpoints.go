@@ -5,6 +5,7 @@
 package endpoints
 
 import (
+	"context"
 	"fmt"
 	"net/url"
 	"strings"
@@ -19,6 +20,35 @@ type TargetRetriever interface {
 	Name() string
 }
 
+// ContextTargetRetriever is a TargetRetriever whose watch can be cancelled.
+type ContextTargetRetriever interface {
+	TargetRetriever
+	// WatchContext is like Watch, but the watch ends once the context is
+	// done.
+	WatchContext(ctx context.Context) error
+}
+
+// WithContext returns the retriever as a ContextTargetRetriever. Retrievers
+// that aren't context-aware are watched with Watch once the context is
+// checked, as their watch can't be cancelled.
+func WithContext(r TargetRetriever) ContextTargetRetriever {
+	if cr, ok := r.(ContextTargetRetriever); ok {
+		return cr
+	}
+	return contextRetriever{r}
+}
+
+type contextRetriever struct {
+	TargetRetriever
+}
+
+func (r contextRetriever) WatchContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return r.Watch()
+}
+
 // Object represents a kubernetes object like a pod or a service or an endpoint.
 type Object struct {
 	Name   string
@@ -36,6 +66,15 @@ type Target struct {
 	// UseBearer tells nri-prometheus whether it should send the Kubernetes Service Account token as a Bearer token in
 	// the HTTP request.
 	UseBearer bool
+	// Compression is the comma separated list of encodings the responses of the target are accepted
+	// compressed with, in order of preference, or "none". The fetcher's default is used when empty.
+	Compression string
+	// Auth configures how the requests to the target are authenticated.
+	Auth Auth
+	// Proxy overrides the proxy the target is scraped through.
+	Proxy Proxy
+	// authSecrets references the Kubernetes Secrets the Auth is read from.
+	authSecrets authSecrets
 }
 
 // Metadata returns the Target's metadata, if the current metadata is nil,
@@ -78,6 +117,16 @@ func redactedURLString(u *url.URL) string {
 // - if no path is provided, it assumes /metrics
 // For example, hostname:8080 will be interpreted as http://hostname:8080/metrics
 func endpointToTarget(tc TargetConfig) ([]Target, error) {
+	if err := tc.Auth.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid authentication: %w", err)
+	}
+	if err := tc.TLSConfig.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid TLS configuration: %w", err)
+	}
+	if err := tc.Proxy.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid proxy: %w", err)
+	}
+
 	targets := make([]Target, 0, len(tc.URLs))
 	for _, URL := range tc.URLs {
 		t, err := urlToTarget(URL, tc.TLSConfig)
@@ -85,6 +134,9 @@ func endpointToTarget(tc TargetConfig) ([]Target, error) {
 			return nil, err
 		}
 		t.UseBearer = tc.UseBearer
+		t.Compression = tc.Compression
+		t.Auth = tc.Auth
+		t.Proxy = tc.Proxy
 		targets = append(targets, t)
 	}
 	return targets, nil
@@ -17,6 +17,14 @@ type TargetConfig struct {
 	// UseBearer tells nri-prometheus whether it should send the Kubernetes Service Account token as a Bearer token in
 	// the HTTP request.
 	UseBearer bool `mapstructure:"use_bearer"`
+	// Compression overrides the scrape_compression of the targets.
+	Compression string `mapstructure:"compression"`
+	// Auth is configured with the basic_auth, headers, bearer_token, bearer_token_file and oauth2 options of the
+	// targets.
+	Auth Auth `mapstructure:",squash"`
+	// Proxy is configured with the proxy_url and no_proxy options of the targets, overriding the scrape_proxy
+	// and scrape_no_proxy ones.
+	Proxy Proxy `mapstructure:",squash"`
 }
 
 // TLSConfig is used to store all the configuration required to use Mutual TLS authentication.
@@ -25,6 +33,15 @@ type TLSConfig struct {
 	CertFilePath       string `mapstructure:"cert_file_path"`
 	KeyFilePath        string `mapstructure:"key_file_path"`
 	InsecureSkipVerify bool   `mapstructure:"insecure_skip_verify"`
+	// ServerName is the name the certificate of the target is verified for, instead of the host of its URL.
+	ServerName string `mapstructure:"server_name"`
+	// MinVersion and MaxVersion limit the TLS versions, like TLS12 or TLS13.
+	MinVersion string `mapstructure:"min_version"`
+	MaxVersion string `mapstructure:"max_version"`
+	// CipherSuites are the names of the cipher suites of TLS 1.2 and lower, all the secure ones when empty.
+	CipherSuites []string `mapstructure:"cipher_suites"`
+	// AppendSystemCAs adds the certificates of the CA file to the ones of the system, instead of replacing them.
+	AppendSystemCAs bool `mapstructure:"append_system_cas"`
 }
 
 // FixedRetriever creates a TargetRetriver that returns the targets belonging to the URLs passed as arguments
@@ -33,7 +50,8 @@ func FixedRetriever(targetCfgs ...TargetConfig) (TargetRetriever, error) {
 	for _, targetCfg := range targetCfgs {
 		targets, err := endpointToTarget(targetCfg)
 		if err != nil {
-			return nil, fmt.Errorf("parsing target %v: %v", targetCfg, err.Error())
+			// The configuration is not printed whole, since it can hold credentials.
+			return nil, fmt.Errorf("parsing target %v: %v", targetCfg.URLs, err.Error())
 		}
 		fixed = append(fixed, targets...)
 	}
@@ -41,6 +41,13 @@ const (
 	defaultScrapePath         = "/metrics"
 )
 
+// scrapeCompressionLabel overrides the compression the responses of the target are accepted with.
+const scrapeCompressionLabel = "prometheus.io/compression"
+
+// tlsServerNameLabel sets the name the certificate of the target is verified for, since targets are scraped by
+// their IP address while their certificates are usually issued for the DNS names of their services.
+const tlsServerNameLabel = "prometheus.io/tls-server-name"
+
 // watchableResource identifies a k8s resource that implement the k8s watchable
 // interface.
 //
@@ -86,7 +93,7 @@ func nodeAddress(node *corev1.Node) (string, map[corev1.NodeAddressType][]string
 
 // listNodes gets all the scrapable nodes that are currently available
 func (k *kubernetesTargetRetriever) listNodes() error {
-	nodes, err := k.client.CoreV1().Nodes().List(context.TODO(), metav1.ListOptions{})
+	nodes, err := k.client.CoreV1().Nodes().List(k.ctx, metav1.ListOptions{})
 	if err != nil {
 		return err
 	}
@@ -150,11 +157,11 @@ func nodeTargets(n *corev1.Node) ([]Target, error) {
 
 // listEndpoints gets the scrapable endpoints that are currently available
 func (k *kubernetesTargetRetriever) listEndpoints() error {
-	endpoints, err := k.client.CoreV1().Endpoints("").List(context.TODO(), metav1.ListOptions{})
+	endpoints, err := k.client.CoreV1().Endpoints("").List(k.ctx, metav1.ListOptions{})
 	if err != nil {
 		return err
 	}
-	services, err := k.client.CoreV1().Services("").List(context.TODO(), metav1.ListOptions{})
+	services, err := k.client.CoreV1().Services("").List(k.ctx, metav1.ListOptions{})
 	if err != nil {
 		return err
 	}
@@ -180,7 +187,7 @@ func (k *kubernetesTargetRetriever) listEndpoints() error {
 
 // listServices gets the scrapable services that are currently available
 func (k *kubernetesTargetRetriever) listServices() error {
-	services, err := k.client.CoreV1().Services("").List(context.TODO(), metav1.ListOptions{})
+	services, err := k.client.CoreV1().Services("").List(k.ctx, metav1.ListOptions{})
 	if err != nil {
 		return err
 	}
@@ -234,6 +241,31 @@ func getPath(o metav1.Object) string {
 	return defaultScrapePath
 }
 
+// getCompression returns the compression the target responses are accepted with, or an empty string
+// to use the default one.
+func getCompression(o metav1.Object) string {
+	// Annotations take precedence over labels.
+	if annotation, ok := o.GetAnnotations()[scrapeCompressionLabel]; ok {
+		return annotation
+	}
+	if label, ok := o.GetLabels()[scrapeCompressionLabel]; ok {
+		return label
+	}
+	return ""
+}
+
+// getTLSConfig returns the TLS configuration of the target, which is empty when it has no server name.
+func getTLSConfig(o metav1.Object) TLSConfig {
+	// Annotations take precedence over labels.
+	if annotation, ok := o.GetAnnotations()[tlsServerNameLabel]; ok {
+		return TLSConfig{ServerName: annotation}
+	}
+	if label, ok := o.GetLabels()[tlsServerNameLabel]; ok {
+		return TLSConfig{ServerName: label}
+	}
+	return TLSConfig{}
+}
+
 func getPort(o metav1.Object) string {
 	// Annotations take precedence over labels.
 	if annotation, ok := o.GetAnnotations()[defaultScrapePortLabel]; ok {
@@ -285,6 +317,9 @@ func endpointsTargets(e *corev1.Endpoints, s *corev1.Service) []Target {
 	// we need to pass the service since the annotations are not inherited
 	port := getPort(s)
 	scheme := getScheme(s)
+	compression := getCompression(s)
+	tlsConfig := getTLSConfig(s)
+	secrets := getAuthSecrets(s)
 	path, query, err := parsePath(getPath(s))
 	if err != nil {
 		klog.WithError(err).Warnf("Skipping endpoints from  %s/%s", s.Namespace, s.Name)
@@ -311,7 +346,11 @@ func endpointsTargets(e *corev1.Endpoints, s *corev1.Service) []Target {
 					Path:     path,
 					RawQuery: query,
 				}
-				targets = append(targets, endpointsTarget(e, u))
+				t := endpointsTarget(e, u)
+				t.Compression = compression
+				t.TLSConfig = tlsConfig
+				t.authSecrets = secrets
+				targets = append(targets, t)
 			}
 		}
 	}
@@ -331,6 +370,9 @@ func serviceTarget(s *corev1.Service, u url.URL) Target {
 			Kind:   "service",
 			Labels: lbls,
 		},
+		Compression: getCompression(s),
+		TLSConfig:   getTLSConfig(s),
+		authSecrets: getAuthSecrets(s),
 	}
 }
 
@@ -378,7 +420,7 @@ func serviceTargets(s *corev1.Service) []Target {
 }
 
 func (k *kubernetesTargetRetriever) listPods() error {
-	pods, err := k.client.CoreV1().Pods("").List(context.TODO(), metav1.ListOptions{})
+	pods, err := k.client.CoreV1().Pods("").List(k.ctx, metav1.ListOptions{})
 	if err != nil {
 		return err
 	}
@@ -417,6 +459,9 @@ func podTarget(p *corev1.Pod, u url.URL) Target {
 			Kind:   "pod",
 			Labels: lbls,
 		},
+		Compression: getCompression(p),
+		TLSConfig:   getTLSConfig(p),
+		authSecrets: getAuthSecrets(p),
 	}
 }
 
@@ -505,13 +550,18 @@ func WithInClusterConfig() Option {
 // kubernetesTargetRetriever sets the watchers for the different Targets
 // and listens for the arrival of new data from them.
 type kubernetesTargetRetriever struct {
-	watching                          bool
+	watching bool
+	// ctx is cancelled when the retriever is stopped, ending its watches.
+	ctx                               context.Context
+	cancel                            context.CancelFunc
 	client                            kubernetes.Interface
 	targets                           *sync.Map
 	scrapeEnabledLabel                string
 	scrapeServices                    bool
 	scrapeEndpoints                   bool
 	requireScrapeEnabledLabelForNodes bool
+	// secrets reads the credentials of the targets referencing Secrets.
+	secrets *secretCache
 }
 
 // NewKubernetesTargetRetriever creates a new kubernetesTargetRetriever
@@ -521,7 +571,10 @@ func NewKubernetesTargetRetriever(scrapeEnabledLabel string, requireScrapeEnable
 		scrapeEnabledLabel = defaultScrapeEnabledLabel
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
 	ktr := &kubernetesTargetRetriever{
+		ctx:                               ctx,
+		cancel:                            cancel,
 		targets:                           new(sync.Map),
 		scrapeEnabledLabel:                scrapeEnabledLabel,
 		scrapeEndpoints:                   scrapeEndpoints,
@@ -531,13 +584,16 @@ func NewKubernetesTargetRetriever(scrapeEnabledLabel string, requireScrapeEnable
 
 	for _, opt := range options {
 		if err := opt(ktr); err != nil {
+			cancel()
 			return nil, err
 		}
 	}
 
 	if ktr.client == nil {
+		cancel()
 		return nil, errors.New("newKubernetesTargetRetriever requires a valid Kubernetes configuration option, none are given")
 	}
+	ktr.secrets = newSecretCache(ktr.client)
 
 	return ktr, nil
 }
@@ -561,6 +617,19 @@ func (k *kubernetesTargetRetriever) Watch() error {
 	return nil
 }
 
+// WatchContext is like Watch, but the watches also end once the context is
+// done.
+func (k *kubernetesTargetRetriever) WatchContext(ctx context.Context) error {
+	context.AfterFunc(ctx, k.cancel)
+	return k.Watch()
+}
+
+// Stop ends the watches started by Watch. The targets already retrieved are
+// still returned by GetTargets.
+func (k *kubernetesTargetRetriever) Stop() {
+	k.cancel()
+}
+
 // Name returns the identifying name of the kubernetesTargetRetriever.
 func (k *kubernetesTargetRetriever) Name() string {
 	return "kubernetes"
@@ -582,6 +651,14 @@ func (k *kubernetesTargetRetriever) GetTargets() ([]Target, error) {
 			if t.Object.Kind == "endpoints" && !k.scrapeEndpoints {
 				continue
 			}
+			if !t.authSecrets.isZero() {
+				// Targets whose credentials can't be read are still scraped, so they are reported as failing.
+				auth, err := k.secrets.auth(t.authSecrets)
+				if err != nil {
+					klog.WithError(err).Warnf("reading the credentials of target %s", t.Name)
+				}
+				t.Auth = auth
+			}
 			targets = append(targets, t)
 		}
 		return true
@@ -608,28 +685,28 @@ func (k *kubernetesTargetRetriever) getWatchableResources() []watchableResource
 		listFunction:              k.listPods,
 		requireScrapeEnabledLabel: true,
 		watchFunction: func() (watch.Interface, error) {
-			return k.client.CoreV1().Pods("").Watch(context.TODO(), metav1.ListOptions{})
+			return k.client.CoreV1().Pods("").Watch(k.ctx, metav1.ListOptions{})
 		},
 	}, {
 		name:                      "node",
 		listFunction:              k.listNodes,
 		requireScrapeEnabledLabel: k.requireScrapeEnabledLabelForNodes,
 		watchFunction: func() (watch.Interface, error) {
-			return k.client.CoreV1().Nodes().Watch(context.TODO(), metav1.ListOptions{})
+			return k.client.CoreV1().Nodes().Watch(k.ctx, metav1.ListOptions{})
 		},
 	}, {
 		name:                      "service",
 		requireScrapeEnabledLabel: true,
 		listFunction:              k.listServices,
 		watchFunction: func() (watch.Interface, error) {
-			return k.client.CoreV1().Services("").Watch(context.TODO(), metav1.ListOptions{})
+			return k.client.CoreV1().Services("").Watch(k.ctx, metav1.ListOptions{})
 		},
 	}, {
 		name:                      "endpoints",
 		requireScrapeEnabledLabel: true,
 		listFunction:              k.listEndpoints,
 		watchFunction: func() (watch.Interface, error) {
-			return k.client.CoreV1().Endpoints("").Watch(context.TODO(), metav1.ListOptions{})
+			return k.client.CoreV1().Endpoints("").Watch(k.ctx, metav1.ListOptions{})
 		},
 	}}
 }
@@ -670,7 +747,7 @@ func (k *kubernetesTargetRetriever) processEvent(event watch.Event, requireLabel
 				debugLogEvent(klog, event.Type, "deleted", object)
 				switch obj := object.(type) {
 				case *corev1.Service:
-					if e, err := k.client.CoreV1().Endpoints(obj.Namespace).Get(context.TODO(), obj.Name, metav1.GetOptions{}); err == nil {
+					if e, err := k.client.CoreV1().Endpoints(obj.Namespace).Get(k.ctx, obj.Name, metav1.GetOptions{}); err == nil {
 						k.targets.Delete(string(e.GetUID()))
 						debugLogEvent(klog, event.Type, "deleted", e)
 					}
@@ -710,7 +787,7 @@ func (k *kubernetesTargetRetriever) isEventScrapable(object metav1.Object) bool
 	scrapable := isObjectScrapable(object, k.scrapeEnabledLabel)
 	switch obj := object.(type) {
 	case *corev1.Endpoints:
-		if s, err := k.client.CoreV1().Services(obj.Namespace).Get(context.TODO(), obj.Name, metav1.GetOptions{}); err == nil {
+		if s, err := k.client.CoreV1().Services(obj.Namespace).Get(k.ctx, obj.Name, metav1.GetOptions{}); err == nil {
 			// For endpoints we need to rely on the service annotations/labels since they are not always propagated
 			scrapable = isObjectScrapable(s, k.scrapeEnabledLabel)
 		}
@@ -731,7 +808,7 @@ func (k *kubernetesTargetRetriever) addTarget(object metav1.Object, event watch.
 			return
 		}
 		// In this case we should fetch the service since the path annotation depends on the service
-		if s, err := k.client.CoreV1().Services(obj.Namespace).Get(context.TODO(), obj.Name, metav1.GetOptions{}); err == nil {
+		if s, err := k.client.CoreV1().Services(obj.Namespace).Get(k.ctx, obj.Name, metav1.GetOptions{}); err == nil {
 			targets = endpointsTargets(obj, s)
 		}
 
@@ -740,7 +817,7 @@ func (k *kubernetesTargetRetriever) addTarget(object metav1.Object, event watch.
 		// In this case we should update as well the endpoints since
 		// the annotation could have been added enabling the scraping not triggering an endpoints events
 		// This is not ideal but its the only way to support annotation since those are not inherited by endpoints
-		if e, err := k.client.CoreV1().Endpoints(obj.Namespace).Get(context.TODO(), obj.Name, metav1.GetOptions{}); err == nil {
+		if e, err := k.client.CoreV1().Endpoints(obj.Namespace).Get(k.ctx, obj.Name, metav1.GetOptions{}); err == nil {
 			endpointsTargets := endpointsTargets(e, obj)
 			if len(endpointsTargets) != 0 {
 				k.targets.Store(string(e.GetUID()), endpointsTargets)
@@ -781,9 +858,10 @@ func debugLogEvent(log *logrus.Entry, event watch.EventType, action string, obje
 
 // watchResource retrieves the scrapable resources and watches for changes
 // on such resources. If the watch connection is terminated, the process is
-// started again to ensure no updates are lost between watch restarts.
+// started again to ensure no updates are lost between watch restarts, until
+// the retriever is stopped.
 func (k *kubernetesTargetRetriever) watchResource(resource watchableResource) {
-	for {
+	for k.ctx.Err() == nil {
 		timer := prometheus.NewTimer(
 			prometheus.ObserverFunc(
 				listTargetsDurationByKind.WithLabelValues(k.Name(), resource.name).Set,
@@ -804,8 +882,8 @@ func (k *kubernetesTargetRetriever) watchResource(resource watchableResource) {
 			)
 			continue
 		}
-		for w := range watches.ResultChan() {
-			k.processEvent(w, resource.requireScrapeEnabledLabel)
+		if !k.processEvents(watches, resource.requireScrapeEnabledLabel) {
+			return
 		}
 		klog.WithError(err).Warnf(
 			"disconnected from %s resource watch, reconnecting",
@@ -813,3 +891,21 @@ func (k *kubernetesTargetRetriever) watchResource(resource watchableResource) {
 		)
 	}
 }
+
+// processEvents processes the events of the watch until it is terminated, or
+// until the retriever is stopped, returning false in that case.
+func (k *kubernetesTargetRetriever) processEvents(watches watch.Interface, requireLabel bool) bool {
+	results := watches.ResultChan()
+	for {
+		select {
+		case <-k.ctx.Done():
+			watches.Stop()
+			return false
+		case w, ok := <-results:
+			if !ok {
+				return true
+			}
+			k.processEvent(w, requireLabel)
+		}
+	}
+}
@@ -650,6 +650,48 @@ func TestWatch_NodeReconnect(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestWatch_Stop(t *testing.T) {
+	t.Parallel()
+
+	client := fake.NewSimpleClientset()
+	retriever := newFakeKubernetesTargetRetriever(client)
+	retriever.watching = true
+
+	watcher := watch.NewRaceFreeFake()
+	resource := watchableResource{
+		name:         "node",
+		listFunction: retriever.listNodes,
+		watchFunction: func() (watch.Interface, error) {
+			return watcher, nil
+		},
+	}
+
+	done := make(chan struct{})
+	go func() {
+		retriever.watchResource(resource)
+		close(done)
+	}()
+	ns := fakeNodeData()
+	watcher.Add(ns[0])
+	require.Eventually(t, func() bool {
+		targets, err := retriever.GetTargets()
+		return err == nil && len(targets) == 2
+	}, 2*time.Second, 10*time.Millisecond)
+
+	retriever.Stop()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the watch didn't end once the retriever was stopped")
+	}
+	assert.True(t, watcher.IsStopped())
+
+	// The targets already retrieved are kept.
+	targets, err := retriever.GetTargets()
+	require.NoError(t, err)
+	assert.Len(t, targets, 2)
+}
+
 func TestWatch_Nodes(t *testing.T) {
 	t.Parallel()
 
@@ -715,13 +757,38 @@ func TestWatch_Nodes_NodesWithNoScrapeLabelAreNotBeingScraped(t *testing.T) {
 	}, retry.Timeout(2*time.Second), retry.Delay(100*time.Millisecond))
 }
 
+func TestWatchContext(t *testing.T) {
+	t.Parallel()
+
+	client := fake.NewSimpleClientset()
+	retriever := newFakeKubernetesTargetRetriever(client)
+	ctx, cancel := context.WithCancel(context.Background())
+	require.NoError(t, WithContext(retriever).WatchContext(ctx))
+	assert.NoError(t, retriever.ctx.Err())
+
+	// The watches end with the context.
+	cancel()
+	require.Eventually(t, func() bool {
+		return retriever.ctx.Err() != nil
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// Retrievers that aren't context-aware aren't watched once it is done.
+	fixed, err := FixedRetriever(TargetConfig{URLs: []string{"http://localhost:9090"}})
+	require.NoError(t, err)
+	assert.ErrorIs(t, WithContext(fixed).WatchContext(ctx), context.Canceled)
+}
+
 func newFakeKubernetesTargetRetriever(client *fake.Clientset) *kubernetesTargetRetriever {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &kubernetesTargetRetriever{
+		ctx:                ctx,
+		cancel:             cancel,
 		client:             client,
 		targets:            new(sync.Map),
 		scrapeEnabledLabel: "prometheus.io/scrape",
 		scrapeServices:     true,
 		scrapeEndpoints:    true,
+		secrets:            newSecretCache(client),
 	}
 }
 
@@ -2446,3 +2513,101 @@ func TestServiceTargetsPathLabel(t *testing.T) {
 		},
 	)
 }
+
+func TestTargetsCompressionAnnotation(t *testing.T) {
+	t.Parallel()
+
+	meta := metav1.ObjectMeta{
+		Name:      "my-object",
+		Namespace: "test-ns",
+		Annotations: map[string]string{
+			"prometheus.io/port":        "8080",
+			"prometheus.io/compression": "zstd,gzip",
+		},
+		Labels: map[string]string{
+			// annotation should override this.
+			"prometheus.io/compression": "none",
+		},
+	}
+	service := &corev1.Service{
+		ObjectMeta: meta,
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{{Port: 8080}},
+		},
+	}
+
+	var targets []Target
+	targets = append(targets, podTargets(&corev1.Pod{
+		ObjectMeta: meta,
+		Status:     corev1.PodStatus{PodIP: "10.0.0.1"},
+	})...)
+	targets = append(targets, serviceTargets(service)...)
+	targets = append(targets, endpointsTargets(&corev1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Name: "my-object", Namespace: "test-ns"},
+		Subsets: []corev1.EndpointSubset{{
+			Addresses: []corev1.EndpointAddress{{IP: "10.0.0.1"}},
+			Ports:     []corev1.EndpointPort{{Port: 8080, Protocol: corev1.ProtocolTCP}},
+		}},
+	}, service)...)
+
+	require.Len(t, targets, 3)
+	for _, target := range targets {
+		assert.Equal(t, "zstd,gzip", target.Compression, target.Object.Kind)
+	}
+
+	// Targets without the annotation nor the label use the default.
+	delete(meta.Annotations, "prometheus.io/compression")
+	meta.Labels = nil
+	pods := podTargets(&corev1.Pod{ObjectMeta: meta, Status: corev1.PodStatus{PodIP: "10.0.0.1"}})
+	require.Len(t, pods, 1)
+	assert.Empty(t, pods[0].Compression)
+}
+
+func TestTargetsTLSServerNameAnnotation(t *testing.T) {
+	t.Parallel()
+
+	meta := metav1.ObjectMeta{
+		Name:      "my-object",
+		Namespace: "test-ns",
+		Annotations: map[string]string{
+			"prometheus.io/port":            "8080",
+			"prometheus.io/tls-server-name": "my-object.test-ns.svc",
+		},
+		Labels: map[string]string{
+			// annotation should override this.
+			"prometheus.io/tls-server-name": "other",
+		},
+	}
+	service := &corev1.Service{
+		ObjectMeta: meta,
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{{Port: 8080}},
+		},
+	}
+
+	var targets []Target
+	targets = append(targets, podTargets(&corev1.Pod{
+		ObjectMeta: meta,
+		Status:     corev1.PodStatus{PodIP: "10.0.0.1"},
+	})...)
+	targets = append(targets, serviceTargets(service)...)
+	targets = append(targets, endpointsTargets(&corev1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Name: "my-object", Namespace: "test-ns"},
+		Subsets: []corev1.EndpointSubset{{
+			Addresses: []corev1.EndpointAddress{{IP: "10.0.0.1"}},
+			Ports:     []corev1.EndpointPort{{Port: 8080, Protocol: corev1.ProtocolTCP}},
+		}},
+	}, service)...)
+
+	require.Len(t, targets, 3)
+	for _, target := range targets {
+		assert.Equal(t, TLSConfig{ServerName: "my-object.test-ns.svc"}, target.TLSConfig, target.Object.Kind)
+	}
+
+	// Targets without the annotation nor the label have no TLS configuration of their own.
+	delete(meta.Annotations, "prometheus.io/tls-server-name")
+	meta.Labels = nil
+	pods := podTargets(&corev1.Pod{ObjectMeta: meta, Status: corev1.PodStatus{PodIP: "10.0.0.1"}})
+	require.Len(t, pods, 1)
+	assert.True(t, pods[0].TLSConfig.IsZero())
+}
@@ -0,0 +1,58 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package endpoints
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// proxySchemes are the schemes of the proxies the targets can be scraped through.
+var proxySchemes = map[string]bool{
+	"http":    true,
+	"https":   true,
+	"socks5":  true,
+	"socks5h": true,
+}
+
+// Proxy configures the proxy the targets are scraped through.
+type Proxy struct {
+	// URL of the proxy, with the http or https scheme for HTTP CONNECT proxies, or socks5.
+	URL string `mapstructure:"proxy_url"`
+	// NoProxy is a comma separated list of the hosts, domain names, IP addresses and CIDR ranges of the targets
+	// scraped without the proxy, like the NO_PROXY environment variable. Loopback addresses never use the proxy.
+	NoProxy string `mapstructure:"no_proxy"`
+}
+
+// IsZero tells whether no proxy option is configured.
+func (p Proxy) IsZero() bool {
+	return p == Proxy{}
+}
+
+// Or returns the proxy with the options it doesn't set taken from the given one.
+func (p Proxy) Or(defaults Proxy) Proxy {
+	if p.URL == "" {
+		p.URL = defaults.URL
+	}
+	if p.NoProxy == "" {
+		p.NoProxy = defaults.NoProxy
+	}
+	return p
+}
+
+// Validate returns an error when the URL of the proxy is not valid.
+func (p Proxy) Validate() error {
+	if p.URL == "" {
+		return nil
+	}
+	u, err := url.Parse(p.URL)
+	if err != nil {
+		return fmt.Errorf("parsing proxy url: %w", err)
+	}
+	if !proxySchemes[u.Scheme] || u.Host == "" {
+		return fmt.Errorf("proxy url %q must be like http://host:port, https://host:port or socks5://host:port",
+			u.Redacted())
+	}
+	return nil
+}
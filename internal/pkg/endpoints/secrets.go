@@ -0,0 +1,164 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package endpoints
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Annotations referencing the Secrets, in the namespace of the annotated object, holding the credentials of the
+// target:
+//   - basic auth: the `username` and `password` keys.
+//   - bearer token: the `token` key.
+//   - headers: every key is the name of a header with its value.
+//   - OAuth2: the `client_id`, `client_secret` and `token_url` keys, and optionally `scopes`, separated by spaces
+//     or commas.
+const (
+	basicAuthSecretAnnotation   = "prometheus.io/basic-auth-secret"
+	bearerTokenSecretAnnotation = "prometheus.io/bearer-token-secret"
+	headersSecretAnnotation     = "prometheus.io/headers-secret"
+	oauth2SecretAnnotation      = "prometheus.io/oauth2-secret"
+)
+
+// secretCacheTTL is how long the Secrets are cached for, so they aren't read for every scrape but their changes are
+// seen soon.
+const secretCacheTTL = time.Minute
+
+// authSecrets are the names of the Secrets holding the credentials of a target.
+type authSecrets struct {
+	namespace   string
+	basicAuth   string
+	bearerToken string
+	headers     string
+	oauth2      string
+}
+
+func (s authSecrets) isZero() bool {
+	return s.basicAuth == "" && s.bearerToken == "" && s.headers == "" && s.oauth2 == ""
+}
+
+// getAuthSecrets returns the Secrets the annotations of the object reference. Unlike the other settings, they
+// can't be set with labels.
+func getAuthSecrets(o metav1.Object) authSecrets {
+	annotations := o.GetAnnotations()
+	s := authSecrets{
+		basicAuth:   annotations[basicAuthSecretAnnotation],
+		bearerToken: annotations[bearerTokenSecretAnnotation],
+		headers:     annotations[headersSecretAnnotation],
+		oauth2:      annotations[oauth2SecretAnnotation],
+	}
+	if !s.isZero() {
+		s.namespace = o.GetNamespace()
+	}
+	return s
+}
+
+type cachedSecret struct {
+	data    map[string][]byte
+	expires time.Time
+}
+
+// secretCache reads Secrets, caching them for secretCacheTTL.
+type secretCache struct {
+	client  kubernetes.Interface
+	lock    sync.Mutex
+	secrets map[string]cachedSecret
+	now     func() time.Time
+}
+
+func newSecretCache(client kubernetes.Interface) *secretCache {
+	return &secretCache{
+		client:  client,
+		secrets: map[string]cachedSecret{},
+		now:     time.Now,
+	}
+}
+
+// get returns the data of the Secret. Secrets that can't be read aren't cached, so they are read again next time.
+func (c *secretCache) get(namespace, name string) (map[string][]byte, error) {
+	key := namespace + "/" + name
+	now := c.now()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if s, ok := c.secrets[key]; ok && now.Before(s.expires) {
+		return s.data, nil
+	}
+	secret, err := c.client.CoreV1().Secrets(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		delete(c.secrets, key)
+		return nil, fmt.Errorf("reading secret %s: %w", key, err)
+	}
+	c.secrets[key] = cachedSecret{data: secret.Data, expires: now.Add(secretCacheTTL)}
+	return secret.Data, nil
+}
+
+// auth returns the authentication configured by the Secrets.
+func (c *secretCache) auth(s authSecrets) (Auth, error) {
+	var auth Auth
+	read := func(name string, required ...string) (map[string][]byte, error) {
+		data, err := c.get(s.namespace, name)
+		if err != nil {
+			return nil, err
+		}
+		for _, k := range required {
+			if len(data[k]) == 0 {
+				return nil, fmt.Errorf("secret %s/%s has no %q key", s.namespace, name, k)
+			}
+		}
+		return data, nil
+	}
+
+	if s.basicAuth != "" {
+		data, err := read(s.basicAuth, "username")
+		if err != nil {
+			return Auth{}, err
+		}
+		auth.BasicAuth = BasicAuth{Username: string(data["username"]), Password: string(data["password"])}
+	}
+	if s.bearerToken != "" {
+		data, err := read(s.bearerToken, "token")
+		if err != nil {
+			return Auth{}, err
+		}
+		auth.BearerToken = strings.TrimSpace(string(data["token"]))
+	}
+	if s.headers != "" {
+		data, err := read(s.headers)
+		if err != nil {
+			return Auth{}, err
+		}
+		auth.Headers = make(map[string]string, len(data))
+		for k, v := range data {
+			auth.Headers[k] = string(v)
+		}
+	}
+	if s.oauth2 != "" {
+		data, err := read(s.oauth2, "client_id", "token_url")
+		if err != nil {
+			return Auth{}, err
+		}
+		auth.OAuth2 = OAuth2{
+			ClientID:     string(data["client_id"]),
+			ClientSecret: string(data["client_secret"]),
+			TokenURL:     string(data["token_url"]),
+			Scopes: strings.FieldsFunc(string(data["scopes"]), func(r rune) bool {
+				return r == ' ' || r == ','
+			}),
+		}
+	}
+
+	if err := auth.Validate(); err != nil {
+		return Auth{}, fmt.Errorf("invalid authentication from secrets: %w", err)
+	}
+	return auth, nil
+}
@@ -0,0 +1,127 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package endpoints
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func secret(name string, data map[string]string) *corev1.Secret {
+	s := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "test-ns"},
+		Data:       map[string][]byte{},
+	}
+	for k, v := range data {
+		s.Data[k] = []byte(v)
+	}
+	return s
+}
+
+func annotatedPod(name string, annotations map[string]string) *corev1.Pod {
+	annotations["prometheus.io/port"] = "8080"
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   "test-ns",
+			Annotations: annotations,
+		},
+		Status: corev1.PodStatus{PodIP: "10.0.0.1"},
+	}
+}
+
+func TestGetTargets_AuthSecrets(t *testing.T) {
+	t.Parallel()
+
+	client := fake.NewSimpleClientset(
+		secret("basic", map[string]string{"username": "user", "password": "pass"}),
+		secret("headers", map[string]string{"X-Api-Key": "key"}),
+		secret("oauth2", map[string]string{
+			"client_id":     "id",
+			"client_secret": "secret",
+			"token_url":     "https://auth/token",
+			"scopes":        "read, metrics",
+		}),
+	)
+	retriever := newFakeKubernetesTargetRetriever(client)
+
+	pods := []*corev1.Pod{
+		annotatedPod("basic-auth", map[string]string{
+			"prometheus.io/basic-auth-secret": "basic",
+			"prometheus.io/headers-secret":    "headers",
+		}),
+		annotatedPod("oauth2", map[string]string{"prometheus.io/oauth2-secret": "oauth2"}),
+		annotatedPod("missing-secret", map[string]string{"prometheus.io/bearer-token-secret": "missing"}),
+		annotatedPod("no-auth", map[string]string{}),
+	}
+	for _, p := range pods {
+		retriever.targets.Store(p.Name, podTargets(p))
+	}
+
+	targets, err := retriever.GetTargets()
+	require.NoError(t, err)
+	auths := map[string]Auth{}
+	for _, target := range targets {
+		auths[target.Name] = target.Auth
+	}
+
+	assert.Equal(t, map[string]Auth{
+		"basic-auth": {
+			BasicAuth: BasicAuth{Username: "user", Password: "pass"},
+			Headers:   map[string]string{"X-Api-Key": "key"},
+		},
+		"oauth2": {
+			OAuth2: OAuth2{
+				ClientID:     "id",
+				ClientSecret: "secret",
+				TokenURL:     "https://auth/token",
+				Scopes:       []string{"read", "metrics"},
+			},
+		},
+		// Targets whose secrets can't be read are still scraped.
+		"missing-secret": {},
+		"no-auth":        {},
+	}, auths)
+}
+
+func TestSecretCache(t *testing.T) {
+	t.Parallel()
+
+	client := fake.NewSimpleClientset(secret("token", map[string]string{"token": "first"}))
+	cache := newSecretCache(client)
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+	secrets := authSecrets{namespace: "test-ns", bearerToken: "token"}
+
+	auth, err := cache.auth(secrets)
+	require.NoError(t, err)
+	assert.Equal(t, "first", auth.BearerToken)
+
+	_, err = client.CoreV1().Secrets("test-ns").Update(context.TODO(), secret("token", map[string]string{"token": "second"}), metav1.UpdateOptions{})
+	require.NoError(t, err)
+
+	// Secrets are cached for a while, and read again once they expire.
+	auth, err = cache.auth(secrets)
+	require.NoError(t, err)
+	assert.Equal(t, "first", auth.BearerToken)
+
+	now = now.Add(secretCacheTTL)
+	auth, err = cache.auth(secrets)
+	require.NoError(t, err)
+	assert.Equal(t, "second", auth.BearerToken)
+
+	// Secrets lacking the required keys are errors.
+	_, err = client.CoreV1().Secrets("test-ns").Update(context.TODO(), secret("token", map[string]string{}), metav1.UpdateOptions{})
+	require.NoError(t, err)
+	now = now.Add(secretCacheTTL)
+	_, err = cache.auth(secrets)
+	assert.Error(t, err)
+}
@@ -0,0 +1,84 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package endpoints
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+)
+
+// tlsVersions are the TLS versions that can be configured.
+var tlsVersions = map[string]uint16{
+	"TLS10": tls.VersionTLS10,
+	"TLS11": tls.VersionTLS11,
+	"TLS12": tls.VersionTLS12,
+	"TLS13": tls.VersionTLS13,
+}
+
+// IsZero tells whether no TLS option is configured.
+func (c TLSConfig) IsZero() bool {
+	return c.CaFilePath == "" && c.CertFilePath == "" && c.KeyFilePath == "" && !c.InsecureSkipVerify &&
+		c.ServerName == "" && c.MinVersion == "" && c.MaxVersion == "" && len(c.CipherSuites) == 0 &&
+		!c.AppendSystemCAs
+}
+
+// Validate returns an error when the TLS options are not consistent.
+func (c TLSConfig) Validate() error {
+	if (c.CertFilePath == "") != (c.KeyFilePath == "") {
+		return fmt.Errorf("cert_file_path and key_file_path must be set together")
+	}
+	minVersion, err := ParseTLSVersion(c.MinVersion)
+	if err != nil {
+		return fmt.Errorf("min_version: %w", err)
+	}
+	maxVersion, err := ParseTLSVersion(c.MaxVersion)
+	if err != nil {
+		return fmt.Errorf("max_version: %w", err)
+	}
+	if minVersion != 0 && maxVersion != 0 && minVersion > maxVersion {
+		return fmt.Errorf("min_version %s is greater than max_version %s", c.MinVersion, c.MaxVersion)
+	}
+	if _, err := ParseCipherSuites(c.CipherSuites); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ParseTLSVersion returns the TLS version with the given name, or 0 when it is empty.
+func ParseTLSVersion(name string) (uint16, error) {
+	if name == "" {
+		return 0, nil
+	}
+	v, ok := tlsVersions[strings.ToUpper(name)]
+	if !ok {
+		return 0, fmt.Errorf("unknown TLS version %q, expected one of TLS10, TLS11, TLS12 or TLS13", name)
+	}
+	return v, nil
+}
+
+// ParseCipherSuites returns the IDs of the cipher suites with the given names, as named by the crypto/tls package.
+// Insecure cipher suites are allowed, since some targets might only support them.
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	suites := map[string]uint16{}
+	for _, s := range tls.CipherSuites() {
+		suites[s.Name] = s.ID
+	}
+	for _, s := range tls.InsecureCipherSuites() {
+		suites[s.Name] = s.ID
+	}
+
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := suites[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
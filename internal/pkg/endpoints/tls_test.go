@@ -0,0 +1,79 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package endpoints
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTLSConfig_Validate(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name  string
+		cfg   TLSConfig
+		valid bool
+	}{
+		{
+			name:  "none",
+			valid: true,
+		},
+		{
+			name: "all the options",
+			cfg: TLSConfig{
+				CaFilePath:      "/ca.crt",
+				CertFilePath:    "/tls.crt",
+				KeyFilePath:     "/tls.key",
+				ServerName:      "my-service.my-namespace.svc",
+				MinVersion:      "TLS12",
+				MaxVersion:      "tls13",
+				CipherSuites:    []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "TLS_RSA_WITH_AES_128_CBC_SHA"},
+				AppendSystemCAs: true,
+			},
+			valid: true,
+		},
+		{
+			name: "certificate without key",
+			cfg:  TLSConfig{CertFilePath: "/tls.crt"},
+		},
+		{
+			name: "unknown version",
+			cfg:  TLSConfig{MinVersion: "SSL3"},
+		},
+		{
+			name: "min version greater than max version",
+			cfg:  TLSConfig{MinVersion: "TLS13", MaxVersion: "TLS12"},
+		},
+		{
+			name: "unknown cipher suite",
+			cfg:  TLSConfig{CipherSuites: []string{"TLS_NOT_A_CIPHER"}},
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			err := tc.cfg.Validate()
+			if tc.valid {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestFixedRetriever_InvalidTLSConfig(t *testing.T) {
+	t.Parallel()
+
+	_, err := FixedRetriever(TargetConfig{
+		URLs:      []string{"https://localhost:9100"},
+		TLSConfig: TLSConfig{MaxVersion: "TLS14"},
+	})
+	assert.Error(t, err)
+}
@@ -0,0 +1,80 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package prometheus
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Content encodings scrape responses can be compressed with.
+const (
+	EncodingGzip = "gzip"
+	EncodingZstd = "zstd"
+	// CompressionNone asks for uncompressed scrape responses.
+	CompressionNone = "none"
+)
+
+// decompressors return a reader of the body decoded with each of the
+// supported content encodings.
+var decompressors = map[string]func(io.Reader) (io.ReadCloser, error){
+	EncodingGzip: func(r io.Reader) (io.ReadCloser, error) {
+		return gzip.NewReader(r)
+	},
+	EncodingZstd: func(r io.Reader) (io.ReadCloser, error) {
+		d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	},
+}
+
+// AcceptEncoding returns the Accept-Encoding header asking for the encodings
+// of a compression setting, which is a comma separated list of them in order
+// of preference. It returns an empty header for an empty setting or "none".
+func AcceptEncoding(compression string) (string, error) {
+	compression = strings.TrimSpace(compression)
+	if compression == "" || compression == CompressionNone {
+		return "", nil
+	}
+
+	var accepted []string
+	seen := map[string]bool{}
+	for _, e := range strings.Split(compression, ",") {
+		e = strings.ToLower(strings.TrimSpace(e))
+		if _, ok := decompressors[e]; !ok {
+			return "", fmt.Errorf("unsupported compression %q, it must be %q, %q or %q", e, EncodingGzip, EncodingZstd, CompressionNone)
+		}
+		if seen[e] {
+			return "", fmt.Errorf("compression %q is repeated", e)
+		}
+		seen[e] = true
+		// Every encoding is less preferred than the previous one.
+		accepted = append(accepted, fmt.Sprintf("%s;q=%.1f", e, 1-0.1*float64(len(accepted))))
+	}
+	return strings.Join(accepted, ", "), nil
+}
+
+// decompress returns a reader of the body decoded with the content encoding
+// of the response.
+func decompress(body io.Reader, header http.Header) (io.ReadCloser, error) {
+	encoding := strings.ToLower(strings.TrimSpace(header.Get("Content-Encoding")))
+	if encoding == "" || encoding == "identity" {
+		return io.NopCloser(body), nil
+	}
+	d, ok := decompressors[encoding]
+	if !ok {
+		return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+	}
+	r, err := d(body)
+	if err != nil {
+		return nil, fmt.Errorf("decoding the %s body: %w", encoding, err)
+	}
+	return r, nil
+}
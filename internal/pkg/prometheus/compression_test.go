@@ -0,0 +1,165 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package prometheus
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAcceptEncoding(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		compression string
+		expected    string
+		err         bool
+	}{
+		{compression: "", expected: ""},
+		{compression: "none", expected: ""},
+		{compression: "gzip", expected: "gzip;q=1.0"},
+		{compression: "zstd, GZIP", expected: "zstd;q=1.0, gzip;q=0.9"},
+		{compression: "br", err: true},
+		{compression: "gzip,gzip", err: true},
+		{compression: "gzip,none", err: true},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.compression, func(t *testing.T) {
+			t.Parallel()
+
+			header, err := AcceptEncoding(tc.compression)
+			if tc.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, header)
+		})
+	}
+}
+
+func compress(t *testing.T, encoding string, payload string) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case EncodingGzip:
+		w = gzip.NewWriter(&buf)
+	case EncodingZstd:
+		zw, err := zstd.NewWriter(&buf)
+		require.NoError(t, err)
+		w = zw
+	default:
+		return []byte(payload)
+	}
+	_, err := io.WriteString(w, payload)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func TestScrape_Compression(t *testing.T) {
+	t.Parallel()
+
+	payload := "# TYPE requests_total counter\nrequests_total 1\n" +
+		strings.Repeat("# A comment making the payload compressible.\n", 100) +
+		"# TYPE temperature gauge\ntemperature 21.5\n"
+
+	testCases := []struct {
+		name        string
+		compression string
+		encoding    string
+		limits      ScrapeLimits
+		expected    error
+	}{
+		{
+			name: "uncompressed",
+		},
+		{
+			name:        "gzip",
+			compression: "gzip",
+			encoding:    EncodingGzip,
+		},
+		{
+			name:        "zstd",
+			compression: "zstd,gzip",
+			encoding:    EncodingZstd,
+		},
+		{
+			name:        "decompressed body over the body size limit",
+			compression: "gzip",
+			encoding:    EncodingGzip,
+			limits:      ScrapeLimits{MaxBodySize: int64(len(payload)) - 1},
+			expected:    ErrBodySizeLimit,
+		},
+	}
+
+	// Like the fetcher's, the client doesn't ask for compressed responses
+	// on its own.
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			body := compress(t, tc.encoding, payload)
+			var acceptEncoding string
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				acceptEncoding = r.Header.Get("Accept-Encoding")
+				if tc.encoding != "" {
+					w.Header().Set("Content-Encoding", tc.encoding)
+				}
+				_, _ = w.Write(body)
+			}))
+			t.Cleanup(ts.Close)
+
+			header, err := AcceptEncoding(tc.compression)
+			require.NoError(t, err)
+
+			var families []string
+			err = Scrape(client, ts.URL, "", "15", ScrapeOptions{Limits: tc.limits, AcceptEncoding: header}, func(mf *dto.MetricFamily) error {
+				families = append(families, mf.GetName())
+				return nil
+			})
+			assert.Equal(t, header, acceptEncoding)
+			if tc.expected != nil {
+				assert.ErrorIs(t, err, tc.expected)
+				return
+			}
+			require.NoError(t, err)
+			assert.ElementsMatch(t, []string{"requests_total", "temperature"}, families)
+
+			assert.Equal(t, float64(len(payload)), testutil.ToFloat64(targetSize.WithLabelValues(ts.URL)))
+			assert.Equal(t, float64(len(body)), testutil.ToFloat64(targetCompressedSize.WithLabelValues(ts.URL)))
+		})
+	}
+}
+
+func TestScrape_UnsupportedEncoding(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "br")
+		_, _ = io.WriteString(w, "requests_total 1\n")
+	}))
+	t.Cleanup(ts.Close)
+
+	err := Scrape(http.DefaultClient, ts.URL, "", "15", ScrapeOptions{}, func(*dto.MetricFamily) error {
+		return nil
+	})
+	assert.Error(t, err)
+}
@@ -22,9 +22,27 @@ var (
 		Name:      "total_payload_size",
 		Help:      "Total size of the payloads scraped",
 	})
+	targetCompressedSize = prom.NewGaugeVec(prom.GaugeOpts{
+		Namespace: "nr_stats",
+		Subsystem: "integration",
+		Name:      "payload_compressed_size",
+		Help:      "Size of target's payload as received, before decompressing it",
+	},
+		[]string{
+			"target",
+		},
+	)
+	totalScrapedCompressedPayload = prom.NewGauge(prom.GaugeOpts{
+		Namespace: "nr_stats",
+		Subsystem: "integration",
+		Name:      "total_payload_compressed_size",
+		Help:      "Total size of the payloads scraped as received, before decompressing them",
+	})
 )
 
 func init() {
 	prom.MustRegister(targetSize)
 	prom.MustRegister(totalScrapedPayload)
+	prom.MustRegister(targetCompressedSize)
+	prom.MustRegister(totalScrapedCompressedPayload)
 }
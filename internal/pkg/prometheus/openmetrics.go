@@ -0,0 +1,556 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package prometheus
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const openMetricsEOF = "# EOF"
+
+// The protobuf format has no types for the OpenMetrics info and stateset
+// families, so the OpenMetrics decoder gives them these ones. Their metrics
+// hold their values in the Gauge field.
+const (
+	MetricTypeInfo     dto.MetricType = 100
+	MetricTypeStateset dto.MetricType = 101
+)
+
+// OpenMetrics metric types.
+const (
+	omCounter        = "counter"
+	omGauge          = "gauge"
+	omHistogram      = "histogram"
+	omGaugeHistogram = "gaugehistogram"
+	omStateset       = "stateset"
+	omInfo           = "info"
+	omSummary        = "summary"
+	omUnknown        = "unknown"
+)
+
+// omSuffixes are the suffixes the samples of each metric type can have
+// appended to the name of their family.
+var omSuffixes = map[string][]string{
+	omCounter:        {"_total", "_created", ""},
+	omGauge:          {""},
+	omHistogram:      {"_bucket", "_count", "_sum", "_created"},
+	omGaugeHistogram: {"_bucket", "_gcount", "_gsum"},
+	omStateset:       {""},
+	omInfo:           {"_info"},
+	omSummary:        {"", "_count", "_sum", "_created"},
+	omUnknown:        {""},
+}
+
+// openMetricsDecoder decodes the OpenMetrics text format, which
+// expfmt.NewDecoder only decodes partially: it fails on `# EOF` and `# UNIT`
+// lines and doesn't know about the `_created` samples. It implements
+// expfmt.Decoder.
+//
+// https://github.com/OpenObservability/OpenMetrics/blob/main/specification/OpenMetrics.md
+type openMetricsDecoder struct {
+	r    *bufio.Reader
+	line int
+	eof  bool
+
+	// Family being parsed, from its metadata or from its first sample.
+	name    string
+	omType  string
+	help    *string
+	unit    *string
+	family  *dto.MetricFamily
+	metrics map[string]*dto.Metric
+
+	// keep filters the families, when set. skip is whether the samples of
+	// the family being parsed are skipped, once decided at its first sample.
+	keep FamilyFilter
+	skip *bool
+}
+
+func newOpenMetricsDecoder(r io.Reader, keep FamilyFilter) *openMetricsDecoder {
+	return &openMetricsDecoder{r: bufio.NewReader(r), keep: keep}
+}
+
+// Decode decodes the next metric family into v. It returns io.EOF once the
+// `# EOF` line is reached, and an error if the payload ends without it, since
+// that means it was truncated.
+func (d *openMetricsDecoder) Decode(v *dto.MetricFamily) error {
+	for !d.eof {
+		line, err := d.r.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if line == "" && err == io.EOF {
+			return fmt.Errorf("openmetrics: payload does not end with %q", openMetricsEOF)
+		}
+		d.line++
+		line = strings.TrimSuffix(line, "\n")
+
+		var done *dto.MetricFamily
+		if line == openMetricsEOF {
+			d.eof = true
+			if rest, _ := d.r.ReadString(0); strings.TrimSpace(rest) != "" {
+				return fmt.Errorf("openmetrics: unexpected content after %q", openMetricsEOF)
+			}
+			done = d.flush()
+		} else if strings.HasPrefix(line, "#") {
+			done, err = d.parseMetadata(line)
+		} else {
+			done, err = d.parseSample(line)
+		}
+		if err != nil {
+			return fmt.Errorf("openmetrics: line %d: %w", d.line, err)
+		}
+		if done != nil {
+			proto.Reset(v)
+			proto.Merge(v, done)
+			return nil
+		}
+	}
+	return io.EOF
+}
+
+// startFamily starts a new family, returning the one parsed until now, if any.
+func (d *openMetricsDecoder) startFamily(name string) *dto.MetricFamily {
+	done := d.flush()
+	d.name = name
+	d.omType = omUnknown
+	d.help = nil
+	d.unit = nil
+	d.skip = nil
+	return done
+}
+
+// flush returns the family being parsed, if it has any metric, and resets it.
+func (d *openMetricsDecoder) flush() *dto.MetricFamily {
+	done := d.family
+	d.name = ""
+	d.family = nil
+	d.metrics = nil
+	return done
+}
+
+func (d *openMetricsDecoder) parseMetadata(line string) (*dto.MetricFamily, error) {
+	parts := strings.SplitN(line, " ", 4)
+	if len(parts) < 3 || parts[0] != "#" {
+		// Comments other than metadata aren't part of OpenMetrics, but they are
+		// harmless.
+		return nil, nil
+	}
+	keyword, name := parts[1], parts[2]
+	var text string
+	if len(parts) == 4 {
+		text = parts[3]
+	}
+
+	switch keyword {
+	case "TYPE", "HELP", "UNIT":
+	default:
+		return nil, nil
+	}
+
+	var done *dto.MetricFamily
+	if name != d.name || d.family != nil {
+		done = d.startFamily(name)
+	}
+	switch keyword {
+	case "TYPE":
+		if _, ok := omSuffixes[text]; !ok {
+			return done, fmt.Errorf("invalid metric type %q", text)
+		}
+		d.omType = text
+	case "HELP":
+		help := unescapeOpenMetrics(text)
+		d.help = &help
+	case "UNIT":
+		d.unit = &text
+	}
+	return done, nil
+}
+
+func (d *openMetricsDecoder) parseSample(line string) (*dto.MetricFamily, error) {
+	if line == "" {
+		return nil, nil
+	}
+
+	nameEnd := strings.IndexAny(line, "{ ")
+	if nameEnd <= 0 {
+		return nil, fmt.Errorf("invalid sample %q", line)
+	}
+	name := line[:nameEnd]
+	rest := line[nameEnd:]
+
+	var done *dto.MetricFamily
+	suffix, ok := d.suffix(name)
+	if !ok {
+		// Samples without metadata belong to a family of unknown type.
+		done = d.startFamily(name)
+		suffix = ""
+	}
+	if d.skipping() {
+		return done, nil
+	}
+
+	var lbls []*dto.LabelPair
+	var err error
+	if strings.HasPrefix(rest, "{") {
+		lbls, rest, err = parseOpenMetricsLabels(rest)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var exemplar *dto.Exemplar
+	if i := strings.Index(rest, " # "); i >= 0 {
+		exemplar, err = parseOpenMetricsExemplar(rest[i+3:])
+		if err != nil {
+			return nil, err
+		}
+		rest = rest[:i]
+	}
+
+	fields := strings.Fields(rest)
+	if len(fields) < 1 || len(fields) > 2 || !strings.HasPrefix(rest, " ") {
+		return nil, fmt.Errorf("invalid value and timestamp for sample %q", name)
+	}
+	value, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value for sample %q: %w", name, err)
+	}
+	var timestampMs *int64
+	if len(fields) == 2 {
+		ts, err := parseOpenMetricsTimestamp(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid timestamp for sample %q: %w", name, err)
+		}
+		timestampMs = proto.Int64(ts.UnixNano() / int64(time.Millisecond))
+	}
+
+	if err := d.addSample(suffix, lbls, value, timestampMs, exemplar); err != nil {
+		return done, fmt.Errorf("sample %q: %w", name, err)
+	}
+	return done, nil
+}
+
+// skipping tells whether the samples of the family being parsed are skipped
+// because the filter doesn't keep it. Its name and type are known by its
+// first sample, as the metadata comes before.
+func (d *openMetricsDecoder) skipping() bool {
+	if d.keep == nil {
+		return false
+	}
+	if d.skip == nil {
+		name, t := d.familyNameAndType()
+		skip := !d.keep(name, t)
+		d.skip = &skip
+	}
+	return *d.skip
+}
+
+// suffix returns the suffix of the sample name for the family being parsed,
+// or false if the sample doesn't belong to it.
+func (d *openMetricsDecoder) suffix(name string) (string, bool) {
+	if d.name == "" || !strings.HasPrefix(name, d.name) {
+		return "", false
+	}
+	suffix := name[len(d.name):]
+	for _, s := range omSuffixes[d.omType] {
+		if s == suffix {
+			return suffix, true
+		}
+	}
+	return "", false
+}
+
+func (d *openMetricsDecoder) addSample(suffix string, lbls []*dto.LabelPair, value float64, timestampMs *int64, exemplar *dto.Exemplar) error {
+	if d.family == nil {
+		d.family = d.newFamily()
+		d.metrics = map[string]*dto.Metric{}
+	}
+
+	var le, quantile *float64
+	var err error
+	switch {
+	case suffix == "_bucket":
+		if le, lbls, err = extractFloatLabel(lbls, "le"); err != nil {
+			return err
+		}
+	case d.omType == omSummary && suffix == "":
+		if quantile, lbls, err = extractFloatLabel(lbls, "quantile"); err != nil {
+			return err
+		}
+	}
+
+	key := labelsKey(lbls)
+	m, ok := d.metrics[key]
+	if !ok {
+		m = d.newMetric(lbls)
+		d.metrics[key] = m
+		d.family.Metric = append(d.family.Metric, m)
+	}
+	if timestampMs != nil {
+		m.TimestampMs = timestampMs
+	}
+
+	if suffix == "_created" {
+		created := timestamppb.New(FloatSecondsToTime(value))
+		switch d.omType {
+		case omCounter:
+			m.Counter.CreatedTimestamp = created
+		case omHistogram:
+			m.Histogram.CreatedTimestamp = created
+		case omSummary:
+			m.Summary.CreatedTimestamp = created
+		}
+		return nil
+	}
+
+	switch d.omType {
+	case omCounter:
+		m.Counter.Value = proto.Float64(value)
+		m.Counter.Exemplar = exemplar
+	case omGauge, omStateset, omInfo:
+		m.Gauge.Value = proto.Float64(value)
+	case omUnknown:
+		m.Untyped.Value = proto.Float64(value)
+	case omHistogram, omGaugeHistogram:
+		switch suffix {
+		case "_bucket":
+			if value < 0 || math.IsNaN(value) {
+				return fmt.Errorf("invalid bucket count %g", value)
+			}
+			m.Histogram.Bucket = append(m.Histogram.Bucket, &dto.Bucket{
+				UpperBound:      le,
+				CumulativeCount: proto.Uint64(uint64(value)),
+				Exemplar:        exemplar,
+			})
+		case "_count", "_gcount":
+			m.Histogram.SampleCount = proto.Uint64(uint64(value))
+		case "_sum", "_gsum":
+			m.Histogram.SampleSum = proto.Float64(value)
+		}
+	case omSummary:
+		switch suffix {
+		case "":
+			m.Summary.Quantile = append(m.Summary.Quantile, &dto.Quantile{
+				Quantile: quantile,
+				Value:    proto.Float64(value),
+			})
+		case "_count":
+			m.Summary.SampleCount = proto.Uint64(uint64(value))
+		case "_sum":
+			m.Summary.SampleSum = proto.Float64(value)
+		}
+	}
+	return nil
+}
+
+// newFamily returns the family being parsed.
+func (d *openMetricsDecoder) newFamily() *dto.MetricFamily {
+	name, t := d.familyNameAndType()
+	return &dto.MetricFamily{
+		Name: proto.String(name),
+		Help: d.help,
+		Unit: d.unit,
+		Type: t.Enum(),
+	}
+}
+
+// familyNameAndType returns the name and type of the family being parsed.
+// Counters are named after their `_total` samples and info metrics after
+// their `_info` ones, as the Prometheus text format names them.
+func (d *openMetricsDecoder) familyNameAndType() (string, dto.MetricType) {
+	switch d.omType {
+	case omCounter:
+		if !strings.HasSuffix(d.name, "_total") {
+			return d.name + "_total", dto.MetricType_COUNTER
+		}
+		return d.name, dto.MetricType_COUNTER
+	case omGauge:
+		return d.name, dto.MetricType_GAUGE
+	case omStateset:
+		return d.name, MetricTypeStateset
+	case omInfo:
+		return d.name + "_info", MetricTypeInfo
+	case omHistogram:
+		return d.name, dto.MetricType_HISTOGRAM
+	case omGaugeHistogram:
+		return d.name, dto.MetricType_GAUGE_HISTOGRAM
+	case omSummary:
+		return d.name, dto.MetricType_SUMMARY
+	}
+	return d.name, dto.MetricType_UNTYPED
+}
+
+func (d *openMetricsDecoder) newMetric(lbls []*dto.LabelPair) *dto.Metric {
+	m := &dto.Metric{Label: lbls}
+	switch d.omType {
+	case omCounter:
+		m.Counter = &dto.Counter{}
+	case omGauge, omStateset, omInfo:
+		m.Gauge = &dto.Gauge{}
+	case omHistogram, omGaugeHistogram:
+		m.Histogram = &dto.Histogram{}
+	case omSummary:
+		m.Summary = &dto.Summary{}
+	default:
+		m.Untyped = &dto.Untyped{}
+	}
+	return m
+}
+
+// parseOpenMetricsLabels parses the labels between braces at the start of s,
+// returning them sorted by name together with the rest of s.
+func parseOpenMetricsLabels(s string) ([]*dto.LabelPair, string, error) {
+	var lbls []*dto.LabelPair
+	s = s[1:]
+	for {
+		if strings.HasPrefix(s, "}") {
+			break
+		}
+		eq := strings.IndexByte(s, '=')
+		if eq <= 0 || len(s) < eq+2 || s[eq+1] != '"' {
+			return nil, "", fmt.Errorf("invalid labels")
+		}
+		name := s[:eq]
+		value, rest, err := parseOpenMetricsQuoted(s[eq+1:])
+		if err != nil {
+			return nil, "", err
+		}
+		lbls = append(lbls, &dto.LabelPair{Name: proto.String(name), Value: proto.String(value)})
+
+		switch {
+		case strings.HasPrefix(rest, ","):
+			s = rest[1:]
+		case strings.HasPrefix(rest, "}"):
+			s = rest
+		default:
+			return nil, "", fmt.Errorf("invalid labels")
+		}
+	}
+	sort.Slice(lbls, func(i, j int) bool { return lbls[i].GetName() < lbls[j].GetName() })
+	return lbls, s[1:], nil
+}
+
+// parseOpenMetricsQuoted parses the quoted string at the start of s,
+// returning its unescaped value and the rest of s.
+func parseOpenMetricsQuoted(s string) (string, string, error) {
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			return b.String(), s[i+1:], nil
+		case '\\':
+			if i+1 == len(s) {
+				return "", "", fmt.Errorf("unterminated label value")
+			}
+			i++
+			switch s[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case '"', '\\':
+				b.WriteByte(s[i])
+			default:
+				return "", "", fmt.Errorf("invalid escape sequence \\%c", s[i])
+			}
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return "", "", fmt.Errorf("unterminated label value")
+}
+
+// parseOpenMetricsExemplar parses an exemplar: its labels, value and
+// optional timestamp.
+func parseOpenMetricsExemplar(s string) (*dto.Exemplar, error) {
+	if !strings.HasPrefix(s, "{") {
+		return nil, fmt.Errorf("invalid exemplar %q", s)
+	}
+	lbls, rest, err := parseOpenMetricsLabels(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid exemplar labels: %w", err)
+	}
+	fields := strings.Fields(rest)
+	if len(fields) < 1 || len(fields) > 2 {
+		return nil, fmt.Errorf("invalid exemplar %q", s)
+	}
+	value, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid exemplar value: %w", err)
+	}
+	e := &dto.Exemplar{Label: lbls, Value: proto.Float64(value)}
+	if len(fields) == 2 {
+		ts, err := parseOpenMetricsTimestamp(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid exemplar timestamp: %w", err)
+		}
+		e.Timestamp = timestamppb.New(ts)
+	}
+	return e, nil
+}
+
+// parseOpenMetricsTimestamp parses a timestamp, which OpenMetrics expresses
+// in seconds, possibly fractional.
+func parseOpenMetricsTimestamp(s string) (time.Time, error) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return time.Time{}, fmt.Errorf("non-finite timestamp %q", s)
+	}
+	return FloatSecondsToTime(f), nil
+}
+
+// FloatSecondsToTime converts seconds since the epoch to a time. Current
+// times have microsecond precision as a float64, so the fraction is rounded to
+// microseconds to drop the representation error.
+func FloatSecondsToTime(f float64) time.Time {
+	sec, frac := math.Modf(f)
+	return time.Unix(int64(sec), int64(math.Round(frac*1e6))*int64(time.Microsecond))
+}
+
+// extractFloatLabel removes the label with the given name, returning its
+// value parsed as a float.
+func extractFloatLabel(lbls []*dto.LabelPair, name string) (*float64, []*dto.LabelPair, error) {
+	for i, l := range lbls {
+		if l.GetName() != name {
+			continue
+		}
+		v, err := strconv.ParseFloat(l.GetValue(), 64)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid %q label: %w", name, err)
+		}
+		rest := append(append([]*dto.LabelPair{}, lbls[:i]...), lbls[i+1:]...)
+		return proto.Float64(v), rest, nil
+	}
+	return nil, nil, fmt.Errorf("missing %q label", name)
+}
+
+// labelsKey identifies a set of labels sorted by name.
+func labelsKey(lbls []*dto.LabelPair) string {
+	var b strings.Builder
+	for _, l := range lbls {
+		b.WriteString(l.GetName())
+		b.WriteByte(0xff)
+		b.WriteString(l.GetValue())
+		b.WriteByte(0xff)
+	}
+	return b.String()
+}
+
+var openMetricsHelpUnescaper = strings.NewReplacer(`\\`, `\`, `\n`, "\n", `\"`, `"`)
+
+func unescapeOpenMetrics(s string) string {
+	return openMetricsHelpUnescaper.Replace(s)
+}
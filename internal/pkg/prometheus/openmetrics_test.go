@@ -0,0 +1,172 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package prometheus
+
+import (
+	"io"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func decodeOpenMetrics(t *testing.T, payload string) map[string]*dto.MetricFamily {
+	t.Helper()
+
+	mfs := map[string]*dto.MetricFamily{}
+	d := newOpenMetricsDecoder(strings.NewReader(payload), nil)
+	for {
+		mf := &dto.MetricFamily{}
+		err := d.Decode(mf)
+		if err == io.EOF {
+			return mfs
+		}
+		require.NoError(t, err)
+		mfs[mf.GetName()] = mf
+	}
+}
+
+const openMetricsPayload = `# HELP http_requests Requests "served".
+# TYPE http_requests counter
+http_requests_total{code="200",method="get"} 1027 # {trace_id="abc123"} 1 1520879607.789
+http_requests_created{code="200",method="get"} 1520872607.123
+# TYPE request_duration_seconds histogram
+# UNIT request_duration_seconds seconds
+request_duration_seconds_bucket{le="0.1"} 2
+request_duration_seconds_bucket{le="1"} 3 # {trace_id="def456"} 0.5
+request_duration_seconds_bucket{le="+Inf"} 4
+request_duration_seconds_count 4
+request_duration_seconds_sum 7.5
+request_duration_seconds_created 1520872607.5
+# TYPE rpc_latency summary
+rpc_latency{service="a",quantile="0.5"} 0.2
+rpc_latency{service="a",quantile="0.9"} 0.8
+rpc_latency_count{service="a"} 10
+rpc_latency_sum{service="a"} 3
+# TYPE temperature gauge
+temperature{room="a \"big\" one\\n"} 21.5 1520879607.789
+# TYPE build info
+build_info{version="1.2.3"} 1
+# TYPE door stateset
+door{door="open"} 1
+door{door="closed"} 0
+# TYPE queue_size gaugehistogram
+queue_size_bucket{le="10"} 3
+queue_size_bucket{le="+Inf"} 5
+queue_size_gcount 5
+queue_size_gsum 42
+no_metadata 3
+# EOF
+`
+
+func TestOpenMetricsDecoder(t *testing.T) {
+	mfs := decodeOpenMetrics(t, openMetricsPayload)
+
+	names := []string{}
+	for k := range mfs {
+		names = append(names, k)
+	}
+	assert.ElementsMatch(t, []string{"http_requests_total", "request_duration_seconds", "rpc_latency", "temperature", "build_info", "door", "queue_size", "no_metadata"}, names)
+
+	counter := mfs["http_requests_total"]
+	assert.Equal(t, dto.MetricType_COUNTER, counter.GetType())
+	assert.Equal(t, `Requests "served".`, counter.GetHelp())
+	require.Len(t, counter.GetMetric(), 1)
+	c := counter.GetMetric()[0]
+	assert.Equal(t, 1027.0, c.GetCounter().GetValue())
+	assert.Equal(t, time.Unix(1520872607, 123000000), c.GetCounter().GetCreatedTimestamp().AsTime().Local())
+	assert.Equal(t, "abc123", c.GetCounter().GetExemplar().GetLabel()[0].GetValue())
+	assert.Equal(t, []string{"code=200", "method=get"}, labelStrings(c.GetLabel()))
+
+	hist := mfs["request_duration_seconds"]
+	assert.Equal(t, dto.MetricType_HISTOGRAM, hist.GetType())
+	assert.Equal(t, "seconds", hist.GetUnit())
+	require.Len(t, hist.GetMetric(), 1)
+	h := hist.GetMetric()[0].GetHistogram()
+	assert.Equal(t, uint64(4), h.GetSampleCount())
+	assert.Equal(t, 7.5, h.GetSampleSum())
+	require.Len(t, h.GetBucket(), 3)
+	assert.Equal(t, 1.0, h.GetBucket()[1].GetUpperBound())
+	assert.Equal(t, uint64(3), h.GetBucket()[1].GetCumulativeCount())
+	assert.Equal(t, 0.5, h.GetBucket()[1].GetExemplar().GetValue())
+	assert.True(t, math.IsInf(h.GetBucket()[2].GetUpperBound(), 1))
+	assert.NotNil(t, h.GetCreatedTimestamp())
+
+	summary := mfs["rpc_latency"]
+	assert.Equal(t, dto.MetricType_SUMMARY, summary.GetType())
+	require.Len(t, summary.GetMetric(), 1)
+	s := summary.GetMetric()[0]
+	assert.Equal(t, []string{"service=a"}, labelStrings(s.GetLabel()))
+	assert.Equal(t, uint64(10), s.GetSummary().GetSampleCount())
+	assert.Len(t, s.GetSummary().GetQuantile(), 2)
+
+	gauge := mfs["temperature"].GetMetric()[0]
+	assert.Equal(t, 21.5, gauge.GetGauge().GetValue())
+	assert.Equal(t, int64(1520879607789), gauge.GetTimestampMs())
+	assert.Equal(t, []string{"room=a \"big\" one\\n"}, labelStrings(gauge.GetLabel()))
+
+	assert.Equal(t, MetricTypeInfo, mfs["build_info"].GetType())
+	assert.Equal(t, 1.0, mfs["build_info"].GetMetric()[0].GetGauge().GetValue())
+
+	assert.Equal(t, MetricTypeStateset, mfs["door"].GetType())
+	require.Len(t, mfs["door"].GetMetric(), 2)
+	assert.Equal(t, []string{"door=closed"}, labelStrings(mfs["door"].GetMetric()[1].GetLabel()))
+
+	gh := mfs["queue_size"]
+	assert.Equal(t, dto.MetricType_GAUGE_HISTOGRAM, gh.GetType())
+	require.Len(t, gh.GetMetric(), 1)
+	assert.Equal(t, uint64(5), gh.GetMetric()[0].GetHistogram().GetSampleCount())
+	assert.Equal(t, 42.0, gh.GetMetric()[0].GetHistogram().GetSampleSum())
+	assert.Len(t, gh.GetMetric()[0].GetHistogram().GetBucket(), 2)
+
+	assert.Equal(t, dto.MetricType_UNTYPED, mfs["no_metadata"].GetType())
+	assert.Equal(t, 3.0, mfs["no_metadata"].GetMetric()[0].GetUntyped().GetValue())
+}
+
+func TestOpenMetricsDecoder_Keep(t *testing.T) {
+	t.Parallel()
+
+	const payload = `# TYPE requests counter
+requests_total 1
+# TYPE skipped gauge
+skipped{invalid labels} not-a-number
+# TYPE build info
+build_info{version="1.2.3"} 1
+unknown 3
+# EOF
+`
+	var seen []string
+	keep := func(name string, t dto.MetricType) bool {
+		seen = append(seen, name)
+		return t != dto.MetricType_GAUGE
+	}
+
+	var families []string
+	d := newOpenMetricsDecoder(strings.NewReader(payload), keep)
+	for {
+		mf := &dto.MetricFamily{}
+		err := d.Decode(mf)
+		if err == io.EOF {
+			break
+		}
+		// The samples of the skipped family are not even parsed.
+		require.NoError(t, err)
+		families = append(families, mf.GetName())
+	}
+
+	// The filter is asked once per family, with the names families get.
+	assert.Equal(t, []string{"requests_total", "skipped", "build_info", "unknown"}, seen)
+	assert.Equal(t, []string{"requests_total", "build_info", "unknown"}, families)
+}
+
+func labelStrings(lbls []*dto.LabelPair) []string {
+	s := make([]string, 0, len(lbls))
+	for _, l := range lbls {
+		s = append(s, l.GetName()+"="+l.GetValue())
+	}
+	return s
+}
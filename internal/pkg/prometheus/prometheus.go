@@ -4,10 +4,11 @@
 package prometheus
 
 import (
-	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
+	"mime"
 	"net/http"
 
 	prom "github.com/prometheus/client_golang/prometheus"
@@ -17,7 +18,7 @@ import (
 
 // MetricFamiliesByName is a map of Prometheus metrics family names and their
 // representation.
-type MetricFamiliesByName map[string]dto.MetricFamily
+type MetricFamiliesByName map[string]*dto.MetricFamily
 
 // HTTPDoer executes http requests. It is implemented by *http.Client.
 type HTTPDoer interface {
@@ -28,12 +29,14 @@ type HTTPDoer interface {
 // metric.
 func ResetTotalScrapedPayload() {
 	totalScrapedPayload.Set(0)
+	totalScrapedCompressedPayload.Set(0)
 }
 
 // ResetTargetSize resets the integration targetSize
 // metric.
 func ResetTargetSize() {
 	targetSize.Reset()
+	targetCompressedSize.Reset()
 }
 
 const (
@@ -41,48 +44,213 @@ const (
 	XPrometheusScrapeTimeoutHeader = "X-Prometheus-Scrape-Timeout-Seconds"
 	// AcceptHeader included in all requests
 	AcceptHeader = "Accept"
+	// ProtobufAcceptHeader requests the delimited protobuf exposition format, the only one
+	// carrying native histograms.
+	ProtobufAcceptHeader = "application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited"
+	// DefaultAcceptHeader requests the Prometheus text format. It is taken directly from the
+	// Prometheus server acceptHeader prior to the OpenMetrics support.
+	// https://github.com/prometheus/prometheus/commit/9c03e11c2cf2ad6c638567471faa5c0f6c11ba3d
+	DefaultAcceptHeader = "text/plain;version=0.0.4;q=1,*/*;q=0.1"
+	// NegotiatedAcceptHeader prefers the exposition formats cheaper to parse: protobuf, then
+	// OpenMetrics and finally the Prometheus text format.
+	NegotiatedAcceptHeader = ProtobufAcceptHeader + ";q=0.5," +
+		"application/openmetrics-text;version=1.0.0;q=0.4," +
+		"application/openmetrics-text;version=0.0.1;q=0.3," +
+		"text/plain;version=0.0.4;q=0.2," +
+		"*/*;q=0.1"
 )
 
+// ErrBodySizeLimit and ErrSampleLimit are returned, wrapped, when a scrape
+// exceeds its limits.
+var (
+	ErrBodySizeLimit = errors.New("body size limit exceeded")
+	ErrSampleLimit   = errors.New("sample limit exceeded")
+)
+
+// ScrapeLimits bounds the size of a scrape. Zero values mean no limit.
+type ScrapeLimits struct {
+	// MaxBodySize is the maximum size in bytes of the body of the response,
+	// once decompressed.
+	MaxBodySize int64
+	// MaxSamples is the maximum number of samples, counting each bucket,
+	// quantile, sum and count of histograms and summaries as one.
+	MaxSamples int
+}
+
+// FamilyFilter tells whether a metric family has to be decoded, given its
+// name and type.
+type FamilyFilter func(name string, t dto.MetricType) bool
+
+// ScrapeOptions configure how a payload is scraped and decoded.
+type ScrapeOptions struct {
+	Limits ScrapeLimits
+	// Keep, when set, filters the metric families. The ones it doesn't keep
+	// aren't passed to the callback nor count towards the sample limit, and
+	// their samples aren't even parsed.
+	Keep FamilyFilter
+	// AcceptEncoding, when set, is the Accept-Encoding header of the request,
+	// as returned by the AcceptEncoding function. Responses are decompressed
+	// according to their Content-Encoding whether it is set or not.
+	AcceptEncoding string
+}
+
 // Get scrapes the given URL and decodes the retrieved payload.
 func Get(client HTTPDoer, url string, acceptHeader string, fetchTimeout string) (MetricFamiliesByName, error) {
 	mfs := MetricFamiliesByName{}
-	req, err := http.NewRequest("GET", url, nil)
+	err := Scrape(client, url, acceptHeader, fetchTimeout, ScrapeOptions{}, func(mf *dto.MetricFamily) error {
+		mfs[mf.GetName()] = mf
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return mfs, nil
+}
+
+// StatusError is returned when the response of the exporter has an error
+// status code.
+type StatusError struct {
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("status code returned by the prometheus exporter indicates an error occurred: %d", e.StatusCode)
+}
+
+// Scrape scrapes the given URL and decodes the payload as it is read, calling
+// fn with every metric family. The protobuf and OpenMetrics formats are
+// decoded one family at a time, while the Prometheus text format is decoded
+// at once by its parser. The scrape fails as soon as it exceeds the limits.
+func Scrape(client HTTPDoer, url string, acceptHeader string, fetchTimeout string, opts ScrapeOptions, fn func(*dto.MetricFamily) error) error {
+	return ScrapeContext(context.Background(), client, url, acceptHeader, fetchTimeout, opts, fn)
+}
+
+// ScrapeContext is like Scrape, but the scrape is cancelled once the context
+// is done.
+func ScrapeContext(ctx context.Context, client HTTPDoer, url string, acceptHeader string, fetchTimeout string, opts ScrapeOptions, fn func(*dto.MetricFamily) error) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
-		return mfs, err
+		return err
 	}
 
+	if acceptHeader == "" {
+		acceptHeader = DefaultAcceptHeader
+	}
 	req.Header.Add(AcceptHeader, acceptHeader)
 	req.Header.Add(XPrometheusScrapeTimeoutHeader, fetchTimeout)
+	if opts.AcceptEncoding != "" {
+		req.Header.Set("Accept-Encoding", opts.AcceptEncoding)
+	}
 
 	resp, err := client.Do(req)
 	if err != nil {
-		return mfs, err
+		return err
 	}
+	defer resp.Body.Close()
 
 	if resp.StatusCode < 200 || resp.StatusCode > 300 {
-		return nil, fmt.Errorf("status code returned by the prometheus exporter indicates an error occurred: %d", resp.StatusCode)
+		return &StatusError{StatusCode: resp.StatusCode}
 	}
 
-	body, err := ioutil.ReadAll(resp.Body)
+	limits := opts.Limits
+	if limits.MaxBodySize > 0 && resp.ContentLength > limits.MaxBodySize {
+		return fmt.Errorf("%w: the body has %d bytes, more than the limit of %d", ErrBodySizeLimit, resp.ContentLength, limits.MaxBodySize)
+	}
+	// The body size limit applies to the decompressed body, so it also
+	// bounds compressed bodies expanding into huge ones.
+	received := &limitedReader{r: resp.Body}
+	decoded, err := decompress(received, resp.Header)
 	if err != nil {
-		return mfs, err
+		return err
 	}
-	r := bytes.NewReader(body)
+	defer decoded.Close()
+	body := &limitedReader{r: decoded, max: limits.MaxBodySize}
 
-	d := expfmt.NewDecoder(r, expfmt.FmtText)
+	var samples int
+	d := newDecoder(body, resp.Header, opts.Keep)
 	for {
-		var mf dto.MetricFamily
-		if err := d.Decode(&mf); err != nil {
-			if err == io.EOF {
-				break
-			}
-			return nil, err
+		mf := &dto.MetricFamily{}
+		err := d.Decode(mf)
+		// Decoders read ahead, so the body may exceed the limit before the
+		// family being decoded.
+		if body.exceeded() {
+			return fmt.Errorf("%w: the body is larger than %d bytes", ErrBodySizeLimit, limits.MaxBodySize)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if opts.Keep != nil && !opts.Keep(mf.GetName(), mf.GetType()) {
+			continue
+		}
+		samples += familySamples(mf)
+		if limits.MaxSamples > 0 && samples > limits.MaxSamples {
+			return fmt.Errorf("%w: the payload has more than %d samples", ErrSampleLimit, limits.MaxSamples)
+		}
+		if err := fn(mf); err != nil {
+			return err
 		}
-		mfs[mf.GetName()] = mf
 	}
 
-	bodySize := float64(len(body))
+	bodySize := float64(body.n)
 	targetSize.With(prom.Labels{"target": url}).Set(bodySize)
 	totalScrapedPayload.Add(bodySize)
-	return mfs, nil
+	receivedSize := float64(received.n)
+	targetCompressedSize.With(prom.Labels{"target": url}).Set(receivedSize)
+	totalScrapedCompressedPayload.Add(receivedSize)
+	return nil
+}
+
+// familySamples returns the number of samples of the family in the
+// exposition formats.
+func familySamples(mf *dto.MetricFamily) int {
+	var samples int
+	for _, m := range mf.GetMetric() {
+		switch {
+		case m.GetHistogram() != nil:
+			samples += len(m.GetHistogram().GetBucket()) + 2
+		case m.GetSummary() != nil:
+			samples += len(m.GetSummary().GetQuantile()) + 2
+		default:
+			samples++
+		}
+	}
+	return samples
+}
+
+// limitedReader counts the bytes read, and fails once they are more than max,
+// when it is set.
+type limitedReader struct {
+	r   io.Reader
+	n   int64
+	max int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.n += int64(n)
+	if l.exceeded() {
+		return n, ErrBodySizeLimit
+	}
+	return n, err
+}
+
+func (l *limitedReader) exceeded() bool {
+	return l.max > 0 && l.n > l.max
+}
+
+// newDecoder returns the decoder for the content type of the response. Responses of any
+// other content type are decoded as the Prometheus text format, as they always have been.
+func newDecoder(r io.Reader, header http.Header, keep FamilyFilter) expfmt.Decoder {
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	switch {
+	case mediaType == expfmt.OpenMetricsType:
+		return newOpenMetricsDecoder(r, keep)
+	case expfmt.ResponseFormat(header).FormatType() == expfmt.TypeProtoDelim:
+		return newProtoDecoder(r, keep)
+	}
+	return newTextDecoder(r, keep)
 }
@@ -3,11 +3,19 @@
 package prometheus_test
 
 import (
+	"context"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"strings"
 	"testing"
 
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
 
 	"github.com/newrelic/nri-prometheus/internal/pkg/prometheus"
 )
@@ -42,3 +50,188 @@ func TestGetHeader(t *testing.T) {
 	assert.NoError(t, err)
 	assert.ElementsMatch(t, expected, actual)
 }
+
+func TestGetDefaultAcceptHeader(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, prometheus.DefaultAcceptHeader, r.Header.Get(prometheus.AcceptHeader))
+		_, _ = w.Write([]byte("metric_a 1\n"))
+	}))
+	defer ts.Close()
+
+	_, err := prometheus.Get(http.DefaultClient, ts.URL, "", "15")
+	assert.NoError(t, err)
+}
+
+func TestGetOpenMetrics(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+		_, _ = w.Write([]byte("# TYPE a counter\na_total 1\na_created 1520872607.123\n# TYPE b gauge\n# UNIT b seconds\nb 2\n# EOF\n"))
+	}))
+	defer ts.Close()
+
+	mfs, err := prometheus.Get(http.DefaultClient, ts.URL, "", "15")
+	require.NoError(t, err)
+	actual := []string{}
+	for k := range mfs {
+		actual = append(actual, k)
+	}
+	assert.ElementsMatch(t, []string{"a_total", "b"}, actual)
+}
+
+func TestGetOpenMetrics_Invalid(t *testing.T) {
+	testCases := map[string]string{
+		"missing EOF":          "# TYPE a gauge\na 1\n",
+		"content after EOF":    "a 1\n# EOF\nb 2\n",
+		"invalid type":         "# TYPE a meter\na 1\n# EOF\n",
+		"bucket without le":    "# TYPE a histogram\na_bucket 1\n# EOF\n",
+		"unterminated label":   "a{b=\"c} 1\n# EOF\n",
+		"missing value":        "a{b=\"c\"}\n# EOF\n",
+		"invalid escape":       "a{b=\"\\c\"} 1\n# EOF\n",
+		"invalid exemplar":     "# TYPE a counter\na_total 1 # trace 1\n# EOF\n",
+		"non-finite timestamp": "a 1 NaN\n# EOF\n",
+	}
+
+	for name, payload := range testCases {
+		payload := payload
+		t.Run(name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+				_, _ = w.Write([]byte(payload))
+			}))
+			defer ts.Close()
+
+			_, err := prometheus.Get(http.DefaultClient, ts.URL, "", "15")
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestGetProtobuf(t *testing.T) {
+	mf := &dto.MetricFamily{
+		Name: proto.String("requests_total"),
+		Type: dto.MetricType_COUNTER.Enum(),
+		Metric: []*dto.Metric{
+			{Counter: &dto.Counter{Value: proto.Float64(42)}},
+		},
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		format := expfmt.NewFormat(expfmt.TypeProtoDelim)
+		w.Header().Set("Content-Type", string(format))
+		assert.NoError(t, expfmt.NewEncoder(w, format).Encode(mf))
+	}))
+	defer ts.Close()
+
+	mfs, err := prometheus.Get(http.DefaultClient, ts.URL, "", "15")
+	require.NoError(t, err)
+	assert.Contains(t, mfs, "requests_total")
+}
+
+func TestScrapeLimits(t *testing.T) {
+	t.Parallel()
+
+	const payload = "# TYPE requests counter\n" +
+		"requests_total 1\n" +
+		"# TYPE latency histogram\n" +
+		"latency_bucket{le=\"1\"} 1\n" +
+		"latency_bucket{le=\"+Inf\"} 2\n" +
+		"latency_sum 3\n" +
+		"latency_count 2\n" +
+		"# EOF\n"
+
+	testCases := []struct {
+		name     string
+		chunked  bool
+		limits   prometheus.ScrapeLimits
+		keep     prometheus.FamilyFilter
+		expected error
+		families []string
+	}{
+		{
+			name:     "no limits",
+			families: []string{"requests_total", "latency"},
+		},
+		{
+			name:   "within the limits",
+			limits: prometheus.ScrapeLimits{MaxBodySize: int64(len(payload)), MaxSamples: 5},
+			// The histogram has two buckets, a sum and a count.
+			families: []string{"requests_total", "latency"},
+		},
+		{
+			name:     "content length over the body size limit",
+			limits:   prometheus.ScrapeLimits{MaxBodySize: int64(len(payload)) - 1},
+			expected: prometheus.ErrBodySizeLimit,
+		},
+		{
+			name:     "chunked body over the body size limit",
+			chunked:  true,
+			limits:   prometheus.ScrapeLimits{MaxBodySize: 30},
+			expected: prometheus.ErrBodySizeLimit,
+		},
+		{
+			name:     "over the sample limit",
+			limits:   prometheus.ScrapeLimits{MaxSamples: 4},
+			expected: prometheus.ErrSampleLimit,
+			families: []string{"requests_total"},
+		},
+		{
+			name:   "filtered families within the sample limit",
+			limits: prometheus.ScrapeLimits{MaxSamples: 1},
+			keep: func(name string, t dto.MetricType) bool {
+				return t != dto.MetricType_HISTOGRAM
+			},
+			families: []string{"requests_total"},
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+				if !tc.chunked {
+					w.Header().Set("Content-Length", strconv.Itoa(len(payload)))
+				}
+				for _, line := range strings.SplitAfter(payload, "\n") {
+					_, _ = io.WriteString(w, line)
+					if tc.chunked {
+						w.(http.Flusher).Flush()
+					}
+				}
+			}))
+			defer ts.Close()
+
+			var families []string
+			err := prometheus.Scrape(http.DefaultClient, ts.URL, "", "15", prometheus.ScrapeOptions{Limits: tc.limits, Keep: tc.keep}, func(mf *dto.MetricFamily) error {
+				families = append(families, mf.GetName())
+				return nil
+			})
+			if tc.expected != nil {
+				assert.ErrorIs(t, err, tc.expected)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tc.families, families)
+		})
+	}
+}
+
+func TestScrapeContext(t *testing.T) {
+	requests := make(chan struct{}, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- struct{}{}
+		<-r.Context().Done()
+	}))
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-requests
+		cancel()
+	}()
+	err := prometheus.ScrapeContext(ctx, http.DefaultClient, ts.URL, "", "15", prometheus.ScrapeOptions{}, func(*dto.MetricFamily) error {
+		return nil
+	})
+	assert.ErrorIs(t, err, context.Canceled)
+}
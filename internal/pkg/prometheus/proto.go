@@ -0,0 +1,133 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package prometheus
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// Field numbers of the MetricFamily message.
+const (
+	familyNameField = 1
+	familyTypeField = 3
+)
+
+// protoDecoder decodes the delimited protobuf format like the expfmt decoder,
+// but it reads the name and type of every family before unmarshalling it, so
+// the families the filter doesn't keep are skipped without decoding their
+// metrics. It implements expfmt.Decoder.
+type protoDecoder struct {
+	r    *bufio.Reader
+	keep FamilyFilter
+	// buf holds the message being decoded, and is reused for the next ones.
+	buf bytes.Buffer
+}
+
+func newProtoDecoder(r io.Reader, keep FamilyFilter) *protoDecoder {
+	return &protoDecoder{r: bufio.NewReader(r), keep: keep}
+}
+
+// Decode decodes the next metric family kept by the filter into v. It returns
+// io.EOF once the body is read.
+func (d *protoDecoder) Decode(v *dto.MetricFamily) error {
+	for {
+		size, err := binary.ReadUvarint(d.r)
+		if err != nil {
+			return err
+		}
+		if size > math.MaxInt64 {
+			return fmt.Errorf("metric family of %d bytes", size)
+		}
+		// The buffer grows as the message is read, so a corrupt size can't
+		// allocate more than the body.
+		d.buf.Reset()
+		if _, err := io.CopyN(&d.buf, d.r, int64(size)); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		msg := d.buf.Bytes()
+
+		if d.keep != nil {
+			name, t, err := familyNameAndType(msg)
+			if err != nil {
+				return err
+			}
+			if !d.keep(name, t) {
+				continue
+			}
+		}
+
+		if err := proto.Unmarshal(msg, v); err != nil {
+			return err
+		}
+		return validateFamily(v)
+	}
+}
+
+// familyNameAndType reads the name and type of a marshaled MetricFamily,
+// without unmarshalling its metrics.
+func familyNameAndType(b []byte) (string, dto.MetricType, error) {
+	var name string
+	var t dto.MetricType
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return "", 0, fmt.Errorf("reading metric family: %w", protowire.ParseError(n))
+		}
+		b = b[n:]
+		switch {
+		case num == familyNameField && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return "", 0, fmt.Errorf("reading metric family name: %w", protowire.ParseError(n))
+			}
+			name = string(v)
+			b = b[n:]
+		case num == familyTypeField && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return "", 0, fmt.Errorf("reading metric family type: %w", protowire.ParseError(n))
+			}
+			t = dto.MetricType(v)
+			b = b[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return "", 0, fmt.Errorf("reading metric family: %w", protowire.ParseError(n))
+			}
+			b = b[n:]
+		}
+	}
+	return name, t, nil
+}
+
+// validateFamily validates the names and label values of the family as the
+// expfmt decoder does.
+func validateFamily(mf *dto.MetricFamily) error {
+	if !model.LegacyValidation.IsValidMetricName(mf.GetName()) {
+		return fmt.Errorf("invalid metric name %q", mf.GetName())
+	}
+	for _, m := range mf.GetMetric() {
+		for _, l := range m.GetLabel() {
+			if !model.LabelValue(l.GetValue()).IsValid() {
+				return fmt.Errorf("invalid label value %q", l.GetValue())
+			}
+			if !model.LegacyValidation.IsValidLabelName(l.GetName()) {
+				return fmt.Errorf("invalid label name %q", l.GetName())
+			}
+		}
+	}
+	return nil
+}
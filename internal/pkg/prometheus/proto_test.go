@@ -0,0 +1,104 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package prometheus
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protodelim"
+	"google.golang.org/protobuf/proto"
+)
+
+func protoPayload(t *testing.T, families ...*dto.MetricFamily) []byte {
+	t.Helper()
+
+	// Unlike the expfmt encoder, protodelim doesn't escape the names.
+	var buf bytes.Buffer
+	for _, mf := range families {
+		_, err := protodelim.MarshalTo(&buf, mf)
+		require.NoError(t, err)
+	}
+	return buf.Bytes()
+}
+
+func gaugeFamily(name string, value float64) *dto.MetricFamily {
+	return &dto.MetricFamily{
+		Name: proto.String(name),
+		Help: proto.String("A gauge."),
+		Type: dto.MetricType_GAUGE.Enum(),
+		Metric: []*dto.Metric{{
+			Label: []*dto.LabelPair{{Name: proto.String("a"), Value: proto.String("b")}},
+			Gauge: &dto.Gauge{Value: proto.Float64(value)},
+		}},
+	}
+}
+
+func TestProtoDecoder(t *testing.T) {
+	t.Parallel()
+
+	families := []*dto.MetricFamily{gaugeFamily("a", 1), gaugeFamily("b", 2)}
+	d := newProtoDecoder(bytes.NewReader(protoPayload(t, families...)), nil)
+	for _, expected := range families {
+		mf := &dto.MetricFamily{}
+		require.NoError(t, d.Decode(mf))
+		assert.True(t, proto.Equal(expected, mf), "family %v", mf)
+	}
+	assert.Equal(t, io.EOF, d.Decode(&dto.MetricFamily{}))
+}
+
+func TestProtoDecoder_Keep(t *testing.T) {
+	t.Parallel()
+
+	counter := &dto.MetricFamily{
+		Name:   proto.String("requests_total"),
+		Type:   dto.MetricType_COUNTER.Enum(),
+		Metric: []*dto.Metric{{Counter: &dto.Counter{Value: proto.Float64(3)}}},
+	}
+	// The metrics of the skipped family are not even unmarshalled.
+	skipped := gaugeFamily("skipped", 1)
+	skipped.Metric[0].Label[0].Name = proto.String("invalid name")
+	payload := protoPayload(t, counter, skipped, gaugeFamily("kept", 2))
+
+	var seen []string
+	keep := func(name string, t dto.MetricType) bool {
+		seen = append(seen, name)
+		return t == dto.MetricType_COUNTER || name == "kept"
+	}
+
+	var families []string
+	d := newProtoDecoder(bytes.NewReader(payload), keep)
+	for {
+		mf := &dto.MetricFamily{}
+		err := d.Decode(mf)
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		families = append(families, mf.GetName())
+	}
+
+	assert.Equal(t, []string{"requests_total", "skipped", "kept"}, seen)
+	assert.Equal(t, []string{"requests_total", "kept"}, families)
+}
+
+func TestProtoDecoder_InvalidNames(t *testing.T) {
+	t.Parallel()
+
+	mf := gaugeFamily("a", 1)
+	mf.Metric[0].Label[0].Name = proto.String("invalid name")
+	d := newProtoDecoder(bytes.NewReader(protoPayload(t, mf)), nil)
+	assert.EqualError(t, d.Decode(&dto.MetricFamily{}), `invalid label name "invalid name"`)
+}
+
+func TestProtoDecoder_Truncated(t *testing.T) {
+	t.Parallel()
+
+	payload := protoPayload(t, gaugeFamily("a", 1))
+	d := newProtoDecoder(bytes.NewReader(payload[:len(payload)-1]), nil)
+	assert.ErrorIs(t, d.Decode(&dto.MetricFamily{}), io.ErrUnexpectedEOF)
+}
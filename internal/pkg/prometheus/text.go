@@ -0,0 +1,212 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package prometheus
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+	"google.golang.org/protobuf/proto"
+)
+
+// textDecoder decodes the Prometheus text format one family at a time, so the
+// families are passed on, and the limits of the scrape checked, as the body is
+// read. expfmt.NewDecoder parses the whole body before returning the first
+// family. The lines of every family are parsed with the expfmt text parser, but
+// the ones of the families the filter doesn't keep, which are known by their
+// TYPE line or else their first sample. It implements expfmt.Decoder.
+//
+// https://prometheus.io/docs/instrumenting/exposition_formats/#text-based-format
+type textDecoder struct {
+	r      *bufio.Reader
+	line   int
+	eof    bool
+	parser expfmt.TextParser
+
+	// next is the first line of the next family, read while looking for the
+	// end of the previous one.
+	next string
+	// Family being read, from its metadata or from its first sample.
+	name     string
+	textType string
+	start    int
+
+	// keep filters the families, when set. skip is whether the lines of the
+	// family being read are skipped, once decided.
+	keep FamilyFilter
+	skip *bool
+}
+
+func newTextDecoder(r io.Reader, keep FamilyFilter) *textDecoder {
+	// The names are validated as expfmt.NewDecoder does for the text format.
+	return &textDecoder{
+		r:      bufio.NewReader(r),
+		parser: expfmt.NewTextParser(model.LegacyValidation),
+		keep:   keep,
+	}
+}
+
+// Decode decodes the next metric family into v. It returns io.EOF once the
+// body is read. The samples of a family have to be consecutive, as they are
+// in the payloads of the Prometheus client libraries.
+func (d *textDecoder) Decode(v *dto.MetricFamily) error {
+	for {
+		lines, err := d.family()
+		if err != nil {
+			return err
+		}
+		if lines == nil {
+			continue
+		}
+		families, err := d.parser.TextToMetricFamilies(bytes.NewReader(lines))
+		if err != nil {
+			return fmt.Errorf("family starting at line %d: %w", d.start, err)
+		}
+		// Families with metadata and no samples are dropped by the parser.
+		for _, mf := range families {
+			proto.Reset(v)
+			proto.Merge(v, mf)
+			return nil
+		}
+	}
+}
+
+// family reads the lines of the next family. They are nil when the family is
+// skipped.
+func (d *textDecoder) family() ([]byte, error) {
+	var buf bytes.Buffer
+	var read bool
+	d.name, d.textType, d.skip = "", "", nil
+	d.start = d.line + 1
+	if d.next != "" {
+		d.start = d.line
+	}
+	for {
+		line := d.next
+		d.next = ""
+		if line == "" {
+			if d.eof {
+				break
+			}
+			var err error
+			line, err = d.r.ReadString('\n')
+			if err == io.EOF {
+				d.eof = true
+			} else if err != nil {
+				return nil, err
+			}
+			if line == "" {
+				continue
+			}
+			d.line++
+		}
+		if !d.inFamily(line) {
+			d.next = line
+			break
+		}
+		read = true
+		if !d.skipping(line) {
+			buf.WriteString(line)
+		}
+	}
+
+	if !read {
+		return nil, io.EOF
+	}
+	if d.skip != nil && *d.skip {
+		return nil, nil
+	}
+	if !bytes.HasSuffix(buf.Bytes(), []byte("\n")) {
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), nil
+}
+
+// skipping tells whether the lines of the family being read are skipped
+// because the filter doesn't keep it, once its TYPE line or its first sample
+// is read. Families of unknown types are kept, for the parser to fail them.
+func (d *textDecoder) skipping(line string) bool {
+	if d.keep == nil {
+		return false
+	}
+	if d.skip == nil {
+		line = strings.TrimSpace(line)
+		if d.textType == "" && (line == "" || line[0] == '#') {
+			return false
+		}
+		t, ok := textTypes[d.textType]
+		if !ok {
+			return false
+		}
+		skip := !d.keep(d.name, t)
+		d.skip = &skip
+	}
+	return *d.skip
+}
+
+// textTypes are the metric types of the TYPE lines of the text format, which
+// are untyped when missing.
+var textTypes = map[string]dto.MetricType{
+	"":                dto.MetricType_UNTYPED,
+	"untyped":         dto.MetricType_UNTYPED,
+	"counter":         dto.MetricType_COUNTER,
+	"gauge":           dto.MetricType_GAUGE,
+	"histogram":       dto.MetricType_HISTOGRAM,
+	"summary":         dto.MetricType_SUMMARY,
+	"gaugehistogram":  dto.MetricType_GAUGE_HISTOGRAM,
+	"gauge_histogram": dto.MetricType_GAUGE_HISTOGRAM,
+}
+
+// inFamily tells whether the line belongs to the family being read. The HELP
+// and TYPE lines of another name, and the samples of another family, start
+// the next one.
+func (d *textDecoder) inFamily(line string) bool {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return true
+	}
+
+	if line[0] == '#' {
+		fields := strings.Fields(line[1:])
+		if len(fields) < 2 || (fields[0] != "HELP" && fields[0] != "TYPE") {
+			return true
+		}
+		if d.name != "" && fields[1] != d.name {
+			return false
+		}
+		d.name = fields[1]
+		if fields[0] == "TYPE" && len(fields) > 2 {
+			d.textType = strings.ToLower(fields[2])
+		}
+		return true
+	}
+
+	name := line
+	if i := strings.IndexAny(line, "{ \t"); i >= 0 {
+		name = line[:i]
+	}
+	if d.name == "" {
+		d.name = name
+		return true
+	}
+	if name == d.name {
+		return true
+	}
+	suffix := strings.TrimPrefix(name, d.name)
+	if suffix == name {
+		return false
+	}
+	switch d.textType {
+	case "histogram", "gaugehistogram", "gauge_histogram":
+		return suffix == "_bucket" || suffix == "_sum" || suffix == "_count"
+	case "summary":
+		return suffix == "_sum" || suffix == "_count"
+	}
+	return false
+}
@@ -0,0 +1,136 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package prometheus
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+const textPayload = `# HELP http_requests_total Requests served.
+# TYPE http_requests_total counter
+http_requests_total{code="200",method="get"} 1027 1395066363000
+http_requests_total{code="400",method="post"} 3 1395066363000
+
+# A comment.
+# HELP request_duration_seconds A histogram.
+# TYPE request_duration_seconds HISTOGRAM
+request_duration_seconds_bucket{le="0.1"} 2
+request_duration_seconds_bucket{le="+Inf"} 4
+request_duration_seconds_sum 7.5
+request_duration_seconds_count 4
+# TYPE rpc_latency summary
+rpc_latency{quantile="0.5"} 0.2
+rpc_latency_sum 3
+rpc_latency_count 10
+# HELP without_samples Dropped, as it has no samples.
+# TYPE without_samples gauge
+untyped_metric{a="b"} 1
+untyped_metric{a="c"} 2
+# TYPE temperature gauge
+temperature 21.5`
+
+func TestTextDecoder(t *testing.T) {
+	t.Parallel()
+
+	p := expfmt.NewTextParser(model.LegacyValidation)
+	expected, err := p.TextToMetricFamilies(strings.NewReader(textPayload + "\n"))
+	require.NoError(t, err)
+
+	d := newTextDecoder(strings.NewReader(textPayload), nil)
+	var names []string
+	for {
+		mf := &dto.MetricFamily{}
+		err := d.Decode(mf)
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		names = append(names, mf.GetName())
+		assert.True(t, proto.Equal(expected[mf.GetName()], mf), "family %s: %v", mf.GetName(), mf)
+	}
+	assert.Equal(t, []string{
+		"http_requests_total", "request_duration_seconds", "rpc_latency", "untyped_metric", "temperature",
+	}, names)
+}
+
+func TestTextDecoder_Errors(t *testing.T) {
+	t.Parallel()
+
+	d := newTextDecoder(strings.NewReader("a 1\nb{ 2\n"), nil)
+	mf := &dto.MetricFamily{}
+	require.NoError(t, d.Decode(mf))
+	assert.Equal(t, "a", mf.GetName())
+
+	err := d.Decode(mf)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "family starting at line 2")
+}
+
+// The families are returned before the rest of the body is written.
+func TestTextDecoder_Streams(t *testing.T) {
+	t.Parallel()
+
+	r, w := io.Pipe()
+	go func() {
+		_, _ = io.WriteString(w, "# TYPE a counter\na 1\na{b=\"c\"} 2\n# TYPE b gauge\n")
+	}()
+
+	d := newTextDecoder(r, nil)
+	mf := &dto.MetricFamily{}
+	require.NoError(t, d.Decode(mf))
+	assert.Equal(t, "a", mf.GetName())
+	assert.Len(t, mf.GetMetric(), 2)
+
+	go func() {
+		_, _ = io.WriteString(w, "b 3\n")
+		_ = w.Close()
+	}()
+	require.NoError(t, d.Decode(mf))
+	assert.Equal(t, "b", mf.GetName())
+	assert.Equal(t, io.EOF, d.Decode(mf))
+}
+
+func TestTextDecoder_Keep(t *testing.T) {
+	t.Parallel()
+
+	const payload = `# HELP requests_total Requests.
+# TYPE requests_total counter
+requests_total 1
+# HELP skipped A gauge.
+# TYPE skipped gauge
+skipped{invalid labels} not-a-number
+skipped_too 2
+untyped 3
+`
+	var seen []string
+	keep := func(name string, t dto.MetricType) bool {
+		seen = append(seen, name)
+		return t != dto.MetricType_GAUGE
+	}
+
+	var families []string
+	d := newTextDecoder(strings.NewReader(payload), keep)
+	for {
+		mf := &dto.MetricFamily{}
+		err := d.Decode(mf)
+		if err == io.EOF {
+			break
+		}
+		// The lines of the skipped family are not even parsed.
+		require.NoError(t, err)
+		families = append(families, mf.GetName())
+	}
+
+	// The filter is asked once per family, at its TYPE line or first sample.
+	assert.Equal(t, []string{"requests_total", "skipped", "skipped_too", "untyped"}, seen)
+	assert.Equal(t, []string{"requests_total", "skipped_too", "untyped"}, families)
+}